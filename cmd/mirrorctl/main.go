@@ -2,16 +2,18 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/cockroachdb/errors"
 	"github.com/spf13/cobra"
 
@@ -65,14 +67,51 @@ Usage:
   # Suppress all output except for errors
   mirrorctl sync --quiet
 
-  # Dry run - calculate disk usage without downloading
+  # Dry run - compare with the current mirrors without downloading packages
   mirrorctl sync --dry-run
 
+  # Dry run with a JSON summary for scripts
+  mirrorctl sync --dry-run --output json
+
 If no mirror IDs are specified, all repositories in the configuration file will be
 synchronized.`,
 	Run: runMirror,
 }
 
+var apiCmd = &cobra.Command{
+	Use:   "api",
+	Short: "Serve the HTTP JSON API",
+	Long: `Serves an HTTP JSON API to list mirrors and snapshots, start syncs and
+stage, publish, promote, roll back and delete snapshots.
+
+Requests are authenticated with the bearer tokens configured in [[api.tokens]],
+which grant the read, sync and publish scopes.  Syncs run in the background and
+are tracked as jobs; they hold the same lock as "mirrorctl sync".  The OpenAPI
+description is served at /api/v1/openapi.yaml.
+
+Examples:
+  mirrorctl api
+  mirrorctl api --listen 0.0.0.0:8443`,
+	Args: cobra.NoArgs,
+	Run:  runAPI,
+}
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema [kind]",
+	Short: "Print the JSON Schema of a report",
+	Long: `Print the JSON Schema of the reports printed with --output json or yaml, or
+list the report kinds.
+
+Every report starts with its kind and schema_version.  Within a schema version,
+fields may be added but are never removed, renamed or retyped.
+
+Examples:
+  mirrorctl schema
+  mirrorctl schema snapshot-list`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runSchema,
+}
+
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print version information",
@@ -93,8 +132,19 @@ var checkCmd = &cobra.Command{
 var checkConfigCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Validate the configuration file",
-	Long:  `Validate the configuration file and report any issues.`,
-	Run:   runValidate,
+	Long: `Validate the configuration file and report any issues.
+
+The configuration is merged with the files matched by its include globs, and
+the files read and the file and line defining each mirror are shown.
+
+Mirrors with extends = "<name>" are merged with [templates.<name>]: keys set by
+the mirror replace those of the template, lists included, while tables such as
+filters, snapshot and tls are merged key by key.  --expand prints the resolved
+configuration as a single TOML file, without includes and templates.
+
+With --output json or yaml, the result is printed as a report, also when the
+file cannot be loaded.  The command exits with status 1 if the file is invalid.`,
+	Run: runValidate,
 }
 
 var checkTLSCmd = &cobra.Command{
@@ -107,11 +157,64 @@ negotiated cipher suites, and examining the certificate chain.
 
 Examples:
   mirrorctl check tls amlfs-noble
-  mirrorctl check tls openenclave`,
+  mirrorctl check tls openenclave
+  mirrorctl check tls openenclave --output json`,
 	Args: cobra.ExactArgs(1),
 	Run:  runTLSCheck,
 }
 
+var checkDepsCmd = &cobra.Command{
+	Use:   "deps <mirror-id>",
+	Short: "Check that package dependencies can be satisfied within a mirror",
+	Long: `Parse all Packages indices of a mirror and report the binary packages whose
+Depends or Pre-Depends cannot be satisfied within the mirror, per suite and
+architecture.  Versioned constraints, alternatives, Provides and multi-arch
+qualifiers are taken into account.
+
+The live mirror is checked unless --snapshot names a snapshot, "live" or
+"staging".  The command exits with status 1 if any package is broken.
+
+Examples:
+  mirrorctl check deps ubuntu-main
+  mirrorctl check deps ubuntu-main --snapshot staging
+  mirrorctl check deps ubuntu-main --snapshot "2024-01-15T10-30-00Z" --format json`,
+	Args: cobra.ExactArgs(1),
+	Run:  runCheckDeps,
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Work with configuration files",
+	Long:  `Generate and convert mirrorctl configuration.`,
+}
+
+var configImportCmd = &cobra.Command{
+	Use:   "import <file>...",
+	Short: "Import mirrors from APT source files",
+	Long: `Convert APT source files into [mirrors.<id>] tables printed as TOML.
+
+One-line entries of sources.list files and deb822 stanzas of *.sources files
+are imported.  Entries sharing a URL are merged into one mirror, with the union
+of their suites, components and architectures.  Flat repositories, whose suite
+ends with "/", are imported as separate mirrors.
+
+  - signed-by is mapped to pgp_key_path
+  - trusted=yes is mapped to no_pgp_check
+  - deb-src entries set mirror_source
+  - entries without architectures use the host architecture
+
+Disabled stanzas are skipped.  What cannot be imported as is, such as inline
+keys or keys that are not ASCII-armored, is reported as warnings.  Mirror IDs
+are derived from the URLs; review them before saving the output, for example
+to a file matched by the include globs of the configuration.
+
+Examples:
+  mirrorctl config import /etc/apt/sources.list.d/*.sources
+  mirrorctl config import /etc/apt/sources.list > /etc/mirrorctl/mirrors.d/system.toml`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runConfigImport,
+}
+
 var snapshotCmd = &cobra.Command{
 	Use:   "snapshot",
 	Short: "Manage repository snapshots",
@@ -126,7 +229,8 @@ var snapshotCreateCmd = &cobra.Command{
 Examples:
   mirrorctl snapshot create ubuntu-main
   mirrorctl snapshot create ubuntu-main "before-upgrade"
-  mirrorctl snapshot create ubuntu-main --stage`,
+  mirrorctl snapshot create ubuntu-main --stage
+  mirrorctl snapshot create ubuntu-main --label ticket=OPS-123 --note "before kernel upgrade"`,
 	Args: cobra.RangeArgs(1, 2),
 	Run:  runSnapshotCreate,
 }
@@ -139,17 +243,29 @@ var snapshotListCmd = &cobra.Command{
 Examples:
   mirrorctl snapshot list
   mirrorctl snapshot list ubuntu-main
-  mirrorctl snapshot list --detailed`,
+  mirrorctl snapshot list --detailed
+  mirrorctl snapshot list ubuntu-main --detailed --filter label.ticket=OPS-123
+  mirrorctl snapshot list --detailed --filter codename=noble
+  mirrorctl snapshot list --output json
+
+Filters match the snapshot metadata.  Keys are label.<name>, codename, version,
+source, mirrorctl_version and note (substring match).
+
+Detailed listings show the disk usage of each snapshot, counting hard-linked
+files once: the bytes shared with other snapshots or the live mirror, and the
+bytes exclusive to the snapshot, which deleting it would free.`,
 	Run: runSnapshotList,
 }
 
 var snapshotPublishCmd = &cobra.Command{
 	Use:   "publish <mirror-id> <snapshot-name>",
-	Short: "Publish a snapshot to production",
-	Long: `Publish a snapshot to production.
+	Short: "Publish a snapshot to production or another channel",
+	Long: `Publish a snapshot to production, or with --channel to any channel of the
+mirror.
 
 Examples:
-  mirrorctl snapshot publish ubuntu-main "2024-01-15T10-30-00Z"`,
+  mirrorctl snapshot publish ubuntu-main "2024-01-15T10-30-00Z"
+  mirrorctl snapshot publish ubuntu-main "2026-07-01T00-00-00Z" --channel lts-2026q3`,
 	Args: cobra.ExactArgs(2),
 	Run:  runSnapshotPublish,
 }
@@ -167,11 +283,22 @@ Examples:
 
 var snapshotPromoteCmd = &cobra.Command{
 	Use:   "promote <mirror-id>",
-	Short: "Promote the currently staged snapshot to production",
-	Long: `Promote the currently staged snapshot to production.
+	Short: "Promote a snapshot to the next channel of the promotion chain",
+	Long: `Promote the snapshot of a channel to the next channel of the promotion chain.
+
+Without flags, the staged snapshot is promoted to production.  Mirrors can
+define their own channels and chain, such as dev -> qa -> prod, in
+[mirrors.<id>.snapshot]; --to must then be the channel following --from.
 
 Examples:
-  mirrorctl snapshot promote ubuntu-main`,
+  mirrorctl snapshot promote ubuntu-main
+  mirrorctl snapshot promote ubuntu-main --from qa --to prod
+  mirrorctl snapshot promote ubuntu-main --from dev
+
+Gates configured in [[snapshot.gates]] or [[mirrors.<id>.snapshot.gates]] run
+before a snapshot is published, staged or promoted, and any failing gate blocks
+it, as does a snapshot larger than the max_size of its mirror.  --override-gates
+proceeds anyway and records the failed gates in the history.`,
 	Args: cobra.ExactArgs(1),
 	Run:  runSnapshotPromote,
 }
@@ -198,11 +325,156 @@ Examples:
   mirrorctl snapshot prune
   mirrorctl snapshot prune ubuntu-main
   mirrorctl snapshot prune ubuntu-main --keep-last 10 --keep-within 60d
-  mirrorctl snapshot prune ubuntu-main --dry-run`,
+  mirrorctl snapshot prune ubuntu-main --keep-daily 7 --keep-weekly 4 --keep-monthly 12
+  mirrorctl snapshot prune ubuntu-main --min-free-space 50GiB --dry-run
+  mirrorctl snapshot prune ubuntu-main --dry-run
+  mirrorctl snapshot prune --dry-run --output yaml
+
+A snapshot is kept if any rule keeps it.  Published, staged and pinned snapshots
+are always kept.  With --dry-run, the rules that keep each snapshot are shown.
+
+The --max-total-size and --min-free-space limits then delete the oldest
+remaining snapshots until the snapshots of the mirror use at most the given
+space beyond the live mirror, and the filesystem has the given free space.
+These limits are also enforced after each sync that creates snapshots.`,
 	Run: runSnapshotPrune,
 }
 
+var snapshotDiffCmd = &cobra.Command{
+	Use:   "diff <mirror-id> <from> <to>",
+	Short: "Show package changes between two snapshots",
+	Long: `Show the packages added, removed, upgraded and downgraded between two snapshots.
+
+Either side may be "live" or "staging" to compare the tree currently published
+to production or staging.
+
+Examples:
+  mirrorctl snapshot diff ubuntu-main "2024-01-15T10-30-00Z" "2024-01-22T10-30-00Z"
+  mirrorctl snapshot diff ubuntu-main live staging
+  mirrorctl snapshot diff ubuntu-main live staging --format markdown`,
+	Args: cobra.ExactArgs(3),
+	Run:  runSnapshotDiff,
+}
+
+var snapshotExportCmd = &cobra.Command{
+	Use:   "export <mirror-id> <snapshot-name>",
+	Short: "Export a snapshot to a portable archive",
+	Long: `Export a snapshot with its metadata and a manifest of file checksums, for
+import on a site without network access to the upstream mirror.
+
+The format is taken from the name given with --to: ".tar" and ".tar.zst"
+create a tar file, anything else an OCI image layout directory, which can be
+copied to a registry with tools such as skopeo or oras.
+
+Examples:
+  mirrorctl snapshot export ubuntu-main "2024-01-15T10-30-00Z" --to /media/usb/ubuntu.tar.zst
+  mirrorctl snapshot export ubuntu-main "2024-01-15T10-30-00Z" --to /srv/export/ubuntu-oci`,
+	Args: cobra.ExactArgs(2),
+	Run:  runSnapshotExport,
+}
+
+var snapshotImportCmd = &cobra.Command{
+	Use:   "import <mirror-id> <archive>",
+	Short: "Import a snapshot from an exported archive",
+	Long: `Import a snapshot exported with "snapshot export" from a tar file, a tar file
+compressed with zstd, or an OCI image layout directory.
+
+Every file is verified against the manifest of the archive before the snapshot
+appears, and archives with unsafe paths are rejected.  The imported snapshot
+can then be published like any other snapshot.
+
+Examples:
+  mirrorctl snapshot import ubuntu-main /media/usb/ubuntu.tar.zst
+  mirrorctl snapshot import ubuntu-main /srv/import/ubuntu-oci --name "2024-01-15-airgap"`,
+	Args: cobra.ExactArgs(2),
+	Run:  runSnapshotImport,
+}
+
+var snapshotExportDeltaCmd = &cobra.Command{
+	Use:   "export-delta <mirror-id>",
+	Short: "Export the changes between two snapshots",
+	Long: `Export a delta archive of the target snapshot that holds its metadata and only
+the files missing from the base snapshot, matched by checksum.  The archive is
+much smaller than a full export when the remote site already has the base.
+
+The format is taken from the name given with --to, as for "snapshot export".
+
+Examples:
+  mirrorctl snapshot export-delta ubuntu-main --base "2024-01-08T10-30-00Z" --target "2024-01-15T10-30-00Z" --to /media/usb/ubuntu-delta.tar.zst`,
+	Args: cobra.ExactArgs(1),
+	Run:  runSnapshotExportDelta,
+}
+
+var snapshotImportDeltaCmd = &cobra.Command{
+	Use:   "import-delta <mirror-id> <archive>",
+	Short: "Import a snapshot from a delta archive",
+	Long: `Import a snapshot from a delta archive created by "snapshot export-delta".
+
+Files not included in the archive are hard-linked from the local copy of the
+base snapshot, named as on the exporting site unless --base is given.  Every
+file is verified, and the import is refused if the base snapshot does not
+match the one the archive was created from.
+
+Examples:
+  mirrorctl snapshot import-delta ubuntu-main /media/usb/ubuntu-delta.tar.zst
+  mirrorctl snapshot import-delta ubuntu-main /media/usb/ubuntu-delta.tar.zst --base "2024-01-08-airgap"`,
+	Args: cobra.ExactArgs(2),
+	Run:  runSnapshotImportDelta,
+}
+
+var snapshotPinCmd = &cobra.Command{
+	Use:   "pin <mirror-id> <snapshot-name...>",
+	Short: "Protect snapshots from pruning",
+	Long: `Pin one or more snapshots so that prune never removes them.
+
+Examples:
+  mirrorctl snapshot pin ubuntu-main "2024-01-15T10-30-00Z" --reason "release 3.2 build"`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotPin(cmd, args, true)
+	},
+}
+
+var snapshotUnpinCmd = &cobra.Command{
+	Use:   "unpin <mirror-id> <snapshot-name...>",
+	Short: "Allow pinned snapshots to be pruned again",
+	Long: `Unpin one or more snapshots.
+
+Examples:
+  mirrorctl snapshot unpin ubuntu-main "2024-01-15T10-30-00Z"`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotPin(cmd, args, false)
+	},
+}
+
+var snapshotHistoryCmd = &cobra.Command{
+	Use:   "history <mirror-id>",
+	Short: "Show the publish history of a mirror",
+	Long: `Show the audit log of publish, stage, promote, rollback and delete operations
+of a mirror, oldest first.
+
+Examples:
+  mirrorctl snapshot history ubuntu-main`,
+	Args: cobra.ExactArgs(1),
+	Run:  runSnapshotHistory,
+}
+
+var snapshotRollbackCmd = &cobra.Command{
+	Use:   "rollback <mirror-id>",
+	Short: "Re-publish a previously published snapshot",
+	Long: `Atomically re-publish the snapshot that was published to production before the
+current one, according to the publish history.  Repeated rollbacks go further back.
+
+Examples:
+  mirrorctl snapshot rollback ubuntu-main
+  mirrorctl snapshot rollback ubuntu-main --steps 2 --reason "broken openssl update"`,
+	Args: cobra.ExactArgs(1),
+	Run:  runSnapshotRollback,
+}
+
 func init() {
+	mirror.Version = version
 	setupPersistentFlags()
 	registerCommands()
 }
@@ -225,7 +497,15 @@ func registerCommands() {
 	rootCmd.AddCommand(versionCmd)
 	registerSyncCommand()
 	registerCheckCommands()
+	registerConfigCommands()
 	registerSnapshotCommands()
+	registerAPICommand()
+	rootCmd.AddCommand(schemaCmd)
+
+	// Read commands print reports for scripts
+	for _, cmd := range []*cobra.Command{syncCmd, checkConfigCmd, checkTLSCmd, snapshotListCmd, snapshotPruneCmd} {
+		cmd.Flags().StringP("output", "o", mirror.OutputTable, "output format (table, json, yaml)")
+	}
 }
 
 // registerSyncCommand configures the sync command and its flags
@@ -234,13 +514,29 @@ func registerSyncCommand() {
 	rootCmd.AddCommand(syncCmd)
 }
 
+// registerAPICommand configures the api command and its flags
+func registerAPICommand() {
+	apiCmd.Flags().String("listen", "", "address to listen on (default: api.listen or "+mirror.DefaultAPIListen+")")
+	rootCmd.AddCommand(apiCmd)
+}
+
 // registerCheckCommands configures the check command and its subcommands
 func registerCheckCommands() {
 	checkCmd.AddCommand(checkConfigCmd)
 	checkCmd.AddCommand(checkTLSCmd)
+	checkCmd.AddCommand(checkDepsCmd)
+	checkConfigCmd.Flags().Bool("expand", false, "print the configuration with includes and templates resolved")
+	checkDepsCmd.Flags().String("snapshot", mirror.DiffLive, "snapshot to check, or live or staging")
+	checkDepsCmd.Flags().String("format", "text", "output format (text, json)")
 	rootCmd.AddCommand(checkCmd)
 }
 
+// registerConfigCommands configures the config command and its subcommands
+func registerConfigCommands() {
+	configCmd.AddCommand(configImportCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
 // registerSnapshotCommands configures the snapshot command and its subcommands
 func registerSnapshotCommands() {
 	// Add subcommands
@@ -251,14 +547,61 @@ func registerSnapshotCommands() {
 	snapshotCmd.AddCommand(snapshotPromoteCmd)
 	snapshotCmd.AddCommand(snapshotDeleteCmd)
 	snapshotCmd.AddCommand(snapshotPruneCmd)
+	snapshotCmd.AddCommand(snapshotDiffCmd)
+	snapshotCmd.AddCommand(snapshotHistoryCmd)
+	snapshotCmd.AddCommand(snapshotPinCmd)
+	snapshotCmd.AddCommand(snapshotUnpinCmd)
+	snapshotCmd.AddCommand(snapshotRollbackCmd)
+	snapshotCmd.AddCommand(snapshotExportCmd)
+	snapshotCmd.AddCommand(snapshotImportCmd)
+	snapshotCmd.AddCommand(snapshotExportDeltaCmd)
+	snapshotCmd.AddCommand(snapshotImportDeltaCmd)
 
 	// Configure flags for snapshot subcommands
 	snapshotCreateCmd.Flags().Bool("force", false, "overwrite existing snapshot with same name")
 	snapshotCreateCmd.Flags().Bool("stage", false, "publish to staging after creation")
-	snapshotListCmd.Flags().Bool("detailed", false, "show detailed snapshot information including size and status")
+	snapshotCreateCmd.Flags().StringArray("label", nil, "label to record in the snapshot metadata (key=value, repeatable)")
+	snapshotCreateCmd.Flags().String("note", "", "note to record in the snapshot metadata")
+	snapshotListCmd.Flags().Bool("detailed", false, "show detailed snapshot information including disk usage and status")
+	snapshotListCmd.Flags().StringArray("filter", nil, "only list snapshots whose metadata matches key=value (repeatable)")
 	snapshotDeleteCmd.Flags().Bool("force", false, "delete even if snapshot is currently published or staged")
 	snapshotPruneCmd.Flags().Int("keep-last", 0, "number of recent snapshots to keep")
 	snapshotPruneCmd.Flags().String("keep-within", "", "keep snapshots within duration (e.g., \"30d\", \"1w\")")
+	snapshotPruneCmd.Flags().Int("keep-daily", 0, "number of days to keep the newest snapshot of")
+	snapshotPruneCmd.Flags().Int("keep-weekly", 0, "number of weeks to keep the newest snapshot of")
+	snapshotPruneCmd.Flags().Int("keep-monthly", 0, "number of months to keep the newest snapshot of")
+	snapshotPruneCmd.Flags().Int("keep-yearly", 0, "number of years to keep the newest snapshot of")
+	snapshotPruneCmd.Flags().String("max-total-size", "", "maximum space used by the snapshots of a mirror (e.g., \"500GiB\")")
+	snapshotPruneCmd.Flags().String("min-free-space", "", "minimum free space on the snapshot filesystem (e.g., \"50GiB\")")
+	snapshotDiffCmd.Flags().String("format", "text", "output format (text, json, markdown)")
+	snapshotPublishCmd.Flags().String("channel", mirror.ChannelLive, "channel to publish the snapshot to")
+	snapshotPromoteCmd.Flags().String("from", mirror.ChannelStaging, "channel to promote the snapshot of")
+	snapshotPromoteCmd.Flags().String("to", "", "channel to promote to (default: the next channel in the promotion chain)")
+	snapshotRollbackCmd.Flags().Int("steps", 1, "number of publications to go back")
+	snapshotExportCmd.Flags().String("to", "", "archive file (.tar, .tar.zst) or OCI layout directory to write")
+	_ = snapshotExportCmd.MarkFlagRequired("to")
+	snapshotImportCmd.Flags().String("name", "", "name of the imported snapshot (default: the exported name)")
+	snapshotImportCmd.Flags().Bool("force", false, "overwrite existing snapshot with same name")
+	snapshotExportDeltaCmd.Flags().String("base", "", "snapshot the remote site already has")
+	snapshotExportDeltaCmd.Flags().String("target", "", "snapshot to export")
+	snapshotExportDeltaCmd.Flags().String("to", "", "archive file (.tar, .tar.zst) or OCI layout directory to write")
+	_ = snapshotExportDeltaCmd.MarkFlagRequired("base")
+	_ = snapshotExportDeltaCmd.MarkFlagRequired("target")
+	_ = snapshotExportDeltaCmd.MarkFlagRequired("to")
+	snapshotImportDeltaCmd.Flags().String("base", "", "local name of the base snapshot (default: the name in the archive)")
+	snapshotImportDeltaCmd.Flags().String("name", "", "name of the imported snapshot (default: the exported name)")
+	snapshotImportDeltaCmd.Flags().Bool("force", false, "overwrite existing snapshot with same name")
+
+	// Gates guard publications unless overridden
+	for _, cmd := range []*cobra.Command{snapshotPublishCmd, snapshotStageCmd, snapshotPromoteCmd} {
+		cmd.Flags().Bool("override-gates", false, "publish even if gates fail, recording the failed gates in the history")
+	}
+
+	// Operations recorded in the publish history accept a reason
+	for _, cmd := range []*cobra.Command{snapshotPublishCmd, snapshotStageCmd, snapshotPromoteCmd,
+		snapshotDeleteCmd, snapshotRollbackCmd, snapshotPinCmd, snapshotUnpinCmd} {
+		cmd.Flags().String("reason", "", "reason recorded in the publish history")
+	}
 
 	rootCmd.AddCommand(snapshotCmd)
 }
@@ -279,35 +622,42 @@ func formatError(err error, verbose bool) string {
 	return err.Error()
 }
 
-// analyzeUndecoded examines undecoded TOML keys and provides helpful suggestions
-func analyzeUndecoded(undecoded []toml.Key) (suggestions []string, unknown []string) {
-	// Group keys by their root section for mirror typos
-	mirrorGroups := make(map[string]int)
+// analyzeUndecoded examines undecoded TOML keys and provides helpful suggestions,
+// naming the file each key comes from
+func analyzeUndecoded(undecoded []mirror.UndecodedKey) (suggestions []string, unknown []string) {
+	// Group keys by their file and root section for mirror typos
+	type section struct{ file, root string }
+	mirrorGroups := make(map[section]int)
+	var sections []section
 
-	for _, key := range undecoded {
-		keyStr := key.String()
+	for _, uk := range undecoded {
+		keyStr := uk.Key.String()
 
 		// Check for common "mirror" vs "mirrors" typo
 		if strings.HasPrefix(keyStr, "mirror.") && !strings.HasPrefix(keyStr, "mirrors.") {
 			// Extract the root section (e.g., "mirror.amlfs-noble" from "mirror.amlfs-noble.url")
 			parts := strings.Split(keyStr, ".")
 			if len(parts) >= 2 {
-				rootSection := parts[0] + "." + parts[1] // "mirror.amlfs-noble"
-				mirrorGroups[rootSection]++
+				s := section{uk.File, parts[0] + "." + parts[1]} // "mirror.amlfs-noble"
+				if mirrorGroups[s] == 0 {
+					sections = append(sections, s)
+				}
+				mirrorGroups[s]++
 			}
 		} else {
 			// Keep track of keys we couldn't provide suggestions for
-			unknown = append(unknown, keyStr)
+			unknown = append(unknown, fmt.Sprintf("%s (in %s)", keyStr, uk.File))
 		}
 	}
 
 	// Generate grouped suggestions
-	for rootSection, count := range mirrorGroups {
-		correctedSection := strings.Replace(rootSection, "mirror.", "mirrors.", 1)
+	for _, s := range sections {
+		count := mirrorGroups[s]
+		correctedSection := strings.Replace(s.root, "mirror.", "mirrors.", 1)
 		if count == 1 {
-			suggestions = append(suggestions, fmt.Sprintf("Section '%s' should be '%s'", rootSection, correctedSection))
+			suggestions = append(suggestions, fmt.Sprintf("Section '%s' should be '%s' (in %s)", s.root, correctedSection, s.file))
 		} else {
-			suggestions = append(suggestions, fmt.Sprintf("Section '%s' should be '%s' (affects %d subsections)", rootSection, correctedSection, count))
+			suggestions = append(suggestions, fmt.Sprintf("Section '%s' should be '%s' (in %s, affects %d subsections)", s.root, correctedSection, s.file, count))
 		}
 	}
 
@@ -315,7 +665,7 @@ func analyzeUndecoded(undecoded []toml.Key) (suggestions []string, unknown []str
 }
 
 // formatUndecodedError builds a user-friendly error message for undecoded TOML keys
-func formatUndecodedError(undecoded []toml.Key) string {
+func formatUndecodedError(undecoded []mirror.UndecodedKey) string {
 	suggestions, unknown := analyzeUndecoded(undecoded)
 
 	var errorMsg strings.Builder
@@ -351,6 +701,11 @@ func runMirror(cmd *cobra.Command, args []string) {
 	verboseErrors, _ := cmd.Flags().GetBool("verbose-errors")
 	quiet, _ := cmd.Flags().GetBool("quiet")
 	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	format := outputFormat(cmd)
+	if format != mirror.OutputTable && !dryRun {
+		slog.Error("--output is only supported with --dry-run")
+		os.Exit(1)
+	}
 
 	// When dry-run is set, use quiet logging (error level only)
 	if dryRun {
@@ -370,6 +725,17 @@ func runMirror(cmd *cobra.Command, args []string) {
 	noPGPCheck, _ := cmd.Flags().GetBool("no-pgp-check")
 	force, _ := cmd.Flags().GetBool("force")
 
+	if dryRun && format != mirror.OutputTable {
+		report, err := mirror.DryRun(config, args, noPGPCheck)
+		if err != nil {
+			errorMsg := formatError(err, verboseErrors)
+			slog.Error("mirror run failed", "error", errorMsg)
+			os.Exit(1)
+		}
+		writeReport(format, report)
+		return
+	}
+
 	if err := mirror.Run(config, args, noPGPCheck, quiet, dryRun, force); err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		if verboseErrors {
@@ -384,13 +750,21 @@ func runMirror(cmd *cobra.Command, args []string) {
 
 func runValidate(cmd *cobra.Command, _ []string) {
 	verboseErrors, _ := cmd.Flags().GetBool("verbose-errors")
+	format := outputFormat(cmd)
+	expand, _ := cmd.Flags().GetBool("expand")
+	if expand && format != mirror.OutputTable {
+		slog.Error("--expand cannot be used with --output")
+		os.Exit(1)
+	}
 
-	config, err := loadAndApplyConfig(ConfigOptions{
-		VerboseErrors: verboseErrors,
-		ApplyLogging:  false, // Don't apply logging for validation
-		Quiet:         false,
-	})
+	// Don't apply logging for validation
+	config, sources, err := loadConfigSources(verboseErrors)
 	if err != nil {
+		if format != mirror.OutputTable {
+			writeReport(format, mirror.NewConfigCheckReport(configPath, []error{err}))
+		} else if !verboseErrors {
+			slog.Info("run with --verbose-errors for detailed stack traces")
+		}
 		os.Exit(1)
 	}
 
@@ -413,6 +787,15 @@ func runValidate(cmd *cobra.Command, _ []string) {
 		}
 	}
 
+	report := mirror.NewConfigCheckReport(configPath, validationErrors).WithSources(sources)
+	if format != mirror.OutputTable {
+		writeReport(format, report)
+		if len(validationErrors) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(validationErrors) > 0 {
 		slog.Error("the toml configuration file is not valid")
 		for _, err := range validationErrors {
@@ -421,11 +804,34 @@ func runValidate(cmd *cobra.Command, _ []string) {
 		os.Exit(1)
 	}
 
+	if expand {
+		if err := config.WriteExpanded(os.Stdout); err != nil {
+			slog.Error("failed to write the configuration", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		printConfigSources(report)
+	}
 	slog.Info("the toml configuration file passes validation checks")
 }
 
-func runTLSCheck(_ *cobra.Command, args []string) {
+// printConfigSources prints the files of the merged configuration and
+// where each mirror is defined.
+func printConfigSources(r *mirror.ConfigCheckReport) {
+	fmt.Println("Configuration files:")
+	for _, file := range r.Files {
+		fmt.Printf("  %s\n", file)
+	}
+	fmt.Printf("\nMirrors (%d):\n", len(r.Mirrors))
+	for _, m := range r.Mirrors {
+		fmt.Printf("  - %s (%s)\n", m.ID, m.ConfigPosition)
+	}
+	fmt.Println()
+}
+
+func runTLSCheck(cmd *cobra.Command, args []string) {
 	mirrorID := args[0]
+	format := outputFormat(cmd)
 
 	// Load configuration file
 	config, err := loadAndApplyConfig(ConfigOptions{
@@ -464,105 +870,122 @@ func runTLSCheck(_ *cobra.Command, args []string) {
 		}
 	}
 
-	fmt.Printf("Checking TLS status for mirror '%s' (%s:%s)...\n\n", mirrorID, host, port)
-
-	// Perform TLS version checks
-	checkTLSVersions(config, host, port)
+	report := mirror.CheckTLS(&config.TLS, mirrorID, host, port)
+	if format == mirror.OutputTable {
+		report.WriteTable(os.Stdout) // #nosec G104 - stdout write errors are not actionable
+		return
+	}
+	writeReport(format, report)
+}
 
-	// Perform detailed certificate check
-	checkCertificateDetails(config, host, port)
+func runCheckDeps(cmd *cobra.Command, args []string) {
+	verboseErrors, _ := cmd.Flags().GetBool("verbose-errors")
+	config, err := loadConfigForSnapshot(verboseErrors)
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(1)
+	}
 
-	fmt.Println("TLS check complete.")
-}
+	mirrorID := args[0]
+	validateMirrorExists(config, mirrorID)
 
-func checkTLSVersions(config *mirror.Config, host, port string) {
-	fmt.Println("[+] TLS Version Support:")
+	format, _ := cmd.Flags().GetString("format")
+	var write func(*mirror.DepsReport) error
+	switch format {
+	case "text":
+		write = func(r *mirror.DepsReport) error { return r.WriteText(os.Stdout) }
+	case "json":
+		write = func(r *mirror.DepsReport) error { return r.WriteJSON(os.Stdout) }
+	default:
+		slog.Error("invalid output format", "format", format)
+		os.Exit(1)
+	}
 
-	tlsVersions := []struct {
-		version uint16
-		name    string
-	}{
-		{tls.VersionTLS10, "TLS 1.0"},
-		{tls.VersionTLS11, "TLS 1.1"},
-		{tls.VersionTLS12, "TLS 1.2"},
-		{tls.VersionTLS13, "TLS 1.3"},
+	// The live and staging trees can be checked without snapshot
+	// configuration
+	snapshotConfig := config.Snapshot
+	if snapshotConfig == nil {
+		snapshotConfig = &mirror.SnapshotConfig{}
 	}
+	sm := mirror.NewSnapshotManager(snapshotConfig, config.Dir)
 
-	for _, tlsVer := range tlsVersions {
-		// Build TLS config from user's global settings
-		tlsConf, err := config.TLS.BuildTLSConfig()
-		if err != nil {
-			fmt.Printf("    %s: Error building TLS config (%v)\n", tlsVer.name, err)
-			continue
-		}
+	tree, _ := cmd.Flags().GetString("snapshot")
+	report, err := sm.CheckDependencies(mirrorID, tree)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to check dependencies", "mirror", mirrorID, "error", errorMsg)
+		os.Exit(1)
+	}
 
-		// Override version settings to test specific version
-		tlsConf.MinVersion = tlsVer.version
-		tlsConf.MaxVersion = tlsVer.version
+	if err := write(report); err != nil {
+		slog.Error("failed to write dependency report", "error", err)
+		os.Exit(1)
+	}
+	if report.BrokenCount() > 0 {
+		os.Exit(1)
+	}
+}
 
-		// Attempt connection
-		conn, err := tls.Dial("tcp", net.JoinHostPort(host, port), tlsConf)
+// outputFormat returns the --output flag of cmd, exiting if it is invalid.
+func runConfigImport(cmd *cobra.Command, args []string) {
+	verboseErrors, _ := cmd.Flags().GetBool("verbose-errors")
+	var entries []*mirror.SourceEntry
+	for _, path := range args {
+		e, err := mirror.ReadSourceFile(path)
 		if err != nil {
-			fmt.Printf("    %s: Not Supported (%v)\n", tlsVer.name, err)
-		} else {
-			fmt.Printf("    %s: Supported\n", tlsVer.name)
-			conn.Close() // #nosec G104 - TLS test connection cleanup, ignore errors
+			errorMsg := formatError(err, verboseErrors)
+			slog.Error("failed to read APT source file", "path", path, "error", errorMsg)
+			os.Exit(1)
 		}
+		entries = append(entries, e...)
 	}
-	fmt.Println()
-}
-
-func checkCertificateDetails(config *mirror.Config, host, port string) {
-	fmt.Println("[+] Connection Details:")
 
-	// Build TLS config from user's global settings without version overrides
-	tlsConf, err := config.TLS.BuildTLSConfig()
-	if err != nil {
-		fmt.Printf("Error building TLS config: %v\n", err)
-		return
+	imported := mirror.ImportSources(entries)
+	for _, w := range imported.Warnings {
+		slog.Warn(w)
 	}
-
-	// Perform connection with best negotiated settings
-	conn, err := tls.Dial("tcp", net.JoinHostPort(host, port), tlsConf)
-	if err != nil {
-		fmt.Printf("Failed to establish connection: %v\n", err)
-		return
+	if err := imported.WriteTOML(os.Stdout); err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to import mirrors", "error", errorMsg)
+		os.Exit(1)
 	}
-	defer conn.Close()
+}
 
-	connState := conn.ConnectionState()
+func outputFormat(cmd *cobra.Command) string {
+	format, _ := cmd.Flags().GetString("output")
+	if err := mirror.CheckOutputFormat(format); err != nil {
+		slog.Error("invalid output format", "error", err)
+		os.Exit(1)
+	}
+	return format
+}
 
-	// Print negotiated details
-	fmt.Printf("    Negotiated Version: %s\n", tlsVersionString(connState.Version))
-	fmt.Printf("    Negotiated Cipher:  %s\n", tls.CipherSuiteName(connState.CipherSuite))
-	fmt.Println()
+// writeReport writes report to stdout in the json or yaml format.
+func writeReport(format string, report any) {
+	if err := mirror.WriteReport(os.Stdout, format, report); err != nil {
+		slog.Error("failed to write report", "error", err)
+		os.Exit(1)
+	}
+}
 
-	// Print certificate chain
-	fmt.Println("[+] Server Certificate Chain:")
-	for i, cert := range connState.PeerCertificates {
-		fmt.Printf("    - Cert %d:\n", i)
-		fmt.Printf("      Subject:  %s\n", cert.Subject.CommonName)
-		fmt.Printf("      Issuer:   %s\n", cert.Issuer.CommonName)
-		fmt.Printf("      Expires:  %s\n", cert.NotAfter.Format(time.RFC3339))
-		if i < len(connState.PeerCertificates)-1 {
-			fmt.Println()
+func runSchema(_ *cobra.Command, args []string) {
+	if len(args) == 0 {
+		for _, kind := range mirror.ReportKinds() {
+			fmt.Println(kind)
 		}
+		return
 	}
-	fmt.Println()
-}
 
-func tlsVersionString(version uint16) string {
-	switch version {
-	case tls.VersionTLS10:
-		return "TLS 1.0"
-	case tls.VersionTLS11:
-		return "TLS 1.1"
-	case tls.VersionTLS12:
-		return "TLS 1.2"
-	case tls.VersionTLS13:
-		return "TLS 1.3"
-	default:
-		return fmt.Sprintf("Unknown (0x%04x)", version)
+	schema, err := mirror.ReportSchema(args[0])
+	if err != nil {
+		slog.Error("failed to get schema", "error", err)
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(schema); err != nil {
+		slog.Error("failed to write schema", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -573,6 +996,68 @@ type ConfigOptions struct {
 	Quiet         bool
 }
 
+func runAPI(cmd *cobra.Command, _ []string) {
+	verboseErrors, _ := cmd.Flags().GetBool("verbose-errors")
+	config, err := loadAndApplyConfig(ConfigOptions{
+		VerboseErrors: verboseErrors,
+		ApplyLogging:  true,
+		Quiet:         false,
+	})
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	server, err := mirror.NewAPIServer(config)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to set up the API", "error", errorMsg)
+		os.Exit(1)
+	}
+
+	listen, _ := cmd.Flags().GetString("listen")
+	if listen == "" {
+		listen = config.API.Listen
+	}
+	if listen == "" {
+		listen = mirror.DefaultAPIListen
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.API.TLSCertFile != "" {
+			serveErr <- srv.ListenAndServeTLS(config.API.TLSCertFile, config.API.TLSKeyFile)
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+	slog.Info("API listening", "address", listen, "tls", config.API.TLSCertFile != "")
+
+	select {
+	case err := <-serveErr:
+		slog.Error("API server failed", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// Let requests finish, then abort running syncs
+	slog.Info("shutting down the API")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("failed to shut down the API server", "error", err)
+	}
+	server.Close()
+}
+
 // loadAndApplyConfig loads configuration and optionally applies logging settings.
 // This centralizes the common pattern of loading config, applying log settings,
 // and overriding log level from command-line flags.
@@ -640,7 +1125,16 @@ func setupSnapshotCommand(cmd *cobra.Command) (*mirror.Config, *mirror.SnapshotM
 		os.Exit(1)
 	}
 
-	sm := mirror.NewSnapshotManager(config.Snapshot, config.Dir)
+	sm := mirror.NewSnapshotManager(config.Snapshot, config.Dir).
+		WithMirrorConfigs(config.Mirrors).
+		WithHooks(config.Hooks).
+		WithNotifier(mirror.NewNotifier(config.Notify, &config.TLS))
+	if reason, _ := cmd.Flags().GetString("reason"); reason != "" {
+		sm = sm.WithReason(reason)
+	}
+	if override, _ := cmd.Flags().GetBool("override-gates"); override {
+		sm = sm.WithOverrideGates()
+	}
 	return config, sm, verboseErrors
 }
 
@@ -678,12 +1172,21 @@ func runSnapshotCreate(cmd *cobra.Command, args []string) {
 
 	force, _ := cmd.Flags().GetBool("force")
 	stage, _ := cmd.Flags().GetBool("stage")
+	labelArgs, _ := cmd.Flags().GetStringArray("label")
+	note, _ := cmd.Flags().GetString("note")
+
+	labels, err := parseKeyValues(labelArgs)
+	if err != nil {
+		slog.Error("invalid label", "error", err)
+		os.Exit(1)
+	}
 
 	if snapshotName == "" {
 		snapshotName = sm.GenerateSnapshotNameForMirror(mirrorConfig.Snapshot)
 	}
 
-	createdSnapshot, err := sm.CreateSnapshot(mirrorID, snapshotName, force, mirrorConfig.Snapshot)
+	opts := mirror.SnapshotOptions{Labels: labels, Note: note}
+	createdSnapshot, err := sm.CreateSnapshotWithOptions(mirrorID, snapshotName, force, mirrorConfig.Snapshot, opts)
 	if err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("failed to create snapshot", "error", errorMsg)
@@ -706,6 +1209,20 @@ func runSnapshotList(cmd *cobra.Command, args []string) {
 	config, sm, verboseErrors := setupSnapshotCommand(cmd)
 
 	detailed, _ := cmd.Flags().GetBool("detailed")
+	filterArgs, _ := cmd.Flags().GetStringArray("filter")
+	format := outputFormat(cmd)
+
+	filters, err := parseKeyValues(filterArgs)
+	if err != nil {
+		slog.Error("invalid filter", "error", err)
+		os.Exit(1)
+	}
+	for key := range filters {
+		if err := mirror.ValidateMetadataFilter(key); err != nil {
+			slog.Error("invalid filter", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// If no mirrors specified, list all configured mirrors
 	mirrors := args
@@ -716,6 +1233,7 @@ func runSnapshotList(cmd *cobra.Command, args []string) {
 		sort.Strings(mirrors)
 	}
 
+	report := mirror.NewSnapshotListReport(detailed)
 	for _, mirrorID := range mirrors {
 		if !validateMirrorExistsNonFatal(config, mirrorID) {
 			continue
@@ -727,15 +1245,32 @@ func runSnapshotList(cmd *cobra.Command, args []string) {
 			slog.Error("failed to list snapshots", "mirror", mirrorID, "error", errorMsg)
 			continue
 		}
+		report.Add(mirrorID, filterSnapshots(snapshots, filters))
+	}
+	if detailed {
+		report.SetUsage(sm.SnapshotsDiskUsage())
+	}
+
+	if format != mirror.OutputTable {
+		writeReport(format, report)
+		return
+	}
+	printSnapshotList(report)
+}
 
-		fmt.Printf("Snapshots for mirror '%s':\n", mirrorID)
-		if len(snapshots) == 0 {
+// printSnapshotList prints a snapshot listing as a table.
+func printSnapshotList(report *mirror.SnapshotListReport) {
+	for _, ms := range report.Mirrors {
+		fmt.Printf("Snapshots for mirror '%s':\n", ms.Mirror)
+		if len(ms.Snapshots) == 0 {
 			fmt.Println("  No snapshots found")
 		} else {
-			for _, snapshot := range snapshots {
-				if detailed {
-					fmt.Printf("  - %s (%s, size: %d bytes, files: %d)\n",
-						snapshot.Name, snapshot.Status(), snapshot.Size, snapshot.FileCount)
+			for _, snapshot := range ms.Snapshots {
+				if report.Detailed() {
+					fmt.Printf("  - %s (%s, size: %s, shared: %s, exclusive: %s, files: %d)\n",
+						snapshot.Name, snapshot.Status(), formatSize(snapshot.Size),
+						formatSize(snapshot.SharedSize), formatSize(snapshot.ExclusiveSize), snapshot.Files)
+					printSnapshotMetadata(snapshot.Metadata)
 				} else {
 					fmt.Printf("  - %s (%s)\n", snapshot.Name, snapshot.Status())
 				}
@@ -743,6 +1278,102 @@ func runSnapshotList(cmd *cobra.Command, args []string) {
 		}
 		fmt.Println()
 	}
+
+	if usage := report.Usage; usage != nil {
+		fmt.Println("All snapshots:")
+		fmt.Printf("  size:      %s (%d files)\n", formatSize(usage.Size), usage.Files)
+		fmt.Printf("  shared:    %s (also in live mirrors)\n", formatSize(usage.Shared))
+		fmt.Printf("  exclusive: %s\n", formatSize(usage.Exclusive))
+	}
+}
+
+// formatSize formats a non-negative byte count.
+func formatSize(n int64) string {
+	return mirror.FormatBytes(uint64(n)) // #nosec G115 - sizes are never negative
+}
+
+// parseKeyValues parses "key=value" arguments into a map.
+func parseKeyValues(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// filterSnapshots returns the snapshots whose metadata matches all filters.
+func filterSnapshots(snapshots []*mirror.SnapshotInfo, filters map[string]string) []*mirror.SnapshotInfo {
+	if len(filters) == 0 {
+		return snapshots
+	}
+	var matched []*mirror.SnapshotInfo
+	for _, snapshot := range snapshots {
+		ok := true
+		for key, value := range filters {
+			if !snapshot.Metadata.Match(key, value) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, snapshot)
+		}
+	}
+	return matched
+}
+
+// printSnapshotMetadata prints the provenance of a snapshot for detailed listings.
+func printSnapshotMetadata(md *mirror.SnapshotMetadata) {
+	if md == nil {
+		fmt.Println("      (no metadata)")
+		return
+	}
+
+	fmt.Printf("      created:  %s (mirrorctl %s)\n", md.CreatedAt.Format(time.RFC3339), md.MirrorctlVersion)
+	fmt.Printf("      source:   %s\n", md.Source)
+	if !md.ImportedAt.IsZero() {
+		fmt.Printf("      imported: %s from %s\n", md.ImportedAt.Format(time.RFC3339), md.ImportedFrom)
+	}
+	if !md.SyncStartedAt.IsZero() {
+		fmt.Printf("      synced:   %s - %s\n", md.SyncStartedAt.Format(time.RFC3339), md.SyncFinishedAt.Format(time.RFC3339))
+	}
+
+	suites := make([]string, 0, len(md.Suites))
+	for suite := range md.Suites {
+		suites = append(suites, suite)
+	}
+	sort.Strings(suites)
+	for _, suite := range suites {
+		sr := md.Suites[suite]
+		fmt.Printf("      suite %s: codename=%s version=%s date=%q", suite, sr.Codename, sr.Version, sr.Date)
+		if sr.SigningKey != "" {
+			fmt.Printf(" key=%s", sr.SigningKey)
+		}
+		fmt.Println()
+	}
+
+	if len(md.Labels) > 0 {
+		keys := make([]string, 0, len(md.Labels))
+		for k := range md.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var pairs []string
+		for _, k := range keys {
+			pairs = append(pairs, k+"="+md.Labels[k])
+		}
+		fmt.Printf("      labels:   %s\n", strings.Join(pairs, ", "))
+	}
+	if md.Note != "" {
+		fmt.Printf("      note:     %s\n", md.Note)
+	}
 }
 
 func runSnapshotPublish(cmd *cobra.Command, args []string) {
@@ -751,15 +1382,21 @@ func runSnapshotPublish(cmd *cobra.Command, args []string) {
 	mirrorID := args[0]
 	snapshotName := args[1]
 
+	channel, _ := cmd.Flags().GetString("channel")
+
 	validateMirrorExists(config, mirrorID)
 
-	if err := sm.PublishSnapshot(mirrorID, snapshotName); err != nil {
+	if err := sm.PublishToChannel(mirrorID, channel, snapshotName); err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("failed to publish snapshot", "error", errorMsg)
 		os.Exit(1)
 	}
 
-	slog.Info("snapshot published to production", "mirror", mirrorID, "snapshot", snapshotName)
+	if channel == mirror.ChannelLive {
+		slog.Info("snapshot published to production", "mirror", mirrorID, "snapshot", snapshotName)
+	} else {
+		slog.Info("snapshot published", "mirror", mirrorID, "channel", channel, "snapshot", snapshotName)
+	}
 }
 
 func runSnapshotStage(cmd *cobra.Command, args []string) {
@@ -784,16 +1421,19 @@ func runSnapshotPromote(cmd *cobra.Command, args []string) {
 
 	mirrorID := args[0]
 
+	from, _ := cmd.Flags().GetString("from")
+	to, _ := cmd.Flags().GetString("to")
+
 	validateMirrorExists(config, mirrorID)
 
-	promotedSnapshot, err := sm.PromoteSnapshot(mirrorID)
+	promotedSnapshot, err := sm.PromoteChannel(mirrorID, from, to)
 	if err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("failed to promote snapshot", "error", errorMsg)
 		os.Exit(1)
 	}
 
-	slog.Info("snapshot promoted to production", "mirror", mirrorID, "snapshot", promotedSnapshot)
+	slog.Info("snapshot promoted", "mirror", mirrorID, "from", from, "snapshot", promotedSnapshot)
 }
 
 func runSnapshotDelete(cmd *cobra.Command, args []string) {
@@ -819,9 +1459,8 @@ func runSnapshotDelete(cmd *cobra.Command, args []string) {
 func runSnapshotPrune(cmd *cobra.Command, args []string) {
 	config, sm, verboseErrors := setupSnapshotCommand(cmd)
 
-	keepLast, _ := cmd.Flags().GetInt("keep-last")
-	keepWithin, _ := cmd.Flags().GetString("keep-within")
 	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	format := outputFormat(cmd)
 
 	// If no mirrors specified, prune all configured mirrors
 	mirrors := args
@@ -832,84 +1471,338 @@ func runSnapshotPrune(cmd *cobra.Command, args []string) {
 		sort.Strings(mirrors)
 	}
 
+	report := mirror.NewPruneReport(dryRun)
 	for _, mirrorID := range mirrors {
 		if !validateMirrorExistsNonFatal(config, mirrorID) {
 			continue
 		}
 		mirrorConfig := config.Mirrors[mirrorID]
 
-		var keepLastPtr *int
-		var keepWithinPtr *string
-		if keepLast > 0 {
-			keepLastPtr = &keepLast
-		}
-		if keepWithin != "" {
-			keepWithinPtr = &keepWithin
-		}
+		pruneConfig := sm.GetPruneConfig(mirrorID, mirrorConfig.Snapshot)
+		applyPruneFlags(cmd, &pruneConfig)
 
-		deletedSnapshots, err := sm.PruneSnapshots(mirrorID, mirrorConfig.Snapshot, dryRun, keepLastPtr, keepWithinPtr)
+		decisions, err := sm.PruneSnapshotsWithConfig(mirrorID, pruneConfig, dryRun)
 		if err != nil {
 			errorMsg := formatError(err, verboseErrors)
 			slog.Error("failed to prune snapshots", "mirror", mirrorID, "error", errorMsg)
 			continue
 		}
 
+		mp := report.Add(mirrorID, decisions)
+
 		if dryRun {
-			if len(deletedSnapshots) > 0 {
-				fmt.Printf("Would delete %d snapshots for mirror '%s':\n", len(deletedSnapshots), mirrorID)
-				for _, snapshot := range deletedSnapshots {
-					fmt.Printf("  - %s\n", snapshot)
-				}
-			} else {
-				fmt.Printf("No snapshots would be deleted for mirror '%s'\n", mirrorID)
+			if format == mirror.OutputTable {
+				printPruneDryRun(mp)
 			}
 		} else {
-			if len(deletedSnapshots) > 0 {
-				slog.Info("pruned snapshots", "mirror", mirrorID, "count", len(deletedSnapshots))
+			if len(mp.Delete) > 0 {
+				slog.Info("pruned snapshots", "mirror", mirrorID, "count", len(mp.Delete))
 			} else {
 				slog.Info("no snapshots pruned", "mirror", mirrorID)
 			}
 		}
 	}
+
+	if format != mirror.OutputTable {
+		writeReport(format, report)
+	}
+}
+
+// printPruneDryRun prints what a prune of a mirror would delete and keep.
+func printPruneDryRun(mp *mirror.MirrorPrune) {
+	if len(mp.Delete) > 0 {
+		fmt.Printf("Would delete %d snapshots for mirror '%s', freeing %s:\n",
+			len(mp.Delete), mp.Mirror, formatSize(mp.FreedSize))
+		for _, e := range mp.Delete {
+			if e.Evicted != "" {
+				fmt.Printf("  - %s (%s exclusive, over %s)\n", e.Snapshot, formatSize(e.ExclusiveSize), e.Evicted)
+			} else {
+				fmt.Printf("  - %s (%s exclusive)\n", e.Snapshot, formatSize(e.ExclusiveSize))
+			}
+		}
+	} else {
+		fmt.Printf("No snapshots would be deleted for mirror '%s'\n", mp.Mirror)
+	}
+	if len(mp.Keep) > 0 {
+		fmt.Printf("Would keep %d snapshots for mirror '%s':\n", len(mp.Keep), mp.Mirror)
+		for _, e := range mp.Keep {
+			fmt.Printf("  - %s (%s)\n", e.Snapshot, strings.Join(e.Reasons, ", "))
+		}
+	}
+}
+
+// applyPruneFlags overrides the retention policy with the prune flags
+// given on the command line.
+func applyPruneFlags(cmd *cobra.Command, config *mirror.SnapshotPruneConfig) {
+	for _, f := range []struct {
+		name  string
+		value *int
+	}{
+		{"keep-last", &config.KeepLast},
+		{"keep-daily", &config.KeepDaily},
+		{"keep-weekly", &config.KeepWeekly},
+		{"keep-monthly", &config.KeepMonthly},
+		{"keep-yearly", &config.KeepYearly},
+	} {
+		if v, _ := cmd.Flags().GetInt(f.name); v > 0 {
+			*f.value = v
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"keep-within", &config.KeepWithin},
+		{"max-total-size", &config.MaxTotalSize},
+		{"min-free-space", &config.MinFreeSpace},
+	} {
+		if v, _ := cmd.Flags().GetString(f.name); v != "" {
+			*f.value = v
+		}
+	}
+}
+
+func runSnapshotPin(cmd *cobra.Command, args []string, pinned bool) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	snapshotNames := args[1:]
+
+	validateMirrorExists(config, mirrorID)
+
+	for _, snapshotName := range snapshotNames {
+		if err := sm.PinSnapshot(mirrorID, snapshotName, pinned); err != nil {
+			errorMsg := formatError(err, verboseErrors)
+			slog.Error("failed to update snapshot pin", "mirror", mirrorID, "snapshot", snapshotName, "error", errorMsg)
+			continue
+		}
+		slog.Info("snapshot pin updated", "mirror", mirrorID, "snapshot", snapshotName, "pinned", pinned)
+	}
+}
+
+func runSnapshotDiff(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	validateMirrorExists(config, mirrorID)
+
+	format, _ := cmd.Flags().GetString("format")
+	var write func(*mirror.SnapshotDiff) error
+	switch format {
+	case "text":
+		write = func(d *mirror.SnapshotDiff) error { return d.WriteText(os.Stdout) }
+	case "json":
+		write = func(d *mirror.SnapshotDiff) error { return d.WriteJSON(os.Stdout) }
+	case "markdown":
+		write = func(d *mirror.SnapshotDiff) error { return d.WriteMarkdown(os.Stdout) }
+	default:
+		slog.Error("invalid output format", "format", format)
+		os.Exit(1)
+	}
+
+	d, err := sm.DiffSnapshots(mirrorID, args[1], args[2])
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to compare snapshots", "error", errorMsg)
+		os.Exit(1)
+	}
+
+	if err := write(d); err != nil {
+		slog.Error("failed to write snapshot diff", "error", err)
+		os.Exit(1)
+	}
+}
+
+func runSnapshotExport(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	snapshotName := args[1]
+	validateMirrorExists(config, mirrorID)
+
+	dest, _ := cmd.Flags().GetString("to")
+	format := mirror.ExportFormatFromPath(dest)
+	m, err := sm.ExportSnapshot(mirrorID, snapshotName, dest, format)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to export snapshot", "mirror", mirrorID, "snapshot", snapshotName, "error", errorMsg)
+		os.Exit(1)
+	}
+	slog.Info("snapshot exported", "mirror", mirrorID, "snapshot", snapshotName, "to", dest,
+		"format", format, "files", len(m.Files), "size", formatSize(m.TotalSize()))
+}
+
+func runSnapshotImport(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	src := args[1]
+	validateMirrorExists(config, mirrorID)
+
+	name, _ := cmd.Flags().GetString("name")
+	force, _ := cmd.Flags().GetBool("force")
+	snapshotName, err := sm.ImportSnapshot(mirrorID, src, mirror.ImportOptions{Name: name, Force: force})
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to import snapshot", "mirror", mirrorID, "from", src, "error", errorMsg)
+		os.Exit(1)
+	}
+	slog.Info("snapshot imported", "mirror", mirrorID, "snapshot", snapshotName, "from", src)
+}
+
+func runSnapshotExportDelta(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	validateMirrorExists(config, mirrorID)
+
+	base, _ := cmd.Flags().GetString("base")
+	target, _ := cmd.Flags().GetString("target")
+	dest, _ := cmd.Flags().GetString("to")
+	format := mirror.ExportFormatFromPath(dest)
+	m, err := sm.ExportDelta(mirrorID, base, target, dest, format)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to export snapshot delta", "mirror", mirrorID, "base", base, "target", target, "error", errorMsg)
+		os.Exit(1)
+	}
+	files, size := m.IncludedSize()
+	slog.Info("snapshot delta exported", "mirror", mirrorID, "base", base, "target", target, "to", dest,
+		"format", format, "files", files, "size", formatSize(size),
+		"reused_files", len(m.Files)-files, "reused_size", formatSize(m.TotalSize()-size))
+}
+
+func runSnapshotImportDelta(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	src := args[1]
+	validateMirrorExists(config, mirrorID)
+
+	base, _ := cmd.Flags().GetString("base")
+	name, _ := cmd.Flags().GetString("name")
+	force, _ := cmd.Flags().GetBool("force")
+	snapshotName, err := sm.ImportDelta(mirrorID, src, mirror.ImportOptions{Name: name, Force: force, Base: base})
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to import snapshot delta", "mirror", mirrorID, "from", src, "error", errorMsg)
+		os.Exit(1)
+	}
+	slog.Info("snapshot imported", "mirror", mirrorID, "snapshot", snapshotName, "from", src)
+}
+
+func runSnapshotHistory(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	validateMirrorExists(config, mirrorID)
+
+	entries, err := sm.ReadHistory(mirrorID)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to read snapshot history", "error", errorMsg)
+		os.Exit(1)
+	}
+
+	fmt.Printf("History for mirror '%s':\n", mirrorID)
+	if len(entries) == 0 {
+		fmt.Println("  No history recorded")
+		return
+	}
+	for _, e := range entries {
+		change := e.Snapshot
+		switch e.Action {
+		case mirror.HistoryDelete:
+			if len(e.Unlinked) > 0 {
+				change += " (unlinked " + strings.Join(e.Unlinked, ", ") + ")"
+			}
+		case mirror.HistoryPin, mirror.HistoryUnpin:
+		default:
+			oldTarget := e.OldTarget
+			if oldTarget == "" {
+				oldTarget = "(none)"
+			}
+			change = oldTarget + " -> " + e.NewTarget
+			switch {
+			case e.FromChannel != "":
+				change = e.FromChannel + " => " + e.Channel + ": " + change
+			case e.Channel != "":
+				change = e.Channel + ": " + change
+			}
+		}
+		fmt.Printf("  %s  %-8s  %s  by %s@%s", e.Time.Local().Format(time.RFC3339), e.Action, change, e.User, e.Host)
+		if e.Reason != "" {
+			fmt.Printf("  reason: %s", e.Reason)
+		}
+		if len(e.OverriddenGates) > 0 {
+			fmt.Printf("  overridden gates: %s", strings.Join(e.OverriddenGates, ", "))
+		}
+		fmt.Println()
+	}
+}
+
+func runSnapshotRollback(cmd *cobra.Command, args []string) {
+	config, sm, verboseErrors := setupSnapshotCommand(cmd)
+
+	mirrorID := args[0]
+	validateMirrorExists(config, mirrorID)
+
+	steps, _ := cmd.Flags().GetInt("steps")
+
+	snapshotName, err := sm.RollbackSnapshot(mirrorID, steps)
+	if err != nil {
+		errorMsg := formatError(err, verboseErrors)
+		slog.Error("failed to roll back snapshot", "error", errorMsg)
+		os.Exit(1)
+	}
+
+	slog.Info("snapshot rolled back in production", "mirror", mirrorID, "snapshot", snapshotName)
 }
 
 // loadConfig loads configuration from file and applies environment variable overrides
 func loadConfig(verboseErrors bool) (*mirror.Config, error) {
+	config, _, err := loadConfigSources(verboseErrors)
+	return config, err
+}
+
+// loadConfigSources is loadConfig that also returns the files the
+// configuration was read from
+func loadConfigSources(verboseErrors bool) (*mirror.Config, *mirror.ConfigSources, error) {
 	config := mirror.NewConfig()
-	meta, err := toml.DecodeFile(configPath, config)
+	sources, err := mirror.LoadConfig(configPath, config)
 	if err != nil {
 		if os.IsNotExist(err) {
 			slog.Error("configuration file not found", "path", configPath)
 			slog.Info("Please create a configuration file at the default location or specify one with the --config flag.")
-			return nil, err
+			return nil, nil, err
 		}
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("failed to decode config file", "error", errorMsg, "path", configPath)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Check for undecoded keys which might indicate parsing stopped early
-	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+	if undecoded := sources.Undecoded; len(undecoded) > 0 {
 		errorMsg := formatUndecodedError(undecoded)
 		slog.Error("configuration validation failed", "error", errorMsg, "path", configPath)
-		return nil, errors.New(errorMsg)
+		return nil, nil, errors.New(errorMsg)
 	}
 
 	// Apply environment variable overrides
 	if err := config.ApplyEnvironmentVariables(); err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("failed to apply environment variables", "error", errorMsg)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Validate the final configuration
 	if err := config.Check(); err != nil {
 		errorMsg := formatError(err, verboseErrors)
 		slog.Error("configuration validation failed", "error", errorMsg)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return config, nil
+	return config, sources, nil
 }
 
 func main() {
@@ -9,9 +9,11 @@ require (
 require (
 	github.com/ProtonMail/gopenpgp/v3 v3.3.0
 	github.com/cockroachdb/errors v1.12.0
+	github.com/klauspost/compress v1.18.0
 	github.com/knqyf263/go-deb-version v0.0.0-20241115132648-6f4aee6ccd23
 	github.com/schollz/progressbar/v3 v3.18.0
 	github.com/spf13/cobra v1.9.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -72,6 +72,12 @@ func (fi *FileInfo) HasChecksum() bool {
 	return fi.checksums.MD5 != nil
 }
 
+// SHA256Sum returns the SHA256 checksum of the file, or nil if fi has
+// no SHA256 checksum.
+func (fi *FileInfo) SHA256Sum() []byte {
+	return fi.checksums.SHA256
+}
+
 // CalcChecksums calculates checksums and stores them in fi.
 func (fi *FileInfo) CalcChecksums(data []byte) {
 	md5sum := md5.Sum(data)   // #nosec G401 - MD5 required for APT repository compatibility
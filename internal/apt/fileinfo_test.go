@@ -215,6 +215,9 @@ func testFileInfoChecksum(t *testing.T) {
 	if fi.SHA256Path() != "/abc/by-hash/SHA256/"+s256 {
 		t.Error(`fi.SHA256Path() != "/abc/by-hash/SHA256/" + s256`)
 	}
+	if !bytes.Equal(fi.SHA256Sum(), sha256sum[:]) {
+		t.Error(`fi.SHA256Sum() != sha256sum`)
+	}
 }
 
 func testFileInfoCopy(t *testing.T) {
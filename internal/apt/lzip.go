@@ -0,0 +1,125 @@
+package apt
+
+// This file implements a decompressor for lzip files.
+// See https://www.nongnu.org/lzip/manual/lzip_manual.html#File-format
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	lzipHeaderLen  = 6
+	lzipTrailerLen = 20
+
+	lzipMinDictSize = 1 << 12
+	lzipMaxDictSize = 1 << 29
+)
+
+// lzipReader decompresses a multi-member lzip stream.
+//
+// Each member is a raw LZMA stream with fixed properties terminated
+// by an end-of-stream marker, so it is decoded by presenting it to
+// lzma.Reader with a synthesized classic LZMA header.
+type lzipReader struct {
+	br   *bufio.Reader
+	lr   *lzma.Reader
+	crc  hash.Hash32
+	size uint64
+}
+
+func newLzipReader(r io.Reader) (*lzipReader, error) {
+	z := &lzipReader{br: bufio.NewReader(r)}
+	if err := z.nextMember(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// nextMember reads the header of the next member and prepares
+// the LZMA decoder for its data.
+func (z *lzipReader) nextMember() error {
+	var h [lzipHeaderLen]byte
+	if _, err := io.ReadFull(z.br, h[:]); err != nil {
+		return errors.Wrap(err, "lzip: read header")
+	}
+	if string(h[:4]) != "LZIP" {
+		return errors.New("lzip: invalid magic")
+	}
+	if h[4] != 1 {
+		return errors.Newf("lzip: unsupported version %d", h[4])
+	}
+
+	base := uint32(1) << (h[5] & 0x1f)
+	dictSize := base - uint32(h[5]>>5)*(base/16)
+	if dictSize < lzipMinDictSize || dictSize > lzipMaxDictSize {
+		return errors.Newf("lzip: invalid dictionary size %d", dictSize)
+	}
+
+	// lc=3, lp=0, pb=2 and an unknown uncompressed size.
+	var lh [lzma.HeaderLen]byte
+	lh[0] = 0x5d
+	binary.LittleEndian.PutUint32(lh[1:5], dictSize)
+	for i := 5; i < len(lh); i++ {
+		lh[i] = 0xff
+	}
+
+	// io.MultiReader is not an io.ByteReader, so lzma.Reader consumes
+	// the member one byte at a time and leaves the trailer in z.br.
+	cfg := lzma.ReaderConfig{DictCap: int(dictSize)}
+	lr, err := cfg.NewReader(io.MultiReader(bytes.NewReader(lh[:]), z.br))
+	if err != nil {
+		return errors.Wrap(err, "lzip")
+	}
+
+	z.lr = lr
+	z.crc = crc32.NewIEEE()
+	z.size = 0
+	return nil
+}
+
+// checkTrailer verifies the trailer of the current member.
+func (z *lzipReader) checkTrailer() error {
+	var t [lzipTrailerLen]byte
+	if _, err := io.ReadFull(z.br, t[:]); err != nil {
+		return errors.Wrap(err, "lzip: read trailer")
+	}
+	if binary.LittleEndian.Uint32(t[0:4]) != z.crc.Sum32() {
+		return errors.New("lzip: CRC mismatch")
+	}
+	if binary.LittleEndian.Uint64(t[4:12]) != z.size {
+		return errors.New("lzip: data size mismatch")
+	}
+	return nil
+}
+
+func (z *lzipReader) Read(p []byte) (int, error) {
+	for {
+		n, err := z.lr.Read(p)
+		z.crc.Write(p[:n])
+		z.size += uint64(n)
+		if !errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		if err := z.checkTrailer(); err != nil {
+			return n, err
+		}
+		if _, err := z.br.Peek(1); errors.Is(err, io.EOF) {
+			return n, io.EOF
+		}
+		if err := z.nextMember(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
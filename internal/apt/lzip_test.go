@@ -0,0 +1,58 @@
+package apt
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestLzipReaderMultiMember(t *testing.T) {
+	t.Parallel()
+
+	member, err := os.ReadFile("testdata/af/Packages.lz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newLzipReader(bytes.NewReader(append(append([]byte{}, member...), member...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(append([]byte{}, want...), want...)) {
+		t.Error("decompressed data mismatch")
+	}
+}
+
+func TestLzipReaderCorrupt(t *testing.T) {
+	t.Parallel()
+
+	member, err := os.ReadFile("testdata/af/Packages.lz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Break the CRC32 in the trailer.
+	data := append([]byte{}, member...)
+	data[len(data)-lzipTrailerLen] ^= 0xff
+
+	r, err := newLzipReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected CRC error")
+	}
+
+	if _, err := newLzipReader(bytes.NewReader([]byte("LZMA\x01\x10"))); err == nil {
+		t.Error("expected magic error")
+	}
+}
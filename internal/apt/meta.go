@@ -13,27 +13,35 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
-// IsMeta returns true if p points a debian repository index file
-// containing checksums for other files.
-func IsMeta(p string) bool {
-	base := path.Base(p)
-
+// TrimCompressionExt removes a compression extension, if any, from p.
+func TrimCompressionExt(p string) string {
 	// https://wiki.debian.org/RepositoryFormat#Compression_of_indices
 	switch {
-	case strings.HasSuffix(base, ".gz"):
-		base = base[0 : len(base)-3]
-	case strings.HasSuffix(base, ".bz2"):
-		base = base[0 : len(base)-4]
-	case strings.HasSuffix(base, ".xz"):
-		base = base[0 : len(base)-3]
-	case strings.HasSuffix(base, ".lzma"):
-		base = base[0 : len(base)-5]
-	case strings.HasSuffix(base, ".lz"):
-		base = base[0 : len(base)-3]
+	case strings.HasSuffix(p, ".gz"):
+		return p[0 : len(p)-3]
+	case strings.HasSuffix(p, ".bz2"):
+		return p[0 : len(p)-4]
+	case strings.HasSuffix(p, ".xz"):
+		return p[0 : len(p)-3]
+	case strings.HasSuffix(p, ".lzma"):
+		return p[0 : len(p)-5]
+	case strings.HasSuffix(p, ".lz"):
+		return p[0 : len(p)-3]
+	case strings.HasSuffix(p, ".zst"):
+		return p[0 : len(p)-4]
 	}
+	return p
+}
+
+// IsMeta returns true if p points a debian repository index file
+// containing checksums for other files.
+func IsMeta(p string) bool {
+	base := TrimCompressionExt(path.Base(p))
 
 	switch base {
 	case "Release", "Release.gpg", "InRelease":
@@ -49,7 +57,7 @@ func IsMeta(p string) bool {
 // decompressed by ExtractFileInfo.
 func IsSupported(p string) bool {
 	switch path.Ext(p) {
-	case "", ".gz", ".bz2", ".gpg", ".xz":
+	case "", ".gz", ".bz2", ".gpg", ".xz", ".zst", ".lzma", ".lz":
 		return true
 	}
 	return false
@@ -66,9 +74,10 @@ func SupportByHash(d Paragraph) bool {
 	return p[0] == "yes"
 }
 
-// validateRepositoryPath validates that a file path from repository metadata is safe.
-// This prevents path traversal attacks from malicious Release files.
-func validateRepositoryPath(p string) error {
+// ValidateRepositoryPath validates that a file path from repository metadata is safe.
+// This prevents path traversal attacks from malicious Release files and snapshot
+// archives.
+func ValidateRepositoryPath(p string) error {
 	// Check for directory traversal attempts in the original path BEFORE cleaning
 	// This catches cases like "main/../binary-amd64/Packages" which would become
 	// "binary-amd64/Packages" after cleaning and lose the attack vector evidence
@@ -121,7 +130,7 @@ func parseChecksum(l string) (p string, size uint64, csum []byte, err error) {
 	p = flds[2]
 
 	// Validate the path for security
-	if err = validateRepositoryPath(p); err != nil {
+	if err = ValidateRepositoryPath(p); err != nil {
 		return
 	}
 
@@ -256,62 +265,72 @@ func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 			return nil, nil, errors.Wrap(err, "parser.Read")
 		}
 
-		filename, ok := d["Filename"]
-		if !ok {
-			return nil, nil, errors.New("no Filename in " + p)
-		}
-		fpath := path.Clean(filename[0])
-
-		// Validate the path for security
-		if err := validateRepositoryPath(fpath); err != nil {
-			return nil, nil, errors.Wrap(err, "invalid Filename in "+p)
-		}
-
-		strsize, ok := d["Size"]
-		if !ok {
-			return nil, nil, errors.New("no Size in " + p)
-		}
-		size, err := strconv.ParseUint(strsize[0], 10, 64)
+		fi, err := fileInfoFromPackagesStanza(p, d)
 		if err != nil {
 			return nil, nil, err
 		}
+		l = append(l, fi)
+	}
 
-		fi := &FileInfo{
-			path: fpath,
-			size: size,
-		}
-		if csum, ok := d["MD5sum"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, nil, err
-			}
-			fi.checksums.MD5 = b
+	return l, nil, nil
+}
+
+// fileInfoFromPackagesStanza returns the *FileInfo described by
+// a single paragraph of a Packages file.
+func fileInfoFromPackagesStanza(p string, d Paragraph) (*FileInfo, error) {
+	filename, ok := d["Filename"]
+	if !ok {
+		return nil, errors.New("no Filename in " + p)
+	}
+	fpath := path.Clean(filename[0])
+
+	// Validate the path for security
+	if err := ValidateRepositoryPath(fpath); err != nil {
+		return nil, errors.Wrap(err, "invalid Filename in "+p)
+	}
+
+	strsize, ok := d["Size"]
+	if !ok {
+		return nil, errors.New("no Size in " + p)
+	}
+	size, err := strconv.ParseUint(strsize[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := &FileInfo{
+		path: fpath,
+		size: size,
+	}
+	if csum, ok := d["MD5sum"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
 		}
-		if csum, ok := d["SHA1"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, nil, err
-			}
-			fi.checksums.SHA1 = b
+		fi.checksums.MD5 = b
+	}
+	if csum, ok := d["SHA1"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
 		}
-		if csum, ok := d["SHA256"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, nil, err
-			}
-			fi.checksums.SHA256 = b
+		fi.checksums.SHA1 = b
+	}
+	if csum, ok := d["SHA256"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
 		}
-		if csum, ok := d["SHA512"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, nil, err
-			}
-			fi.checksums.SHA512 = b
+		fi.checksums.SHA256 = b
+	}
+	if csum, ok := d["SHA512"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
 		}
-		l = append(l, fi)
+		fi.checksums.SHA512 = b
 	}
-
-	return l, nil, nil
+	return fi, nil
 }
 
 // getFilesFromSources parses Sources file and returns
@@ -329,103 +348,115 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, Paragraph, error)
 			return nil, nil, errors.Wrap(err, "parser.Read")
 		}
 
-		dir, ok := d["Directory"]
-		if !ok {
-			return nil, nil, errors.New("no Directory in " + p)
+		fil, err := fileInfosFromSourcesStanza(p, d)
+		if err != nil {
+			return nil, nil, err
 		}
+		l = append(l, fil...)
+	}
+
+	return l, nil, nil
+}
 
-		// Validate the directory path for security
-		if err := validateRepositoryPath(dir[0]); err != nil {
-			return nil, nil, errors.Wrap(err, "invalid Directory in "+p)
+// fileInfosFromSourcesStanza returns the list of *FileInfo described
+// by a single paragraph of a Sources file.
+func fileInfosFromSourcesStanza(p string, d Paragraph) ([]*FileInfo, error) {
+	dir, ok := d["Directory"]
+	if !ok {
+		return nil, errors.New("no Directory in " + p)
+	}
+
+	// Validate the directory path for security
+	if err := ValidateRepositoryPath(dir[0]); err != nil {
+		return nil, errors.Wrap(err, "invalid Directory in "+p)
+	}
+
+	m := make(map[string]*FileInfo)
+
+	for _, l := range d["Files"] {
+		fname, size, csum, err := parseChecksum(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Files")
 		}
 
-		m := make(map[string]*FileInfo)
+		fpath := path.Clean(path.Join(dir[0], fname))
+		m[fpath] = &FileInfo{
+			path: fpath,
+			size: size,
+			checksums: Checksums{
+				MD5: csum,
+			},
+		}
+	}
 
-		for _, l := range d["Files"] {
-			fname, size, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Files")
-			}
+	for _, l := range d["Checksums-Sha1"] {
+		fname, size, csum, err := parseChecksum(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
+		}
 
-			fpath := path.Clean(path.Join(dir[0], fname))
+		fpath := path.Clean(path.Join(dir[0], fname))
+		if _, ok := m[fpath]; ok {
+			m[fpath].checksums.SHA1 = csum
+		} else {
 			m[fpath] = &FileInfo{
 				path: fpath,
 				size: size,
 				checksums: Checksums{
-					MD5: csum,
+					SHA1: csum,
 				},
 			}
 		}
+	}
 
-		for _, l := range d["Checksums-Sha1"] {
-			fname, size, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
-			}
-
-			fpath := path.Clean(path.Join(dir[0], fname))
-			if _, ok := m[fpath]; ok {
-				m[fpath].checksums.SHA1 = csum
-			} else {
-				m[fpath] = &FileInfo{
-					path: fpath,
-					size: size,
-					checksums: Checksums{
-						SHA1: csum,
-					},
-				}
-			}
+	for _, l := range d["Checksums-Sha256"] {
+		fname, size, csum, err := parseChecksum(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
 		}
 
-		for _, l := range d["Checksums-Sha256"] {
-			fname, size, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
-			}
-
-			fpath := path.Clean(path.Join(dir[0], fname))
-			if _, ok := m[fpath]; ok {
-				m[fpath].checksums.SHA256 = csum
-			} else {
-				m[fpath] = &FileInfo{
-					path: fpath,
-					size: size,
-					checksums: Checksums{
-						SHA256: csum,
-					},
-				}
+		fpath := path.Clean(path.Join(dir[0], fname))
+		if _, ok := m[fpath]; ok {
+			m[fpath].checksums.SHA256 = csum
+		} else {
+			m[fpath] = &FileInfo{
+				path: fpath,
+				size: size,
+				checksums: Checksums{
+					SHA256: csum,
+				},
 			}
 		}
+	}
 
-		for _, l := range d["Checksums-Sha512"] {
-			fname, size, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "parseChecksum for Checksums-Sha512")
-			}
-
-			fpath := path.Clean(path.Join(dir[0], fname))
-			if _, ok := m[fpath]; ok {
-				m[fpath].checksums.SHA512 = csum
-			} else {
-				m[fpath] = &FileInfo{
-					path: fpath,
-					size: size,
-					checksums: Checksums{
-						SHA512: csum,
-					},
-				}
-			}
+	for _, l := range d["Checksums-Sha512"] {
+		fname, size, csum, err := parseChecksum(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha512")
 		}
 
-		for _, fi := range m {
-			if len(fi.checksums.MD5) == 0 && len(fi.checksums.SHA1) == 0 && len(fi.checksums.SHA256) == 0 && len(fi.checksums.SHA512) == 0 {
-				return nil, nil, errors.New("no checksum in " + fi.path)
+		fpath := path.Clean(path.Join(dir[0], fname))
+		if _, ok := m[fpath]; ok {
+			m[fpath].checksums.SHA512 = csum
+		} else {
+			m[fpath] = &FileInfo{
+				path: fpath,
+				size: size,
+				checksums: Checksums{
+					SHA512: csum,
+				},
 			}
-			l = append(l, fi)
 		}
 	}
 
-	return l, nil, nil
+	l := make([]*FileInfo, 0, len(m))
+	for _, fi := range m {
+		if len(fi.checksums.MD5) == 0 && len(fi.checksums.SHA1) == 0 && len(fi.checksums.SHA256) == 0 && len(fi.checksums.SHA512) == 0 {
+			return nil, errors.New("no checksum in " + fi.path)
+		}
+		l = append(l, fi)
+	}
+	return l, nil
 }
 
 // getFilesFromIndex parses i18n/Index file and returns
@@ -434,19 +465,11 @@ func getFilesFromIndex(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
 	return getFilesFromRelease(p, r)
 }
 
-// ExtractFileInfo parses debian repository index files such as
-// Release, Packages, or Sources and return a list of *FileInfo
-// listed in the file.
-//
-// If the index is Release, InRelease, or Index, this function
-// also returns non-nil Paragraph data of the index.
-//
-// p is the relative path of the file.
-func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
-	if !IsMeta(p) {
-		return nil, nil, errors.New("not a meta data file: " + p)
-	}
-
+// decompress wraps r with a decompressor chosen by the extension of p.
+// It returns the decompressed reader, the base name of p without the
+// compression extension, and an optional io.Closer that must be closed
+// when reading is done.
+func decompress(p string, r io.Reader) (io.Reader, string, io.Closer, error) {
 	base := path.Base(p)
 	ext := path.Ext(base)
 	switch ext {
@@ -455,23 +478,84 @@ func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
 	case ".gz":
 		gz, err := gzip.NewReader(r)
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
 		}
-		defer gz.Close()
-		r = gz
-		base = base[:len(base)-3]
+		return gz, base[:len(base)-3], gz, nil
 	case ".bz2":
-		r = bzip2.NewReader(r)
-		base = base[:len(base)-4]
+		return bzip2.NewReader(r), base[:len(base)-4], nil, nil
 	case ".xz":
 		xzr, err := xz.NewReader(r)
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
+		}
+		return xzr, base[:len(base)-3], nil, nil
+	case ".zst":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", nil, err
 		}
-		r = xzr
-		base = base[:len(base)-3]
+		rc := zr.IOReadCloser()
+		return rc, base[:len(base)-4], rc, nil
+	case ".lzma":
+		lr, err := lzma.NewReader(r)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return lr, base[:len(base)-5], nil, nil
+	case ".lz":
+		lr, err := newLzipReader(r)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return lr, base[:len(base)-3], nil, nil
 	default:
-		return nil, nil, errors.New("unsupported file extension: " + ext)
+		return nil, "", nil, errors.New("unsupported file extension: " + ext)
+	}
+	return r, base, nil, nil
+}
+
+type decompressReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (d decompressReader) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// Decompress returns a reader that decompresses r according to the
+// compression extension of p.  The returned reader should be closed
+// when reading is done; it does not close r.
+func Decompress(p string, r io.Reader) (io.ReadCloser, error) {
+	r, _, closer, err := decompress(p, r)
+	if err != nil {
+		return nil, err
+	}
+	return decompressReader{Reader: r, closer: closer}, nil
+}
+
+// ExtractFileInfo parses debian repository index files such as
+// Release, Packages, or Sources and return a list of *FileInfo
+// listed in the file.
+//
+// If the index is Release, InRelease, or Index, this function
+// also returns non-nil Paragraph data of the index.
+//
+// p is the relative path of the file.
+func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
+	if !IsMeta(p) {
+		return nil, nil, errors.New("not a meta data file: " + p)
+	}
+
+	r, base, closer, err := decompress(p, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if closer != nil {
+		defer closer.Close()
 	}
 
 	switch base {
@@ -482,6 +566,9 @@ func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
 	case "Sources":
 		return getFilesFromSources(p, r)
 	case "Index":
+		if IsPDiff(p) {
+			return getFilesFromPDiffIndex(p, r)
+		}
 		return getFilesFromIndex(p, r)
 	}
 	return nil, nil, nil
@@ -340,3 +340,59 @@ func TestExtractFileInfoWithXZ(t *testing.T) {
 		t.Error("pool/c/cybozu-abc_0.2.2-1_amd64.deb")
 	}
 }
+
+func TestExtractFileInfoWithOtherCompressions(t *testing.T) {
+	t.Parallel()
+
+	sha1sum, _ := hex.DecodeString("903b3305c86e872db25985f2b686ef8d1c3760cf")
+	fi := &FileInfo{
+		path: "pool/c/cybozu-abc_0.2.2-1_amd64.deb",
+		size: 102369852,
+		checksums: Checksums{
+			SHA1: sha1sum,
+		},
+	}
+
+	for _, name := range []string{"Packages.zst", "Packages.lzma", "Packages.lz"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if !IsSupported(name) {
+				t.Errorf("!IsSupported(%q)", name)
+			}
+
+			f, err := os.Open("testdata/af/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			fil, _, err := ExtractFileInfo("ubuntu/dists/testing/"+name, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !containsFileInfo(fi, fil) {
+				t.Error("pool/c/cybozu-abc_0.2.2-1_amd64.deb")
+			}
+		})
+	}
+}
+
+func TestTrimCompressionExt(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"main/binary-amd64/Packages":      "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.gz":   "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.bz2":  "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.xz":   "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.zst":  "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.lzma": "main/binary-amd64/Packages",
+		"main/binary-amd64/Packages.lz":   "main/binary-amd64/Packages",
+	}
+	for p, want := range tests {
+		if got := TrimCompressionExt(p); got != want {
+			t.Errorf("TrimCompressionExt(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
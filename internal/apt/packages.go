@@ -0,0 +1,154 @@
+package apt
+
+// This file provides package-level views of Packages and Sources indices.
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// SourceArchitecture is the pseudo architecture assigned to
+// packages read from Sources indices.
+const SourceArchitecture = "source"
+
+// Package is a binary or source package described by a single
+// paragraph of a Packages or Sources index.
+type Package struct {
+	// Name is the value of the Package field.
+	Name string
+
+	// Version is the value of the Version field.
+	Version string
+
+	// Architecture is the value of the Architecture field for binary
+	// packages, or SourceArchitecture for source packages.
+	Architecture string
+
+	// Source and SourceVersion identify the source package this
+	// package was built from.  For source packages they are the same
+	// as Name and Version.
+	Source        string
+	SourceVersion string
+
+	// Files lists the files that belong to the package.
+	Files []*FileInfo
+
+	// MultiArch is the value of the Multi-Arch field of binary
+	// packages, such as "same", "foreign" or "allowed".
+	MultiArch string
+
+	// Depends, PreDepends and Provides are the unparsed relationship
+	// fields of binary packages.  See ParseRelations.
+	Depends    string
+	PreDepends string
+	Provides   string
+}
+
+// IsSource returns true if pkg was read from a Sources index.
+func (pkg *Package) IsSource() bool {
+	return pkg.Architecture == SourceArchitecture
+}
+
+// parseSourceField parses the Source field of a binary package
+// paragraph.  The field has the form "name" or "name (version)".
+// Missing values default to the binary package name and version.
+func parseSourceField(d Paragraph, name, version string) (string, string) {
+	src, ok := d["Source"]
+	if !ok || len(src) == 0 {
+		return name, version
+	}
+
+	s := strings.TrimSpace(src[0])
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		srcVersion := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s[i+1:]), ")"))
+		return strings.TrimSpace(s[:i]), srcVersion
+	}
+	return s, version
+}
+
+// firstValue returns the first value of field in d, or an empty string.
+func firstValue(d Paragraph, field string) string {
+	if v, ok := d[field]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// ExtractPackages parses a Packages or Sources index and returns
+// the packages listed in the file.
+//
+// p is the relative path of the file.  Compressed indices are
+// decompressed the same way as ExtractFileInfo does.
+func ExtractPackages(p string, r io.Reader) ([]*Package, error) {
+	r, base, closer, err := decompress(p, r)
+	if err != nil {
+		return nil, err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	var source bool
+	switch base {
+	case "Packages":
+	case "Sources":
+		source = true
+	default:
+		return nil, errors.New("not a Packages or Sources index: " + p)
+	}
+
+	var l []*Package
+	parser := NewParser(r)
+	for {
+		d, err := parser.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parser.Read")
+		}
+
+		pkg := &Package{
+			Name:    firstValue(d, "Package"),
+			Version: firstValue(d, "Version"),
+		}
+
+		if source {
+			fil, err := fileInfosFromSourcesStanza(p, d)
+			if err != nil {
+				return nil, err
+			}
+			pkg.Architecture = SourceArchitecture
+			pkg.Source = pkg.Name
+			pkg.SourceVersion = pkg.Version
+			pkg.Files = fil
+		} else {
+			fi, err := fileInfoFromPackagesStanza(p, d)
+			if err != nil {
+				return nil, err
+			}
+			pkg.Architecture = firstValue(d, "Architecture")
+			pkg.Source, pkg.SourceVersion = parseSourceField(d, pkg.Name, pkg.Version)
+			pkg.Files = []*FileInfo{fi}
+			pkg.MultiArch = firstValue(d, "Multi-Arch")
+			pkg.Depends = strings.Join(d["Depends"], " ")
+			pkg.PreDepends = strings.Join(d["Pre-Depends"], " ")
+			pkg.Provides = strings.Join(d["Provides"], " ")
+		}
+		l = append(l, pkg)
+	}
+
+	return l, nil
+}
+
+// IsPackageIndex returns true if p points to a Packages or Sources index.
+func IsPackageIndex(p string) bool {
+	switch path.Base(TrimCompressionExt(p)) {
+	case "Packages", "Sources":
+		return true
+	}
+	return false
+}
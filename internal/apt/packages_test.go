@@ -0,0 +1,130 @@
+package apt
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtractPackagesBinary(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/af/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pkgs, err := ExtractPackages("main/binary-amd64/Packages", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 3 {
+		t.Fatalf("expected 3 packages, got %d", len(pkgs))
+	}
+
+	pkg := pkgs[0]
+	if pkg.Name != "cybozu-abc" || pkg.Version != "0.2.2-1" || pkg.Architecture != "amd64" {
+		t.Errorf("unexpected package: %+v", pkg)
+	}
+	if pkg.IsSource() {
+		t.Error("binary package reported as source")
+	}
+	if pkg.Source != "cybozu-abc" || pkg.SourceVersion != "0.2.2-1" {
+		t.Errorf("unexpected source reference: %s %s", pkg.Source, pkg.SourceVersion)
+	}
+	if len(pkg.Files) != 1 || pkg.Files[0].Path() != "pool/c/cybozu-abc_0.2.2-1_amd64.deb" {
+		t.Errorf("unexpected files: %v", pkg.Files)
+	}
+
+	if pkg.PreDepends != "adduser" || pkg.Depends != "" {
+		t.Errorf("unexpected relationships: %q %q", pkg.PreDepends, pkg.Depends)
+	}
+
+	// The third stanza misspells the Package field.
+	if pkgs[2].Name != "" {
+		t.Errorf("expected empty name, got %q", pkgs[2].Name)
+	}
+}
+
+func TestExtractPackagesSources(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/af/Sources.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pkgs, err := ExtractPackages("main/source/Sources.gz", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) == 0 {
+		t.Fatal("no source packages")
+	}
+
+	pkg := pkgs[0]
+	if pkg.Name != "aalib" || pkg.Version != "1.4p5-41" {
+		t.Errorf("unexpected package: %s %s", pkg.Name, pkg.Version)
+	}
+	if !pkg.IsSource() {
+		t.Error("source package not reported as source")
+	}
+	if len(pkg.Files) != 3 {
+		t.Fatalf("expected 3 files, got %d", len(pkg.Files))
+	}
+	for _, fi := range pkg.Files {
+		if !strings.HasPrefix(fi.Path(), "pool/main/a/aalib/aalib_1.4p5") {
+			t.Errorf("unexpected file path: %s", fi.Path())
+		}
+	}
+}
+
+func TestExtractPackagesNotIndex(t *testing.T) {
+	t.Parallel()
+
+	_, err := ExtractPackages("Release", strings.NewReader(""))
+	if err == nil {
+		t.Error("expected error for Release")
+	}
+}
+
+func TestParseSourceField(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		d           Paragraph
+		wantName    string
+		wantVersion string
+	}{
+		{"absent", Paragraph{}, "libfoo1", "1.0-1"},
+		{"name only", Paragraph{"Source": {"foo"}}, "foo", "1.0-1"},
+		{"name and version", Paragraph{"Source": {"foo (1:0.9-2)"}}, "foo", "1:0.9-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, version := parseSourceField(tt.d, "libfoo1", "1.0-1")
+			if name != tt.wantName || version != tt.wantVersion {
+				t.Errorf("got (%s, %s), want (%s, %s)", name, version, tt.wantName, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestIsPackageIndex(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range []string{"Packages", "main/binary-amd64/Packages.xz", "main/source/Sources.gz"} {
+		if !IsPackageIndex(p) {
+			t.Errorf("!IsPackageIndex(%q)", p)
+		}
+	}
+	for _, p := range []string{"Release", "main/i18n/Index", "pool/c/foo.deb"} {
+		if IsPackageIndex(p) {
+			t.Errorf("IsPackageIndex(%q)", p)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package apt
+
+// This file implements incremental index updates with PDiff.
+// See https://wiki.debian.org/DebianRepository/Format#Diffs_of_indices
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+)
+
+const pdiffDirExt = ".diff"
+
+var edCommandPattern = regexp.MustCompile(`^(\d+)(?:,(\d+))?([acd])$`)
+
+// IsPDiff returns true if p points a file in the PDiff directory of an
+// index, such as "main/binary-amd64/Packages.diff/Index".
+func IsPDiff(p string) bool {
+	return path.Ext(path.Dir(p)) == pdiffDirExt
+}
+
+// PDiffDir returns the PDiff directory for the index at p.
+// The compression extension of p, if any, is ignored.
+func PDiffDir(p string) string {
+	return TrimCompressionExt(p) + pdiffDirExt
+}
+
+type pdiffHistory struct {
+	fi    *FileInfo
+	patch string
+}
+
+// PDiffIndex is the content of the Index file in a PDiff directory.
+type PDiffIndex struct {
+	current   *FileInfo
+	history   []pdiffHistory
+	downloads map[string]*FileInfo
+	merged    bool
+}
+
+// Current returns the information of the uncompressed index that
+// the patches produce.
+func (idx *PDiffIndex) Current() *FileInfo {
+	return idx.current
+}
+
+// History returns the information of the past versions of the
+// uncompressed index that can be patched to the current one.
+func (idx *PDiffIndex) History() []*FileInfo {
+	l := make([]*FileInfo, len(idx.history))
+	for i, h := range idx.history {
+		l[i] = h.fi
+	}
+	return l
+}
+
+// Downloads returns the compressed patch files listed in the index.
+func (idx *PDiffIndex) Downloads() []*FileInfo {
+	l := make([]*FileInfo, 0, len(idx.downloads))
+	for _, fi := range idx.downloads {
+		l = append(l, fi)
+	}
+	return l
+}
+
+// PatchesFrom returns the compressed patch files that need to be
+// applied, in order, to update the index described by old to the
+// current one.
+func (idx *PDiffIndex) PatchesFrom(old *FileInfo) ([]*FileInfo, error) {
+	for i, h := range idx.history {
+		if !h.fi.Same(old) {
+			continue
+		}
+
+		// Merged patches update any past version to the current one
+		// in a single step.
+		names := []string{h.patch}
+		if !idx.merged {
+			names = names[:0]
+			for _, h2 := range idx.history[i:] {
+				names = append(names, h2.patch)
+			}
+		}
+
+		l := make([]*FileInfo, 0, len(names))
+		for _, name := range names {
+			fi, ok := idx.downloads[name]
+			if !ok {
+				return nil, errors.New("no download entry for patch " + name)
+			}
+			l = append(l, fi)
+		}
+		return l, nil
+	}
+	return nil, errors.New("no patch for " + old.Path())
+}
+
+// parsePDiffLine parses a line such as "<sha256> <size> <name>"
+// or "<sha256> <size>".
+func parsePDiffLine(l string) (name string, size uint64, csum []byte, err error) {
+	flds := strings.Fields(l)
+	if len(flds) != 2 && len(flds) != 3 {
+		err = errors.New("invalid PDiff line: " + l)
+		return
+	}
+
+	csum, err = hex.DecodeString(flds[0])
+	if err != nil {
+		return
+	}
+	size, err = strconv.ParseUint(flds[1], 10, 64)
+	if err != nil {
+		return
+	}
+	if len(flds) == 3 {
+		name = flds[2]
+		if strings.ContainsRune(name, '/') {
+			err = errors.New("invalid patch name: " + name)
+		}
+	}
+	return
+}
+
+// ParsePDiffIndex parses the Index file of a PDiff directory.
+//
+// p is the relative path of the file.  Only SHA256 checksums are used.
+func ParsePDiffIndex(p string, r io.Reader) (*PDiffIndex, error) {
+	if !IsPDiff(p) || path.Base(p) != "Index" {
+		return nil, errors.New("not a PDiff index: " + p)
+	}
+	dir := path.Dir(p)
+	target := strings.TrimSuffix(dir, pdiffDirExt)
+
+	d, err := NewParser(r).Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "NewParser(r).Read()")
+	}
+
+	current := d["SHA256-Current"]
+	if len(current) != 1 {
+		return nil, errors.New("no SHA256-Current in " + p)
+	}
+	_, size, csum, err := parsePDiffLine(current[0])
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &PDiffIndex{
+		current:   &FileInfo{path: target, size: size, checksums: Checksums{SHA256: csum}},
+		downloads: make(map[string]*FileInfo),
+	}
+	if v := d["X-Patch-Precedence"]; len(v) == 1 && v[0] == "merged" {
+		idx.merged = true
+	}
+
+	for _, l := range d["SHA256-History"] {
+		name, size, csum, err := parsePDiffLine(l)
+		if err != nil {
+			return nil, err
+		}
+		idx.history = append(idx.history, pdiffHistory{
+			fi:    &FileInfo{path: target, size: size, checksums: Checksums{SHA256: csum}},
+			patch: name,
+		})
+	}
+
+	for _, l := range d["SHA256-Download"] {
+		name, size, csum, err := parsePDiffLine(l)
+		if err != nil {
+			return nil, err
+		}
+		fpath := path.Join(dir, name)
+		if err := ValidateRepositoryPath(fpath); err != nil {
+			return nil, err
+		}
+		idx.downloads[TrimCompressionExt(name)] = &FileInfo{
+			path:      fpath,
+			size:      size,
+			checksums: Checksums{SHA256: csum},
+		}
+	}
+
+	return idx, nil
+}
+
+// getFilesFromPDiffIndex parses the Index file of a PDiff directory
+// and returns a list of *FileInfo for the patch files.
+func getFilesFromPDiffIndex(p string, r io.Reader) ([]*FileInfo, Paragraph, error) {
+	idx, err := ParsePDiffIndex(p, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx.Downloads(), Paragraph{}, nil
+}
+
+// edCommand is a single change of an ed script that replaces lines
+// from start to end (1-based, inclusive) with text.  For appends,
+// end is start-1.
+type edCommand struct {
+	start, end int
+	text       [][]byte
+}
+
+// parseEdScript parses an ed script as produced by "diff --ed".
+// Only the a, c and d commands are supported.
+func parseEdScript(r io.Reader) ([]edCommand, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, startBufSize), maxScanTokenSize)
+
+	var cmds []edCommand
+	for s.Scan() {
+		m := edCommandPattern.FindStringSubmatch(s.Text())
+		if m == nil {
+			return nil, errors.New("unsupported ed command: " + s.Text())
+		}
+
+		start, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if m[2] != "" {
+			end, err = strconv.Atoi(m[2])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		cmd := edCommand{start: start, end: end}
+		switch m[3] {
+		case "a":
+			if m[2] != "" {
+				return nil, errors.New("invalid ed command: " + s.Text())
+			}
+			cmd.start = start + 1
+			cmd.end = start
+		case "c", "d":
+			if start < 1 || end < start {
+				return nil, errors.New("invalid ed command: " + s.Text())
+			}
+		}
+
+		if m[3] != "d" {
+			for {
+				if !s.Scan() {
+					return nil, errors.New("unterminated ed command")
+				}
+				l := s.Bytes()
+				if len(l) == 1 && l[0] == '.' {
+					break
+				}
+				cmd.text = append(cmd.text, append([]byte(nil), l...))
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+// applyEdScript applies commands to the lines read from r and writes
+// the result to w.  Commands must be in the descending order of lines
+// as produced by "diff --ed", which allows applying them in a single
+// pass without holding the lines in memory.
+func applyEdScript(w *bufio.Writer, r *bufio.Reader, cmds []edCommand) error {
+	for i := 1; i < len(cmds); i++ {
+		if cmds[i].end >= cmds[i-1].start || cmds[i].start >= cmds[i-1].start {
+			return errors.New("ed commands are not in descending order")
+		}
+	}
+
+	n := 0 // lines read
+	for i := len(cmds) - 1; i >= 0; i-- {
+		cmd := cmds[i]
+		for ; n < cmd.end; n++ {
+			out := w
+			if n >= cmd.start-1 {
+				out = nil // replaced or deleted
+			}
+			err := copyLine(out, r)
+			if err == io.EOF {
+				return errors.Newf("ed command for line %d beyond the end of file", cmd.end)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, l := range cmd.text {
+			_, _ = w.Write(l)
+			_ = w.WriteByte('\n')
+		}
+	}
+
+	for {
+		err := copyLine(w, r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// copyLine copies a line read from r to w, or discards it if w is nil.
+// A newline is added to the last line if it has none.  It returns
+// io.EOF if r has no more lines.  Write errors are returned by the
+// Flush method of w.
+func copyLine(w *bufio.Writer, r *bufio.Reader) error {
+	for partial := false; ; partial = true {
+		chunk, err := r.ReadSlice('\n')
+		if w != nil {
+			_, _ = w.Write(chunk)
+		}
+		switch err {
+		case nil:
+			return nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if !partial && len(chunk) == 0 {
+				return io.EOF
+			}
+			if w != nil {
+				_ = w.WriteByte('\n')
+			}
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// PatchIndex applies ed-style patches, in order, to the uncompressed
+// index read from r and writes the result to w.
+//
+// The ed scripts are parsed in memory, but the index is streamed: each
+// patch is applied in its own goroutine that feeds the next one through
+// a pipe, so that large indices such as Contents are never held whole.
+func PatchIndex(w io.Writer, r io.Reader, patches ...io.Reader) error {
+	scripts := make([][]edCommand, 0, len(patches))
+	for _, patch := range patches {
+		cmds, err := parseEdScript(patch)
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, cmds)
+	}
+	if len(scripts) == 0 {
+		scripts = append(scripts, nil)
+	}
+
+	var wg sync.WaitGroup
+	var pipes []*io.PipeReader
+	defer func() {
+		// Stop the previous stages if a later one failed
+		for _, pr := range pipes {
+			_ = pr.Close()
+		}
+		wg.Wait()
+	}()
+
+	in := r
+	for _, cmds := range scripts[:len(scripts)-1] {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pr)
+		wg.Add(1)
+		go func(in io.Reader, cmds []edCommand) {
+			defer wg.Done()
+			pw.CloseWithError(applyEdScript(bufio.NewWriter(pw), bufio.NewReader(in), cmds))
+		}(in, cmds)
+		in = pr
+	}
+	return applyEdScript(bufio.NewWriter(w), bufio.NewReader(in), scripts[len(scripts)-1])
+}
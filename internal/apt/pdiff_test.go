@@ -0,0 +1,152 @@
+package apt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIsPDiff(t *testing.T) {
+	t.Parallel()
+
+	if !IsPDiff("main/binary-amd64/Packages.diff/Index") {
+		t.Error(`!IsPDiff("main/binary-amd64/Packages.diff/Index")`)
+	}
+	if !IsPDiff("main/binary-amd64/Packages.diff/T-2024-01-01-0204.27-F-2024-01-01-0204.27.gz") {
+		t.Error("!IsPDiff(patch)")
+	}
+	if IsPDiff("main/i18n/Index") {
+		t.Error(`IsPDiff("main/i18n/Index")`)
+	}
+	if PDiffDir("main/binary-amd64/Packages.xz") != "main/binary-amd64/Packages.diff" {
+		t.Error(PDiffDir("main/binary-amd64/Packages.xz"))
+	}
+}
+
+func TestPatchIndex(t *testing.T) {
+	t.Parallel()
+
+	old := "a\nb\nc\nd\ne\n"
+	p1 := "5a\nf\n.\n3c\nC\n.\n1,2d\n"
+	p2 := "0a\nz\n.\n"
+
+	var buf bytes.Buffer
+	err := PatchIndex(&buf, strings.NewReader(old), strings.NewReader(p1), strings.NewReader(p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "z\nC\nd\ne\nf\n" {
+		t.Errorf("unexpected result: %q", buf.String())
+	}
+
+	// Lines longer than the read buffer and a missing final newline
+	long := strings.Repeat("x", 10000)
+	buf.Reset()
+	err = PatchIndex(&buf, strings.NewReader("a\n"+long+"\nc"), strings.NewReader("1d\n"), strings.NewReader("2a\nd\n.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != long+"\nc\nd\n" {
+		t.Errorf("unexpected result: %.20q", buf.String())
+	}
+
+	// Errors of a patch stop the following ones
+	if err := PatchIndex(&buf, strings.NewReader(old), strings.NewReader("6d\n"), strings.NewReader("1d\n")); err == nil {
+		t.Error("expected error for a patch beyond the end")
+	}
+
+	for _, p := range []string{
+		"1d\n3d\n",         // ascending
+		"6d\n",             // beyond the end
+		"1,2s/a/b/\n",      // unsupported
+		"2a\nunterminated", // no "."
+	} {
+		if err := PatchIndex(&buf, strings.NewReader(old), strings.NewReader(p)); err == nil {
+			t.Errorf("expected error for %q", p)
+		}
+	}
+}
+
+func sha256Line(data, name string) string {
+	sum := sha256.Sum256([]byte(data))
+	return fmt.Sprintf(" %s %d %s", hex.EncodeToString(sum[:]), len(data), name)
+}
+
+func TestParsePDiffIndex(t *testing.T) {
+	t.Parallel()
+
+	v1, v2, v3 := "a\n", "a\nb\n", "a\nb\nc\n"
+	p1, p2 := "1a\nb\n.\n", "2a\nc\n.\n"
+
+	index := func(merged bool) string {
+		var b strings.Builder
+		fmt.Fprintf(&b, "SHA256-Current:%s\n", strings.TrimSuffix(sha256Line(v3, ""), " "))
+		b.WriteString("SHA256-History:\n")
+		b.WriteString(sha256Line(v1, "T-1") + "\n")
+		b.WriteString(sha256Line(v2, "T-2") + "\n")
+		b.WriteString("SHA256-Patches:\n")
+		b.WriteString(sha256Line(p1, "T-1") + "\n")
+		b.WriteString(sha256Line(p2, "T-2") + "\n")
+		b.WriteString("SHA256-Download:\n")
+		b.WriteString(sha256Line("x", "T-1.gz") + "\n")
+		b.WriteString(sha256Line("y", "T-2.gz") + "\n")
+		if merged {
+			b.WriteString("X-Patch-Precedence: merged\n")
+		}
+		return b.String()
+	}
+
+	p := "dists/sid/main/binary-amd64/Packages.diff/Index"
+	idx, err := ParsePDiffIndex(p, strings.NewReader(index(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur := &FileInfo{path: "dists/sid/main/binary-amd64/Packages"}
+	cur.CalcChecksums([]byte(v3))
+	if !idx.Current().Same(cur) {
+		t.Error("unexpected current")
+	}
+	if len(idx.History()) != 2 || len(idx.Downloads()) != 2 {
+		t.Fatalf("unexpected history or downloads: %d %d", len(idx.History()), len(idx.Downloads()))
+	}
+
+	old := &FileInfo{path: "dists/sid/main/binary-amd64/Packages"}
+	old.CalcChecksums([]byte(v1))
+	patches, err := idx.PatchesFrom(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 || patches[0].Path() != "dists/sid/main/binary-amd64/Packages.diff/T-1.gz" {
+		t.Errorf("unexpected patches: %v", patches)
+	}
+
+	idx, err = ParsePDiffIndex(p, strings.NewReader(index(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches, err = idx.PatchesFrom(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 {
+		t.Errorf("expected a single merged patch, got %d", len(patches))
+	}
+
+	unknown := &FileInfo{path: "dists/sid/main/binary-amd64/Packages"}
+	unknown.CalcChecksums([]byte("z\n"))
+	if _, err := idx.PatchesFrom(unknown); err == nil {
+		t.Error("expected error for unknown version")
+	}
+
+	fil, _, err := ExtractFileInfo(p, strings.NewReader(index(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fil) != 2 {
+		t.Errorf("expected 2 patch files, got %d", len(fil))
+	}
+}
@@ -0,0 +1,149 @@
+package apt
+
+// This file parses the relationship fields of binary packages.
+//
+// The syntax is described in Debian policy 7.1:
+// https://www.debian.org/doc/debian-policy/ch-relationships.html
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Relation is a single package in a relationship field, such as
+// "libc6:any (>= 2.38) [amd64]".
+type Relation struct {
+	// Name is the name of the package.
+	Name string
+
+	// Arch is the architecture qualifier: "any", "native", an
+	// architecture name, or empty.
+	Arch string
+
+	// Op is one of "<<", "<=", "=", ">=" and ">>", or empty for
+	// unversioned relations.  The obsolete "<" and ">" are read as
+	// "<=" and ">=".
+	Op      string
+	Version string
+
+	// Archs restricts the relation to the listed architectures, or
+	// to all other architectures if NotArchs is set.
+	Archs    []string
+	NotArchs bool
+}
+
+// AppliesTo returns true if r applies on architecture arch.
+func (r *Relation) AppliesTo(arch string) bool {
+	if len(r.Archs) == 0 {
+		return true
+	}
+	for _, a := range r.Archs {
+		if a == arch || a == "any" {
+			return !r.NotArchs
+		}
+	}
+	return r.NotArchs
+}
+
+// String returns r in the syntax of relationship fields, without
+// architecture restrictions.
+func (r *Relation) String() string {
+	s := r.Name
+	if r.Arch != "" {
+		s += ":" + r.Arch
+	}
+	if r.Op != "" {
+		s += " (" + r.Op + " " + r.Version + ")"
+	}
+	return s
+}
+
+// ParseRelations parses a relationship field such as Depends.
+//
+// The result is a list of groups of alternatives.  The field is
+// satisfied if one relation of every group is satisfied.  Build
+// profile restrictions ("<!nocheck>") are ignored.
+func ParseRelations(s string) ([][]Relation, error) {
+	var groups [][]Relation
+	for _, g := range strings.Split(s, ",") {
+		if strings.TrimSpace(g) == "" {
+			continue
+		}
+		var alternatives []Relation
+		for _, a := range strings.Split(g, "|") {
+			r, err := parseRelation(a)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, r)
+		}
+		groups = append(groups, alternatives)
+	}
+	return groups, nil
+}
+
+// parseRelation parses a single relation.
+func parseRelation(s string) (Relation, error) {
+	var r Relation
+	orig := s
+	s = strings.TrimSpace(s)
+
+	// Build profiles follow the version constraint, which may contain '<'
+	start := strings.IndexByte(s, ')') + 1
+	if i := strings.IndexByte(s[start:], '<'); i >= 0 {
+		s = strings.TrimSpace(s[:start+i])
+	}
+
+	// Architecture restrictions
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		j := strings.IndexByte(s, ']')
+		if j < i {
+			return r, errors.New("invalid architecture restriction: " + orig)
+		}
+		for _, a := range strings.Fields(s[i+1 : j]) {
+			neg := strings.HasPrefix(a, "!")
+			if len(r.Archs) > 0 && neg != r.NotArchs {
+				return r, errors.New("mixed architecture restriction: " + orig)
+			}
+			r.NotArchs = neg
+			r.Archs = append(r.Archs, strings.TrimPrefix(a, "!"))
+		}
+		s = strings.TrimSpace(s[:i] + s[j+1:])
+	}
+
+	// Version constraint
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		j := strings.IndexByte(s, ')')
+		if j < i {
+			return r, errors.New("invalid version constraint: " + orig)
+		}
+		c := strings.TrimSpace(s[i+1 : j])
+		n := strings.IndexFunc(c, func(r rune) bool {
+			return !strings.ContainsRune("<=>", r)
+		})
+		if n <= 0 {
+			return r, errors.New("invalid version constraint: " + orig)
+		}
+		switch r.Op = c[:n]; r.Op {
+		case "<<", "<=", "=", ">=", ">>":
+		case "<":
+			r.Op = "<="
+		case ">":
+			r.Op = ">="
+		default:
+			return r, errors.New("invalid version constraint: " + orig)
+		}
+		r.Version = strings.TrimSpace(c[n:])
+		if r.Version == "" {
+			return r, errors.New("invalid version constraint: " + orig)
+		}
+		s = strings.TrimSpace(s[:i] + s[j+1:])
+	}
+
+	r.Name, r.Arch, _ = strings.Cut(s, ":")
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t") {
+		return r, errors.New("invalid relation: " + orig)
+	}
+	return r, nil
+}
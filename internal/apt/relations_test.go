@@ -0,0 +1,63 @@
+package apt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRelations(t *testing.T) {
+	t.Parallel()
+
+	groups, err := ParseRelations("libc6 (>= 2.38), python3:any, default-mta | mail-transport-agent, libfoo:i386 (<< 2:1.0~rc1) [amd64 i386] <!nocheck>, bar (> 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Relation{
+		{{Name: "libc6", Op: ">=", Version: "2.38"}},
+		{{Name: "python3", Arch: "any"}},
+		{{Name: "default-mta"}, {Name: "mail-transport-agent"}},
+		{{Name: "libfoo", Arch: "i386", Op: "<<", Version: "2:1.0~rc1", Archs: []string{"amd64", "i386"}}},
+		{{Name: "bar", Op: ">=", Version: "1"}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("unexpected relations:\n got: %+v\nwant: %+v", groups, want)
+	}
+	if s := groups[3][0].String(); s != "libfoo:i386 (<< 2:1.0~rc1)" {
+		t.Errorf("unexpected string: %s", s)
+	}
+
+	if groups, err := ParseRelations(""); err != nil || len(groups) != 0 {
+		t.Errorf("expected no relations, got %v, %v", groups, err)
+	}
+
+	for _, s := range []string{"foo (>= )", "foo (~ 1)", "foo [amd64 !i386]", "foo bar", ":any"} {
+		if _, err := ParseRelations(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestRelationAppliesTo(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		field string
+		arch  string
+		want  bool
+	}{
+		{"foo", "amd64", true},
+		{"foo [amd64 arm64]", "arm64", true},
+		{"foo [amd64 arm64]", "i386", false},
+		{"foo [!amd64]", "amd64", false},
+		{"foo [!amd64]", "i386", true},
+	}
+	for _, tt := range tests {
+		groups, err := ParseRelations(tt.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := groups[0][0].AppliesTo(tt.arch); got != tt.want {
+			t.Errorf("%q on %s: got %v", tt.field, tt.arch, got)
+		}
+	}
+}
@@ -40,9 +40,9 @@ func TestValidateRepositoryPath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := validateRepositoryPath(tt.path)
+			err := ValidateRepositoryPath(tt.path)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("validateRepositoryPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+				t.Errorf("ValidateRepositoryPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
 			}
 		})
 	}
@@ -0,0 +1,743 @@
+package mirror
+
+// This file implements the HTTP JSON API served by "mirrorctl api".
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token scopes.
+const (
+	// ScopeRead allows listing mirrors, snapshots, history and sync jobs.
+	ScopeRead = "read"
+
+	// ScopeSync allows starting syncs and reading their jobs.
+	ScopeSync = "sync"
+
+	// ScopePublish allows creating, staging, publishing, promoting,
+	// rolling back and deleting snapshots.
+	ScopePublish = "publish"
+)
+
+// apiScopes lists the valid API token scopes.
+var apiScopes = []string{ScopeRead, ScopeSync, ScopePublish}
+
+// Sync job states.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+const (
+	// DefaultAPIListen is the default listen address of the API.
+	DefaultAPIListen = "127.0.0.1:8080"
+
+	// defaultAPIMaxJobs is the number of finished sync jobs kept.
+	defaultAPIMaxJobs = 100
+
+	// apiPrefix prefixes all API paths.
+	apiPrefix = "/api/v1"
+
+	// maxAPIRequestSize limits request bodies.
+	maxAPIRequestSize = 1 << 20
+)
+
+//go:embed api_openapi.yaml
+var openAPISpec []byte
+
+// APIConfig configures the HTTP API.
+type APIConfig struct {
+	// Listen is the address to listen on.  Defaults to 127.0.0.1:8080.
+	Listen string `toml:"listen,omitempty"`
+
+	// TLSCertFile and TLSKeyFile enable HTTPS.
+	TLSCertFile string `toml:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `toml:"tls_key_file,omitempty"`
+
+	// MaxJobs is the number of finished sync jobs kept for status
+	// queries.  Defaults to 100.
+	MaxJobs int `toml:"max_jobs,omitempty"`
+
+	Tokens []*APIToken `toml:"tokens"`
+}
+
+// Check validates the API configuration.
+func (c *APIConfig) Check() error {
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("api.listen: %w", err)
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("api: tls_cert_file and tls_key_file must be set together")
+	}
+	if c.MaxJobs < 0 {
+		return errors.New("api.max_jobs must not be negative")
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Tokens {
+		if err := t.Check(); err != nil {
+			return fmt.Errorf("api: %w", err)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("api: duplicate token name %q", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// APIToken is a bearer token of the API and the scopes it grants.
+type APIToken struct {
+	// Name identifies the token in logs and in the publish history.
+	Name string `toml:"name"`
+
+	// Token, or the environment variable TokenEnv, is the secret.
+	Token    string `toml:"token,omitempty"`
+	TokenEnv string `toml:"token_env,omitempty"`
+
+	Scopes []string `toml:"scopes"`
+}
+
+// Check validates the token configuration.
+func (t *APIToken) Check() error {
+	if t.Name == "" {
+		return errors.New("token name is required")
+	}
+	if t.Token == "" && t.TokenEnv == "" {
+		return fmt.Errorf("token %s: token or token_env is required", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("token %s: scopes is required", t.Name)
+	}
+	for _, s := range t.Scopes {
+		if !slices.Contains(apiScopes, s) {
+			return fmt.Errorf("token %s: unknown scope %q", t.Name, s)
+		}
+	}
+	return nil
+}
+
+// secret returns the secret of the token.
+func (t *APIToken) secret() (string, error) {
+	if t.TokenEnv != "" {
+		if s := os.Getenv(t.TokenEnv); s != "" {
+			return s, nil
+		}
+		if t.Token == "" {
+			return "", fmt.Errorf("token %s: environment variable %s is not set", t.Name, t.TokenEnv)
+		}
+	}
+	return t.Token, nil
+}
+
+// apiToken is a configured token with the hash of its secret.
+type apiToken struct {
+	name   string
+	sum    [sha256.Size]byte
+	scopes []string
+}
+
+// SyncJob tracks a sync started through the API.
+type SyncJob struct {
+	ID          string     `json:"id"`
+	Mirrors     []string   `json:"mirrors"`
+	Force       bool       `json:"force,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	RequestedBy string     `json:"requested_by"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+// APIServer serves the HTTP API.  Syncs run in the background while
+// holding the same lock as "mirrorctl sync", so at most one sync runs
+// at a time across the API and the command line.  Snapshot operations
+// through the API are serialized.
+type APIServer struct {
+	config *Config
+	tokens []*apiToken
+	sm     *SnapshotManager
+	mux    *http.ServeMux
+
+	// publishMu serializes snapshot operations
+	publishMu sync.Mutex
+
+	jobsMu sync.Mutex
+	jobs   []*SyncJob
+
+	// ctx is canceled by Close to abort running syncs
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// runSync runs a sync while the lock is held, and returns the
+	// notifications to send once it is released
+	runSync func(ctx context.Context, mirrors []string, force bool) ([]*Notification, error)
+}
+
+// NewAPIServer returns an APIServer for config, which must have an
+// [api] section with at least one token.
+func NewAPIServer(config *Config) (*APIServer, error) {
+	if config.API == nil || len(config.API.Tokens) == 0 {
+		return nil, errors.New("the api configuration has no tokens")
+	}
+
+	s := &APIServer{config: config, mux: http.NewServeMux()}
+	for _, t := range config.API.Tokens {
+		secret, err := t.secret()
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = append(s.tokens, &apiToken{name: t.Name, sum: sha256.Sum256([]byte(secret)), scopes: t.Scopes})
+	}
+	if config.Snapshot != nil {
+		s.sm = NewSnapshotManager(config.Snapshot, config.Dir).
+			WithMirrorConfigs(config.Mirrors).
+			WithHooks(config.Hooks).
+			WithNotifier(NewNotifier(config.Notify, &config.TLS))
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.runSync = func(ctx context.Context, mirrors []string, force bool) ([]*Notification, error) {
+		_, notifications, err := run(ctx, config, mirrors, false, true, false, force)
+		return notifications, err
+	}
+
+	s.mux.HandleFunc("GET "+apiPrefix+"/openapi.yaml", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec) // #nosec G104 - the client may have gone away
+	})
+	s.handle("GET /mirrors", s.listMirrors, ScopeRead)
+	s.handle("GET /mirrors/{mirror}/snapshots", s.listSnapshots, ScopeRead)
+	s.handle("GET /mirrors/{mirror}/history", s.readHistory, ScopeRead)
+	s.handle("POST /mirrors/{mirror}/snapshots", s.createSnapshot, ScopePublish)
+	s.handle("DELETE /mirrors/{mirror}/snapshots/{snapshot}", s.deleteSnapshot, ScopePublish)
+	s.handle("POST /mirrors/{mirror}/stage", s.stageSnapshot, ScopePublish)
+	s.handle("POST /mirrors/{mirror}/publish", s.publishSnapshot, ScopePublish)
+	s.handle("POST /mirrors/{mirror}/promote", s.promoteSnapshot, ScopePublish)
+	s.handle("POST /mirrors/{mirror}/rollback", s.rollbackSnapshot, ScopePublish)
+	s.handle("POST /syncs", s.startSync, ScopeSync)
+	s.handle("GET /syncs", s.listJobs, ScopeRead, ScopeSync)
+	s.handle("GET /syncs/{id}", s.getJob, ScopeRead, ScopeSync)
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close aborts running syncs and waits for them to finish.
+func (s *APIServer) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// apiHandler handles an authenticated request.
+type apiHandler func(w http.ResponseWriter, r *http.Request, token *apiToken)
+
+// handle registers h for pattern below apiPrefix.  The request must
+// carry a bearer token with any of scopes.
+func (s *APIServer) handle(pattern string, h apiHandler, scopes ...string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	s.mux.HandleFunc(method+" "+apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+		token := s.authenticate(r)
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mirrorctl"`)
+			writeAPIError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		if !slices.ContainsFunc(scopes, func(scope string) bool { return slices.Contains(token.scopes, scope) }) {
+			writeAPIError(w, http.StatusForbidden, fmt.Errorf("token %s lacks the %s scope", token.name, strings.Join(scopes, " or ")))
+			return
+		}
+		h(w, r, token)
+	})
+}
+
+// authenticate returns the token of the bearer token of r, or nil.
+func (s *APIServer) authenticate(r *http.Request) *apiToken {
+	auth := r.Header.Get("Authorization")
+	secret, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || secret == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(secret))
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.sum[:]) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// writeAPIJSON writes v as the JSON response with status.
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("failed to write API response", "error", err)
+	}
+}
+
+// apiError is the body of error responses.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeAPIError writes err as the JSON response with status.
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, &apiError{Error: err.Error()})
+}
+
+// readAPIRequest decodes the JSON body of r into v.  An empty body
+// leaves v alone.
+func readAPIRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// snapshotManager returns the SnapshotManager for a request by token,
+// or writes an error if snapshots are not configured.
+func (s *APIServer) snapshotManager(w http.ResponseWriter, token *apiToken, reason string, overrideGates bool) *SnapshotManager {
+	if s.sm == nil {
+		writeAPIError(w, http.StatusNotFound, errors.New("snapshot configuration is required"))
+		return nil
+	}
+	sm := s.sm.WithUser("api:" + token.name).WithReason(reason)
+	if overrideGates {
+		sm = sm.WithOverrideGates()
+	}
+	return sm
+}
+
+// mirrorParam returns the mirror of the path of r, or writes an error if
+// it is not configured.
+func (s *APIServer) mirrorParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("mirror")
+	if _, ok := s.config.Mirrors[id]; !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("mirror %s is not configured", id))
+		return "", false
+	}
+	return id, true
+}
+
+// checkSnapshotExists writes an error if the snapshot of mirror does
+// not exist.
+func checkSnapshotExists(w http.ResponseWriter, sm *SnapshotManager, mirror, snapshotName string) bool {
+	p, err := sm.GetSnapshotPath(mirror, snapshotName)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return false
+	}
+	if _, err := os.Stat(p); err != nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror))
+		return false
+	}
+	return true
+}
+
+// apiMirror describes a mirror.
+type apiMirror struct {
+	ID       string        `json:"id"`
+	URL      string        `json:"url"`
+	Channels []*apiChannel `json:"channels,omitempty"`
+}
+
+// apiChannel describes a channel of a mirror.
+type apiChannel struct {
+	Name     string `json:"name"`
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+func (s *APIServer) listMirrors(w http.ResponseWriter, _ *http.Request, _ *apiToken) {
+	ids := make([]string, 0, len(s.config.Mirrors))
+	for id := range s.config.Mirrors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	mirrors := make([]*apiMirror, 0, len(ids))
+	for _, id := range ids {
+		m := &apiMirror{ID: id}
+		if u := s.config.Mirrors[id].URL.URL; u != nil {
+			m.URL = u.Redacted()
+		}
+		if s.sm != nil {
+			channels, err := s.sm.ListChannels(id)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, err)
+				return
+			}
+			for _, ch := range channels {
+				m.Channels = append(m.Channels, &apiChannel{Name: ch.Name, Snapshot: ch.Snapshot})
+			}
+		}
+		mirrors = append(mirrors, m)
+	}
+	writeAPIJSON(w, http.StatusOK, mirrors)
+}
+
+// apiSnapshot describes a snapshot.
+type apiSnapshot struct {
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"created_at"`
+	Channels  []string          `json:"channels,omitempty"`
+	Pinned    bool              `json:"pinned,omitempty"`
+	Metadata  *SnapshotMetadata `json:"metadata,omitempty"`
+}
+
+func (s *APIServer) listSnapshots(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	mirror, ok := s.mirrorParam(w, r)
+	if !ok {
+		return
+	}
+	sm := s.snapshotManager(w, token, "", false)
+	if sm == nil {
+		return
+	}
+	snapshots, err := sm.ListSnapshots(mirror)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := make([]*apiSnapshot, 0, len(snapshots))
+	for _, si := range snapshots {
+		list = append(list, &apiSnapshot{
+			Name:      si.Name,
+			CreatedAt: si.CreatedAt,
+			Channels:  si.Channels,
+			Pinned:    si.IsPinned,
+			Metadata:  si.Metadata,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+func (s *APIServer) readHistory(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	mirror, ok := s.mirrorParam(w, r)
+	if !ok {
+		return
+	}
+	sm := s.snapshotManager(w, token, "", false)
+	if sm == nil {
+		return
+	}
+	history, err := sm.ReadHistory(mirror)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if history == nil {
+		history = []*HistoryEntry{}
+	}
+	writeAPIJSON(w, http.StatusOK, history)
+}
+
+// apiPublishRequest is the body of snapshot operations.
+type apiPublishRequest struct {
+	Snapshot      string            `json:"snapshot,omitempty"`
+	Channel       string            `json:"channel,omitempty"`
+	From          string            `json:"from,omitempty"`
+	To            string            `json:"to,omitempty"`
+	Steps         int               `json:"steps,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Note          string            `json:"note,omitempty"`
+	Force         bool              `json:"force,omitempty"`
+	Stage         bool              `json:"stage,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+	OverrideGates bool              `json:"override_gates,omitempty"`
+}
+
+// apiPublishResult is the response of snapshot operations.
+type apiPublishResult struct {
+	Mirror   string `json:"mirror"`
+	Snapshot string `json:"snapshot"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// publishOp runs a snapshot operation of the request r.  op returns the
+// affected snapshot and channel.  Failed operations are reported as
+// conflicts with the state of the mirror.
+func (s *APIServer) publishOp(w http.ResponseWriter, r *http.Request, token *apiToken, snapshotRequired bool,
+	op func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error)) {
+	mirror, ok := s.mirrorParam(w, r)
+	if !ok {
+		return
+	}
+	req := &apiPublishRequest{}
+	if !readAPIRequest(w, r, req) {
+		return
+	}
+	sm := s.snapshotManager(w, token, req.Reason, req.OverrideGates)
+	if sm == nil {
+		return
+	}
+	if snapshotRequired {
+		if req.Snapshot == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("snapshot is required"))
+			return
+		}
+		if !checkSnapshotExists(w, sm, mirror, req.Snapshot) {
+			return
+		}
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	snapshotName, channel, err := op(sm, mirror, req)
+	if err != nil {
+		slog.Error("API snapshot operation failed", "path", r.URL.Path, "token", token.name, "error", err)
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+	slog.Info("API snapshot operation", "path", r.URL.Path, "token", token.name, "mirror", mirror, "snapshot", snapshotName, "channel", channel)
+	writeAPIJSON(w, http.StatusOK, &apiPublishResult{Mirror: mirror, Snapshot: snapshotName, Channel: channel})
+}
+
+func (s *APIServer) createSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	s.publishOp(w, r, token, false, func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error) {
+		mc := s.config.Mirrors[mirror]
+		name := req.Snapshot
+		if name == "" {
+			name = sm.GenerateSnapshotNameForMirror(mc.Snapshot)
+		}
+		name, err := sm.CreateSnapshotWithOptions(mirror, name, req.Force, mc.Snapshot, SnapshotOptions{Labels: req.Labels, Note: req.Note})
+		if err != nil || !req.Stage {
+			return name, "", err
+		}
+		return name, ChannelStaging, sm.PublishSnapshotToStaging(mirror, name)
+	})
+}
+
+func (s *APIServer) deleteSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	mirror, ok := s.mirrorParam(w, r)
+	if !ok {
+		return
+	}
+	sm := s.snapshotManager(w, token, r.URL.Query().Get("reason"), false)
+	if sm == nil {
+		return
+	}
+	snapshotName := r.PathValue("snapshot")
+	if !checkSnapshotExists(w, sm, mirror, snapshotName) {
+		return
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	if err := sm.DeleteSnapshot(mirror, snapshotName, r.URL.Query().Get("force") == "true"); err != nil {
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+	slog.Info("API snapshot operation", "path", r.URL.Path, "token", token.name, "mirror", mirror, "snapshot", snapshotName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *APIServer) stageSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	s.publishOp(w, r, token, true, func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error) {
+		return req.Snapshot, ChannelStaging, sm.PublishSnapshotToStaging(mirror, req.Snapshot)
+	})
+}
+
+func (s *APIServer) publishSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	s.publishOp(w, r, token, true, func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error) {
+		channel := req.Channel
+		if channel == "" {
+			channel = ChannelLive
+		}
+		return req.Snapshot, channel, sm.PublishToChannel(mirror, channel, req.Snapshot)
+	})
+}
+
+func (s *APIServer) promoteSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	s.publishOp(w, r, token, false, func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error) {
+		from := req.From
+		if from == "" {
+			from = ChannelStaging
+		}
+		to := req.To
+		if to == "" {
+			next, err := sm.nextChannel(mirror, from)
+			if err != nil {
+				return "", "", err
+			}
+			to = next
+		}
+		snapshotName, err := sm.PromoteChannel(mirror, from, to)
+		return snapshotName, to, err
+	})
+}
+
+func (s *APIServer) rollbackSnapshot(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	s.publishOp(w, r, token, false, func(sm *SnapshotManager, mirror string, req *apiPublishRequest) (string, string, error) {
+		steps := req.Steps
+		if steps == 0 {
+			steps = 1
+		}
+		snapshotName, err := sm.RollbackSnapshot(mirror, steps)
+		return snapshotName, ChannelLive, err
+	})
+}
+
+// apiSyncRequest is the body of sync requests.
+type apiSyncRequest struct {
+	Mirrors []string `json:"mirrors,omitempty"`
+	Force   bool     `json:"force,omitempty"`
+}
+
+// newJobID returns a random sync job ID.
+func newJobID() string {
+	var b [8]byte
+	rand.Read(b[:]) // #nosec G104 - crypto/rand.Read does not fail
+	return hex.EncodeToString(b[:])
+}
+
+func (s *APIServer) startSync(w http.ResponseWriter, r *http.Request, token *apiToken) {
+	req := &apiSyncRequest{}
+	if !readAPIRequest(w, r, req) {
+		return
+	}
+	for _, id := range req.Mirrors {
+		if _, ok := s.config.Mirrors[id]; !ok {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("mirror %s is not configured", id))
+			return
+		}
+	}
+	mirrors := slices.Clone(req.Mirrors)
+	if len(mirrors) == 0 {
+		for id := range s.config.Mirrors {
+			mirrors = append(mirrors, id)
+		}
+	}
+	sort.Strings(mirrors)
+
+	// The lock is taken before responding, so that a sync in progress,
+	// from the API or the command line, is reported as a conflict
+	unlock, err := lockDir(s.config.Dir)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("another sync is running: %w", err))
+		return
+	}
+
+	job := &SyncJob{
+		ID:          newJobID(),
+		Mirrors:     mirrors,
+		Force:       req.Force,
+		Status:      JobRunning,
+		RequestedBy: token.name,
+		Started:     time.Now().UTC(),
+	}
+	s.addJob(job)
+	slog.Info("API sync started", "job", job.ID, "token", token.name, "mirrors", mirrors)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		notifications, err := s.runSync(s.ctx, mirrors, req.Force)
+		unlock()
+		// Sent once the job is recorded, without holding any lock
+		defer NewNotifier(s.config.Notify, &s.config.TLS).Notify(s.ctx, notifications...)
+
+		s.jobsMu.Lock()
+		defer s.jobsMu.Unlock()
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		job.Status = JobSucceeded
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			slog.Error("API sync failed", "job", job.ID, "error", err)
+			return
+		}
+		slog.Info("API sync succeeded", "job", job.ID)
+	}()
+
+	w.Header().Set("Location", apiPrefix+"/syncs/"+job.ID)
+	writeAPIJSON(w, http.StatusAccepted, s.jobSnapshot(job))
+}
+
+// addJob records job, forgetting the oldest finished jobs beyond
+// max_jobs.
+func (s *APIServer) addJob(job *SyncJob) {
+	maxJobs := s.config.API.MaxJobs
+	if maxJobs == 0 {
+		maxJobs = defaultAPIMaxJobs
+	}
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	s.jobs = append(s.jobs, job)
+	finished := 0
+	for _, j := range s.jobs {
+		if j.Status != JobRunning {
+			finished++
+		}
+	}
+	for ; finished > maxJobs; finished-- {
+		i := slices.IndexFunc(s.jobs, func(j *SyncJob) bool { return j.Status != JobRunning })
+		s.jobs = slices.Delete(s.jobs, i, i+1)
+	}
+}
+
+// jobSnapshot returns a copy of job that is safe to encode.
+func (s *APIServer) jobSnapshot(job *SyncJob) *SyncJob {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	c := *job
+	return &c
+}
+
+func (s *APIServer) listJobs(w http.ResponseWriter, _ *http.Request, _ *apiToken) {
+	s.jobsMu.Lock()
+	jobs := make([]SyncJob, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+	s.jobsMu.Unlock()
+	writeAPIJSON(w, http.StatusOK, jobs)
+}
+
+func (s *APIServer) getJob(w http.ResponseWriter, r *http.Request, _ *apiToken) {
+	id := r.PathValue("id")
+	s.jobsMu.Lock()
+	i := slices.IndexFunc(s.jobs, func(j *SyncJob) bool { return j.ID == id })
+	var job SyncJob
+	if i >= 0 {
+		job = *s.jobs[i]
+	}
+	s.jobsMu.Unlock()
+
+	if i < 0 {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("sync job %s does not exist", id))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, &job)
+}
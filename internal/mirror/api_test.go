@@ -0,0 +1,225 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPIServer returns an API server for a configuration with the
+// mirror test-mirror and the tokens reader, syncer and publisher.
+func newTestAPIServer(t *testing.T) (*APIServer, *Config) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "live")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Dir:      dir,
+		Snapshot: &SnapshotConfig{},
+		Mirrors:  map[string]*MirrorConfig{"test-mirror": {}},
+		API: &APIConfig{Tokens: []*APIToken{
+			{Name: "reader", Token: "r", Scopes: []string{ScopeRead}},
+			{Name: "syncer", Token: "s", Scopes: []string{ScopeSync}},
+			{Name: "publisher", Token: "p", Scopes: []string{ScopeRead, ScopePublish}},
+		}},
+	}
+	s, err := NewAPIServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s, config
+}
+
+// apiRequest sends a request with the bearer token to s and decodes the
+// JSON response into v, if not nil.
+func apiRequest(t *testing.T, s *APIServer, method, path, token string, body any, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, apiPrefix+path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if v != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, rec.Body)
+		}
+	}
+	return rec
+}
+
+func TestAPIServer_Auth(t *testing.T) {
+	s, _ := newTestAPIServer(t)
+
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/openapi.yaml", "", http.StatusOK},
+		{"GET", "/mirrors", "", http.StatusUnauthorized},
+		{"GET", "/mirrors", "wrong", http.StatusUnauthorized},
+		{"GET", "/mirrors", "r", http.StatusOK},
+		{"GET", "/mirrors", "s", http.StatusForbidden},
+		{"GET", "/syncs", "s", http.StatusOK},
+		{"POST", "/syncs", "r", http.StatusForbidden},
+		{"POST", "/mirrors/test-mirror/stage", "r", http.StatusForbidden},
+		{"GET", "/mirrors/unknown/snapshots", "r", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := apiRequest(t, s, tt.method, tt.path, tt.token, nil, nil); rec.Code != tt.code {
+			t.Errorf("%s %s with %q: expected %d, got %d: %s", tt.method, tt.path, tt.token, tt.code, rec.Code, rec.Body)
+		}
+	}
+	rec := apiRequest(t, s, "GET", "/mirrors", "", nil, nil)
+	if !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("expected a bearer challenge, got %q", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestAPIServer_Publish(t *testing.T) {
+	s, _ := newTestAPIServer(t)
+	writeGateTestSnapshot(t, s.sm, "s1")
+
+	if rec := apiRequest(t, s, "POST", "/mirrors/test-mirror/stage", "p", map[string]any{"snapshot": "missing"}, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing snapshot, got %d", rec.Code)
+	}
+	if rec := apiRequest(t, s, "POST", "/mirrors/test-mirror/stage", "p", map[string]any{"snapshot": "s1", "bogus": 1}, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown field, got %d", rec.Code)
+	}
+
+	var result apiPublishResult
+	rec := apiRequest(t, s, "POST", "/mirrors/test-mirror/stage", "p", map[string]any{"snapshot": "s1", "reason": "CHG-1"}, &result)
+	if rec.Code != http.StatusOK || result.Snapshot != "s1" || result.Channel != ChannelStaging {
+		t.Fatalf("stage failed: %d %s", rec.Code, rec.Body)
+	}
+	rec = apiRequest(t, s, "POST", "/mirrors/test-mirror/promote", "p", nil, &result)
+	if rec.Code != http.StatusOK || result.Snapshot != "s1" || result.Channel != ChannelLive {
+		t.Fatalf("promote failed: %d %s", rec.Code, rec.Body)
+	}
+
+	var mirrors []*apiMirror
+	apiRequest(t, s, "GET", "/mirrors", "r", nil, &mirrors)
+	if len(mirrors) != 1 || mirrors[0].ID != "test-mirror" || len(mirrors[0].Channels) != 2 || mirrors[0].Channels[0].Snapshot != "s1" {
+		t.Errorf("unexpected mirrors: %+v", mirrors)
+	}
+	var snapshots []*apiSnapshot
+	apiRequest(t, s, "GET", "/mirrors/test-mirror/snapshots", "r", nil, &snapshots)
+	if len(snapshots) != 1 || snapshots[0].Name != "s1" || len(snapshots[0].Channels) != 2 {
+		t.Errorf("unexpected snapshots: %+v", snapshots)
+	}
+
+	var history []*HistoryEntry
+	apiRequest(t, s, "GET", "/mirrors/test-mirror/history", "r", nil, &history)
+	if len(history) != 2 || history[0].User != "api:publisher" || history[0].Reason != "CHG-1" || history[1].Action != HistoryPromote {
+		t.Errorf("unexpected history: %+v", history)
+	}
+
+	// Published snapshots are only deleted with force
+	if rec := apiRequest(t, s, "DELETE", "/mirrors/test-mirror/snapshots/s1", "p", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a published snapshot, got %d", rec.Code)
+	}
+	if rec := apiRequest(t, s, "DELETE", "/mirrors/test-mirror/snapshots/s1?force=true", "p", nil, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIServer_Sync(t *testing.T) {
+	s, config := newTestAPIServer(t)
+	release := make(chan struct{})
+	var synced []string
+	s.runSync = func(ctx context.Context, mirrors []string, _ bool) ([]*Notification, error) {
+		synced = mirrors
+		select {
+		case <-release:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var job SyncJob
+	rec := apiRequest(t, s, "POST", "/syncs", "s", nil, &job)
+	if rec.Code != http.StatusAccepted || job.Status != JobRunning || job.RequestedBy != "syncer" {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body)
+	}
+	if loc := rec.Header().Get("Location"); loc != apiPrefix+"/syncs/"+job.ID {
+		t.Errorf("unexpected location %q", loc)
+	}
+
+	// The lock is held by the running sync
+	if rec := apiRequest(t, s, "POST", "/syncs", "s", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 while a sync runs, got %d", rec.Code)
+	}
+	if _, err := lockDir(config.Dir); err == nil {
+		t.Error("expected the command line lock to be held")
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		apiRequest(t, s, "GET", "/syncs/"+job.ID, "r", nil, &job)
+	}
+	if job.Status != JobSucceeded || job.Finished == nil || len(synced) != 1 || synced[0] != "test-mirror" {
+		t.Errorf("unexpected job: %+v, synced %v", job, synced)
+	}
+
+	// A sync from the command line blocks the API
+	unlock, err := lockDir(config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := apiRequest(t, s, "POST", "/syncs", "s", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 while the command line syncs, got %d", rec.Code)
+	}
+	unlock()
+
+	if rec := apiRequest(t, s, "POST", "/syncs", "s", map[string]any{"mirrors": []string{"unknown"}}, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown mirror, got %d", rec.Code)
+	}
+	if rec := apiRequest(t, s, "GET", "/syncs/unknown", "s", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", rec.Code)
+	}
+	var jobs []SyncJob
+	apiRequest(t, s, "GET", "/syncs", "r", nil, &jobs)
+	if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+}
+
+func TestAPIConfig_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		config APIConfig
+		valid  bool
+	}{
+		{"valid", APIConfig{Listen: ":8080", Tokens: []*APIToken{{Name: "portal", TokenEnv: "PORTAL_TOKEN", Scopes: []string{ScopeRead, ScopeSync}}}}, true},
+		{"bad listen", APIConfig{Listen: "localhost"}, false},
+		{"cert without key", APIConfig{TLSCertFile: "/etc/ssl/api.pem"}, false},
+		{"no secret", APIConfig{Tokens: []*APIToken{{Name: "portal", Scopes: []string{ScopeRead}}}}, false},
+		{"no scopes", APIConfig{Tokens: []*APIToken{{Name: "portal", Token: "x"}}}, false},
+		{"bad scope", APIConfig{Tokens: []*APIToken{{Name: "portal", Token: "x", Scopes: []string{"admin"}}}}, false},
+		{"duplicate", APIConfig{Tokens: []*APIToken{{Name: "a", Token: "x", Scopes: []string{ScopeRead}}, {Name: "a", Token: "y", Scopes: []string{ScopeRead}}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package mirror
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
@@ -37,11 +38,15 @@ func NewAPTParser(storage *Storage, config *MirrorConfig, mirrorID string) *APTP
 	}
 }
 
-// extractItems extracts file information from downloaded APT index files
-func (ap *APTParser) extractItems(indices []*apt.FileInfo, indexMap map[string][]*apt.FileInfo, itemMap map[string]*apt.FileInfo, byhash bool, suite string) error {
+// extractItems extracts file information from downloaded APT index files.
+//
+// Packages and Sources indices are parsed per stanza so that the packages
+// they describe can be filtered as a whole; those are returned as well.
+func (ap *APTParser) extractItems(indices []*apt.FileInfo, indexMap map[string][]*apt.FileInfo, itemMap map[string]*apt.FileInfo, byhash bool, suite string) ([]*apt.Package, error) {
+	var packages []*apt.Package
 	for _, index := range indices {
 		path := index.Path()
-		if !ap.config.MatchingIndex(path) || !apt.IsSupported(path) {
+		if !ap.config.MatchingIndex(path) || !apt.IsMeta(path) || !apt.IsSupported(path) {
 			continue
 		}
 		hashPath := path
@@ -50,15 +55,37 @@ func (ap *APTParser) extractItems(indices []*apt.FileInfo, indexMap map[string][
 		}
 		f, err := ap.storage.Open(hashPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		fil, _, err := apt.ExtractFileInfo(path, f)
+		var fil []*apt.FileInfo
+		if apt.IsPackageIndex(path) {
+			var pkgs []*apt.Package
+			pkgs, err = apt.ExtractPackages(path, f)
+			for _, pkg := range pkgs {
+				for i, fi := range pkg.Files {
+					pkg.Files[i] = ap.itemFileInfo(fi, suite)
+				}
+				fil = append(fil, pkg.Files...)
+			}
+			packages = append(packages, pkgs...)
+		} else {
+			var all []*apt.FileInfo
+			all, _, err = apt.ExtractFileInfo(path, f)
+			for _, fi := range all {
+				fi = ap.itemFileInfo(fi, suite)
+				// i18n/Index lists the translations of every language;
+				// keep only those selected by the configuration.
+				if apt.IsMeta(fi.Path()) || ap.config.MatchingIndex(fi.Path()) {
+					fil = append(fil, fi)
+				}
+			}
+		}
 		if closeErr := f.Close(); closeErr != nil {
 			slog.Warn("failed to close file", "path", hashPath, "error", closeErr)
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		for _, fi := range fil {
@@ -67,22 +94,23 @@ func (ap *APTParser) extractItems(indices []*apt.FileInfo, indexMap map[string][
 				// already included in Release/InRelease
 				continue
 			}
-
-			// For flat repositories, package file paths need to be prefixed with the suite
-			// Example: suite="xUbuntu_24.04/" + fipath="amd64/rear_2.7-0_amd64.deb"
-			// Result: "xUbuntu_24.04/amd64/rear_2.7-0_amd64.deb"
-			if isFlat(suite) && !apt.IsMeta(fipath) {
-				// Create a new FileInfo with the corrected path for flat repositories
-				// Use AddPrefix to prepend the suite path (without trailing slash)
-				correctedFI := fi.AddPrefix(strings.TrimSuffix(suite, "/"))
-				correctedPath := correctedFI.Path()
-				itemMap[correctedPath] = correctedFI
-			} else {
-				itemMap[fipath] = fi
-			}
+			itemMap[fipath] = fi
 		}
 	}
-	return nil
+	return packages, nil
+}
+
+// itemFileInfo returns fi with its path adjusted for the given suite.
+//
+// For flat repositories, package file paths need to be prefixed with the suite
+// Example: suite="xUbuntu_24.04/" + fipath="amd64/rear_2.7-0_amd64.deb"
+// Result: "xUbuntu_24.04/amd64/rear_2.7-0_amd64.deb"
+func (ap *APTParser) itemFileInfo(fi *apt.FileInfo, suite string) *apt.FileInfo {
+	if isFlat(suite) && !apt.IsMeta(fi.Path()) {
+		// Use AddPrefix to prepend the suite path (without trailing slash)
+		return fi.AddPrefix(strings.TrimSuffix(suite, "/"))
+	}
+	return fi
 }
 
 // addFileInfoToList adds a FileInfo to a list, checking for duplicates
@@ -109,9 +137,11 @@ func addFileInfoToList(fi *apt.FileInfo, m map[string][]*apt.FileInfo, byhash bo
 }
 
 // handleReleaseResults processes download results from Release/InRelease files
-func (ap *APTParser) handleReleaseResults(results <-chan *dlResult, byhash *bool, _ *Mirror) ([]*apt.FileInfo, map[string]*dlResult, error) {
+// and returns the paragraph of the Release file as well.
+func (ap *APTParser) handleReleaseResults(results <-chan *dlResult, byhash *bool, _ *Mirror) ([]*apt.FileInfo, apt.Paragraph, map[string]*dlResult, error) {
 	downloaded := make(map[string]*dlResult)
 	var allFileInfos []*apt.FileInfo
+	var release apt.Paragraph
 	var processedOne bool
 	var downloadErrors []error
 	var resultsReceived int
@@ -163,20 +193,20 @@ func (ap *APTParser) handleReleaseResults(results <-chan *dlResult, byhash *bool
 
 			err := ap.storage.StoreLink(releaseFile, result.tempfile.Name())
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "storeLink")
+				return nil, nil, nil, errors.Wrap(err, "storeLink")
 			}
 
 			f, err := ap.storage.Open(hashPath)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 
-			fil, _, err := apt.ExtractFileInfo(resultPath, f)
+			fil, d, err := apt.ExtractFileInfo(resultPath, f)
 			if closeErr := f.Close(); closeErr != nil {
 				slog.Warn("failed to close file", "path", hashPath, "error", closeErr)
 			}
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 
 			// Check if the repository supports by-hash by looking for by-hash entries
@@ -187,6 +217,7 @@ func (ap *APTParser) handleReleaseResults(results <-chan *dlResult, byhash *bool
 				}
 			}
 
+			release = d
 			allFileInfos = append(allFileInfos, fil...)
 
 			// Package file sizes will be calculated later when processing downloaded index files
@@ -216,27 +247,27 @@ func (ap *APTParser) handleReleaseResults(results <-chan *dlResult, byhash *bool
 	if len(downloaded) == 0 {
 		if len(actualErrors) > 0 {
 			slog.Error("all release file downloads failed with errors", "repo", ap.mirrorID, "errors", actualErrors)
-			return nil, nil, errors.Wrap(errors.Join(actualErrors...), "failed to download Release/InRelease")
+			return nil, nil, nil, errors.Wrap(errors.Join(actualErrors...), "failed to download Release/InRelease")
 		} else if len(notFoundErrors) > 0 {
 			slog.Error("no release files found - all variants returned 404", "repo", ap.mirrorID, "tried", len(notFoundErrors))
-			return nil, nil, errors.Wrap(errors.Join(notFoundErrors...), "no Release/InRelease files available")
+			return nil, nil, nil, errors.Wrap(errors.Join(notFoundErrors...), "no Release/InRelease files available")
 		}
 		if resultsReceived == 0 {
 			slog.Error("no download results received - channel closed without data", "repo", ap.mirrorID)
-			return nil, nil, errors.New("no download results received - possible network or timeout issue")
+			return nil, nil, nil, errors.New("no download results received - possible network or timeout issue")
 		}
 		slog.Error("no release files downloaded and no errors reported", "repo", ap.mirrorID,
 			"results_received", resultsReceived,
 			"total_download_errors", len(downloadErrors),
 			"download_errors", downloadErrors)
-		return nil, nil, errors.New("failed to download Release/InRelease")
+		return nil, nil, nil, errors.New("failed to download Release/InRelease")
 	}
 
 	if len(actualErrors) > 0 {
 		slog.Warn("some release file downloads failed", "repo", ap.mirrorID, "errors", actualErrors)
 	}
 
-	return allFileInfos, downloaded, nil
+	return allFileInfos, release, downloaded, nil
 }
 
 // downloadRelease downloads Release/InRelease files and extracts index information
@@ -275,10 +306,13 @@ func (ap *APTParser) downloadRelease(ctx context.Context, httpClient *HTTPClient
 	}()
 
 	// Process all download results
-	allFileInfos, downloaded, err := ap.handleReleaseResults(results, &byhash, m)
+	allFileInfos, release, downloaded, err := ap.handleReleaseResults(results, &byhash, m)
 	if err != nil {
 		return nil, false, err
 	}
+	if m != nil {
+		m.record.setRelease(suite, release)
+	}
 
 	// Calculate usage statistics for index files listed in Release metadata
 	if m != nil && m.usageStats != nil {
@@ -330,17 +364,8 @@ func (ap *APTParser) downloadRelease(ctx context.Context, httpClient *HTTPClient
 func (ap *APTParser) downloadIndices(ctx context.Context, httpClient *HTTPClient,
 	indexMap map[string][]*apt.FileInfo, byhash bool, m *Mirror) ([]*apt.FileInfo, error) {
 
-	var indices []*apt.FileInfo
-	for _, fil := range indexMap {
-		for _, fi := range fil {
-			path := fi.Path()
-			if ap.config.MatchingIndex(path) && apt.IsSupported(path) {
-				indices = append(indices, fi)
-			}
-		}
-	}
-
-	if len(indices) == 0 {
+	groups := ap.indexVariants(indexMap)
+	if len(groups) == 0 {
 		return nil, nil
 	}
 
@@ -349,26 +374,120 @@ func (ap *APTParser) downloadIndices(ctx context.Context, httpClient *HTTPClient
 
 	// In dry-run mode, still download index files to calculate package sizes
 	if m != nil && m.dryRun {
-		slog.Info("downloading index files to calculate package sizes", "repo", ap.mirrorID, "total", len(indices))
-		// Download index files even in dry-run mode so we can parse them for package info
-		return httpClient.downloadIndicesFiles(ctx, ap.config, indices, true, byhash)
+		slog.Info("downloading index files to calculate package sizes", "repo", ap.mirrorID, "total", len(groups))
 	}
 
-	return httpClient.downloadIndicesFiles(ctx, ap.config, indices, true, byhash)
+	// Indices that can be updated with PDiff are handled after the
+	// others because they need the PDiff Index files.
+	var plain, patchable [][][]*apt.FileInfo
+	for _, g := range groups {
+		if ap.pdiffTarget(g, indexMap) != nil {
+			patchable = append(patchable, g)
+		} else {
+			plain = append(plain, g)
+		}
+	}
+
+	indices, err := ap.downloadVariants(ctx, httpClient, plain, byhash)
+	if err != nil {
+		return nil, err
+	}
+	if len(patchable) == 0 {
+		return indices, nil
+	}
+
+	patched, err := ap.downloadPatchable(ctx, httpClient, patchable, indexMap, indices, byhash)
+	if err != nil {
+		return nil, err
+	}
+	return append(indices, patched...), nil
+}
+
+// downloadVariants downloads the preferred variant of every index in
+// groups.  Indices whose variant is missing on the server fall back
+// to the next one.
+func (ap *APTParser) downloadVariants(ctx context.Context, httpClient *HTTPClient,
+	groups [][][]*apt.FileInfo, byhash bool) ([]*apt.FileInfo, error) {
+
+	var indices []*apt.FileInfo
+	for len(groups) > 0 {
+		var batch []*apt.FileInfo
+		for _, g := range groups {
+			batch = append(batch, g[0]...)
+		}
+
+		downloaded, err := httpClient.downloadIndicesFiles(ctx, ap.config, batch, true, byhash)
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, downloaded...)
+
+		got := make(map[string]bool, len(downloaded))
+		for _, fi := range downloaded {
+			got[fi.Path()] = true
+		}
+
+		var next [][][]*apt.FileInfo
+		for _, g := range groups {
+			if !got[g[0][0].Path()] && len(g) > 1 {
+				slog.Debug("falling back to another index variant", "repo", ap.mirrorID, "path", g[1][0].Path())
+				next = append(next, g[1:])
+			}
+		}
+		groups = next
+	}
+
+	return indices, nil
+}
+
+// indexVariants groups the wanted indices of indexMap by their path
+// without the compression extension.  Each group lists the variants
+// in order of preference, smallest first; a variant may have several
+// entries when the repository supports by-hash.
+//
+// If the mirror is configured with all_index_variants, every variant
+// forms its own group so that all of them are downloaded.
+func (ap *APTParser) indexVariants(indexMap map[string][]*apt.FileInfo) [][][]*apt.FileInfo {
+	m := make(map[string][][]*apt.FileInfo)
+	for p, fil := range indexMap {
+		if len(fil) == 0 || !ap.wantIndex(p) {
+			continue
+		}
+		key := apt.TrimCompressionExt(p)
+		if ap.config.AllIndexVariants {
+			key = p
+		}
+		m[key] = append(m[key], fil)
+	}
+
+	groups := make([][][]*apt.FileInfo, 0, len(m))
+	for _, g := range m {
+		sort.Slice(g, func(i, j int) bool {
+			if g[i][0].Size() != g[j][0].Size() {
+				return g[i][0].Size() < g[j][0].Size()
+			}
+			return g[i][0].Path() < g[j][0].Path()
+		})
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// wantIndex returns true if the index file at path should be downloaded.
+// Meta indices must be in a format that ExtractFileInfo can read; other
+// index families such as Contents or DEP-11 are mirrored as they are.
+func (ap *APTParser) wantIndex(p string) bool {
+	if !ap.config.MatchingIndex(p) {
+		return false
+	}
+	isMeta := apt.IsMeta(p) || apt.IsMeta(strings.TrimSuffix(p, path.Ext(p)))
+	return !isMeta || apt.IsSupported(p)
 }
 
 // isIndexFile determines if a file path represents an index file (Packages, Sources, Contents)
 func (ap *APTParser) isIndexFile(path string) bool {
-	base := filepath.Base(path)
-
 	// Remove compression extensions
-	if strings.HasSuffix(base, ".gz") {
-		base = base[:len(base)-3]
-	} else if strings.HasSuffix(base, ".bz2") {
-		base = base[:len(base)-4]
-	} else if strings.HasSuffix(base, ".xz") {
-		base = base[:len(base)-3]
-	}
+	base := apt.TrimCompressionExt(filepath.Base(path))
 
 	return base == "Packages" || base == "Sources" || base == "Contents" || base == "Index"
 }
@@ -377,10 +496,15 @@ func (ap *APTParser) isIndexFile(path string) bool {
 func (ap *APTParser) downloadItems(ctx context.Context, httpClient *HTTPClient,
 	indices []*apt.FileInfo, byhash, _ bool, m *Mirror, suite string) ([]*apt.FileInfo, error) {
 
+	// Files already downloaded as indices, such as PDiff patches,
+	// must not be stored again as items.
 	indexMap := make(map[string][]*apt.FileInfo)
+	for _, fi := range indices {
+		indexMap[fi.Path()] = append(indexMap[fi.Path()], fi)
+	}
 	itemMap := make(map[string]*apt.FileInfo)
 
-	err := ap.extractItems(indices, indexMap, itemMap, byhash, suite)
+	packages, err := ap.extractItems(indices, indexMap, itemMap, byhash, suite)
 	if err != nil {
 		return nil, err
 	}
@@ -390,7 +514,7 @@ func (ap *APTParser) downloadItems(ctx context.Context, httpClient *HTTPClient,
 	}
 
 	// Apply package filtering if configured
-	filteredItemMap := ap.applyPackageFilters(itemMap)
+	filteredItemMap := ap.applyPackageFilters(itemMap, packages)
 
 	var items []*apt.FileInfo
 	for _, fi := range filteredItemMap {
@@ -407,10 +531,19 @@ func (ap *APTParser) downloadItems(ctx context.Context, httpClient *HTTPClient,
 	// In dry-run mode, skip actual package downloads after calculating sizes
 	if m != nil && m.dryRun {
 		stats := m.usageStats.GetStats()
-		slog.Info("calculated package file sizes", "repo", ap.mirrorID, "total", len(items), "total_size", formatBytes(stats.PackageFiles))
+		slog.Info("calculated package file sizes", "repo", ap.mirrorID, "total", len(items), "total_size", FormatBytes(stats.PackageFiles))
 		return items, nil // Return file info but don't download
 	}
 
+	// Fail before downloading rather than when the disk is full
+	if m != nil {
+		release, err := m.preflight(items, byhash)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
 	// Check if we need to download files
 	reusableCount, needDownloadCount := httpClient.countReusableFiles(items, byhash)
 
@@ -425,6 +558,70 @@ func (ap *APTParser) downloadItems(ctx context.Context, httpClient *HTTPClient,
 	return httpClient.downloadPackageFiles(ctx, ap.config, items, true, byhash)
 }
 
+// signingFingerprint returns the hex fingerprint of the key that made
+// a verified signature.
+func signingFingerprint(vr *crypto.VerifyResult) string {
+	return strings.ToUpper(hex.EncodeToString(vr.SignedByFingerprint()))
+}
+
+// loadPGPKey reads the armored PGP keyring at keyPath.
+func loadPGPKey(keyPath string) (*crypto.Key, error) {
+	data, err := os.ReadFile(keyPath) // #nosec G304 - pgp_key_path comes from the configuration
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read PGP keyring from: %s", keyPath)
+	}
+	key, err := crypto.NewKeyFromArmored(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse PGP keyring from: %s", keyPath)
+	}
+	return key, nil
+}
+
+// verifyReleaseSignature verifies the clear-signed inRelease or, if it
+// is nil, release with its detached signature sig.  It returns the
+// fingerprint of the signing key.
+func verifyReleaseSignature(verifier crypto.PGPVerify, inRelease, release, sig []byte) (string, error) {
+	if inRelease != nil {
+		result, err := verifier.VerifyCleartext(inRelease)
+		if err != nil {
+			return "", errors.Wrap(err, "InRelease")
+		}
+		if err := result.SignatureError(); err != nil {
+			return "", errors.Wrap(err, "InRelease")
+		}
+		return signingFingerprint(&result.VerifyResult), nil
+	}
+
+	if release == nil || sig == nil {
+		return "", errors.New("no valid signed file found (checked InRelease, Release+Release.gpg)")
+	}
+	result, err := verifier.VerifyDetached(release, sig, crypto.Armor)
+	if err != nil {
+		return "", errors.Wrap(err, "Release.gpg")
+	}
+	if err := result.SignatureError(); err != nil {
+		return "", errors.Wrap(err, "Release.gpg")
+	}
+	return signingFingerprint(result), nil
+}
+
+// readDownloaded reads the downloaded file name, or returns nil if it
+// has not been downloaded.
+func readDownloaded(downloaded map[string]*dlResult, name string) ([]byte, error) {
+	r, ok := downloaded[name]
+	if !ok {
+		return nil, nil
+	}
+	if _, err := r.tempfile.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "failed to seek %s tempfile", name)
+	}
+	data, err := io.ReadAll(r.tempfile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s tempfile", name)
+	}
+	return data, nil
+}
+
 func (ap *APTParser) verifyPGPSignature(m *Mirror, suite string, downloaded map[string]*dlResult) error {
 	// PGP validation logic
 	performCheck := !m.noPGPCheck && !m.mc.NoPGPCheck
@@ -437,98 +634,35 @@ func (ap *APTParser) verifyPGPSignature(m *Mirror, suite string, downloaded map[
 		return errors.Newf("PGP verification is required for repo '%s', but 'pgp_key_path' is not set", m.id)
 	}
 
-	keyringFile, err := os.Open(m.mc.PGPKeyPath)
+	publicKey, err := loadPGPKey(m.mc.PGPKeyPath)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open PGP key file: %s", m.mc.PGPKeyPath)
+		return err
 	}
-	defer keyringFile.Close()
-
-	keyringBytes, err := io.ReadAll(keyringFile)
+	verifier, err := ap.pgp.Verify().VerificationKey(publicKey).New()
 	if err != nil {
-		return errors.Wrapf(err, "failed to read PGP keyring from: %s", m.mc.PGPKeyPath)
+		return errors.Wrap(err, "failed to create verifier")
 	}
 
-	// Parse the keyring
-	publicKey, err := crypto.NewKeyFromArmored(string(keyringBytes))
-	if err != nil {
-		return errors.Wrapf(err, "failed to parse PGP keyring from: %s", m.mc.PGPKeyPath)
-	}
-
-	// Strategy 1: Verify InRelease file
-	if inReleaseResult, ok := downloaded["InRelease"]; ok {
-		slog.Info("verifying InRelease signature", "repo", m.id, "suite", suite)
-		_, err := inReleaseResult.tempfile.Seek(0, io.SeekStart)
-		if err != nil {
-			return errors.Wrap(err, "failed to seek InRelease tempfile")
-		}
-
-		// Try to decode as a clear-signed message first
-		inReleaseBytes, err := io.ReadAll(inReleaseResult.tempfile)
-		if err != nil {
-			return errors.Wrap(err, "failed to read InRelease tempfile")
-		}
-
-		verifier, err := ap.pgp.Verify().VerificationKey(publicKey).New()
-		if err != nil {
-			return errors.Wrap(err, "failed to create verifier")
-		}
-
-		verifyResult, err := verifier.VerifyCleartext(inReleaseBytes)
-		if err != nil {
-			return errors.Wrapf(err, "PGP signature verification failed for InRelease file in repo '%s'", m.id)
+	// InRelease is preferred to Release + Release.gpg
+	var release, sig []byte
+	inRelease, err := readDownloaded(downloaded, "InRelease")
+	if err == nil && inRelease == nil {
+		if release, err = readDownloaded(downloaded, "Release"); err == nil {
+			sig, err = readDownloaded(downloaded, "Release.gpg")
 		}
-
-		if sigErr := verifyResult.SignatureError(); sigErr != nil {
-			return errors.Wrapf(sigErr, "PGP signature verification failed for InRelease file in repo '%s'", m.id)
-		}
-
-		slog.Info("PGP signature for clear-signed InRelease is valid", "repo", m.id, "suite", suite, "key_id", publicKey.GetHexKeyID())
-		return nil
 	}
-
-	// Strategy 2: Verify Release + Release.gpg
-	releaseResult, releaseOK := downloaded["Release"]
-	releaseGPGResult, releaseGPGOK := downloaded["Release.gpg"]
-	if releaseOK && releaseGPGOK {
-		slog.Info("verifying Release signature", "repo", m.id, "suite", suite)
-		_, err := releaseResult.tempfile.Seek(0, io.SeekStart)
-		if err != nil {
-			return errors.Wrap(err, "failed to seek Release tempfile")
-		}
-		_, err = releaseGPGResult.tempfile.Seek(0, io.SeekStart)
-		if err != nil {
-			return errors.Wrap(err, "failed to seek Release.gpg tempfile")
-		}
-
-		releaseBytes, err := io.ReadAll(releaseResult.tempfile)
-		if err != nil {
-			return errors.Wrap(err, "failed to read Release tempfile")
-		}
-
-		sigBytes, err := io.ReadAll(releaseGPGResult.tempfile)
-		if err != nil {
-			return errors.Wrap(err, "failed to read Release.gpg tempfile")
-		}
-
-		verifier, err := ap.pgp.Verify().VerificationKey(publicKey).New()
-		if err != nil {
-			return errors.Wrap(err, "failed to create verifier")
-		}
-
-		verifyResult, err := verifier.VerifyDetached(releaseBytes, sigBytes, crypto.Armor)
-		if err != nil {
-			return errors.Wrapf(err, "PGP signature verification failed for Release file in repo '%s'", m.id)
-		}
-
-		if sigErr := verifyResult.SignatureError(); sigErr != nil {
-			return errors.Wrapf(sigErr, "PGP signature verification failed for Release file in repo '%s'", m.id)
-		}
-
-		slog.Info("PGP signature for Release is valid", "repo", m.id, "suite", suite, "key_id", publicKey.GetHexKeyID())
-		return nil
+	if err != nil {
+		return err
 	}
 
-	return errors.Newf("PGP verification failed for repo '%s': no valid signed file found (checked InRelease, Release+Release.gpg)", m.id)
+	slog.Info("verifying Release signature", "repo", m.id, "suite", suite)
+	fingerprint, err := verifyReleaseSignature(verifier, inRelease, release, sig)
+	if err != nil {
+		return errors.Wrapf(err, "PGP verification failed for repo '%s'", m.id)
+	}
+	slog.Info("PGP signature is valid", "repo", m.id, "suite", suite, "key_id", publicKey.GetHexKeyID())
+	m.record.setSigningKey(suite, fingerprint)
+	return nil
 }
 
 // packageNameVersion holds parsed package name and version from filename
@@ -565,23 +699,90 @@ func parsePackageNameVersion(filePath string) packageNameVersion {
 	}
 }
 
-// applyPackageFilters filters packages based on configured rules
-func (ap *APTParser) applyPackageFilters(itemMap map[string]*apt.FileInfo) map[string]*apt.FileInfo {
-	if ap.config.Filters == nil {
-		slog.Debug("no package filters configured", "repo", ap.mirrorID)
-		return itemMap // No filtering configured
+// filterCandidate is the unit of package filtering: a binary or source
+// package together with the files that are kept or dropped with it.
+type filterCandidate struct {
+	name          string
+	version       string
+	arch          string
+	source        bool
+	sourceName    string
+	sourceVersion string
+	files         []*apt.FileInfo
+}
+
+// groupKey returns the key under which versions of the same package
+// are compared against each other.
+func (c *filterCandidate) groupKey() string {
+	kind := "binary"
+	if c.source {
+		kind = "source"
 	}
+	return kind + "/" + c.name + "/" + c.arch
+}
 
-	slog.Debug("applying package filters", "repo", ap.mirrorID,
-		"keep_versions", ap.config.Filters.KeepVersions,
-		"exclude_patterns", len(ap.config.Filters.ExcludePatterns),
-		"total_items", len(itemMap))
+// sourceKey returns the source package (name and version) this
+// candidate refers to.
+func (c *filterCandidate) sourceKey() string {
+	return c.sourceName + "_" + c.sourceVersion
+}
 
-	// Group packages by name from filename
-	packages := make(map[string][]*apt.FileInfo)
-	skippedFiles := 0
+// versionGreater reports whether Debian version a is newer than b.
+func versionGreater(a, b string) bool {
+	v1, err1 := version.NewVersion(a)
+	v2, err2 := version.NewVersion(b)
+	if err1 != nil || err2 != nil {
+		// Fallback to string comparison if version parsing fails
+		return a > b
+	}
+	return v1.GreaterThan(v2)
+}
 
+// filterCandidates builds filter candidates from the package stanzas
+// read from Packages and Sources indices.  Items that are index files
+// (such as translations listed in i18n/Index) are returned separately
+// and are not subject to filtering.  Other items that are not described
+// by any stanza fall back to parsing their .deb filename; items that
+// cannot be parsed are skipped and counted.
+func (ap *APTParser) filterCandidates(itemMap map[string]*apt.FileInfo, packages []*apt.Package) ([]*filterCandidate, []*apt.FileInfo, int) {
+	var candidates []*filterCandidate
+	covered := make(map[string]bool)
+
+	for _, pkg := range packages {
+		if pkg.Name == "" || pkg.Version == "" {
+			continue // Leave it to the filename fallback below
+		}
+
+		c := &filterCandidate{
+			name:          pkg.Name,
+			version:       pkg.Version,
+			arch:          pkg.Architecture,
+			source:        pkg.IsSource(),
+			sourceName:    pkg.Source,
+			sourceVersion: pkg.SourceVersion,
+		}
+		for _, fi := range pkg.Files {
+			if item, ok := itemMap[fi.Path()]; ok {
+				c.files = append(c.files, item)
+				covered[fi.Path()] = true
+			}
+		}
+		if len(c.files) > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+
+	var indexItems []*apt.FileInfo
+	skippedFiles := 0
 	for filePath, fileInfo := range itemMap {
+		if covered[filePath] {
+			continue
+		}
+		if apt.IsMeta(filePath) || apt.IsPDiff(filePath) || ap.config.matchingOptionalIndex(filePath) {
+			indexItems = append(indexItems, fileInfo)
+			continue
+		}
+
 		// Parse package name and version from filename
 		nameVersion := parsePackageNameVersion(filePath)
 		if nameVersion.name == "" {
@@ -589,66 +790,152 @@ func (ap *APTParser) applyPackageFilters(itemMap map[string]*apt.FileInfo) map[s
 			continue // Not a package file
 		}
 
-		// Check exclude patterns
-		if ap.shouldExcludePackageByName(nameVersion.name, nameVersion.version) {
-			slog.Debug("excluding package by pattern", "repo", ap.mirrorID,
-				"package", nameVersion.name, "version", nameVersion.version)
-			continue
+		candidates = append(candidates, &filterCandidate{
+			name:          nameVersion.name,
+			version:       nameVersion.version,
+			sourceName:    nameVersion.name,
+			sourceVersion: nameVersion.version,
+			files:         []*apt.FileInfo{fileInfo},
+		})
+	}
+
+	return candidates, indexItems, skippedFiles
+}
+
+// keepNewestVersions returns the candidates whose version is among the
+// newest keep distinct versions of the group.  keep <= 0 keeps all.
+func keepNewestVersions(group []*filterCandidate, keep int) []*filterCandidate {
+	var versions []string
+	seen := make(map[string]bool)
+	for _, c := range group {
+		if !seen[c.version] {
+			seen[c.version] = true
+			versions = append(versions, c.version)
 		}
+	}
 
-		packages[nameVersion.name] = append(packages[nameVersion.name], fileInfo)
+	if keep <= 0 || keep >= len(versions) {
+		return group
 	}
 
-	slog.Debug("package grouping results", "repo", ap.mirrorID,
-		"total_files", len(itemMap), "skipped_files", skippedFiles,
-		"unique_packages", len(packages))
+	// Sort versions in descending order (newest first)
+	sort.Slice(versions, func(i, j int) bool {
+		return versionGreater(versions[i], versions[j])
+	})
 
-	// Apply version filtering
-	filteredMap := make(map[string]*apt.FileInfo)
-	totalPackages := 0
-	keptPackages := 0
+	kept := make(map[string]bool)
+	for _, v := range versions[:keep] {
+		kept[v] = true
+	}
 
-	for packageName, versions := range packages {
-		totalPackages += len(versions)
+	var result []*filterCandidate
+	for _, c := range group {
+		if kept[c.version] {
+			result = append(result, c)
+		}
+	}
+	return result
+}
 
-		// Sort versions in descending order (newest first)
-		sort.Slice(versions, func(i, j int) bool {
-			nv1 := parsePackageNameVersion(versions[i].Path())
-			nv2 := parsePackageNameVersion(versions[j].Path())
+// applyPackageFilters filters packages based on configured rules.
+//
+// Binary and source packages are filtered by their Package and Version
+// fields.  All files of a kept package are kept; a file shared by several
+// packages (such as an .orig.tar.* used by two source revisions) is kept
+// if any of them is kept.  With filters.sources_from_binaries, source
+// packages are selected by the Source field of the kept binary packages
+// instead of by the rules.
+func (ap *APTParser) applyPackageFilters(itemMap map[string]*apt.FileInfo, packages []*apt.Package) map[string]*apt.FileInfo {
+	if ap.config.Filters == nil {
+		slog.Debug("no package filters configured", "repo", ap.mirrorID)
+		return itemMap // No filtering configured
+	}
 
-			v1, err1 := version.NewVersion(nv1.version)
-			v2, err2 := version.NewVersion(nv2.version)
+	filters := ap.config.Filters
+	slog.Debug("applying package filters", "repo", ap.mirrorID,
+		"keep_versions", filters.KeepVersions,
+		"exclude_patterns", len(filters.ExcludePatterns),
+		"sources_from_binaries", filters.SourcesFromBinaries,
+		"total_items", len(itemMap))
 
-			if err1 != nil || err2 != nil {
-				// Fallback to string comparison if version parsing fails
-				return nv1.version > nv2.version
-			}
+	candidates, indexItems, skippedFiles := ap.filterCandidates(itemMap, packages)
 
-			return v1.GreaterThan(v2)
-		})
+	// Group packages by kind, name and architecture
+	binaryGroups := make(map[string][]*filterCandidate)
+	sourceGroups := make(map[string][]*filterCandidate)
+	var sourceCandidates []*filterCandidate
 
-		// Keep only the specified number of versions
-		keepCount := len(versions)
-		if ap.config.Filters.KeepVersions > 0 && ap.config.Filters.KeepVersions < len(versions) {
-			keepCount = ap.config.Filters.KeepVersions
+	for _, c := range candidates {
+		if c.source {
+			sourceCandidates = append(sourceCandidates, c)
+			if filters.SourcesFromBinaries {
+				continue
+			}
 		}
 
-		for i := 0; i < keepCount; i++ {
-			pkg := versions[i]
-			filteredMap[pkg.Path()] = pkg
-			keptPackages++
+		// Check exclude patterns
+		if ap.shouldExcludePackageByName(c.name, c.version) {
+			slog.Debug("excluding package by pattern", "repo", ap.mirrorID,
+				"package", c.name, "version", c.version, "source", c.source)
+			continue
 		}
 
-		if len(versions) > keepCount {
+		if c.source {
+			sourceGroups[c.groupKey()] = append(sourceGroups[c.groupKey()], c)
+		} else {
+			binaryGroups[c.groupKey()] = append(binaryGroups[c.groupKey()], c)
+		}
+	}
+
+	slog.Debug("package grouping results", "repo", ap.mirrorID,
+		"total_files", len(itemMap), "skipped_files", skippedFiles,
+		"unique_packages", len(binaryGroups)+len(sourceGroups))
+
+	// Apply version filtering
+	var kept []*filterCandidate
+	for groupKey, group := range binaryGroups {
+		result := keepNewestVersions(group, filters.KeepVersions)
+		if len(result) < len(group) {
 			slog.Debug("filtered package versions", "repo", ap.mirrorID,
-				"package", packageName, "total_versions", len(versions),
-				"kept_versions", keepCount)
+				"package", groupKey, "total", len(group), "kept", len(result))
+		}
+		kept = append(kept, result...)
+	}
+
+	if filters.SourcesFromBinaries {
+		wanted := make(map[string]bool)
+		for _, c := range kept {
+			wanted[c.sourceKey()] = true
+		}
+		for _, c := range sourceCandidates {
+			if wanted[c.sourceKey()] {
+				kept = append(kept, c)
+			}
+		}
+	} else {
+		for groupKey, group := range sourceGroups {
+			result := keepNewestVersions(group, filters.KeepVersions)
+			if len(result) < len(group) {
+				slog.Debug("filtered source package versions", "repo", ap.mirrorID,
+					"package", groupKey, "total", len(group), "kept", len(result))
+			}
+			kept = append(kept, result...)
+		}
+	}
+
+	filteredMap := make(map[string]*apt.FileInfo)
+	for _, fi := range indexItems {
+		filteredMap[fi.Path()] = fi
+	}
+	for _, c := range kept {
+		for _, fi := range c.files {
+			filteredMap[fi.Path()] = fi
 		}
 	}
 
 	slog.Info("package filtering complete", "repo", ap.mirrorID,
-		"total_packages", totalPackages, "kept_packages", keptPackages,
-		"filtered_out", totalPackages-keptPackages)
+		"total_packages", len(candidates), "kept_packages", len(kept),
+		"filtered_out", len(candidates)-len(kept))
 
 	return filteredMap
 }
@@ -675,8 +962,8 @@ func (ap *APTParser) shouldExcludePackageByName(name, version string) bool {
 	return false
 }
 
-// formatBytes formats a byte count as a human-readable string
-func formatBytes(bytes uint64) string {
+// FormatBytes formats a byte count as a human-readable string
+func FormatBytes(bytes uint64) string {
 	if bytes == 0 {
 		return "0 B"
 	}
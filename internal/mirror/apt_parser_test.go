@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
@@ -219,7 +220,7 @@ func TestApplyPackageFilters(t *testing.T) {
 				mirrorID: "test",
 			}
 
-			gotMap := ap.applyPackageFilters(itemMap)
+			gotMap := ap.applyPackageFilters(itemMap, nil)
 
 			// Check count
 			if len(gotMap) != tt.wantCount {
@@ -620,3 +621,200 @@ func TestVerifyPGPSignature_MissingPGPKeyPath(t *testing.T) {
 		t.Errorf("unexpected error message: %v", err)
 	}
 }
+
+func TestApplyPackageFiltersWithSources(t *testing.T) {
+	fi := func(p string) *apt.FileInfo { return apt.MakeFileInfoNoChecksum(p, 100) }
+
+	itemMap := map[string]*apt.FileInfo{
+		"pool/v/vim/vim_8.1-1_amd64.deb":         fi("pool/v/vim/vim_8.1-1_amd64.deb"),
+		"pool/v/vim/vim_8.2-1_amd64.deb":         fi("pool/v/vim/vim_8.2-1_amd64.deb"),
+		"pool/v/vim/vim-common_8.2-1_all.deb":    fi("pool/v/vim/vim-common_8.2-1_all.deb"),
+		"pool/v/vim/vim_8.1-1.dsc":               fi("pool/v/vim/vim_8.1-1.dsc"),
+		"pool/v/vim/vim_8.2-1.dsc":               fi("pool/v/vim/vim_8.2-1.dsc"),
+		"pool/v/vim/vim_8.2.orig.tar.gz":         fi("pool/v/vim/vim_8.2.orig.tar.gz"),
+		"pool/v/vim/vim_8.1.orig.tar.gz":         fi("pool/v/vim/vim_8.1.orig.tar.gz"),
+		"pool/v/vim/vim_8.2-1.debian.tar.xz":     fi("pool/v/vim/vim_8.2-1.debian.tar.xz"),
+		"pool/v/vim/vim_8.1-1.debian.tar.xz":     fi("pool/v/vim/vim_8.1-1.debian.tar.xz"),
+		"pool/n/nano/nano_4.0-1.dsc":             fi("pool/n/nano/nano_4.0-1.dsc"),
+		"pool/n/nano/nano_4.0.orig.tar.gz":       fi("pool/n/nano/nano_4.0.orig.tar.gz"),
+		"pool/v/vim/vim-tiny_8.2-1+b1_amd64.deb": fi("pool/v/vim/vim-tiny_8.2-1+b1_amd64.deb"),
+	}
+
+	files := func(paths ...string) []*apt.FileInfo {
+		var l []*apt.FileInfo
+		for _, p := range paths {
+			l = append(l, fi(p))
+		}
+		return l
+	}
+	packages := []*apt.Package{
+		{Name: "vim", Version: "8.1-1", Architecture: "amd64", Source: "vim", SourceVersion: "8.1-1",
+			Files: files("pool/v/vim/vim_8.1-1_amd64.deb")},
+		{Name: "vim", Version: "8.2-1", Architecture: "amd64", Source: "vim", SourceVersion: "8.2-1",
+			Files: files("pool/v/vim/vim_8.2-1_amd64.deb")},
+		{Name: "vim-common", Version: "8.2-1", Architecture: "all", Source: "vim", SourceVersion: "8.2-1",
+			Files: files("pool/v/vim/vim-common_8.2-1_all.deb")},
+		{Name: "vim-tiny", Version: "8.2-1+b1", Architecture: "amd64", Source: "vim", SourceVersion: "8.2-1",
+			Files: files("pool/v/vim/vim-tiny_8.2-1+b1_amd64.deb")},
+		{Name: "vim", Version: "8.1-1", Architecture: apt.SourceArchitecture, Source: "vim", SourceVersion: "8.1-1",
+			Files: files("pool/v/vim/vim_8.1-1.dsc", "pool/v/vim/vim_8.1.orig.tar.gz", "pool/v/vim/vim_8.1-1.debian.tar.xz")},
+		{Name: "vim", Version: "8.2-1", Architecture: apt.SourceArchitecture, Source: "vim", SourceVersion: "8.2-1",
+			Files: files("pool/v/vim/vim_8.2-1.dsc", "pool/v/vim/vim_8.2.orig.tar.gz", "pool/v/vim/vim_8.2-1.debian.tar.xz")},
+		{Name: "nano", Version: "4.0-1", Architecture: apt.SourceArchitecture, Source: "nano", SourceVersion: "4.0-1",
+			Files: files("pool/n/nano/nano_4.0-1.dsc", "pool/n/nano/nano_4.0.orig.tar.gz")},
+	}
+
+	tests := []struct {
+		name        string
+		filters     *PackageFilters
+		wantPresent []string
+		wantMissing []string
+	}{
+		{
+			name:    "keep one version of binaries and sources",
+			filters: &PackageFilters{KeepVersions: 1},
+			wantPresent: []string{
+				"pool/v/vim/vim_8.2-1_amd64.deb", "pool/v/vim/vim-common_8.2-1_all.deb",
+				"pool/v/vim/vim_8.2-1.dsc", "pool/v/vim/vim_8.2.orig.tar.gz", "pool/v/vim/vim_8.2-1.debian.tar.xz",
+				"pool/n/nano/nano_4.0-1.dsc", "pool/n/nano/nano_4.0.orig.tar.gz",
+			},
+			wantMissing: []string{
+				"pool/v/vim/vim_8.1-1_amd64.deb",
+				"pool/v/vim/vim_8.1-1.dsc", "pool/v/vim/vim_8.1.orig.tar.gz", "pool/v/vim/vim_8.1-1.debian.tar.xz",
+			},
+		},
+		{
+			name:        "exclude source package by name",
+			filters:     &PackageFilters{ExcludePatterns: []string{"nano"}},
+			wantPresent: []string{"pool/v/vim/vim_8.1-1.dsc", "pool/v/vim/vim_8.2-1.dsc"},
+			wantMissing: []string{"pool/n/nano/nano_4.0-1.dsc", "pool/n/nano/nano_4.0.orig.tar.gz"},
+		},
+		{
+			name:    "sources from binaries",
+			filters: &PackageFilters{KeepVersions: 1, SourcesFromBinaries: true},
+			wantPresent: []string{
+				"pool/v/vim/vim_8.2-1_amd64.deb", "pool/v/vim/vim-tiny_8.2-1+b1_amd64.deb",
+				"pool/v/vim/vim_8.2-1.dsc", "pool/v/vim/vim_8.2.orig.tar.gz",
+			},
+			wantMissing: []string{
+				"pool/v/vim/vim_8.1-1.dsc", "pool/v/vim/vim_8.1.orig.tar.gz",
+				"pool/n/nano/nano_4.0-1.dsc", "pool/n/nano/nano_4.0.orig.tar.gz",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ap := &APTParser{
+				config:   &MirrorConfig{Source: true, Filters: tt.filters},
+				mirrorID: "test",
+			}
+
+			gotMap := ap.applyPackageFilters(itemMap, packages)
+
+			for _, p := range tt.wantPresent {
+				if _, ok := gotMap[p]; !ok {
+					t.Errorf("expected %s to be present", p)
+				}
+			}
+			for _, p := range tt.wantMissing {
+				if _, ok := gotMap[p]; ok {
+					t.Errorf("expected %s to be missing", p)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPackageFiltersKeepsIndexItems(t *testing.T) {
+	itemMap := map[string]*apt.FileInfo{
+		"pool/vim_8.0_amd64.deb":                   apt.MakeFileInfoNoChecksum("pool/vim_8.0_amd64.deb", 100),
+		"dists/noble/main/i18n/Translation-en.bz2": apt.MakeFileInfoNoChecksum("dists/noble/main/i18n/Translation-en.bz2", 10),
+	}
+
+	ap := &APTParser{
+		config: &MirrorConfig{
+			Suites:       []string{"noble"},
+			Sections:     []string{"main"},
+			Translations: []string{"en"},
+			Filters:      &PackageFilters{ExcludePatterns: []string{"vim"}},
+		},
+		mirrorID: "test",
+	}
+
+	gotMap := ap.applyPackageFilters(itemMap, nil)
+	if _, ok := gotMap["dists/noble/main/i18n/Translation-en.bz2"]; !ok {
+		t.Error("expected translation to be kept by package filters")
+	}
+	if _, ok := gotMap["pool/vim_8.0_amd64.deb"]; ok {
+		t.Error("expected vim to be excluded")
+	}
+}
+
+func TestWantIndex(t *testing.T) {
+	ap := &APTParser{
+		config: &MirrorConfig{
+			Suites:        []string{"bookworm"},
+			Sections:      []string{"main"},
+			Architectures: []string{"amd64"},
+			DEP11:         true,
+		},
+		mirrorID: "test",
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"dists/bookworm/main/binary-amd64/Packages.xz", true},
+		{"dists/bookworm/main/binary-amd64/Packages.zz", false},
+		{"dists/bookworm/main/dep11/Components-amd64.yml", true},
+		{"dists/bookworm/main/dep11/icons-48x48.tar.gz", true},
+		{"dists/bookworm/main/Contents-amd64.gz", false},
+	}
+
+	for _, tt := range tests {
+		if got := ap.wantIndex(tt.path); got != tt.want {
+			t.Errorf("wantIndex(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIndexVariants(t *testing.T) {
+	config := &MirrorConfig{
+		Suites:        []string{"bookworm"},
+		Sections:      []string{"main"},
+		Architectures: []string{"amd64"},
+	}
+	ap := &APTParser{config: config, mirrorID: "test"}
+
+	dir := "dists/bookworm/main/binary-amd64/"
+	indexMap := map[string][]*apt.FileInfo{}
+	for _, fi := range []*apt.FileInfo{
+		apt.MakeFileInfoNoChecksum(dir+"Packages", 1000),
+		apt.MakeFileInfoNoChecksum(dir+"Packages.gz", 300),
+		apt.MakeFileInfoNoChecksum(dir+"Packages.xz", 200),
+		apt.MakeFileInfoNoChecksum(dir+"Packages.zst", 250),
+		apt.MakeFileInfoNoChecksum(dir+"Packages.zz", 100),
+	} {
+		indexMap[fi.Path()] = []*apt.FileInfo{fi}
+	}
+
+	groups := ap.indexVariants(indexMap)
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 group, got %d", len(groups))
+	}
+	var got []string
+	for _, v := range groups[0] {
+		got = append(got, filepath.Base(v[0].Path()))
+	}
+	want := []string{"Packages.xz", "Packages.zst", "Packages.gz", "Packages"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected variant order: %v", got)
+	}
+
+	config.AllIndexVariants = true
+	if groups := ap.indexVariants(indexMap); len(groups) != 4 {
+		t.Errorf("expected 4 groups with all_index_variants, got %d", len(groups))
+	}
+}
@@ -10,8 +10,11 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
 )
 
 const (
@@ -265,10 +268,20 @@ func (u *tomlURL) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (u tomlURL) MarshalText() ([]byte, error) {
+	if u.URL == nil {
+		return nil, nil
+	}
+	return []byte(u.String()), nil
+}
+
 // MirrorConfig is an auxiliary struct for Config.
 //
 //revive:disable:exported
 type MirrorConfig struct {
+	// Extends names the template the mirror is merged with
+	Extends string `toml:"extends,omitempty"`
+
 	URL           tomlURL  `toml:"url"`
 	Suites        []string `toml:"suites"`
 	Sections      []string `toml:"sections"`
@@ -278,6 +291,25 @@ type MirrorConfig struct {
 	PGPKeyPath string `toml:"pgp_key_path,omitempty"`
 	NoPGPCheck bool   `toml:"no_pgp_check,omitempty"`
 
+	// Optional index families (non-flat repositories only)
+	Contents     bool     `toml:"contents,omitempty"`
+	Translations []string `toml:"translations,omitempty"`
+	DEP11        bool     `toml:"dep11,omitempty"`
+	CNF          bool     `toml:"cnf,omitempty"`
+
+	// AllIndexVariants mirrors every compressed variant of an index
+	// instead of only the smallest one.
+	AllIndexVariants bool `toml:"all_index_variants,omitempty"`
+
+	// By-hash files of indices from previous syncs are kept for
+	// ByHashGenerations syncs, but not longer than ByHashGracePeriod.
+	ByHashGenerations int    `toml:"byhash_generations,omitempty"`
+	ByHashGracePeriod string `toml:"byhash_grace_period,omitempty"`
+
+	// MaxSize is the size the mirror may grow to, such as "500GiB".
+	// Syncs past it fail, and snapshots past it are not published.
+	MaxSize string `toml:"max_size,omitempty"`
+
 	// Staging workflow configuration
 	PublishToStaging bool `toml:"publish_to_staging,omitempty"`
 
@@ -289,12 +321,19 @@ type MirrorConfig struct {
 
 	// TLS configuration overrides for this mirror
 	TLS *TLSOverrides `toml:"tls,omitempty"`
+
+	// Hooks of this mirror, run after the global hooks
+	Hooks []*HookConfig `toml:"hooks,omitempty"`
 }
 
 // PackageFilters defines filtering rules for packages
 type PackageFilters struct {
 	KeepVersions    int      `toml:"keep_versions,omitempty"`
 	ExcludePatterns []string `toml:"exclude_patterns,omitempty"`
+
+	// SourcesFromBinaries keeps exactly the source packages referenced
+	// by the Source field of the kept binary packages.
+	SourcesFromBinaries bool `toml:"sources_from_binaries,omitempty"`
 }
 
 // isFlat returns true if suite ends with "/" as described in
@@ -320,6 +359,9 @@ func (mc *MirrorConfig) Check() error {
 		if len(mc.Architectures) != 0 {
 			return errors.New("flat repository cannot have architectures")
 		}
+		if mc.Contents || len(mc.Translations) != 0 || mc.DEP11 || mc.CNF {
+			return errors.New("flat repository cannot have contents, translations, dep11 or cnf")
+		}
 	} else {
 		if len(mc.Sections) == 0 {
 			return errors.New("no sections")
@@ -335,6 +377,38 @@ func (mc *MirrorConfig) Check() error {
 		}
 	}
 
+	for _, lang := range mc.Translations {
+		if _, err := path.Match(lang, ""); err != nil {
+			return errors.New("invalid translations pattern: " + lang)
+		}
+	}
+
+	if mc.ByHashGenerations < 0 {
+		return errors.New("byhash_generations must not be negative")
+	}
+	if _, err := parseDuration(mc.ByHashGracePeriod); err != nil {
+		return fmt.Errorf("byhash_grace_period: %w", err)
+	}
+	if _, err := parseSize(mc.MaxSize); err != nil {
+		return fmt.Errorf("max_size: %w", err)
+	}
+
+	if mc.Snapshot != nil {
+		if err := mc.Snapshot.Check(); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range mc.Hooks {
+		if err := h.Check(); err != nil {
+			return err
+		}
+	}
+
+	if mc.Filters != nil && mc.Filters.SourcesFromBinaries && !mc.Source {
+		return errors.New("filters.sources_from_binaries requires mirror_source = true")
+	}
+
 	// PGP configuration validation
 	if !mc.NoPGPCheck && mc.PGPKeyPath != "" {
 		if !path.IsAbs(mc.PGPKeyPath) {
@@ -397,6 +471,11 @@ func rawName(filePath string) string {
 
 // MatchingIndex returns true if mc is configured for the given index.
 func (mc *MirrorConfig) MatchingIndex(filePath string) bool {
+	// PDiff files follow the index they patch.
+	if apt.IsPDiff(filePath) {
+		return mc.MatchingIndex(strings.TrimSuffix(path.Dir(filePath), ".diff"))
+	}
+
 	rawName := rawName(filePath)
 
 	if rawName == "Index" {
@@ -441,6 +520,100 @@ func (mc *MirrorConfig) MatchingIndex(filePath string) bool {
 		}
 	}
 
+	return mc.matchingOptionalIndex(filePath)
+}
+
+// matchingArchitecture returns true if arch is one of the configured
+// architectures, "all", or "source" when sources are mirrored.
+func (mc *MirrorConfig) matchingArchitecture(arch string) bool {
+	if arch == "all" {
+		return true
+	}
+	if arch == "source" {
+		return mc.Source
+	}
+	for _, a := range mc.Architectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingDir returns true if dir is "dists/<suite>" for one of the
+// configured suites, or "dists/<suite>/<section>" for one of the
+// configured suites and sections when withSection is true.
+func (mc *MirrorConfig) matchingDir(dir string, withSection bool) bool {
+	for _, suite := range mc.Suites {
+		suiteDir := path.Join("dists", suite)
+		if !withSection {
+			if dir == suiteDir {
+				return true
+			}
+			continue
+		}
+		for _, section := range mc.Sections {
+			if dir == path.Join(suiteDir, path.Clean(section)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchingOptionalIndex returns true if filePath belongs to one of the
+// optional index families enabled for mc:
+//
+//   - Contents-<arch> at suite or section level (contents = true)
+//   - <section>/i18n/Translation-<lang> (translations = ["en", ...])
+//   - <section>/dep11/{Components-<arch>.yml,CID-Index-<arch>.json,icons-*.tar} (dep11 = true)
+//   - <section>/cnf/Commands-<arch> (cnf = true)
+func (mc *MirrorConfig) matchingOptionalIndex(filePath string) bool {
+	name := apt.TrimCompressionExt(path.Base(filePath))
+	dir := path.Dir(filePath)
+	family := path.Base(dir)
+
+	switch {
+	case strings.HasPrefix(name, "Contents-"):
+		if !mc.Contents {
+			return false
+		}
+		// Contents-udeb-<arch> describes installer packages, which are not mirrored.
+		arch := strings.TrimPrefix(name, "Contents-")
+		if strings.HasPrefix(arch, "udeb-") {
+			return false
+		}
+		return mc.matchingArchitecture(arch) && (mc.matchingDir(dir, false) || mc.matchingDir(dir, true))
+
+	case family == "i18n" && strings.HasPrefix(name, "Translation-"):
+		lang := strings.TrimPrefix(name, "Translation-")
+		for _, pattern := range mc.Translations {
+			if matched, _ := path.Match(pattern, lang); matched {
+				return mc.matchingDir(path.Dir(dir), true)
+			}
+		}
+		return false
+
+	case family == "dep11":
+		if !mc.DEP11 || !mc.matchingDir(path.Dir(dir), true) {
+			return false
+		}
+		name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, ".yml"), ".json"), ".tar")
+		switch {
+		case strings.HasPrefix(name, "icons-"):
+			return true
+		case strings.HasPrefix(name, "Components-"):
+			return mc.matchingArchitecture(strings.TrimPrefix(name, "Components-"))
+		case strings.HasPrefix(name, "CID-Index-"):
+			return mc.matchingArchitecture(strings.TrimPrefix(name, "CID-Index-"))
+		}
+		return false
+
+	case family == "cnf" && strings.HasPrefix(name, "Commands-"):
+		return mc.CNF && mc.matchingDir(path.Dir(dir), true) &&
+			mc.matchingArchitecture(strings.TrimPrefix(name, "Commands-"))
+	}
+
 	return false
 }
 
@@ -491,19 +664,28 @@ func (lc *LogConfig) ShouldShowProgress() bool {
 
 // Config is a struct to read TOML configurations.
 //
-// Use https://github.com/BurntSushi/toml as follows:
+// Use LoadConfig to read a configuration and the files it includes:
 //
 //	config := mirror.NewConfig()
-//	md, err := toml.DecodeFile("/path/to/config.toml", config)
+//	sources, err := mirror.LoadConfig("/path/to/config.toml", config)
 //	if err != nil {
 //	    ...
 //	}
 type Config struct {
+	// Include lists globs of files defining more mirrors and templates
+	Include []string `toml:"include,omitempty"`
+
+	// Templates are partial mirror configurations that mirrors extend
+	Templates map[string]*MirrorConfig `toml:"templates,omitempty"`
+
 	Dir      string                   `toml:"dir" env:"MIRRORCTL_DIR"`
 	MaxConns int                      `toml:"max_conns" env:"MIRRORCTL_MAX_CONNS"`
 	Log      LogConfig                `toml:"log"`
 	TLS      TLSConfig                `toml:"tls"`
 	Snapshot *SnapshotConfig          `toml:"snapshot,omitempty"`
+	Hooks    []*HookConfig            `toml:"hooks,omitempty"`
+	Notify   *NotifyConfig            `toml:"notify,omitempty"`
+	API      *APIConfig               `toml:"api,omitempty"`
 	Mirrors  map[string]*MirrorConfig `toml:"mirrors"`
 }
 
@@ -525,6 +707,35 @@ func (c *Config) Check() error {
 		return errors.New("max_conns must be a positive integer")
 	}
 
+	if c.Snapshot != nil {
+		if err := c.Snapshot.Prune.Check(); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+		for _, g := range c.Snapshot.Gates {
+			if err := g.Check(); err != nil {
+				return fmt.Errorf("snapshot: %w", err)
+			}
+		}
+	}
+
+	for _, h := range c.Hooks {
+		if err := h.Check(); err != nil {
+			return err
+		}
+	}
+
+	if c.Notify != nil {
+		if err := c.Notify.Check(); err != nil {
+			return err
+		}
+	}
+
+	if c.API != nil {
+		if err := c.API.Check(); err != nil {
+			return err
+		}
+	}
+
 	// Validate mirror IDs
 	for mirrorID := range c.Mirrors {
 		if !IsValidID(mirrorID) {
@@ -532,6 +743,65 @@ func (c *Config) Check() error {
 		}
 	}
 
+	return c.checkChannelPaths()
+}
+
+// checkChannelPaths checks that no two channels of any mirrors share a
+// symlink, unless a channel is configured as an alias of its own
+// mirror's live or staging symlink.  A symlink may not be a directory
+// of another one either, such as a channel "ubuntu/stable" next to the
+// live symlink of mirror "ubuntu", which would place the channel inside
+// the tree it points to.
+func (c *Config) checkChannelPaths() error {
+	// owners maps symlinks, and dirs the directories holding them, to
+	// their mirror
+	owners := make(map[string]string)
+	dirs := make(map[string]string)
+	for mirrorID := range c.Mirrors {
+		owners[mirrorID] = mirrorID
+		owners[mirrorID+"-staging"] = mirrorID
+	}
+
+	ids := make([]string, 0, len(c.Mirrors))
+	for mirrorID := range c.Mirrors {
+		ids = append(ids, mirrorID)
+	}
+	sort.Strings(ids)
+
+	for _, mirrorID := range ids {
+		mc := c.Mirrors[mirrorID]
+		if mc == nil || mc.Snapshot == nil {
+			continue
+		}
+		names := make([]string, 0, len(mc.Snapshot.Channels))
+		for name := range mc.Snapshot.Channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			p := mirrorID + "-" + name
+			if ch := mc.Snapshot.Channels[name]; ch != nil && ch.Path != "" {
+				p = ch.Path
+			}
+			if p == mirrorID || p == mirrorID+"-staging" {
+				continue
+			}
+			if owner, ok := owners[p]; ok {
+				return fmt.Errorf("path %s of channel %s of mirror %s is already used by mirror %s", p, name, mirrorID, owner)
+			}
+			if owner, ok := dirs[p]; ok {
+				return fmt.Errorf("path %s of channel %s of mirror %s is a directory of a channel of mirror %s", p, name, mirrorID, owner)
+			}
+			for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+				if owner, ok := owners[dir]; ok {
+					return fmt.Errorf("path %s of channel %s of mirror %s is inside symlink %s of mirror %s", p, name, mirrorID, dir, owner)
+				}
+				dirs[dir] = mirrorID
+			}
+			owners[p] = mirrorID
+		}
+	}
 	return nil
 }
 
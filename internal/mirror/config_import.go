@@ -0,0 +1,448 @@
+package mirror
+
+// This file implements importing mirror definitions from APT source
+// files: one-line sources.list entries and deb822 .sources stanzas.
+// See sources.list(5).
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// SourceEntry is a repository listed in an APT source file: one suite
+// of one URI.
+type SourceEntry struct {
+	File string
+	Line int
+
+	// Source is true for deb-src entries
+	Source        bool
+	URI           string
+	Suite         string
+	Components    []string
+	Architectures []string
+
+	// SignedBy lists key files or fingerprints, or holds an inline
+	// key with one element per line.
+	SignedBy []string
+	Trusted  bool
+}
+
+// position returns the file and line of e.
+func (e *SourceEntry) position() string {
+	return ConfigPosition{File: e.File, Line: e.Line}.String()
+}
+
+// flat reports whether e is a flat repository, whose suite is a path
+// ending with "/".
+func (e *SourceEntry) flat() bool {
+	return isFlat(e.Suite)
+}
+
+// ReadSourceFile reads the entries of the APT source file path.  Files
+// named *.sources are in the deb822 format, others in the one-line
+// format.
+func ReadSourceFile(path string) ([]*SourceEntry, error) {
+	f, err := os.Open(path) // #nosec G304 - source files are given by the user
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".sources") {
+		return parseDeb822Sources(f, path)
+	}
+	return parseSourcesList(f, path)
+}
+
+// parseSourcesList parses one-line entries such as
+//
+//	deb [arch=amd64 signed-by=/usr/share/keyrings/k.gpg] https://example.com/debian bookworm main
+func parseSourcesList(r io.Reader, file string) ([]*SourceEntry, error) {
+	var entries []*SourceEntry
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := &SourceEntry{File: file, Line: n}
+		switch fields[0] {
+		case "deb":
+		case "deb-src":
+			e.Source = true
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", e.position(), fields[0])
+		}
+		fields = fields[1:]
+
+		// Options are in brackets, which may be separated by spaces
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+			var opts []string
+			for len(fields) > 0 {
+				f := fields[0]
+				fields = fields[1:]
+				end := strings.HasSuffix(f, "]")
+				f = strings.TrimSuffix(strings.TrimPrefix(f, "["), "]")
+				if f != "" {
+					opts = append(opts, f)
+				}
+				if end {
+					break
+				}
+			}
+			for _, opt := range opts {
+				key, value, ok := strings.Cut(opt, "=")
+				if !ok {
+					return nil, fmt.Errorf("%s: invalid option %q", e.position(), opt)
+				}
+				e.setOption(strings.TrimRight(key, "+-"), strings.Split(value, ","), strings.HasSuffix(key, "-"))
+			}
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: expected a URI and a suite", e.position())
+		}
+		e.URI, e.Suite, e.Components = fields[0], fields[1], fields[2:]
+		if !e.flat() && len(e.Components) == 0 {
+			return nil, fmt.Errorf("%s: suite %s has no components", e.position(), e.Suite)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// setOption sets the option key of e to values, or removes them.
+// Unsupported options are ignored.
+func (e *SourceEntry) setOption(key string, values []string, remove bool) {
+	var list *[]string
+	switch strings.ToLower(key) {
+	case "arch", "architectures":
+		list = &e.Architectures
+	case "signed-by":
+		list = &e.SignedBy
+	case "trusted":
+		e.Trusted = len(values) > 0 && values[0] == "yes"
+		return
+	default:
+		return
+	}
+	for _, v := range values {
+		switch {
+		case v == "":
+		case remove:
+			*list = slices.DeleteFunc(*list, func(s string) bool { return s == v })
+		case !slices.Contains(*list, v):
+			*list = append(*list, v)
+		}
+	}
+}
+
+// parseDeb822Sources parses deb822 stanzas such as
+//
+//	Types: deb deb-src
+//	URIs: https://example.com/debian
+//	Suites: bookworm bookworm-updates
+//	Components: main
+//	Signed-By: /usr/share/keyrings/k.gpg
+func parseDeb822Sources(r io.Reader, file string) ([]*SourceEntry, error) {
+	// The control file parser ends at the first empty paragraph, so
+	// comments and runs of empty lines are dropped, remembering the line
+	// each stanza starts at
+	var buf bytes.Buffer
+	var starts []int
+	s := bufio.NewScanner(r)
+	blank := true
+	for n := 1; s.Scan(); n++ {
+		l := s.Text()
+		switch {
+		case strings.HasPrefix(l, "#"):
+			continue
+		case strings.TrimSpace(l) == "":
+			if blank {
+				continue
+			}
+			blank = true
+			buf.WriteString("\n")
+			continue
+		}
+		if blank {
+			starts = append(starts, n)
+		}
+		blank = false
+		buf.WriteString(l + "\n")
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []*SourceEntry
+	p := apt.NewParser(&buf)
+	for i := 0; ; i++ {
+		para, err := p.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		fields := make(map[string][]string, len(para))
+		for k, v := range para {
+			fields[strings.ToLower(k)] = v
+		}
+		line := 0
+		if i < len(starts) {
+			line = starts[i]
+		}
+		stanza, err := newDeb822Entries(fields, file, line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, stanza...)
+	}
+	return entries, nil
+}
+
+// newDeb822Entries returns the entries of a deb822 stanza whose field
+// names are lower case.
+func newDeb822Entries(fields map[string][]string, file string, line int) ([]*SourceEntry, error) {
+	words := func(name string) []string {
+		return strings.Fields(strings.Join(fields[name], " "))
+	}
+	pos := ConfigPosition{File: file, Line: line}
+	if enabled := words("enabled"); len(enabled) > 0 && enabled[0] == "no" {
+		return nil, nil
+	}
+
+	base := SourceEntry{File: file, Line: line, Components: words("components")}
+	base.setOption("architectures", words("architectures"), false)
+	base.setOption("trusted", words("trusted"), false)
+	if signedBy := fields["signed-by"]; len(signedBy) > 1 {
+		base.SignedBy = signedBy // inline key
+	} else {
+		base.setOption("signed-by", strings.FieldsFunc(strings.Join(signedBy, ""), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}), false)
+	}
+
+	types, uris, suites := words("types"), words("uris"), words("suites")
+	if len(types) == 0 || len(uris) == 0 || len(suites) == 0 {
+		return nil, fmt.Errorf("%s: Types, URIs and Suites are required", pos)
+	}
+
+	var entries []*SourceEntry
+	for _, typ := range types {
+		if typ != "deb" && typ != "deb-src" {
+			return nil, fmt.Errorf("%s: unknown type %q", pos, typ)
+		}
+		for _, uri := range uris {
+			for _, suite := range suites {
+				e := base
+				e.Source = typ == "deb-src"
+				e.URI = uri
+				e.Suite = suite
+				if !e.flat() && len(e.Components) == 0 {
+					return nil, fmt.Errorf("%s: suite %s has no components", pos, suite)
+				}
+				entries = append(entries, &e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// SourceImport is the result of importing APT source entries.
+type SourceImport struct {
+	Mirrors map[string]*MirrorConfig
+
+	// Warnings are about what could not be imported as is
+	Warnings []string
+}
+
+// sourceGroup is the entries merged into one mirror.
+type sourceGroup struct {
+	uri     string
+	flat    bool
+	entries []*SourceEntry
+}
+
+// ImportSources converts APT source entries into mirrors.  Entries
+// sharing a URI are merged into one mirror, except that flat
+// repositories are separate mirrors.  signed-by is mapped to
+// pgp_key_path, trusted=yes to no_pgp_check and deb-src to
+// mirror_source.
+func ImportSources(entries []*SourceEntry) *SourceImport {
+	si := &SourceImport{Mirrors: make(map[string]*MirrorConfig)}
+
+	var groups []*sourceGroup
+	for _, e := range entries {
+		uri := strings.TrimSuffix(e.URI, "/") + "/"
+		i := slices.IndexFunc(groups, func(g *sourceGroup) bool {
+			return g.uri == uri && g.flat == e.flat()
+		})
+		if i < 0 {
+			groups = append(groups, &sourceGroup{uri: uri, flat: e.flat()})
+			i = len(groups) - 1
+		}
+		groups[i].entries = append(groups[i].entries, e)
+	}
+
+	for _, g := range groups {
+		first := g.entries[0]
+		var u tomlURL
+		if err := u.UnmarshalText([]byte(g.uri)); err != nil {
+			si.warnf("%s: skipped %s: %v", first.position(), first.URI, err)
+			continue
+		}
+		mc := &MirrorConfig{URL: u}
+		for _, e := range g.entries {
+			mc.Suites = appendNew(mc.Suites, e.Suite)
+			mc.Source = mc.Source || e.Source
+			mc.NoPGPCheck = mc.NoPGPCheck || e.Trusted
+			if g.flat {
+				continue
+			}
+			mc.Sections = appendNew(mc.Sections, e.Components...)
+			if e.Source {
+				continue // architectures do not apply to sources
+			}
+			archs := e.Architectures
+			if len(archs) == 0 {
+				archs = []string{hostArchitecture()}
+			}
+			mc.Architectures = appendNew(mc.Architectures, archs...)
+		}
+		if !g.flat && len(mc.Architectures) == 0 {
+			mc.Architectures = []string{hostArchitecture()}
+		}
+		si.setKey(mc, g)
+
+		id := importedMirrorID(g.uri)
+		if g.flat {
+			id += "-flat"
+		}
+		for n, base := 2, id; si.Mirrors[id] != nil; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		si.Mirrors[id] = mc
+	}
+	return si
+}
+
+// setKey sets the pgp_key_path of mc from the signed-by options of the
+// entries of g.
+func (si *SourceImport) setKey(mc *MirrorConfig, g *sourceGroup) {
+	for _, e := range g.entries {
+		switch {
+		case len(e.SignedBy) == 0:
+			continue
+		case len(e.SignedBy) > 1 && strings.HasPrefix(e.SignedBy[0], "-----BEGIN"):
+			si.warnf("%s: inline Signed-By keys are not imported; save the key to a file and set pgp_key_path", e.position())
+			continue
+		case len(e.SignedBy) > 1:
+			si.warnf("%s: only the first of the Signed-By keys of %s is used", e.position(), e.URI)
+		}
+		key := e.SignedBy[0]
+		if !strings.HasPrefix(key, "/") {
+			si.warnf("%s: Signed-By %s is not a key file; set pgp_key_path", e.position(), key)
+			continue
+		}
+		if mc.PGPKeyPath == "" {
+			mc.PGPKeyPath = key
+			si.checkArmored(e, key)
+		} else if mc.PGPKeyPath != key {
+			si.warnf("%s: %s is also signed by %s, but only %s is used", e.position(), e.URI, key, mc.PGPKeyPath)
+		}
+	}
+	if mc.PGPKeyPath == "" && !mc.NoPGPCheck {
+		si.warnf("%s: %s has no signing key; set pgp_key_path", g.entries[0].position(), g.uri)
+	}
+	if mc.NoPGPCheck {
+		si.warnf("%s: %s is trusted, so its signatures are not checked", g.entries[0].position(), g.uri)
+	}
+}
+
+// checkArmored warns if the key file of e is readable but not
+// ASCII-armored, the only format pgp_key_path supports.
+func (si *SourceImport) checkArmored(e *SourceEntry, key string) {
+	data, err := os.ReadFile(key) // #nosec G304 - key files are listed in source files given by the user
+	if err != nil {
+		return
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		si.warnf("%s: %s is not ASCII-armored; convert it with gpg --enarmor or gpg --export --armor", e.position(), key)
+	}
+}
+
+// warnf adds a warning, unless it was already added for another entry
+// of the same stanza.
+func (si *SourceImport) warnf(format string, args ...any) {
+	si.Warnings = appendNew(si.Warnings, fmt.Sprintf(format, args...))
+}
+
+// WriteTOML writes the [mirrors.<id>] tables of the imported mirrors
+// to w, in alphabetical order.
+func (si *SourceImport) WriteTOML(w io.Writer) error {
+	if len(si.Mirrors) == 0 {
+		return errors.New("no mirrors to import")
+	}
+	return toml.NewEncoder(w).Encode(map[string]map[string]*MirrorConfig{"mirrors": si.Mirrors})
+}
+
+// appendNew appends the values that list does not contain.
+func appendNew(list []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// invalidIDChars matches runs of characters not allowed in mirror IDs.
+var invalidIDChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// importedMirrorID returns a mirror ID for uri made of its host and
+// path, such as deb-debian-org-debian for https://deb.debian.org/debian/.
+func importedMirrorID(uri string) string {
+	_, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		rest = uri
+	}
+	id := strings.Trim(invalidIDChars.ReplaceAllString(strings.ToLower(rest), "-"), "-")
+	if id == "" {
+		return "mirror"
+	}
+	return id
+}
+
+// debianArchitectures maps Go architectures to Debian architectures.
+var debianArchitectures = map[string]string{
+	"386":      "i386",
+	"arm":      "armhf",
+	"ppc64le":  "ppc64el",
+	"mips64le": "mips64el",
+}
+
+// hostArchitecture returns the Debian architecture of the host, which
+// APT uses for entries without architectures.
+func hostArchitecture() string {
+	if arch, ok := debianArchitectures[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
@@ -0,0 +1,255 @@
+package mirror
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSourcesList = `# Docker
+deb [arch=amd64,arm64 signed-by=/usr/share/keyrings/docker.asc] https://download.docker.com/linux/ubuntu noble stable
+deb-src [ signed-by=/usr/share/keyrings/docker.asc ] https://download.docker.com/linux/ubuntu/ noble stable # sources
+
+deb [trusted=yes] http://example.com/repo ./
+`
+
+const testDeb822Sources = `# Ubuntu
+
+
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates
+Components: main universe
+Architectures: amd64
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+types: deb
+uris: http://archive.ubuntu.com/ubuntu/
+suites: noble-backports
+components: main restricted
+architectures: amd64 i386
+signed-by: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main
+Enabled: no
+
+Types: deb deb-src
+URIs: https://repo.example.org/debian
+Suites: stable
+Components: main
+Architectures: amd64
+Signed-By:
+ -----BEGIN PGP PUBLIC KEY BLOCK-----
+ .
+ mQINBF
+ -----END PGP PUBLIC KEY BLOCK-----
+`
+
+func writeImportTestFiles(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	list := filepath.Join(dir, "sources.list")
+	sources := filepath.Join(dir, "ubuntu.sources")
+	writeTestFile(t, list, []byte(testSourcesList))
+	writeTestFile(t, sources, []byte(testDeb822Sources))
+	return list, sources
+}
+
+func TestReadSourceFile(t *testing.T) {
+	list, sources := writeImportTestFiles(t)
+
+	entries, err := ReadSourceFile(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	want := &SourceEntry{
+		File: list, Line: 3, Source: true,
+		URI: "https://download.docker.com/linux/ubuntu/", Suite: "noble", Components: []string{"stable"},
+		SignedBy: []string{"/usr/share/keyrings/docker.asc"},
+	}
+	if !reflect.DeepEqual(entries[1], want) {
+		t.Errorf("unexpected entry: %+v", entries[1])
+	}
+	if !reflect.DeepEqual(entries[0].Architectures, []string{"amd64", "arm64"}) {
+		t.Errorf("unexpected architectures: %v", entries[0].Architectures)
+	}
+	if !entries[2].flat() || !entries[2].Trusted || len(entries[2].Components) != 0 {
+		t.Errorf("unexpected flat entry: %+v", entries[2])
+	}
+
+	// Stanzas are expanded per type, URI and suite; disabled ones skipped
+	entries, err = ReadSourceFile(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.position()+" "+e.Suite)
+	}
+	wantPos := []string{
+		sources + ":4 noble", sources + ":4 noble-updates", sources + ":11 noble-backports",
+		sources + ":24 stable", sources + ":24 stable",
+	}
+	if !reflect.DeepEqual(got, wantPos) {
+		t.Errorf("unexpected entries: %v", got)
+	}
+	if !reflect.DeepEqual(entries[2].Architectures, []string{"amd64", "i386"}) {
+		t.Errorf("unexpected architectures: %v", entries[2].Architectures)
+	}
+	if e := entries[4]; !e.Source || len(e.SignedBy) != 4 {
+		t.Errorf("unexpected deb-src entry: %+v", e)
+	}
+}
+
+func TestReadSourceFile_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+	}{
+		{"type", "a.list", "\ndeb-foo http://example.com/ noble main\n", `a.list:2: unknown type "deb-foo"`},
+		{"suite", "a.list", "deb [arch=amd64] http://example.com/\n", "a.list:1: expected a URI and a suite"},
+		{"components", "a.list", "deb http://example.com/ noble\n", "a.list:1: suite noble has no components"},
+		{"option", "a.list", "deb [trusted] http://example.com/ ./\n", `a.list:1: invalid option "trusted"`},
+		{"fields", "a.sources", "# c\n\nTypes: deb\nSuites: noble\n", "a.sources:3: Types, URIs and Suites are required"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		writeTestFile(t, path, []byte(tt.content))
+		_, err := ReadSourceFile(path)
+		if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestImportSources(t *testing.T) {
+	list, sources := writeImportTestFiles(t)
+	var entries []*SourceEntry
+	for _, path := range []string{list, sources} {
+		e, err := ReadSourceFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e...)
+	}
+	// A flat repository at the same URL is a separate mirror
+	entries = append(entries, &SourceEntry{File: "c.list", Line: 1, URI: "http://archive.ubuntu.com/ubuntu", Suite: "extras/"},
+		&SourceEntry{File: "c.list", Line: 2, URI: "ftp://example.com/debian", Suite: "stable", Components: []string{"main"}})
+
+	si := ImportSources(entries)
+	var ids []string
+	for id := range si.Mirrors {
+		ids = append(ids, id)
+	}
+	wantIDs := []string{"archive-ubuntu-com-ubuntu", "archive-ubuntu-com-ubuntu-flat", "download-docker-com-linux-ubuntu", "example-com-repo-flat", "repo-example-org-debian"}
+	if len(ids) != len(wantIDs) {
+		t.Fatalf("unexpected mirrors: %v", ids)
+	}
+	for _, id := range wantIDs {
+		if si.Mirrors[id] == nil {
+			t.Errorf("missing mirror %s in %v", id, ids)
+		}
+	}
+
+	// Entries sharing a URL are merged
+	ubuntu := si.Mirrors["archive-ubuntu-com-ubuntu"]
+	if ubuntu.URL.String() != "http://archive.ubuntu.com/ubuntu/" ||
+		!reflect.DeepEqual(ubuntu.Suites, []string{"noble", "noble-updates", "noble-backports"}) ||
+		!reflect.DeepEqual(ubuntu.Sections, []string{"main", "universe", "restricted"}) ||
+		!reflect.DeepEqual(ubuntu.Architectures, []string{"amd64", "i386"}) ||
+		ubuntu.PGPKeyPath != "/usr/share/keyrings/ubuntu-archive-keyring.gpg" || ubuntu.Source {
+		t.Errorf("unexpected ubuntu mirror: %+v", ubuntu)
+	}
+	docker := si.Mirrors["download-docker-com-linux-ubuntu"]
+	if !docker.Source || docker.PGPKeyPath != "/usr/share/keyrings/docker.asc" ||
+		!reflect.DeepEqual(docker.Architectures, []string{"amd64", "arm64"}) {
+		t.Errorf("unexpected docker mirror: %+v", docker)
+	}
+	flat := si.Mirrors["example-com-repo-flat"]
+	if !reflect.DeepEqual(flat.Suites, []string{"./"}) || flat.Sections != nil || flat.Architectures != nil || !flat.NoPGPCheck {
+		t.Errorf("unexpected flat mirror: %+v", flat)
+	}
+
+	wantWarnings := []string{
+		list + ":5: http://example.com/repo/ is trusted, so its signatures are not checked",
+		sources + ":24: inline Signed-By keys are not imported; save the key to a file and set pgp_key_path",
+		sources + ":24: https://repo.example.org/debian/ has no signing key; set pgp_key_path",
+		"c.list:1: http://archive.ubuntu.com/ubuntu/ has no signing key; set pgp_key_path",
+		"c.list:2: skipped ftp://example.com/debian: unsupported scheme: ftp",
+	}
+	for _, w := range wantWarnings {
+		found := false
+		for _, got := range si.Warnings {
+			found = found || got == w
+		}
+		if !found {
+			t.Errorf("missing warning %q in %q", w, si.Warnings)
+		}
+	}
+	if len(si.Warnings) != len(wantWarnings) {
+		t.Errorf("unexpected warnings: %q", si.Warnings)
+	}
+
+	// The output is a valid configuration
+	var buf bytes.Buffer
+	if err := si.WriteTOML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := writeIncludeTestConfig(t, dir, map[string]string{
+		"mirror.toml": "dir = \"" + dir + "\"\ninclude = [\"imported.toml\"]\n",
+	})
+	writeTestFile(t, filepath.Join(dir, "imported.toml"), buf.Bytes())
+	config := NewConfig()
+	src, err := LoadConfig(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Mirrors) != len(wantIDs) || len(src.Undecoded) != 0 {
+		t.Errorf("unexpected configuration: %v, undecoded %v", config.Mirrors, src.Undecoded)
+	}
+}
+
+func TestImportSources_KeyChecks(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "binary.gpg")
+	if err := os.WriteFile(binary, []byte{0x99, 0x02, 0x0d}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries := []*SourceEntry{
+		{File: "a.list", Line: 1, URI: "https://a.example.com/", Suite: "stable", Components: []string{"main"},
+			SignedBy: []string{binary}},
+		{File: "a.list", Line: 2, URI: "https://a.example.com", Suite: "testing", Components: []string{"main"},
+			SignedBy: []string{"/etc/apt/other.asc"}},
+		{File: "a.list", Line: 3, URI: "https://b.example.com/", Suite: "stable", Components: []string{"main"},
+			SignedBy: []string{"0123456789ABCDEF"}},
+	}
+	si := ImportSources(entries)
+	if si.Mirrors["a-example-com"].PGPKeyPath != binary {
+		t.Errorf("unexpected key: %s", si.Mirrors["a-example-com"].PGPKeyPath)
+	}
+	want := []string{
+		"a.list:1: " + binary + " is not ASCII-armored; convert it with gpg --enarmor or gpg --export --armor",
+		"a.list:2: https://a.example.com is also signed by /etc/apt/other.asc, but only " + binary + " is used",
+		"a.list:3: Signed-By 0123456789ABCDEF is not a key file; set pgp_key_path",
+		"a.list:3: https://b.example.com/ has no signing key; set pgp_key_path",
+	}
+	if !reflect.DeepEqual(si.Warnings, want) {
+		t.Errorf("unexpected warnings:\n%q\nwant:\n%q", si.Warnings, want)
+	}
+
+	if err := ImportSources(nil).WriteTOML(&bytes.Buffer{}); err == nil {
+		t.Error("expected an error without mirrors")
+	}
+}
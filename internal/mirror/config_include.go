@@ -0,0 +1,213 @@
+package mirror
+
+// This file implements loading configurations split across files.  The
+// include globs of the configuration file match files that define
+// [mirrors.<id>] and [templates.<name>] tables, such as one file per
+// team in a conf.d directory.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigPosition is a position in a configuration file.  Line is 0 if
+// it is unknown.
+type ConfigPosition struct {
+	File string `json:"file"`
+	Line int    `json:"line,omitempty"`
+}
+
+func (p ConfigPosition) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return p.File + ":" + strconv.Itoa(p.Line)
+}
+
+// UndecodedKey is a configuration key that matches no field.
+type UndecodedKey struct {
+	File string
+	Key  toml.Key
+}
+
+// ConfigSources records where a configuration was read from.
+type ConfigSources struct {
+	// Files are the configuration file and the files it includes, in
+	// the order they were read.
+	Files []string
+
+	// Mirrors and Templates map mirror and template names to their
+	// definitions.
+	Mirrors   map[string]ConfigPosition
+	Templates map[string]ConfigPosition
+
+	// Undecoded are the keys that match no configuration field.
+	Undecoded []UndecodedKey
+}
+
+// includedConfig is the content of included files.
+type includedConfig struct {
+	Templates map[string]*MirrorConfig `toml:"templates"`
+	Mirrors   map[string]*MirrorConfig `toml:"mirrors"`
+}
+
+// LoadConfig decodes the configuration file path into config, and the
+// [mirrors.<id>] and [templates.<name>] tables of the files matched by
+// its include globs.  Relative globs are relative to the directory of
+// path.  A mirror or template must be defined only once across all
+// files.  Mirrors are then merged with the templates they extend.
+//
+// Errors reading path are returned as is, so that os.IsNotExist works.
+func LoadConfig(path string, config *Config) (*ConfigSources, error) {
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+	raw := newRawConfig()
+	if _, err := toml.DecodeFile(path, raw); err != nil {
+		return nil, err
+	}
+	src := &ConfigSources{
+		Files:     []string{path},
+		Mirrors:   make(map[string]ConfigPosition),
+		Templates: make(map[string]ConfigPosition),
+	}
+	src.addUndecoded(path, meta.Undecoded())
+	src.define(src.Mirrors, "mirror", path, slices.Collect(maps.Keys(config.Mirrors)))
+	src.define(src.Templates, "template", path, slices.Collect(maps.Keys(config.Templates)))
+
+	files, err := includedFiles(path, config.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	var dups []error
+	for _, file := range files {
+		var inc includedConfig
+		meta, err := toml.DecodeFile(file, &inc)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", file, err)
+		}
+		incRaw := newRawConfig()
+		if _, err := toml.DecodeFile(file, incRaw); err != nil {
+			return nil, fmt.Errorf("include %s: %w", file, err)
+		}
+		src.Files = append(src.Files, file)
+		src.addUndecoded(file, meta.Undecoded())
+
+		ids, errs := src.define(src.Mirrors, "mirror", file, slices.Collect(maps.Keys(inc.Mirrors)))
+		dups = append(dups, errs...)
+		for _, id := range ids {
+			if config.Mirrors == nil {
+				config.Mirrors = make(map[string]*MirrorConfig)
+			}
+			config.Mirrors[id] = inc.Mirrors[id]
+			raw.Mirrors[id] = incRaw.Mirrors[id]
+		}
+
+		names, errs := src.define(src.Templates, "template", file, slices.Collect(maps.Keys(inc.Templates)))
+		dups = append(dups, errs...)
+		for _, name := range names {
+			if config.Templates == nil {
+				config.Templates = make(map[string]*MirrorConfig)
+			}
+			config.Templates[name] = inc.Templates[name]
+			raw.Templates[name] = incRaw.Templates[name]
+		}
+	}
+	if len(dups) > 0 {
+		return nil, errors.Join(dups...)
+	}
+
+	if err := resolveTemplates(config, raw); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// define records the definitions of the tables of kind, such as
+// mirror, named names in file.  It returns the names that were not
+// defined before, and errors for the others.
+func (src *ConfigSources) define(positions map[string]ConfigPosition, kind, file string, names []string) ([]string, []error) {
+	sort.Strings(names)
+	lines := tableLines(file, kind+"s")
+	var fresh []string
+	var errs []error
+	for _, name := range names {
+		pos := ConfigPosition{File: file, Line: lines[name]}
+		if prev, ok := positions[name]; ok {
+			errs = append(errs, fmt.Errorf("%s %s is defined twice: at %s and at %s", kind, name, prev, pos))
+			continue
+		}
+		positions[name] = pos
+		fresh = append(fresh, name)
+	}
+	return fresh, errs
+}
+
+// addUndecoded records the undecoded keys of file.
+func (src *ConfigSources) addUndecoded(file string, keys []toml.Key) {
+	for _, key := range keys {
+		src.Undecoded = append(src.Undecoded, UndecodedKey{File: file, Key: key})
+	}
+}
+
+// includedFiles returns the files matched by the include globs of the
+// configuration file path, sorted per glob, without duplicates.
+func includedFiles(path string, globs []string) ([]string, error) {
+	var files []string
+	for _, glob := range globs {
+		if !filepath.IsAbs(glob) {
+			glob = filepath.Join(filepath.Dir(path), glob)
+		}
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", glob, err)
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				continue
+			}
+			if filepath.Clean(m) != filepath.Clean(path) && !slices.Contains(files, m) {
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// tableLines returns the line of the first table header of each
+// [<table>.<name>] table, or of its subtables, in the configuration file
+// path.  Tables defined otherwise, such as inline tables, are missing.
+func tableLines(path, table string) map[string]int {
+	header := regexp.MustCompile(`^\s*\[\[?\s*` + regexp.QuoteMeta(table) + `\s*\.\s*(?:"([^"]*)"|'([^']*)'|([A-Za-z0-9_-]+))`)
+	lines := make(map[string]int)
+	f, err := os.Open(path) // #nosec G304 - configuration files are chosen by the administrator
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		m := header.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		name := m[1] + m[2] + m[3]
+		if _, ok := lines[name]; !ok {
+			lines[name] = n
+		}
+	}
+	return lines
+}
@@ -0,0 +1,108 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIncludedMirror = `
+[mirrors.%s]
+url = "http://archive.ubuntu.com/ubuntu"
+suites = ["noble"]
+sections = ["main"]
+architectures = ["amd64"]
+no_pgp_check = true
+`
+
+func writeIncludeTestConfig(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), []byte(content))
+	}
+	return filepath.Join(dir, "mirror.toml")
+}
+
+func TestLoadConfig_Include(t *testing.T) {
+	dir := t.TempDir()
+	path := writeIncludeTestConfig(t, dir, map[string]string{
+		"mirror.toml": "include = [\"mirrors.d/*.toml\"]\ndir = \"/var/www/apt\"\n" +
+			strings.ReplaceAll(testIncludedMirror, "%s", "main"),
+		"mirrors.d/a.toml": "# team a\n" + strings.ReplaceAll(testIncludedMirror, "%s", "security"),
+		"mirrors.d/b.toml": strings.ReplaceAll(testIncludedMirror, "%s", `"updates"`) + "\n[mirrors.updates.filters]\nkeep_versions = 2\n",
+		"mirrors.d/c.txt":  "not toml",
+	})
+
+	config := NewConfig()
+	src, err := LoadConfig(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Mirrors) != 3 || config.Mirrors["updates"].Filters.KeepVersions != 2 {
+		t.Errorf("unexpected mirrors: %v", config.Mirrors)
+	}
+	wantFiles := []string{path, filepath.Join(dir, "mirrors.d/a.toml"), filepath.Join(dir, "mirrors.d/b.toml")}
+	if !reflect.DeepEqual(src.Files, wantFiles) {
+		t.Errorf("unexpected files: %v", src.Files)
+	}
+	wantMirrors := map[string]ConfigPosition{
+		"main":     {File: path, Line: 4},
+		"security": {File: wantFiles[1], Line: 3},
+		"updates":  {File: wantFiles[2], Line: 2},
+	}
+	if !reflect.DeepEqual(src.Mirrors, wantMirrors) {
+		t.Errorf("unexpected mirror positions: %v", src.Mirrors)
+	}
+	if len(src.Undecoded) != 0 {
+		t.Errorf("unexpected undecoded keys: %v", src.Undecoded)
+	}
+}
+
+func TestLoadConfig_IncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writeIncludeTestConfig(t, dir, map[string]string{
+		"mirror.toml":   "include = [\"*.d.toml\"]\ndir = \"/var/www/apt\"\n" + strings.ReplaceAll(testIncludedMirror, "%s", "main"),
+		"team.d.toml":   "\n" + strings.ReplaceAll(testIncludedMirror, "%s", "main"),
+		"typos.d.toml":  "dir = \"/srv\"\n[mirror.typo]\nurl = \"http://example.com/\"\n",
+		"unrelated.txt": "",
+	})
+
+	// Duplicate mirrors name both definitions
+	_, err := LoadConfig(path, NewConfig())
+	if err == nil {
+		t.Fatal("expected a duplicate mirror")
+	}
+	want := "mirror main is defined twice: at " + path + ":4 and at " + filepath.Join(dir, "team.d.toml") + ":3"
+	if err.Error() != want {
+		t.Errorf("unexpected error:\n got %s\nwant %s", err, want)
+	}
+
+	// Keys other than mirrors are undecoded in included files
+	if err := os.Remove(filepath.Join(dir, "team.d.toml")); err != nil {
+		t.Fatal(err)
+	}
+	src, err := LoadConfig(path, NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, uk := range src.Undecoded {
+		if uk.File != filepath.Join(dir, "typos.d.toml") {
+			t.Errorf("unexpected file of %s: %s", uk.Key, uk.File)
+		}
+		keys = append(keys, uk.Key.String())
+	}
+	if !reflect.DeepEqual(keys, []string{"dir", "mirror.typo", "mirror.typo.url"}) {
+		t.Errorf("unexpected undecoded keys: %v", keys)
+	}
+
+	// Missing configuration files can be detected
+	if _, err := LoadConfig(filepath.Join(dir, "missing.toml"), NewConfig()); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+}
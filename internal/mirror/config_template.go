@@ -0,0 +1,143 @@
+package mirror
+
+// This file implements mirror templates.  A mirror or template with
+// extends = "<name>" is merged with the [templates.<name>] table:
+//
+//   - keys the mirror sets replace those of the template, including
+//     lists such as suites, hooks and gates, which are not appended;
+//   - tables such as filters, snapshot and tls are merged key by key
+//     with the same rules, at any depth.
+//
+// Templates are merged as TOML tables rather than as structs, so that
+// mirrors can override a template with zero values such as false.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// rawConfig is the configuration as TOML tables, to merge templates
+// with the keys mirrors set.
+type rawConfig struct {
+	Templates map[string]map[string]any `toml:"templates"`
+	Mirrors   map[string]map[string]any `toml:"mirrors"`
+}
+
+// newRawConfig returns an empty rawConfig.
+func newRawConfig() *rawConfig {
+	return &rawConfig{
+		Templates: make(map[string]map[string]any),
+		Mirrors:   make(map[string]map[string]any),
+	}
+}
+
+// resolveTemplates replaces the mirrors of config that extend a
+// template with their merge with the template.
+func resolveTemplates(config *Config, raw *rawConfig) error {
+	var errs []error
+	ids := slices.Sorted(maps.Keys(config.Mirrors))
+	for _, id := range ids {
+		mc := config.Mirrors[id]
+		if mc == nil || mc.Extends == "" {
+			continue
+		}
+		table, err := raw.resolve(raw.Mirrors[id], nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mirror %s: %w", id, err))
+			continue
+		}
+		resolved, err := decodeMirrorTable(table)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mirror %s: %w", id, err))
+			continue
+		}
+		resolved.Extends = mc.Extends
+		config.Mirrors[id] = resolved
+	}
+	return errors.Join(errs...)
+}
+
+// resolve returns table merged with the templates it extends.  chain
+// lists the templates being resolved, to detect cycles.
+func (raw *rawConfig) resolve(table map[string]any, chain []string) (map[string]any, error) {
+	name, _ := table["extends"].(string)
+	if name == "" {
+		return table, nil
+	}
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("templates extend each other: %s -> %s", strings.Join(chain, " -> "), name)
+	}
+	tmpl, ok := raw.Templates[name]
+	if !ok {
+		return nil, fmt.Errorf("extends unknown template %q", name)
+	}
+	base, err := raw.resolve(tmpl, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	merged := mergeTables(base, table)
+	delete(merged, "extends")
+	return merged, nil
+}
+
+// mergeTables returns the keys of base replaced by those of over.
+// Tables in both are merged recursively.  base and over are not
+// modified.
+func mergeTables(base, over map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(over))
+	maps.Copy(merged, base)
+	for k, v := range over {
+		bt, ok1 := merged[k].(map[string]any)
+		ot, ok2 := v.(map[string]any)
+		if ok1 && ok2 {
+			merged[k] = mergeTables(bt, ot)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// decodeMirrorTable decodes a merged mirror table.
+func decodeMirrorTable(table map[string]any) (*MirrorConfig, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+		return nil, err
+	}
+	mc := &MirrorConfig{}
+	if _, err := toml.Decode(buf.String(), mc); err != nil {
+		return nil, err
+	}
+	return mc, nil
+}
+
+// Expanded returns a copy of c as if it were written in one file
+// without templates: without include globs, templates and extends.
+func (c *Config) Expanded() *Config {
+	e := *c
+	e.Include = nil
+	e.Templates = nil
+	e.Mirrors = make(map[string]*MirrorConfig, len(c.Mirrors))
+	for id, mc := range c.Mirrors {
+		if mc == nil {
+			continue
+		}
+		m := *mc
+		m.Extends = ""
+		e.Mirrors[id] = &m
+	}
+	return &e
+}
+
+// WriteExpanded writes the expanded configuration to w in TOML, with
+// the mirrors in alphabetical order.
+func (c *Config) WriteExpanded(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(c.Expanded())
+}
@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTemplateConfig = `
+dir = "/var/www/apt"
+
+[templates.ubuntu]
+url = "http://archive.ubuntu.com/ubuntu"
+sections = ["main", "universe"]
+architectures = ["amd64"]
+mirror_source = true
+no_pgp_check = true
+
+[templates.ubuntu.filters]
+keep_versions = 2
+exclude_patterns = ["*-dbg"]
+
+[[templates.ubuntu.hooks]]
+events = ["post-sync"]
+command = ["/usr/local/bin/notify"]
+
+[templates.ubuntu-security]
+extends = "ubuntu"
+url = "http://security.ubuntu.com/ubuntu"
+
+[mirrors.main]
+extends = "ubuntu"
+suites = ["noble"]
+mirror_source = false
+
+[mirrors.main.filters]
+keep_versions = 3
+
+[mirrors.security]
+extends = "ubuntu-security"
+suites = ["noble-security"]
+sections = ["main"]
+
+[mirrors.plain]
+url = "http://deb.debian.org/debian"
+suites = ["bookworm"]
+sections = ["main"]
+architectures = ["amd64"]
+no_pgp_check = true
+`
+
+func TestLoadConfig_Templates(t *testing.T) {
+	path := writeIncludeTestConfig(t, t.TempDir(), map[string]string{"mirror.toml": testTemplateConfig})
+	config := NewConfig()
+	src, err := LoadConfig(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if src.Templates["ubuntu-security"].Line != 19 {
+		t.Errorf("unexpected template positions: %v", src.Templates)
+	}
+
+	// Mirrors override templates, even with false
+	main := config.Mirrors["main"]
+	if main.URL.String() != "http://archive.ubuntu.com/ubuntu/" || main.Source || !main.NoPGPCheck || main.Extends != "ubuntu" {
+		t.Errorf("unexpected main mirror: %+v", main)
+	}
+	// Tables are merged key by key
+	if main.Filters.KeepVersions != 3 || !reflect.DeepEqual(main.Filters.ExcludePatterns, []string{"*-dbg"}) {
+		t.Errorf("unexpected filters: %+v", main.Filters)
+	}
+	if len(main.Hooks) != 1 || main.Hooks[0].Events[0] != HookPostSync {
+		t.Errorf("unexpected hooks: %+v", main.Hooks)
+	}
+
+	// Templates extend templates, and lists are replaced
+	security := config.Mirrors["security"]
+	if security.URL.String() != "http://security.ubuntu.com/ubuntu/" || !security.Source ||
+		!reflect.DeepEqual(security.Sections, []string{"main"}) || !reflect.DeepEqual(security.Architectures, []string{"amd64"}) ||
+		security.Filters.KeepVersions != 2 {
+		t.Errorf("unexpected security mirror: %+v", security)
+	}
+
+	if plain := config.Mirrors["plain"]; plain.Extends != "" || plain.Filters != nil {
+		t.Errorf("unexpected plain mirror: %+v", plain)
+	}
+}
+
+func TestLoadConfig_TemplateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			"unknown",
+			"[mirrors.main]\nextends = \"ubuntu\"\n",
+			`mirror main: extends unknown template "ubuntu"`,
+		},
+		{
+			"cycle",
+			"[templates.a]\nextends = \"b\"\n[templates.b]\nextends = \"a\"\n[mirrors.main]\nextends = \"a\"\n",
+			"mirror main: templates extend each other: a -> b -> a",
+		},
+		{
+			"type",
+			"[templates.a]\nsuites = \"noble\"\n[mirrors.main]\nextends = \"a\"\n",
+			"toml: line 2 (last key \"templates.a.suites\"): incompatible types",
+		},
+	}
+	for _, tt := range tests {
+		path := writeIncludeTestConfig(t, t.TempDir(), map[string]string{"mirror.toml": tt.config})
+		_, err := LoadConfig(path, NewConfig())
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestConfig_WriteExpanded(t *testing.T) {
+	dir := t.TempDir()
+	path := writeIncludeTestConfig(t, dir, map[string]string{
+		"mirror.toml":      "include = [\"mirrors.d/*.toml\"]\n" + testTemplateConfig,
+		"mirrors.d/a.toml": "[mirrors.updates]\nextends = \"ubuntu\"\nsuites = [\"noble-updates\"]\n",
+	})
+	config := NewConfig()
+	if _, err := LoadConfig(path, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := config.WriteExpanded(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, unwanted := range []string{"include", "templates", "extends"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("unexpected %s in:\n%s", unwanted, out)
+		}
+	}
+
+	// The expanded configuration reads as the original one
+	expanded := filepath.Join(dir, "expanded.toml")
+	if err := os.WriteFile(expanded, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reread := NewConfig()
+	src, err := LoadConfig(expanded, reread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(src.Undecoded) != 0 {
+		t.Errorf("unexpected undecoded keys: %v", src.Undecoded)
+	}
+	var again bytes.Buffer
+	if err := reread.WriteExpanded(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != out {
+		t.Errorf("unexpected configuration:\n%s\nwant:\n%s", again.String(), out)
+	}
+	if !config.Mirrors["updates"].Source {
+		t.Error("expected the included mirror to extend the template")
+	}
+}
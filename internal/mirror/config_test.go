@@ -220,3 +220,151 @@ func TestConfig_Check(t *testing.T) {
 		t.Errorf("expected no error for valid mirror ID, but got: %v", err)
 	}
 }
+
+func TestMirrorConfig_CheckSourcesFromBinaries(t *testing.T) {
+	t.Parallel()
+
+	var u tomlURL
+	if err := u.UnmarshalText([]byte("https://deb.example.com/debian/")); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := &MirrorConfig{
+		URL:           u,
+		Suites:        []string{"stable"},
+		Sections:      []string{"main"},
+		Architectures: []string{"amd64"},
+		Filters:       &PackageFilters{SourcesFromBinaries: true},
+	}
+	if err := mc.Check(); err == nil {
+		t.Error("expected an error for sources_from_binaries without mirror_source, but got none")
+	}
+
+	mc.Source = true
+	if err := mc.Check(); err != nil {
+		t.Errorf("expected no error, but got: %v", err)
+	}
+}
+
+func TestMirrorConfig_CheckByHash(t *testing.T) {
+	t.Parallel()
+
+	var u tomlURL
+	if err := u.UnmarshalText([]byte("https://deb.example.com/debian/")); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := &MirrorConfig{
+		URL:               u,
+		Suites:            []string{"stable"},
+		Sections:          []string{"main"},
+		Architectures:     []string{"amd64"},
+		ByHashGenerations: 3,
+		ByHashGracePeriod: "1d",
+	}
+	if err := mc.Check(); err != nil {
+		t.Errorf("expected no error, but got: %v", err)
+	}
+
+	mc.ByHashGracePeriod = "soon"
+	if err := mc.Check(); err == nil {
+		t.Error("expected an error for invalid byhash_grace_period, but got none")
+	}
+
+	mc.ByHashGracePeriod = ""
+	mc.ByHashGenerations = -1
+	if err := mc.Check(); err == nil {
+		t.Error("expected an error for negative byhash_generations, but got none")
+	}
+}
+
+func TestMirrorConfig_MatchingOptionalIndex(t *testing.T) {
+	t.Parallel()
+
+	mc := &MirrorConfig{
+		Suites:        []string{"noble", "noble-updates"},
+		Sections:      []string{"main"},
+		Architectures: []string{"amd64"},
+	}
+
+	paths := []string{
+		"dists/noble/Contents-amd64.gz",
+		"dists/noble/main/Contents-amd64.gz",
+		"dists/noble/main/i18n/Translation-en.bz2",
+		"dists/noble/main/dep11/Components-amd64.yml.gz",
+		"dists/noble/main/dep11/icons-64x64.tar.gz",
+		"dists/noble/main/cnf/Commands-amd64.xz",
+	}
+
+	// Nothing is enabled by default
+	for _, p := range paths {
+		if mc.MatchingIndex(p) {
+			t.Errorf("should not match %s by default", p)
+		}
+	}
+
+	mc.Contents = true
+	mc.Translations = []string{"en", "pt_*"}
+	mc.DEP11 = true
+	mc.CNF = true
+
+	for _, p := range paths {
+		if !mc.MatchingIndex(p) {
+			t.Errorf("should match %s", p)
+		}
+	}
+
+	notMatching := []string{
+		"dists/noble/Contents-arm64.gz",
+		"dists/noble/Contents-udeb-amd64.gz",
+		"dists/noble/Contents-source.gz",
+		"dists/noble/universe/Contents-amd64.gz",
+		"dists/jammy/main/Contents-amd64.gz",
+		"dists/noble/main/i18n/Translation-de.bz2",
+		"dists/noble/universe/i18n/Translation-en.bz2",
+		"dists/noble/main/dep11/Components-arm64.yml.gz",
+		"dists/noble/main/cnf/Commands-arm64.xz",
+	}
+	for _, p := range notMatching {
+		if mc.MatchingIndex(p) {
+			t.Errorf("should not match %s", p)
+		}
+	}
+
+	if !mc.MatchingIndex("dists/noble-updates/main/i18n/Translation-pt_BR.bz2") {
+		t.Error("should match Translation-pt_BR with pattern pt_*")
+	}
+
+	mc.Source = true
+	if !mc.MatchingIndex("dists/noble/main/Contents-source.gz") {
+		t.Error("should match Contents-source when mirroring sources")
+	}
+}
+
+func TestMirrorConfig_MatchingPDiff(t *testing.T) {
+	t.Parallel()
+
+	mc := &MirrorConfig{
+		Suites:        []string{"noble"},
+		Sections:      []string{"main"},
+		Architectures: []string{"amd64"},
+	}
+
+	for _, p := range []string{
+		"dists/noble/main/binary-amd64/Packages.diff/Index",
+		"dists/noble/main/binary-amd64/Packages.diff/T-2024-01-01-0204.27-F-2024-01-01-0204.27.gz",
+	} {
+		if !mc.MatchingIndex(p) {
+			t.Errorf("!MatchingIndex(%q)", p)
+		}
+	}
+	for _, p := range []string{
+		"dists/noble/main/binary-arm64/Packages.diff/Index",
+		"dists/noble/main/source/Sources.diff/Index",
+		"dists/noble/main/i18n/Translation-de.diff/Index",
+	} {
+		if mc.MatchingIndex(p) {
+			t.Errorf("MatchingIndex(%q)", p)
+		}
+	}
+}
@@ -2,10 +2,10 @@ package mirror
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -37,78 +37,75 @@ func validateLockFilePath(lockFile, baseDir string) error {
 	return nil
 }
 
-func updateMirrors(ctx context.Context, config *Config, mirrors []string, noPGPCheck, quiet, dryRun bool) ([]*Mirror, error) {
+// updateMirrors syncs mirrors concurrently.  It returns the updated
+// mirrors, and the notifications of the syncs to be sent once the lock
+// is released, even if a sync failed.
+func updateMirrors(ctx context.Context, config *Config, mirrors []string, noPGPCheck, quiet, dryRun bool) ([]*Mirror, []*Notification, error) {
 	timestamp := time.Now()
 
 	var mirrorList []*Mirror
+	budget := newDiskBudget(config.Dir)
 	for _, mirrorID := range mirrors {
 		mirror, err := NewMirror(timestamp, mirrorID, config, noPGPCheck, quiet, dryRun)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		mirror.budget = budget
 		mirrorList = append(mirrorList, mirror)
 	}
 
 	if dryRun {
 		slog.Info("dry-run mode: calculating disk usage without downloading")
 	} else {
+		// A failed pre-sync hook aborts the sync of all mirrors
+		for _, mirror := range mirrorList {
+			if err := mirror.runSyncHooks(config.Hooks, HookPreSync, nil); err != nil {
+				err = errors.Wrap(err, mirror.id)
+				mirror.runSyncHooks(config.Hooks, HookOnFailure, err) // #nosec G104 - failures are logged
+				return nil, nil, err
+			}
+		}
 		slog.Info("update starts")
 	}
 
 	// run goroutines in an environment.
 	group, ctx := errgroup.WithContext(ctx)
+	notifier := NewNotifier(config.Notify, &config.TLS)
 
-	for _, mirror := range mirrorList {
+	// Notifications are collected rather than sent, so that a slow
+	// webhook does not delay the sync.  Each goroutine has its own slot.
+	pending := make([][]*Notification, len(mirrorList))
+	for i, mirror := range mirrorList {
 		mirror := mirror // capture loop variable
 		group.Go(func() error {
-			return mirror.Update(ctx)
+			err := mirror.Update(ctx)
+			if dryRun {
+				return err
+			}
+			event := HookPostSync
+			if err != nil {
+				event = HookOnFailure
+			}
+			mirror.runSyncHooks(config.Hooks, event, err) // #nosec G104 - failures are logged
+			if notifier != nil {
+				pending[i] = append(pending[i], syncNotification(mirror.syncEvent(event, err)))
+				if err == nil {
+					pending[i] = append(pending[i], notifier.keyExpiryNotification(mirror))
+				}
+			}
+			return err
 		})
 	}
 	err := group.Wait()
+	notifications := slices.Concat(pending...)
 	if err != nil {
-		return nil, err
+		return nil, notifications, err
 	}
 
-	// Print summary in dry-run mode
-	if dryRun {
-		printDryRunSummary(mirrorList)
-	} else {
+	if !dryRun {
 		slog.Info("update ends")
 	}
-	return mirrorList, nil
-}
-
-// printDryRunSummary prints a summary of disk usage for all mirrors
-func printDryRunSummary(mirrors []*Mirror) {
-	fmt.Println()
-	fmt.Println("=== Disk Usage Summary (Dry Run) ===")
-	fmt.Println()
-
-	// Sort mirrors alphabetically by ID for consistent output
-	sort.Slice(mirrors, func(i, j int) bool {
-		return mirrors[i].id < mirrors[j].id
-	})
-
-	var totalUsage UsageStats
-	for _, mirror := range mirrors {
-		stats := mirror.UsageStats()
-		totalUsage.ReleaseFiles += stats.ReleaseFiles
-		totalUsage.IndexFiles += stats.IndexFiles
-		totalUsage.PackageFiles += stats.PackageFiles
-		totalUsage.Total += stats.Total
-		totalUsage.FileCount += stats.FileCount
-
-		mirror.PrintUsageStats()
-	}
-
-	fmt.Printf("Total across all repositories:\n")
-	fmt.Printf("  Release files:  %s\n", formatBytes(totalUsage.ReleaseFiles))
-	fmt.Printf("  Index files:    %s\n", formatBytes(totalUsage.IndexFiles))
-	fmt.Printf("  Package files:  %s\n", formatBytes(totalUsage.PackageFiles))
-	fmt.Printf("  Total size:     %s (%d files)\n", formatBytes(totalUsage.Total), totalUsage.FileCount)
-	fmt.Printf("\nNote: In dry-run mode, index files are downloaded to calculate package sizes,\n")
-	fmt.Printf("but actual package files are not downloaded.\n")
-	fmt.Println()
+	return mirrorList, notifications, nil
 }
 
 // gc removes old mirror files, if any.
@@ -119,6 +116,19 @@ func gc(ctx context.Context, config *Config) error {
 		"..":         true,
 	}
 
+	// Keep the directories holding channel symlinks
+	for _, mc := range config.Mirrors {
+		if mc == nil || mc.Snapshot == nil {
+			continue
+		}
+		for _, ch := range mc.Snapshot.Channels {
+			if ch != nil && ch.Path != "" {
+				dir, _, _ := strings.Cut(ch.Path, "/")
+				using[dir] = true
+			}
+		}
+	}
+
 	dirEntries, err := os.ReadDir(config.Dir)
 	if err != nil {
 		return err
@@ -172,9 +182,16 @@ func gc(ctx context.Context, config *Config) error {
 	return nil
 }
 
-// handleSnapshotting creates and stages snapshots for mirrors with publish_to_staging = true
-func handleSnapshotting(config *Config, mirrors []*Mirror, force bool) error {
-	snapshotManager := NewSnapshotManager(config.Snapshot, config.Dir)
+// handleSnapshotting creates and stages snapshots for mirrors with
+// publish_to_staging = true.  It returns the notifications of the
+// staged snapshots, to be sent once the lock is released.
+func handleSnapshotting(config *Config, mirrors []*Mirror, force bool) ([]*Notification, error) {
+	var notifications []*Notification
+	snapshotManager := NewSnapshotManager(config.Snapshot, config.Dir).
+		WithMirrorConfigs(config.Mirrors).
+		WithHooks(config.Hooks).
+		WithNotifier(NewNotifier(config.Notify, &config.TLS)).
+		WithPendingNotifications(&notifications)
 
 	for _, mirror := range mirrors {
 		mirrorConfig := config.Mirrors[mirror.id]
@@ -190,6 +207,8 @@ func handleSnapshotting(config *Config, mirrors []*Mirror, force bool) error {
 		snapshotName, err := snapshotManager.CreateSnapshot(mirror.id, "", force, mirrorConfig.Snapshot)
 		if err != nil {
 			slog.Error("failed to create snapshot", "repo", mirror.id, "error", err)
+			e := &HookEvent{Action: HookActionSnapshot, Mirror: mirror.id, Error: err.Error()}
+			runHooks(mirrorHooks(config.Hooks, mirrorConfig), HookOnFailure, e) // #nosec G104 - failures are logged
 			continue
 		}
 
@@ -203,7 +222,30 @@ func handleSnapshotting(config *Config, mirrors []*Mirror, force bool) error {
 		slog.Info("snapshot staged successfully", "repo", mirror.id, "snapshot", snapshotName)
 	}
 
-	return nil
+	enforceSnapshotSpaceLimits(config, snapshotManager)
+	return notifications, nil
+}
+
+// enforceSnapshotSpaceLimits deletes old snapshots of all mirrors that
+// exceed the max_total_size and min_free_space prune limits.
+func enforceSnapshotSpaceLimits(config *Config, snapshotManager *SnapshotManager) {
+	ids := make([]string, 0, len(config.Mirrors))
+	for id := range config.Mirrors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		pruneConfig := snapshotManager.GetPruneConfig(id, config.Mirrors[id].Snapshot)
+		deleted, err := snapshotManager.EnforceSpaceLimits(id, pruneConfig)
+		if err != nil {
+			slog.Error("failed to enforce snapshot space limits", "repo", id, "error", err)
+			continue
+		}
+		if len(deleted) > 0 {
+			slog.Info("pruned snapshots to meet space limits", "repo", id, "snapshots", deleted)
+		}
+	}
 }
 
 // Run starts mirroring.
@@ -214,11 +256,30 @@ func handleSnapshotting(config *Config, mirrors []*Mirror, force bool) error {
 // (or keys in c.Mirrors).  If mirrors is an empty list, all mirrors
 // will be updated.
 func Run(config *Config, mirrors []string, noPGPCheck, quiet, dryRun, force bool) error {
-	lockFile := filepath.Join(config.Dir, lockFilename)
+	unlock, err := lockDir(config.Dir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	updated, notifications, err := run(ctx, config, mirrors, noPGPCheck, quiet, dryRun, force)
+	unlock()
+	NewNotifier(config.Notify, &config.TLS).Notify(ctx, notifications...)
+	if err != nil || !dryRun {
+		return err
+	}
+	return newDryRunReport(config, updated).WriteTable(os.Stdout)
+}
+
+// lockDir acquires flock on the lock file of dir, which is held while
+// mirrors are synced.  It fails if another process holds it.  The
+// returned function releases the lock and removes the lock file.
+func lockDir(dir string) (func(), error) {
+	lockFile := filepath.Join(dir, lockFilename)
 
 	// Validate lock file path for security
-	if err := validateLockFilePath(lockFile, config.Dir); err != nil {
-		return errors.Wrap(err, "Run")
+	if err := validateLockFilePath(lockFile, dir); err != nil {
+		return nil, errors.Wrap(err, "Run")
 	}
 
 	file, err := os.Open(lockFile) // #nosec G304 - lockFile path is validated by validateLockFilePath
@@ -226,45 +287,51 @@ func Run(config *Config, mirrors []string, noPGPCheck, quiet, dryRun, force bool
 	case os.IsNotExist(err):
 		file2, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644) // #nosec G304,G302 - lockFile path validated, 0644 standard for lock files
 		if err != nil {
-			return err
+			return nil, err
 		}
 		file = file2
 	case err != nil:
-		return err
+		return nil, err
 	}
-	defer func() {
+
+	fileLock := Flock{file}
+	if err := fileLock.Lock(); err != nil {
 		if err := file.Close(); err != nil {
 			slog.Warn("failed to close lock file", "error", err)
 		}
-	}()
-
-	fileLock := Flock{file}
-	err = fileLock.Lock()
-	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err := fileLock.Unlock(); err != nil {
-			slog.Warn("failed to unlock file", "error", err)
-		}
-	}()
 
-	// Clean up the lock file when the process completes
-	defer func() {
+	return func() {
+		// Clean up the lock file when the process completes
 		if err := os.Remove(lockFile); err != nil {
 			slog.Warn("failed to remove lock file", "error", err, "path", lockFile)
 		}
-	}()
+		if err := fileLock.Unlock(); err != nil {
+			slog.Warn("failed to unlock file", "error", err)
+		}
+		if err := file.Close(); err != nil {
+			slog.Warn("failed to close lock file", "error", err)
+		}
+	}, nil
+}
 
+// run updates mirrors while the caller holds the lock of config.Dir, and
+// returns them with the notifications the caller sends after releasing
+// the lock.  Notifications are returned even if the sync failed.
+func run(ctx context.Context, config *Config, mirrors []string, noPGPCheck, quiet, dryRun, force bool) ([]*Mirror, []*Notification, error) {
 	if len(mirrors) == 0 {
 		for mirrorID := range config.Mirrors {
 			mirrors = append(mirrors, mirrorID)
 		}
 	}
 
-	group, ctx := errgroup.WithContext(context.Background())
+	var updatedMirrors []*Mirror
+	var notifications []*Notification
+	group, ctx := errgroup.WithContext(ctx)
 	group.Go(func() error {
-		updatedMirrors, err := updateMirrors(ctx, config, mirrors, noPGPCheck, quiet, dryRun)
+		var err error
+		updatedMirrors, notifications, err = updateMirrors(ctx, config, mirrors, noPGPCheck, quiet, dryRun)
 		if err != nil {
 			if gcErr := gc(ctx, config); gcErr != nil {
 				err = errors.Wrap(err, gcErr.Error())
@@ -274,18 +341,24 @@ func Run(config *Config, mirrors []string, noPGPCheck, quiet, dryRun, force bool
 
 		// Handle snapshotting for mirrors with publish_to_staging = true
 		if !dryRun && config.Snapshot != nil {
-			err = handleSnapshotting(config, updatedMirrors, force)
+			staged, err := handleSnapshotting(config, updatedMirrors, force)
+			notifications = append(notifications, staged...)
 			if err != nil {
 				slog.Warn("snapshot creation failed", "error", err)
 				// Don't fail the entire sync for snapshot errors
 			}
 		}
 
-		return gc(ctx, config)
+		if err := gc(ctx, config); err != nil {
+			return err
+		}
+		if !dryRun {
+			notifications = append(notifications, NewNotifier(config.Notify, &config.TLS).diskSpaceNotification(config.Dir))
+		}
+		return nil
 	})
-	err = group.Wait()
-	if err != nil {
-		return err
+	if err := group.Wait(); err != nil {
+		return nil, notifications, err
 	}
 
 	if dryRun {
@@ -293,5 +366,5 @@ func Run(config *Config, mirrors []string, noPGPCheck, quiet, dryRun, force bool
 	} else {
 		slog.Info("sync is fully complete")
 	}
-	return nil
+	return updatedMirrors, notifications, nil
 }
@@ -583,10 +583,13 @@ SHA256: a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3
 	indexMap := make(map[string][]*apt.FileInfo)
 	itemMap := make(map[string]*apt.FileInfo)
 
-	err = mirror.parser.extractItems(indices, indexMap, itemMap, false, "test/")
+	packages, err := mirror.parser.extractItems(indices, indexMap, itemMap, false, "test/")
 	if err != nil {
 		t.Errorf("extractItems failed: %v", err)
 	}
+	if len(packages) != 2 {
+		t.Errorf("Expected 2 extracted packages, got %d", len(packages))
+	}
 
 	// Verify extracted items (for flat repositories, paths should be prefixed with suite)
 	expectedFiles := []string{
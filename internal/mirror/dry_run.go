@@ -0,0 +1,347 @@
+package mirror
+
+// This file implements dry runs of syncs.  A dry run downloads the
+// Release files and indices of the mirrors, but not their package
+// files, and compares what a sync would store with the current trees.
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// maxListedChanges is the number of added and removed packages listed
+// per mirror in the table of a dry run.
+const maxListedChanges = 20
+
+// DryRunReport is the disk usage a sync would need, per mirror.
+type DryRunReport struct {
+	ReportHeader
+	Mirrors []*MirrorUsage `json:"mirrors"`
+	Total   UsageReport    `json:"total"`
+	Disk    DiskProjection `json:"disk"`
+}
+
+// MirrorUsage is the disk usage of a mirror and the changes a sync
+// would make to it.
+type MirrorUsage struct {
+	Mirror string `json:"mirror"`
+	UsageReport
+
+	// Changes counts the package changes, which Packages lists by
+	// index.  They are nil if the indices could not be compared.
+	Changes  *PackageCounts `json:"changes,omitempty"`
+	Packages []*IndexDiff   `json:"packages,omitempty"`
+
+	// MaxSize is the max_size of the mirror in bytes, and OverMaxSize
+	// reports whether the sync would grow the mirror past it.
+	MaxSize     int64 `json:"max_size,omitempty"`
+	OverMaxSize bool  `json:"over_max_size,omitempty"`
+}
+
+// UsageReport is the disk usage of mirror files, in bytes.
+//
+// New files are not in the current tree and must be downloaded, while
+// reused files are linked from it.  FreedSize is the space removing the
+// current tree frees after the sync, and SnapshotSize the space the
+// snapshot created for staging after the sync takes.
+type UsageReport struct {
+	ReleaseSize  uint64 `json:"release_size"`
+	IndexSize    uint64 `json:"index_size"`
+	PackageSize  uint64 `json:"package_size"`
+	TotalSize    uint64 `json:"total_size"`
+	Files        int    `json:"files"`
+	NewSize      uint64 `json:"new_size"`
+	NewFiles     int    `json:"new_files"`
+	ReusedSize   uint64 `json:"reused_size"`
+	ReusedFiles  int    `json:"reused_files"`
+	FreedSize    uint64 `json:"freed_size"`
+	SnapshotSize uint64 `json:"snapshot_size"`
+}
+
+// DiskProjection is the disk usage of the mirror and snapshot
+// directories, in bytes.
+type DiskProjection struct {
+	Current int64 `json:"current"`
+
+	// Peak is the usage at the end of the sync, before the previous
+	// trees are removed.
+	Peak int64 `json:"peak"`
+
+	AfterSync     int64 `json:"after_sync"`
+	AfterSnapshot int64 `json:"after_snapshot"`
+
+	// Available is the free space of the filesystem, AvailableInodes
+	// its free inodes or -1 if it does not limit them, and Fits
+	// reports whether the sync fits in both.
+	Available       int64 `json:"available"`
+	AvailableInodes int64 `json:"available_inodes"`
+	Fits            bool  `json:"fits"`
+}
+
+// add adds stats and the changes of a sync in d to u.
+func (u *UsageReport) add(stats *UsageStats, d *UsageReport) {
+	u.ReleaseSize += stats.ReleaseFiles
+	u.IndexSize += stats.IndexFiles
+	u.PackageSize += stats.PackageFiles
+	u.TotalSize += stats.Total
+	u.Files += stats.FileCount
+	if d != nil {
+		u.NewSize += d.NewSize
+		u.NewFiles += d.NewFiles
+		u.ReusedSize += d.ReusedSize
+		u.ReusedFiles += d.ReusedFiles
+		u.FreedSize += d.FreedSize
+		u.SnapshotSize += d.SnapshotSize
+	}
+}
+
+// DryRun calculates the disk usage of a sync of mirrors without
+// downloading package files, like Run in dry-run mode, and returns it
+// rather than printing it.
+func DryRun(config *Config, mirrors []string, noPGPCheck bool) (*DryRunReport, error) {
+	unlock, err := lockDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	updated, _, err := run(context.Background(), config, mirrors, noPGPCheck, true, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return newDryRunReport(config, updated), nil
+}
+
+// newDryRunReport returns the disk usage of the dry run of mirrors.
+// It must be called after the trees of the dry run are removed.
+func newDryRunReport(config *Config, mirrors []*Mirror) *DryRunReport {
+	r := &DryRunReport{ReportHeader: newReportHeader(ReportDryRun), Mirrors: []*MirrorUsage{}}
+	for _, mirror := range mirrors {
+		stats := mirror.UsageStats()
+		mu := &MirrorUsage{Mirror: mirror.id}
+		var d *UsageReport
+		if mirror.delta != nil {
+			delta := mirror.delta.UsageReport
+			d = &delta
+			mu.Changes = mirror.delta.Changes
+			mu.Packages = mirror.delta.Packages
+
+			// Only mirrors published to staging are snapshotted
+			if config.Snapshot == nil || !mirror.mc.PublishToStaging {
+				d.SnapshotSize = 0
+			}
+			if mu.MaxSize = mirror.mc.maxSize(); mu.MaxSize > 0 {
+				mu.OverMaxSize = d.NewSize+d.ReusedSize > uint64(mu.MaxSize) // #nosec G115 - sizes are never negative
+			}
+		}
+		mu.add(&stats, d)
+		r.Mirrors = append(r.Mirrors, mu)
+		r.Total.add(&stats, d)
+	}
+
+	// Sort mirrors alphabetically by ID for consistent output
+	sort.Slice(r.Mirrors, func(i, j int) bool {
+		return r.Mirrors[i].Mirror < r.Mirrors[j].Mirror
+	})
+
+	// Snapshots are always a .snapshots sibling of the mirror directory
+	dir := filepath.Clean(config.Dir)
+	current := MeasureDiskUsage(dir, filepath.Join(filepath.Dir(dir), ".snapshots")).Size
+	added := int64(r.Total.NewSize)         // #nosec G115 - sizes fit in int64
+	freed := int64(r.Total.FreedSize)       // #nosec G115 - sizes fit in int64
+	snapshot := int64(r.Total.SnapshotSize) // #nosec G115 - sizes fit in int64
+	r.Disk = DiskProjection{
+		Current:       current,
+		Peak:          current + added + snapshot,
+		AfterSync:     current + added - freed,
+		AfterSnapshot: current + added - freed + snapshot,
+	}
+	if available, inodes, err := diskFree(dir); err != nil {
+		slog.Warn("failed to get free space", "dir", dir, "error", err)
+	} else {
+		r.Disk.Available = available
+		r.Disk.AvailableInodes = inodes
+		r.Disk.Fits = added+snapshot <= available && (inodes < 0 || int64(r.Total.NewFiles) <= inodes)
+	}
+	return r
+}
+
+// WriteTable writes a summary of disk usage for all mirrors to w.
+func (r *DryRunReport) WriteTable(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("\n=== Disk Usage Summary (Dry Run) ===\n\n")
+	writeUsage := func(u *UsageReport) {
+		ew.printf("  Release files:  %s\n", FormatBytes(u.ReleaseSize))
+		ew.printf("  Index files:    %s\n", FormatBytes(u.IndexSize))
+		ew.printf("  Package files:  %s\n", FormatBytes(u.PackageSize))
+		ew.printf("  Total size:     %s (%d files)\n", FormatBytes(u.TotalSize), u.Files)
+		ew.printf("  New:            %s (%d files)\n", FormatBytes(u.NewSize), u.NewFiles)
+		ew.printf("  Reused:         %s (%d files)\n", FormatBytes(u.ReusedSize), u.ReusedFiles)
+		ew.printf("  Freed:          %s\n", FormatBytes(u.FreedSize))
+		if u.SnapshotSize > 0 {
+			ew.printf("  Snapshot:       %s\n", FormatBytes(u.SnapshotSize))
+		}
+	}
+	for _, mu := range r.Mirrors {
+		ew.printf("Repository: %s\n", mu.Mirror)
+		writeUsage(&mu.UsageReport)
+		if c := mu.Changes; c != nil {
+			ew.printf("  Packages:       %d added, %d removed, %d upgraded, %d downgraded\n",
+				c.Added, c.Removed, c.Upgraded, c.Downgraded)
+			mu.writeChanges(ew)
+		}
+		if mu.OverMaxSize {
+			ew.printf("  Max size:       %s (exceeded, the sync would fail)\n", formatSize(mu.MaxSize))
+		} else if mu.MaxSize > 0 {
+			ew.printf("  Max size:       %s\n", formatSize(mu.MaxSize))
+		}
+		ew.printf("\n")
+	}
+
+	ew.printf("Total across all repositories:\n")
+	writeUsage(&r.Total)
+	ew.printf("\nProjected disk usage:\n")
+	ew.printf("  Current:        %s\n", formatSize(r.Disk.Current))
+	ew.printf("  During sync:    %s\n", formatSize(r.Disk.Peak))
+	ew.printf("  After sync:     %s\n", formatSize(r.Disk.AfterSync))
+	ew.printf("  After snapshot: %s\n", formatSize(r.Disk.AfterSnapshot))
+	needed := r.Total.NewSize + r.Total.SnapshotSize
+	if needed <= uint64(max(r.Disk.Available, 0)) {
+		ew.printf("  Available:      %s\n", formatSize(r.Disk.Available))
+	} else {
+		ew.printf("  Available:      %s (not enough for the sync)\n", formatSize(r.Disk.Available))
+	}
+	switch inodes := r.Disk.AvailableInodes; {
+	case inodes >= int64(r.Total.NewFiles):
+		ew.printf("  Free inodes:    %d\n", inodes)
+	case inodes >= 0:
+		ew.printf("  Free inodes:    %d (not enough for the sync)\n", inodes)
+	}
+	ew.printf("\nNote: In dry-run mode, index files are downloaded to compare with the current mirrors,\n")
+	ew.printf("but actual package files are not downloaded.\n\n")
+	return ew.err
+}
+
+// writeChanges lists the first added and removed packages of mu.
+func (mu *MirrorUsage) writeChanges(ew *errWriter) {
+	listed, total := 0, 0
+	for _, idx := range mu.Packages {
+		for _, c := range idx.Added {
+			if total++; listed < maxListedChanges {
+				ew.printf("    + %s:%s %s (%s)\n", c.Name, c.Architecture, c.NewVersion, idx.Name())
+				listed++
+			}
+		}
+		for _, c := range idx.Removed {
+			if total++; listed < maxListedChanges {
+				ew.printf("    - %s:%s %s (%s)\n", c.Name, c.Architecture, c.OldVersion, idx.Name())
+				listed++
+			}
+		}
+	}
+	if total > listed {
+		ew.printf("    ... and %d more\n", total-listed)
+	}
+}
+
+// formatSize formats a non-negative byte count.
+func formatSize(n int64) string {
+	if n < 0 {
+		n = 0
+	}
+	return FormatBytes(uint64(n))
+}
+
+// measureDelta compares the files a sync of m would store with the
+// current tree, after a dry run.  items are the package files of the
+// sync, which the dry run does not store.
+func (m *Mirror) measureDelta(items map[string]*apt.FileInfo) {
+	stored := m.storage.infoCopy()
+
+	d := &MirrorUsage{Mirror: m.id}
+	reused := make(map[fileID]bool)
+	for fi := range distinctFiles(stored, items) {
+		var local *apt.FileInfo
+		var fullpath string
+		if m.current != nil {
+			local, fullpath = m.current.Lookup(fi, true)
+		}
+		if local == nil {
+			d.NewSize += fi.Size()
+			d.NewFiles++
+			continue
+		}
+		d.ReusedSize += fi.Size()
+		d.ReusedFiles++
+		if id, ok := inodeOf(fullpath); ok {
+			reused[id] = true
+		}
+	}
+
+	// The previous tree is removed after the sync unless it is a
+	// snapshot.  Its files that are linked elsewhere stay on disk.
+	if m.previous != "" && filepath.Dir(filepath.Dir(m.previous)) == m.dir {
+		x := newLinkIndex(filepath.Dir(m.previous))
+		for id, iu := range x.inodes {
+			if iu.links >= iu.nlink && !reused[id] {
+				d.FreedSize += uint64(iu.size) // #nosec G115 - sizes are never negative
+			}
+		}
+	}
+
+	// Snapshots link the files of the tree, but copy its checksums
+	checksums := make([]*ExportFile, 0, len(stored)+len(items))
+	addChecksum := func(p string, fi *apt.FileInfo) {
+		if sum := fi.SHA256Sum(); sum != nil {
+			checksums = append(checksums, &ExportFile{Path: p, Size: int64(fi.Size()), SHA256: hex.EncodeToString(sum)}) // #nosec G115 - sizes fit in int64
+		}
+	}
+	for p, fi := range stored {
+		addChecksum(p, fi)
+	}
+	for p, fi := range items {
+		if _, ok := stored[p]; !ok {
+			addChecksum(p, fi)
+		}
+	}
+	if data, err := json.MarshalIndent(checksums, "", "  "); err == nil {
+		d.SnapshotSize = uint64(len(data) + 1)
+	}
+
+	indices, err := diffTrees(m.previous, filepath.Join(m.storage.Dir(), m.id))
+	if err != nil {
+		slog.Warn("failed to compare package indices", "repo", m.id, "error", err)
+	} else {
+		d.Changes = &PackageCounts{}
+		for _, idx := range indices {
+			d.Changes.Added += len(idx.Added)
+			d.Changes.Removed += len(idx.Removed)
+			d.Changes.Upgraded += len(idx.Upgraded)
+			d.Changes.Downgraded += len(idx.Downgraded)
+		}
+		d.Packages = indices
+	}
+	m.delta = d
+}
+
+// inodeOf returns the inode of the file at p.
+func inodeOf(p string) (fileID, bool) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return fileID{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: st.Ino}, true // #nosec G115 - device numbers are never negative
+}
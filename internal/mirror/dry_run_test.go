@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// setTestPackages serves a Release and Packages index listing packages,
+// a map of package names to contents, in the suite test of repo.
+func setTestPackages(repo *MockAPTRepository, packages map[string]string) {
+	var index strings.Builder
+	for _, name := range []string{"bar", "baz", "foo"} {
+		content, ok := packages[name]
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256([]byte(content))
+		fmt.Fprintf(&index, "Package: %s\nVersion: 1.0\nArchitecture: amd64\nFilename: pool/%s.deb\nSize: %d\nSHA256: %s\n\n",
+			name, name, len(content), hex.EncodeToString(sum[:]))
+		repo.AddFile("pool/"+name+".deb", content)
+	}
+	sum := sha256.Sum256([]byte(index.String()))
+	repo.AddFile("dists/test/main/binary-amd64/Packages", index.String())
+	repo.AddFile("dists/test/Release", fmt.Sprintf("Suite: test\nArchitectures: amd64\nComponents: main\nSHA256:\n %s %d main/binary-amd64/Packages\n",
+		hex.EncodeToString(sum[:]), index.Len()))
+}
+
+func TestDryRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	repo := NewMockAPTRepository()
+	defer repo.Close()
+	setTestPackages(repo, map[string]string{"foo": "foo-1.0", "bar": "bar-1.0"})
+
+	var u tomlURL
+	if err := u.UnmarshalText([]byte(repo.URL())); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Dir:      t.TempDir(),
+		MaxConns: 5,
+		Mirrors: map[string]*MirrorConfig{"test-mirror": {
+			URL:           u,
+			Suites:        []string{"test"},
+			Sections:      []string{"main"},
+			Architectures: []string{"amd64"},
+		}},
+	}
+	if err := Run(config, nil, true, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// foo is reused, bar removed and baz added
+	setTestPackages(repo, map[string]string{"foo": "foo-1.0", "baz": "baz-1.00"})
+	r, err := DryRun(config, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Mirrors) != 1 {
+		t.Fatalf("unexpected mirrors: %+v", r.Mirrors)
+	}
+	mu := r.Mirrors[0]
+	if mu.ReusedFiles != 1 || mu.ReusedSize != 7 || mu.NewSize != 8+mu.IndexSize+mu.ReleaseSize || mu.NewFiles != 3 {
+		t.Errorf("unexpected delta: %+v", mu.UsageReport)
+	}
+	if mu.FreedSize == 0 {
+		t.Error("expected the previous tree to free space")
+	}
+	if mu.Changes == nil || mu.Changes.Added != 1 || mu.Changes.Removed != 1 ||
+		mu.Packages[0].Added[0].Name != "baz" || mu.Packages[0].Removed[0].Name != "bar" {
+		t.Errorf("unexpected package changes: %+v", mu.Changes)
+	}
+	if mu.SnapshotSize != 0 {
+		t.Error("expected no snapshot without publish_to_staging")
+	}
+
+	d := r.Disk
+	if d.Current == 0 || d.Peak != d.Current+int64(mu.NewSize) || d.AfterSync != d.Peak-int64(mu.FreedSize) || d.AfterSnapshot != d.AfterSync || !d.Fits {
+		t.Errorf("unexpected projection: %+v", d)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"Repository: test-mirror\n",
+		"  Reused:         7 B (1 files)\n",
+		"  Packages:       1 added, 1 removed, 0 upgraded, 0 downgraded\n",
+		"    + baz:amd64 1.0 (test/main/amd64)\n",
+		"    - bar:amd64 1.0 (test/main/amd64)\n",
+		"Projected disk usage:\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+
+	// The dry run leaves the live tree alone
+	if err := Run(config, nil, true, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	r, err = DryRun(config, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mu := r.Mirrors[0]; mu.NewFiles != 0 || mu.ReusedFiles != 4 || mu.Changes.Added+mu.Changes.Removed != 0 {
+		t.Errorf("expected no changes after the sync, got %+v", mu)
+	}
+}
@@ -0,0 +1,345 @@
+package mirror
+
+// This file implements lifecycle hooks, external commands that run
+// when mirrors are synced and when their snapshots are published.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Hook events.
+const (
+	// HookPreSync fires before a mirror is synced.  A failure aborts
+	// the sync.
+	HookPreSync = "pre-sync"
+
+	// HookPostSync fires after a mirror has been synced.
+	HookPostSync = "post-sync"
+
+	// HookPrePublish fires before a snapshot is published, staged,
+	// promoted, rolled back to or deleted.  A failure aborts the action.
+	HookPrePublish = "pre-publish"
+
+	// HookPostPublish fires after a snapshot has been published,
+	// staged, promoted, rolled back to or deleted.
+	HookPostPublish = "post-publish"
+
+	// HookOnFailure fires when any of these actions fails.
+	HookOnFailure = "on-failure"
+)
+
+// hookEvents lists the valid hook events.
+var hookEvents = []string{HookPreSync, HookPostSync, HookPrePublish, HookPostPublish, HookOnFailure}
+
+// Hook actions besides the history actions HistoryPublish, HistoryStage,
+// HistoryPromote, HistoryDelete and HistoryRollback.
+const (
+	HookActionSync     = "sync"
+	HookActionSnapshot = "snapshot"
+)
+
+// defaultHookTimeout limits the run time of hook commands.
+const defaultHookTimeout = 5 * time.Minute
+
+// HookConfig configures a hook, an external command that runs on
+// events.  The command gets the event as JSON on its standard input
+// and in environment variables.
+type HookConfig struct {
+	// Name identifies the hook in messages.  It defaults to the command.
+	Name    string   `toml:"name,omitempty"`
+	Events  []string `toml:"events"`
+	Command []string `toml:"command"`
+	Timeout string   `toml:"timeout,omitempty"`
+}
+
+// name returns the name of the hook.
+func (h *HookConfig) name() string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case len(h.Command) > 0:
+		return filepath.Base(h.Command[0])
+	}
+	return "hook"
+}
+
+// Check validates the hook configuration.
+func (h *HookConfig) Check() error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("hook %s: command is required", h.name())
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("hook %s: events is required", h.name())
+	}
+	for _, e := range h.Events {
+		if !slices.Contains(hookEvents, e) {
+			return fmt.Errorf("hook %s: unknown event %q", h.name(), e)
+		}
+	}
+	if _, err := parseDuration(h.Timeout); err != nil {
+		return fmt.Errorf("hook %s: timeout: %w", h.name(), err)
+	}
+	return nil
+}
+
+// PackageCounts counts the package changes of a sync or publication.
+type PackageCounts struct {
+	Added      int `json:"added"`
+	Removed    int `json:"removed"`
+	Upgraded   int `json:"upgraded"`
+	Downgraded int `json:"downgraded"`
+}
+
+// HookEvent is passed to hook commands.
+type HookEvent struct {
+	Event  string    `json:"event"`
+	Action string    `json:"action"`
+	Mirror string    `json:"mirror"`
+	Time   time.Time `json:"time"`
+
+	// StorageDir is the new storage directory of a sync.
+	StorageDir string `json:"storage_dir,omitempty"`
+
+	// Snapshot is the snapshot that is published or deleted, and
+	// OldSnapshot the one the channel pointed to before.
+	Snapshot     string `json:"snapshot,omitempty"`
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	Channel      string `json:"channel,omitempty"`
+	OldSnapshot  string `json:"old_snapshot,omitempty"`
+
+	// Changes counts the package changes against the previous tree.
+	// It is nil if they are unknown.
+	Changes *PackageCounts `json:"changes,omitempty"`
+
+	// Error is set for HookOnFailure.
+	Error string `json:"error,omitempty"`
+}
+
+// env returns the environment variables describing e.
+func (e *HookEvent) env() []string {
+	env := []string{
+		"MIRRORCTL_EVENT=" + e.Event,
+		"MIRRORCTL_ACTION=" + e.Action,
+		"MIRRORCTL_MIRROR=" + e.Mirror,
+	}
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	add("MIRRORCTL_STORAGE_DIR", e.StorageDir)
+	add("MIRRORCTL_SNAPSHOT", e.Snapshot)
+	add("MIRRORCTL_SNAPSHOT_PATH", e.SnapshotPath)
+	add("MIRRORCTL_CHANNEL", e.Channel)
+	add("MIRRORCTL_OLD_SNAPSHOT", e.OldSnapshot)
+	if c := e.Changes; c != nil {
+		env = append(env,
+			"MIRRORCTL_PACKAGES_ADDED="+strconv.Itoa(c.Added),
+			"MIRRORCTL_PACKAGES_REMOVED="+strconv.Itoa(c.Removed),
+			"MIRRORCTL_PACKAGES_UPGRADED="+strconv.Itoa(c.Upgraded),
+			"MIRRORCTL_PACKAGES_DOWNGRADED="+strconv.Itoa(c.Downgraded),
+		)
+	}
+	add("MIRRORCTL_ERROR", e.Error)
+	return env
+}
+
+// mirrorHooks returns the global hooks followed by the hooks of mc.
+func mirrorHooks(global []*HookConfig, mc *MirrorConfig) []*HookConfig {
+	var hooks []*HookConfig
+	hooks = append(hooks, global...)
+	if mc != nil {
+		hooks = append(hooks, mc.Hooks...)
+	}
+	return hooks
+}
+
+// countChanges counts the package changes between the trees at fromDir
+// and toDir.  An empty fromDir is an empty tree.  It returns nil if the
+// trees cannot be compared.
+func countChanges(fromDir, toDir string) *PackageCounts {
+	indices, err := diffTrees(fromDir, toDir)
+	if err != nil {
+		slog.Warn("failed to count package changes for hooks", "from", fromDir, "to", toDir, "error", err)
+		return nil
+	}
+	c := &PackageCounts{}
+	for _, d := range indices {
+		c.Added += len(d.Added)
+		c.Removed += len(d.Removed)
+		c.Upgraded += len(d.Upgraded)
+		c.Downgraded += len(d.Downgraded)
+	}
+	return c
+}
+
+// runHooks runs the hooks among hooks that fire on event, in order,
+// with e.  Pre-hooks stop at the first failure, which is returned.
+// Failures of other hooks are logged.
+func runHooks(hooks []*HookConfig, event string, e *HookEvent) error {
+	ev := *e
+	ev.Event = event
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		return err
+	}
+
+	pre := event == HookPreSync || event == HookPrePublish
+	for _, h := range hooks {
+		if !slices.Contains(h.Events, event) {
+			continue
+		}
+		slog.Info("running hook", "mirror", ev.Mirror, "event", event, "action", ev.Action, "hook", h.name())
+		err := runHook(h, &ev, data)
+		switch {
+		case err == nil:
+		case pre:
+			return fmt.Errorf("%s hook %s: %w", event, h.name(), err)
+		default:
+			slog.Error("hook failed", "mirror", ev.Mirror, "event", event, "action", ev.Action, "hook", h.name(), "error", err)
+		}
+	}
+	return nil
+}
+
+// runHook runs the command of h with the event e encoded as data.
+func runHook(h *HookConfig, e *HookEvent, data []byte) error {
+	timeout := defaultHookTimeout
+	if h.Timeout != "" {
+		d, err := parseDuration(h.Timeout)
+		if err != nil {
+			return err
+		}
+		timeout = d
+	}
+	return runCommand(h.Command, timeout, "", e.env(), bytes.NewReader(data))
+}
+
+// firesOn reports whether any of hooks fires on one of events.
+func firesOn(hooks []*HookConfig, events ...string) bool {
+	for _, h := range hooks {
+		for _, e := range events {
+			if slices.Contains(h.Events, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithHooks returns a copy of sm that runs the global hooks and the
+// hooks of the mirrors given to WithMirrorConfigs.
+func (sm *SnapshotManager) WithHooks(hooks []*HookConfig) *SnapshotManager {
+	c := *sm
+	c.hooks = hooks
+	return &c
+}
+
+// publishEvent returns the hook event of an action on the snapshot of
+// mirror, which replaces oldSnapshot on channel, or nil if mirror has
+// no hooks and nothing is notified.  Package changes against the tree
+// of the channel are counted for publications.
+func (sm *SnapshotManager) publishEvent(action, mirror, snapshotName, channel, oldSnapshot string) *HookEvent {
+	hooks := mirrorHooks(sm.hooks, sm.mirrors[mirror])
+	if len(hooks) == 0 && sm.notifier == nil {
+		return nil
+	}
+
+	e := &HookEvent{
+		Action:      action,
+		Mirror:      mirror,
+		Snapshot:    snapshotName,
+		Channel:     channel,
+		OldSnapshot: oldSnapshot,
+	}
+	e.SnapshotPath, _ = sm.GetSnapshotPath(mirror, snapshotName)
+	if _, err := os.Stat(e.SnapshotPath); err != nil || channel == "" || (sm.notifier == nil && !firesOn(hooks, HookPrePublish, HookPostPublish)) {
+		return e
+	}
+
+	// The channel may point to a storage directory rather than a
+	// snapshot, or to nothing yet
+	var oldPath string
+	if linkPath, err := sm.GetChannelPath(mirror, channel); err == nil {
+		oldPath, _ = filepath.EvalSymlinks(linkPath)
+	}
+	e.Changes = countChanges(oldPath, e.SnapshotPath)
+	return e
+}
+
+// prePublish runs the pre-publish hooks of e, if any.
+func (sm *SnapshotManager) prePublish(e *HookEvent) error {
+	if e == nil {
+		return nil
+	}
+	return runHooks(mirrorHooks(sm.hooks, sm.mirrors[e.Mirror]), HookPrePublish, e)
+}
+
+// postPublish runs the post-publish hooks of e and sends its
+// notification, or runs the on-failure hooks if the action failed with
+// err.
+func (sm *SnapshotManager) postPublish(e *HookEvent, err error) {
+	if e == nil {
+		return
+	}
+	hooks := mirrorHooks(sm.hooks, sm.mirrors[e.Mirror])
+	if err != nil {
+		f := *e
+		f.Error = err.Error()
+		runHooks(hooks, HookOnFailure, &f) // #nosec G104 - failures are logged
+		return
+	}
+	runHooks(hooks, HookPostPublish, e) // #nosec G104 - failures are logged
+	if sm.notifier == nil {
+		return
+	}
+	if sm.pending != nil {
+		*sm.pending = append(*sm.pending, publishNotification(e))
+		return
+	}
+	sm.notifier.Notify(context.Background(), publishNotification(e))
+}
+
+// runSyncHooks runs the hooks of the sync of m that fire on event.
+// err is the error of a failed sync.
+func (m *Mirror) runSyncHooks(global []*HookConfig, event string, err error) error {
+	hooks := mirrorHooks(global, m.mc)
+	if !firesOn(hooks, event) {
+		return nil
+	}
+
+	return runHooks(hooks, event, m.syncEvent(event, err))
+}
+
+// syncEvent returns the hook event of the sync of m.  Package changes
+// are counted for HookPostSync.
+func (m *Mirror) syncEvent(event string, err error) *HookEvent {
+	e := &HookEvent{Action: HookActionSync, Mirror: m.id, StorageDir: m.storage.Dir()}
+	if event == HookPostSync {
+		e.Changes = m.syncChanges()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// syncChanges counts the package changes of the sync of m once.
+func (m *Mirror) syncChanges() *PackageCounts {
+	if m.changes == nil {
+		m.changes = countChanges(m.previous, filepath.Join(m.storage.Dir(), m.id))
+	}
+	return m.changes
+}
@@ -0,0 +1,149 @@
+package mirror
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readHookLog reads the events written by a hook that appends its
+// standard input to a file.
+func readHookLog(t *testing.T, p string) []*HookEvent {
+	t.Helper()
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []*HookEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &HookEvent{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestSnapshotManager_Hooks(t *testing.T) {
+	tmpDir := t.TempDir()
+	log := filepath.Join(tmpDir, "hooks.log")
+	logHook := &HookConfig{
+		Events:  []string{HookPrePublish, HookPostPublish, HookOnFailure},
+		Command: []string{"sh", "-c", `cat >> "` + log + `" && echo >> "` + log + `"`},
+	}
+	guard := &HookConfig{
+		Name:    "freeze",
+		Events:  []string{HookPrePublish},
+		Command: []string{"sh", "-c", `test "$MIRRORCTL_SNAPSHOT" != frozen || { echo "mirror is frozen" >&2; exit 1; }`},
+	}
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live")).
+		WithMirrorConfigs(map[string]*MirrorConfig{"test-mirror": {Hooks: []*HookConfig{guard}}}).
+		WithHooks([]*HookConfig{logHook})
+
+	writeGateTestSnapshot(t, sm, "s1")
+	writeGateTestSnapshot(t, sm, "frozen")
+	writeGateTestSnapshot(t, sm, "old")
+
+	if err := sm.PublishSnapshot("test-mirror", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	events := readHookLog(t, log)
+	if len(events) != 2 || events[0].Event != HookPrePublish || events[1].Event != HookPostPublish {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	e := events[1]
+	if e.Action != HistoryPublish || e.Mirror != "test-mirror" || e.Snapshot != "s1" || e.Channel != ChannelLive || e.OldSnapshot != "" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e.Changes == nil || e.Changes.Added != 1 {
+		t.Errorf("expected one added package, got %+v", e.Changes)
+	}
+
+	// A failing pre-publish hook aborts the publication
+	err := sm.PublishSnapshot("test-mirror", "frozen")
+	if err == nil || !strings.Contains(err.Error(), "pre-publish hook freeze") || !strings.Contains(err.Error(), "mirror is frozen") {
+		t.Fatalf("expected the hook to abort, got %v", err)
+	}
+	if current, _ := sm.GetCurrentlyPublished("test-mirror"); current != "s1" {
+		t.Errorf("expected s1 to stay live, got %s", current)
+	}
+	events = readHookLog(t, log)[2:]
+	if len(events) != 2 || events[1].Event != HookOnFailure || events[1].OldSnapshot != "s1" || !strings.Contains(events[1].Error, "mirror is frozen") {
+		t.Errorf("unexpected events: %+v", events)
+	}
+	if c := events[0].Changes; c == nil || *c != (PackageCounts{}) {
+		t.Errorf("expected no package changes, got %+v", c)
+	}
+
+	if err := sm.DeleteSnapshot("test-mirror", "old", false); err != nil {
+		t.Fatal(err)
+	}
+	events = readHookLog(t, log)[4:]
+	if len(events) != 2 || events[1].Event != HookPostPublish || events[1].Action != HistoryDelete || events[1].Snapshot != "old" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestMirror_SyncHooks(t *testing.T) {
+	tmpDir := t.TempDir()
+	storage, err := NewStorage(tmpDir, "test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpDir, "env")
+	hook := &HookConfig{
+		Events:  []string{HookPreSync, HookPostSync},
+		Command: []string{"sh", "-c", `echo "$MIRRORCTL_EVENT $MIRRORCTL_MIRROR $MIRRORCTL_STORAGE_DIR $MIRRORCTL_PACKAGES_ADDED" >> "` + out + `"; test "$MIRRORCTL_EVENT" != pre-sync`},
+	}
+	m := &Mirror{id: "test-mirror", mc: &MirrorConfig{Hooks: []*HookConfig{hook}}, storage: storage}
+	writeTestFile(t, filepath.Join(tmpDir, "test-mirror/dists/noble/main/binary-amd64/Packages"),
+		[]byte("Package: foo\nVersion: 1.0\nArchitecture: amd64\nFilename: pool/f/foo.deb\nSize: 3\n\n"))
+
+	if err := m.runSyncHooks(nil, HookPreSync, nil); err == nil {
+		t.Error("expected the failing pre-sync hook to return an error")
+	}
+	if err := m.runSyncHooks(nil, HookPostSync, nil); err != nil {
+		t.Error(err)
+	}
+	if err := m.runSyncHooks(nil, HookOnFailure, os.ErrClosed); err != nil {
+		t.Error(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pre-sync test-mirror " + tmpDir + " \npost-sync test-mirror " + tmpDir + " 1\n"
+	if string(data) != want {
+		t.Errorf("unexpected hook output:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestHookConfig_Check(t *testing.T) {
+	tests := []struct {
+		name  string
+		hook  HookConfig
+		valid bool
+	}{
+		{"valid", HookConfig{Events: []string{HookPostSync, HookOnFailure}, Command: []string{"true"}, Timeout: "30s"}, true},
+		{"no command", HookConfig{Events: []string{HookPostSync}}, false},
+		{"no events", HookConfig{Command: []string{"true"}}, false},
+		{"unknown event", HookConfig{Events: []string{"post-prune"}, Command: []string{"true"}}, false},
+		{"bad timeout", HookConfig{Events: []string{HookPreSync}, Command: []string{"true"}, Timeout: "later"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.hook.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
@@ -180,6 +180,18 @@ func TestMirrorUpdateCycle(t *testing.T) {
 		}
 	}
 
+	// Verify the sync record
+	record, err := loadSyncRecord(mirror.storage.Dir())
+	if err != nil {
+		t.Fatal("Failed to load sync record:", err)
+	}
+	if !record.StartedAt.Equal(timestamp.UTC()) || record.FinishedAt.Before(record.StartedAt) {
+		t.Errorf("Unexpected sync times: %v - %v", record.StartedAt, record.FinishedAt)
+	}
+	if sr := record.Suites["test"]; sr == nil || sr.Date != "Wed, 15 Mar 2023 12:00:00 UTC" {
+		t.Errorf("Unexpected suite release info: %+v", record.Suites)
+	}
+
 	// Verify request count
 	requestCount := mockRepo.RequestCount()
 	if requestCount == 0 {
@@ -2,7 +2,6 @@ package mirror
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"os"
 	"path"
@@ -124,6 +123,19 @@ type Mirror struct {
 	quiet      bool
 	dryRun     bool
 	usageStats *UsageStats
+	record     *SyncRecord
+
+	// previous is the tree the symlink pointed to before the sync
+	previous string
+
+	// changes caches the package changes of the sync; see syncChanges
+	changes *PackageCounts
+
+	// delta is what the sync changes, measured by dry runs
+	delta *MirrorUsage
+
+	// budget is shared by the mirrors synced together; see preflight
+	budget *diskBudget
 }
 
 // NewMirror constructs a Mirror for given mirror id.
@@ -198,6 +210,10 @@ func NewMirror(timestamp time.Time, mirrorID string, config *Config, noPGPCheck,
 		quiet:      quiet,
 		dryRun:     dryRun,
 		usageStats: &UsageStats{},
+		record:     &SyncRecord{StartedAt: timestamp.UTC()},
+	}
+	if currentStorage != nil {
+		mirror.previous = currentDir
 	}
 	return mirror, nil
 }
@@ -229,17 +245,6 @@ func (m *Mirror) UsageStats() UsageStats {
 	return m.usageStats.GetStats()
 }
 
-// PrintUsageStats prints usage statistics for this mirror.
-func (m *Mirror) PrintUsageStats() {
-	stats := m.usageStats.GetStats()
-	fmt.Printf("Repository: %s\n", m.id)
-	fmt.Printf("  Release files:  %s\n", formatBytes(stats.ReleaseFiles))
-	fmt.Printf("  Index files:    %s\n", formatBytes(stats.IndexFiles))
-	fmt.Printf("  Package files:  %s\n", formatBytes(stats.PackageFiles))
-	fmt.Printf("  Total size:     %s (%d files)\n", formatBytes(stats.Total), stats.FileCount)
-	fmt.Println()
-}
-
 // Update synchronizes the mirror with the upstream repository.
 //
 // Process flow:
@@ -255,8 +260,9 @@ func (m *Mirror) PrintUsageStats() {
 // The entire process is atomic - the old mirror remains accessible until
 // the new one is complete and the symlink is updated.
 //
-// In dry-run mode, downloads index files to calculate sizes but skips
-// actual package downloads and storage operations.
+// In dry-run mode, downloads index files to calculate sizes and compare
+// them with the current tree, but skips actual package downloads and
+// storage operations.
 func (m *Mirror) Update(ctx context.Context) error {
 	itemMap := make(map[string]*apt.FileInfo)
 
@@ -272,12 +278,39 @@ func (m *Mirror) Update(ctx context.Context) error {
 
 	if m.dryRun {
 		// In dry-run mode, skip storage operations
+		m.measureDelta(itemMap)
 		return nil
 	}
 
+	// Indices of later suites may have pushed the tree past max_size
+	if err := m.checkMaxSize(nil); err != nil {
+		return err
+	}
+
+	// Keep by-hash files of the previous generations for clients
+	// that fetched InRelease just before the switch
+	if m.current != nil && m.mc.ByHashGenerations > 0 {
+		grace, err := parseDuration(m.mc.ByHashGracePeriod)
+		if err != nil {
+			return errors.Wrap(err, m.id)
+		}
+		n, err := m.storage.CarryForwardByHash(m.current, m.mc.ByHashGenerations, grace, time.Now())
+		if err != nil {
+			return errors.Wrap(err, m.id)
+		}
+		slog.Info("kept by-hash files of previous generations", "repo", m.id, "files", n)
+	}
+
+	// Record the provenance of this sync for snapshots
+	m.record.FinishedAt = time.Now().UTC()
+	err := m.record.save(m.storage.Dir())
+	if err != nil {
+		return errors.Wrap(err, m.id)
+	}
+
 	// Phase 2: Persist metadata for future incremental updates
 	// all files are downloaded (or reused)
-	err := m.storage.Save()
+	err = m.storage.Save()
 	if err != nil {
 		return errors.Wrap(err, m.id)
 	}
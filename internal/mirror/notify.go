@@ -0,0 +1,532 @@
+package mirror
+
+// This file implements notifications to HTTP webhooks.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification events.
+const (
+	NotifySyncSucceeded     = "sync-succeeded"
+	NotifySyncFailed        = "sync-failed"
+	NotifySnapshotStaged    = "snapshot-staged"
+	NotifySnapshotPublished = "snapshot-published"
+	NotifySnapshotPromoted  = "snapshot-promoted"
+
+	// NotifyKeyExpiry warns that the pgp_key_path of a mirror has
+	// expired or expires within key_expiry_warning.
+	NotifyKeyExpiry = "key-expiry"
+
+	// NotifyDiskSpace warns that the free space of the filesystem
+	// holding dir is below min_free_space after a sync.
+	NotifyDiskSpace = "disk-space"
+)
+
+// notifyEvents lists the valid notification events.
+var notifyEvents = []string{
+	NotifySyncSucceeded, NotifySyncFailed,
+	NotifySnapshotStaged, NotifySnapshotPublished, NotifySnapshotPromoted,
+	NotifyKeyExpiry, NotifyDiskSpace,
+}
+
+// Webhook payload formats.
+const (
+	// WebhookJSON posts the Notification as JSON.
+	WebhookJSON = "json"
+
+	// WebhookSlack posts a Slack-compatible message.
+	WebhookSlack = "slack"
+
+	// WebhookTeams posts a Microsoft Teams message card.
+	WebhookTeams = "teams"
+)
+
+// Webhook request headers.
+const (
+	webhookEventHeader     = "X-Mirrorctl-Event"
+	webhookTimestampHeader = "X-Mirrorctl-Timestamp"
+	webhookSignatureHeader = "X-Mirrorctl-Signature"
+)
+
+const (
+	// defaultWebhookTimeout limits each delivery attempt.
+	defaultWebhookTimeout = 10 * time.Second
+
+	// defaultWebhookAttempts is the number of delivery attempts.
+	defaultWebhookAttempts = 4
+
+	// defaultWebhookBackoff is the delay before the first retry.  It
+	// doubles with every attempt, up to maxWebhookBackoff.
+	defaultWebhookBackoff = time.Second
+	maxWebhookBackoff     = time.Minute
+
+	// defaultKeyExpiryWarning is how long before the expiry of a key
+	// NotifyKeyExpiry is sent.
+	defaultKeyExpiryWarning = 30 * 24 * time.Hour
+)
+
+// NotifyConfig configures notifications.
+type NotifyConfig struct {
+	// KeyExpiryWarning is how long before the expiry of the
+	// pgp_key_path of a mirror to warn about it.  Defaults to "30d".
+	KeyExpiryWarning string `toml:"key_expiry_warning,omitempty"`
+
+	// MinFreeSpace is the free space of the filesystem holding dir
+	// below which to warn after a sync, such as "50GiB".
+	MinFreeSpace string `toml:"min_free_space,omitempty"`
+
+	Webhooks []*WebhookConfig `toml:"webhooks"`
+}
+
+// Check validates the notification configuration.
+func (c *NotifyConfig) Check() error {
+	if _, err := parseDuration(c.KeyExpiryWarning); err != nil {
+		return fmt.Errorf("notify.key_expiry_warning: %w", err)
+	}
+	if _, err := parseSize(c.MinFreeSpace); err != nil {
+		return fmt.Errorf("notify.min_free_space: %w", err)
+	}
+	for _, w := range c.Webhooks {
+		if err := w.Check(); err != nil {
+			return fmt.Errorf("notify: %w", err)
+		}
+	}
+	return nil
+}
+
+// WebhookConfig configures an HTTP webhook.
+type WebhookConfig struct {
+	// Name identifies the webhook in messages.  It defaults to the
+	// host of the URL.
+	Name   string `toml:"name,omitempty"`
+	URL    string `toml:"url"`
+	Format string `toml:"format,omitempty"`
+
+	// Events and Mirrors restrict the notifications sent.  By default,
+	// all are sent.
+	Events  []string `toml:"events,omitempty"`
+	Mirrors []string `toml:"mirrors,omitempty"`
+
+	// Secret, or the environment variable SecretEnv, is the key of the
+	// HMAC-SHA256 signature of the payload.
+	Secret    string `toml:"secret,omitempty"`
+	SecretEnv string `toml:"secret_env,omitempty"`
+
+	// Timeout limits each attempt; MaxAttempts limits the attempts.
+	Timeout     string `toml:"timeout,omitempty"`
+	MaxAttempts int    `toml:"max_attempts,omitempty"`
+}
+
+// name returns the name of the webhook.
+func (w *WebhookConfig) name() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	if u, err := url.Parse(w.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "webhook"
+}
+
+// Check validates the webhook configuration.
+func (w *WebhookConfig) Check() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %s: url must be an http or https URL", w.name())
+	}
+	switch w.Format {
+	case "", WebhookJSON, WebhookSlack, WebhookTeams:
+	default:
+		return fmt.Errorf("webhook %s: unknown format %q", w.name(), w.Format)
+	}
+	for _, e := range w.Events {
+		if !slices.Contains(notifyEvents, e) {
+			return fmt.Errorf("webhook %s: unknown event %q", w.name(), e)
+		}
+	}
+	if _, err := parseDuration(w.Timeout); err != nil {
+		return fmt.Errorf("webhook %s: timeout: %w", w.name(), err)
+	}
+	if w.MaxAttempts < 0 {
+		return fmt.Errorf("webhook %s: max_attempts must not be negative", w.name())
+	}
+	return nil
+}
+
+// wants reports whether the webhook receives nt.
+func (w *WebhookConfig) wants(nt *Notification) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, nt.Event) {
+		return false
+	}
+	return len(w.Mirrors) == 0 || nt.Mirror == "" || slices.Contains(w.Mirrors, nt.Mirror)
+}
+
+// secret returns the signing key of the webhook, or nil.
+func (w *WebhookConfig) secret() []byte {
+	if w.SecretEnv != "" {
+		if s := os.Getenv(w.SecretEnv); s != "" {
+			return []byte(s)
+		}
+	}
+	if w.Secret != "" {
+		return []byte(w.Secret)
+	}
+	return nil
+}
+
+// Notification is sent to webhooks.  Webhooks in the json format get
+// it as is.
+type Notification struct {
+	Event   string    `json:"event"`
+	Mirror  string    `json:"mirror,omitempty"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+
+	StorageDir string         `json:"storage_dir,omitempty"`
+	Snapshot   string         `json:"snapshot,omitempty"`
+	Channel    string         `json:"channel,omitempty"`
+	Changes    *PackageCounts `json:"changes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+
+	// KeyPath and KeyExpired describe NotifyKeyExpiry
+	KeyPath    string `json:"key_path,omitempty"`
+	KeyExpired bool   `json:"key_expired,omitempty"`
+
+	// FreeSpace and MinFreeSpace describe NotifyDiskSpace, in bytes
+	FreeSpace    int64 `json:"free_space,omitempty"`
+	MinFreeSpace int64 `json:"min_free_space,omitempty"`
+}
+
+// warning reports whether nt reports a problem.
+func (nt *Notification) warning() bool {
+	switch nt.Event {
+	case NotifySyncFailed, NotifyKeyExpiry, NotifyDiskSpace:
+		return true
+	}
+	return false
+}
+
+// changesText describes c for messages.
+func changesText(c *PackageCounts) string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%d added, %d removed, %d upgraded, %d downgraded)", c.Added, c.Removed, c.Upgraded, c.Downgraded)
+}
+
+// syncNotification returns the notification of the sync described by
+// e, which failed if e.Error is set.
+func syncNotification(e *HookEvent) *Notification {
+	nt := &Notification{
+		Event:      NotifySyncSucceeded,
+		Mirror:     e.Mirror,
+		StorageDir: e.StorageDir,
+		Changes:    e.Changes,
+		Message:    fmt.Sprintf("mirrorctl: sync of %s succeeded%s", e.Mirror, changesText(e.Changes)),
+	}
+	if e.Error != "" {
+		nt.Event = NotifySyncFailed
+		nt.Error = e.Error
+		nt.Changes = nil
+		nt.Message = fmt.Sprintf("mirrorctl: sync of %s failed: %s", e.Mirror, e.Error)
+	}
+	return nt
+}
+
+// publishNotification returns the notification of a successful
+// publication described by e, or nil if it is not notified.
+func publishNotification(e *HookEvent) *Notification {
+	nt := &Notification{
+		Mirror:   e.Mirror,
+		Snapshot: e.Snapshot,
+		Channel:  e.Channel,
+		Changes:  e.Changes,
+	}
+	switch e.Action {
+	case HistoryStage:
+		nt.Event = NotifySnapshotStaged
+		nt.Message = fmt.Sprintf("mirrorctl: snapshot %s of %s staged%s", e.Snapshot, e.Mirror, changesText(e.Changes))
+	case HistoryPromote:
+		nt.Event = NotifySnapshotPromoted
+		nt.Message = fmt.Sprintf("mirrorctl: snapshot %s of %s promoted to %s%s", e.Snapshot, e.Mirror, e.Channel, changesText(e.Changes))
+	case HistoryPublish, HistoryRollback:
+		nt.Event = NotifySnapshotPublished
+		nt.Message = fmt.Sprintf("mirrorctl: snapshot %s of %s published to %s%s", e.Snapshot, e.Mirror, e.Channel, changesText(e.Changes))
+	default:
+		return nil
+	}
+	return nt
+}
+
+// Notifier delivers notifications to webhooks.  A nil *Notifier
+// delivers nothing.
+type Notifier struct {
+	config  *NotifyConfig
+	client  *http.Client
+	backoff time.Duration
+}
+
+// NewNotifier returns a Notifier for config that connects with the
+// TLS configuration and proxy settings used for mirrors, or nil if no
+// webhooks are configured.
+func NewNotifier(config *NotifyConfig, tlsConfig *TLSConfig) *Notifier {
+	if config == nil || len(config.Webhooks) == 0 {
+		return nil
+	}
+	return &Notifier{
+		config:  config,
+		client:  clonedTransport(tlsConfig),
+		backoff: defaultWebhookBackoff,
+	}
+}
+
+// Notify delivers nts to the webhooks that want them.  Nil
+// notifications are skipped.  Failures are logged, and deliveries stop
+// when ctx is done.
+func (n *Notifier) Notify(ctx context.Context, nts ...*Notification) {
+	if n == nil {
+		return
+	}
+	for _, nt := range nts {
+		if nt == nil {
+			continue
+		}
+		if nt.Time.IsZero() {
+			nt.Time = time.Now().UTC()
+		}
+		for _, w := range n.config.Webhooks {
+			if !w.wants(nt) {
+				continue
+			}
+			if err := n.deliver(ctx, w, nt); err != nil {
+				slog.Error("failed to deliver webhook", "webhook", w.name(), "event", nt.Event, "mirror", nt.Mirror, "error", err)
+			}
+		}
+	}
+}
+
+// deliver posts nt to w, retrying with exponential backoff on network
+// errors, 429 and 5xx responses, until ctx is done.
+func (n *Notifier) deliver(ctx context.Context, w *WebhookConfig, nt *Notification) error {
+	body, err := webhookPayload(w.Format, nt)
+	if err != nil {
+		return err
+	}
+	timeout := defaultWebhookTimeout
+	if w.Timeout != "" {
+		if timeout, err = parseDuration(w.Timeout); err != nil {
+			return err
+		}
+	}
+	attempts := w.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultWebhookAttempts
+	}
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, delay, err := n.post(ctx, w, nt.Event, body, timeout)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= attempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+		if delay == 0 {
+			delay = backoff
+			backoff = min(2*backoff, maxWebhookBackoff)
+		}
+		slog.Warn("webhook delivery failed, retrying", "webhook", w.name(), "event", nt.Event, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("attempt %d: %w", attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// post makes a single delivery attempt.  It returns whether the attempt
+// may be retried, and the delay requested by the receiver.
+func (n *Notifier) post(ctx context.Context, w *WebhookConfig, event string, body []byte, timeout time.Duration) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mirrorctl/"+Version)
+	req.Header.Set(webhookEventHeader, event)
+	if secret := w.secret(); secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, "sha256="+SignWebhookPayload(secret, ts, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // #nosec G104 - drain for connection reuse
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var delay time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			delay = min(time.Duration(s)*time.Second, maxWebhookBackoff)
+		}
+		return true, delay, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, 0, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// SignWebhookPayload returns the hex-encoded HMAC-SHA256 of the
+// timestamp, a dot and the body, as sent in the X-Mirrorctl-Signature
+// header.  Receivers recompute it to authenticate deliveries, and
+// check the X-Mirrorctl-Timestamp header against replays.
+func SignWebhookPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// slackMessage is the payload of Slack-compatible incoming webhooks.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// teamsMessageCard is the payload of Microsoft Teams incoming webhooks.
+type teamsMessageCard struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	ThemeColor string `json:"themeColor"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+// webhookPayload encodes nt in format.
+func webhookPayload(format string, nt *Notification) ([]byte, error) {
+	switch format {
+	case WebhookSlack:
+		return json.Marshal(&slackMessage{Text: nt.Message})
+	case WebhookTeams:
+		color := "2EB886"
+		if nt.warning() {
+			color = "D9534F"
+		}
+		return json.Marshal(&teamsMessageCard{
+			Type:       "MessageCard",
+			Context:    "https://schema.org/extensions",
+			Summary:    nt.Message,
+			ThemeColor: color,
+			Title:      "mirrorctl: " + nt.Event,
+			Text:       nt.Message,
+		})
+	}
+	return json.Marshal(nt)
+}
+
+// checkKeyExpiry returns a NotifyKeyExpiry notification if the key at
+// keyPath of mirror has expired or expires within warning of now, or
+// nil.
+func checkKeyExpiry(mirror, keyPath string, warning time.Duration, now time.Time) (*Notification, error) {
+	key, err := loadPGPKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	nt := &Notification{Event: NotifyKeyExpiry, Mirror: mirror, KeyPath: keyPath}
+	switch {
+	case key.IsExpired(now.Unix()):
+		nt.KeyExpired = true
+		nt.Message = fmt.Sprintf("mirrorctl: the PGP key %s of %s has expired", keyPath, mirror)
+	case key.IsExpired(now.Add(warning).Unix()):
+		nt.Message = fmt.Sprintf("mirrorctl: the PGP key %s of %s expires within %s", keyPath, mirror, strings.TrimSuffix(warning.String(), "0m0s"))
+	default:
+		return nil, nil
+	}
+	return nt, nil
+}
+
+// WithNotifier returns a copy of sm that sends notifications of
+// publications with n.
+func (sm *SnapshotManager) WithNotifier(n *Notifier) *SnapshotManager {
+	c := *sm
+	c.notifier = n
+	return &c
+}
+
+// WithPendingNotifications returns a copy of sm that appends the
+// notifications of publications to pending rather than sending them,
+// for callers that hold the lock.
+func (sm *SnapshotManager) WithPendingNotifications(pending *[]*Notification) *SnapshotManager {
+	c := *sm
+	c.pending = pending
+	return &c
+}
+
+// keyExpiryNotification returns a warning about the pgp_key_path of m
+// if it expires soon, or nil.
+func (n *Notifier) keyExpiryNotification(m *Mirror) *Notification {
+	if n == nil || m.mc.PGPKeyPath == "" || m.mc.NoPGPCheck || m.noPGPCheck {
+		return nil
+	}
+	warning := defaultKeyExpiryWarning
+	if n.config.KeyExpiryWarning != "" {
+		warning, _ = parseDuration(n.config.KeyExpiryWarning)
+	}
+	nt, err := checkKeyExpiry(m.id, m.mc.PGPKeyPath, warning, time.Now())
+	if err != nil {
+		slog.Warn("failed to check PGP key expiry", "repo", m.id, "error", err)
+		return nil
+	}
+	return nt
+}
+
+// diskSpaceNotification returns a warning if the free space of the
+// filesystem holding dir is below min_free_space, or nil.
+func (n *Notifier) diskSpaceNotification(dir string) *Notification {
+	if n == nil || n.config.MinFreeSpace == "" {
+		return nil
+	}
+	limit, err := parseSize(n.config.MinFreeSpace)
+	if err != nil {
+		return nil
+	}
+	free, err := availableSpace(dir)
+	if err != nil {
+		slog.Warn("failed to check free space", "dir", dir, "error", err)
+		return nil
+	}
+	if free >= limit {
+		return nil
+	}
+	return &Notification{
+		Event:        NotifyDiskSpace,
+		FreeSpace:    free,
+		MinFreeSpace: limit,
+		Message:      fmt.Sprintf("mirrorctl: only %s free in %s, below %s", FormatBytes(uint64(free)), dir, n.config.MinFreeSpace), // #nosec G115 - free is not negative
+	}
+}
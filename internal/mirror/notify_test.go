@@ -0,0 +1,222 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// webhookRequest is a request received by a test webhook.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver starts a test webhook that fails the first failures
+// requests with 500.
+func webhookReceiver(t *testing.T, failures int) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, webhookRequest{r.Header.Clone(), body})
+		if len(received) <= failures {
+			http.Error(w, "try again", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), received...)
+	}
+}
+
+func TestNotifier_SignedDeliveryWithRetries(t *testing.T) {
+	srv, received := webhookReceiver(t, 2)
+	n := NewNotifier(&NotifyConfig{Webhooks: []*WebhookConfig{{URL: srv.URL, Secret: "s3cret"}}}, &TLSConfig{})
+	n.backoff = time.Millisecond
+
+	n.Notify(context.Background(), syncNotification(&HookEvent{Mirror: "test-mirror", Changes: &PackageCounts{Added: 2}}))
+	reqs := received()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 2 retries, got %d requests", len(reqs))
+	}
+
+	r := reqs[2]
+	if r.header.Get(webhookEventHeader) != NotifySyncSucceeded {
+		t.Errorf("unexpected event header %q", r.header.Get(webhookEventHeader))
+	}
+	want := "sha256=" + SignWebhookPayload([]byte("s3cret"), r.header.Get(webhookTimestampHeader), r.body)
+	if got := r.header.Get(webhookSignatureHeader); got != want {
+		t.Errorf("unexpected signature %q, want %q", got, want)
+	}
+	var nt Notification
+	if err := json.Unmarshal(r.body, &nt); err != nil {
+		t.Fatal(err)
+	}
+	if nt.Event != NotifySyncSucceeded || nt.Mirror != "test-mirror" || nt.Changes == nil || nt.Changes.Added != 2 || nt.Time.IsZero() {
+		t.Errorf("unexpected notification: %+v", nt)
+	}
+
+	// Client errors are not retried
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+	if err := n.deliver(context.Background(), &WebhookConfig{URL: gone.URL}, &nt); err == nil || !strings.Contains(err.Error(), "attempt 1:") {
+		t.Errorf("expected a single failed attempt, got %v", err)
+	}
+}
+
+func TestNotifier_DeliveryCanceled(t *testing.T) {
+	srv, received := webhookReceiver(t, 100)
+	n := NewNotifier(&NotifyConfig{Webhooks: []*WebhookConfig{{URL: srv.URL}}}, &TLSConfig{})
+	n.backoff = time.Hour
+
+	// The backoff is cut short when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := n.deliver(ctx, n.config.Webhooks[0], syncNotification(&HookEvent{Mirror: "test-mirror"}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("delivery took %s", d)
+	}
+	if reqs := received(); len(reqs) != 1 {
+		t.Errorf("expected 1 request, got %d", len(reqs))
+	}
+}
+
+func TestNotifier_FormatsAndFilters(t *testing.T) {
+	slack, slackReceived := webhookReceiver(t, 0)
+	teams, teamsReceived := webhookReceiver(t, 0)
+	n := NewNotifier(&NotifyConfig{Webhooks: []*WebhookConfig{
+		{URL: slack.URL, Format: WebhookSlack, Events: []string{NotifySyncFailed}},
+		{URL: teams.URL, Format: WebhookTeams, Mirrors: []string{"other"}},
+	}}, &TLSConfig{})
+
+	n.Notify(context.Background(), syncNotification(&HookEvent{Mirror: "test-mirror"}))
+	n.Notify(context.Background(), syncNotification(&HookEvent{Mirror: "test-mirror", Error: "connection refused"}))
+	n.Notify(context.Background(), syncNotification(&HookEvent{Mirror: "other", Error: "connection refused"}))
+
+	reqs := slackReceived()
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 slack messages, got %d", len(reqs))
+	}
+	var msg slackMessage
+	if err := json.Unmarshal(reqs[0].body, &msg); err != nil || !strings.Contains(msg.Text, "sync of test-mirror failed: connection refused") {
+		t.Errorf("unexpected slack message: %s", reqs[0].body)
+	}
+	if reqs[0].header.Get(webhookSignatureHeader) != "" {
+		t.Error("expected no signature without a secret")
+	}
+
+	reqs = teamsReceived()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 teams message, got %d", len(reqs))
+	}
+	var card teamsMessageCard
+	if err := json.Unmarshal(reqs[0].body, &card); err != nil || card.Type != "MessageCard" || card.Title != "mirrorctl: "+NotifySyncFailed || card.ThemeColor != "D9534F" {
+		t.Errorf("unexpected teams message: %s", reqs[0].body)
+	}
+}
+
+func TestSnapshotManager_Notifications(t *testing.T) {
+	srv, received := webhookReceiver(t, 0)
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live")).
+		WithNotifier(NewNotifier(&NotifyConfig{Webhooks: []*WebhookConfig{{URL: srv.URL}}}, &TLSConfig{}))
+	writeGateTestSnapshot(t, sm, "s1")
+
+	if err := sm.PublishSnapshotToStaging("test-mirror", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.PublishSnapshot("test-mirror", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.DeleteSnapshot("test-mirror", "s1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for _, r := range received() {
+		var nt Notification
+		if err := json.Unmarshal(r.body, &nt); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, nt.Event)
+		if nt.Snapshot != "s1" || nt.Changes == nil || nt.Changes.Added != 1 {
+			t.Errorf("unexpected notification: %+v", nt)
+		}
+	}
+	if strings.Join(events, " ") != NotifySnapshotStaged+" "+NotifySnapshotPublished {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestCheckKeyExpiry(t *testing.T) {
+	now := time.Now()
+	key, err := crypto.PGP().KeyGeneration().
+		AddUserId("test", "test@example.com").
+		GenerationTime(now.Unix()).
+		Lifetime(int32((10 * 24 * time.Hour).Seconds())).
+		New().GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := key.GetArmoredPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "key.asc")
+	if err := os.WriteFile(p, []byte(armored), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if nt, err := checkKeyExpiry("test-mirror", p, 24*time.Hour, now); err != nil || nt != nil {
+		t.Errorf("expected no warning, got %+v, %v", nt, err)
+	}
+	nt, err := checkKeyExpiry("test-mirror", p, 30*24*time.Hour, now)
+	if err != nil || nt == nil || nt.Event != NotifyKeyExpiry || nt.KeyExpired || !strings.Contains(nt.Message, "expires within 720h") {
+		t.Errorf("expected an expiry warning, got %+v, %v", nt, err)
+	}
+	nt, err = checkKeyExpiry("test-mirror", p, 0, now.Add(11*24*time.Hour))
+	if err != nil || nt == nil || !nt.KeyExpired {
+		t.Errorf("expected the key to have expired, got %+v, %v", nt, err)
+	}
+}
+
+func TestNotifyConfig_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		config NotifyConfig
+		valid  bool
+	}{
+		{"valid", NotifyConfig{KeyExpiryWarning: "14d", MinFreeSpace: "50GiB", Webhooks: []*WebhookConfig{{URL: "https://hooks.example.com/x", Format: WebhookTeams, Events: []string{NotifyDiskSpace}}}}, true},
+		{"bad url", NotifyConfig{Webhooks: []*WebhookConfig{{URL: "ftp://example.com"}}}, false},
+		{"bad format", NotifyConfig{Webhooks: []*WebhookConfig{{URL: "https://example.com", Format: "xml"}}}, false},
+		{"bad event", NotifyConfig{Webhooks: []*WebhookConfig{{URL: "https://example.com", Events: []string{"sync"}}}}, false},
+		{"bad size", NotifyConfig{MinFreeSpace: "lots"}, false},
+		{"bad warning", NotifyConfig{KeyExpiryWarning: "soon"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
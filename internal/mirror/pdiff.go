@@ -0,0 +1,301 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// pdiffTarget returns the uncompressed index listed in Release that the
+// variants in g can be updated to with PDiff patches, or nil if the
+// repository does not provide PDiff for the index.
+func (ap *APTParser) pdiffTarget(g [][]*apt.FileInfo, indexMap map[string][]*apt.FileInfo) *apt.FileInfo {
+	key := apt.TrimCompressionExt(g[0][0].Path())
+
+	var found bool
+	for _, v := range g {
+		if v[0].Path() == key {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	diffIndex := path.Join(apt.PDiffDir(key), "Index")
+	if len(indexMap[diffIndex]) == 0 || !ap.wantIndex(diffIndex) {
+		return nil
+	}
+
+	for _, fi := range indexMap[key] {
+		if fi.SHA256Path() != "" {
+			return fi
+		}
+	}
+	return nil
+}
+
+// downloadPatchable downloads indices that can be updated with PDiff.
+//
+// For each group, the index is first patched from a past version in
+// the current storage.  The compressed variants are then not
+// downloaded, as that would cost more than the patches save: clients
+// that request them get 404 and fall back to the uncompressed index
+// listed in Release, and apt clients holding a past version use the
+// patches.  Otherwise the preferred variant is downloaded as usual,
+// and the uncompressed index is stored as well so that the next update
+// can patch it.  Either way, every patch listed in the PDiff Index is
+// mirrored so that clients can update from any past version.
+// downloaded lists the indices downloaded so far, which include the
+// PDiff Index files.
+//
+// With all_index_variants, each variant is a group of its own, so the
+// compressed variants are still downloaded in full.
+func (ap *APTParser) downloadPatchable(ctx context.Context, httpClient *HTTPClient,
+	groups [][][]*apt.FileInfo, indexMap map[string][]*apt.FileInfo,
+	downloaded []*apt.FileInfo, byhash bool) ([]*apt.FileInfo, error) {
+
+	got := make(map[string]*apt.FileInfo, len(downloaded))
+	for _, fi := range downloaded {
+		got[fi.Path()] = fi
+	}
+
+	var indices []*apt.FileInfo
+	var fallback [][][]*apt.FileInfo
+	targets := make(map[string]*apt.FileInfo)
+	for _, g := range groups {
+		target := ap.pdiffTarget(g, indexMap)
+		idx := ap.readPDiffIndex(got[path.Join(apt.PDiffDir(target.Path()), "Index")], byhash)
+
+		var patches []*apt.FileInfo
+		if idx != nil {
+			var err error
+			patches, err = httpClient.downloadIndicesFiles(ctx, ap.config, idx.Downloads(), true, byhash)
+			if err != nil {
+				return nil, err
+			}
+			indices = append(indices, patches...)
+		}
+
+		fi, applied := ap.patchIndex(httpClient, target, idx, patches, byhash)
+		if fi != nil {
+			slog.Info("updated index with PDiff", "repo", ap.mirrorID, "path", fi.Path(), "patches", applied)
+			indices = append(indices, fi)
+			continue
+		}
+
+		targets[target.Path()] = target
+		fallback = append(fallback, g)
+	}
+
+	fil, err := ap.downloadVariants(ctx, httpClient, fallback, byhash)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]bool)
+	for _, fi := range fil {
+		target := targets[apt.TrimCompressionExt(fi.Path())]
+		if target == nil || fi.Path() == target.Path() {
+			indices = append(indices, fi)
+			continue
+		}
+		if stored[target.Path()] {
+			continue
+		}
+
+		err := ap.storeDecompressed(httpClient, fi, target, byhash)
+		if err != nil {
+			slog.Warn("failed to store uncompressed index", "repo", ap.mirrorID, "path", target.Path(), "error", err)
+			indices = append(indices, fi)
+			continue
+		}
+		stored[target.Path()] = true
+		indices = append(indices, target)
+	}
+
+	return indices, nil
+}
+
+// openStored opens a file stored in ap.storage.
+func (ap *APTParser) openStored(fi *apt.FileInfo, byhash bool) (*os.File, error) {
+	p := fi.Path()
+	if byhash && fi.SHA256Path() != "" {
+		p = fi.SHA256Path()
+	}
+	return ap.storage.Open(p)
+}
+
+// readPDiffIndex parses the stored PDiff Index file diffIndex.  It
+// returns nil if diffIndex is nil or cannot be read.
+func (ap *APTParser) readPDiffIndex(diffIndex *apt.FileInfo, byhash bool) *apt.PDiffIndex {
+	if diffIndex == nil {
+		return nil
+	}
+	f, err := ap.openStored(diffIndex, byhash)
+	if err != nil {
+		slog.Warn("failed to open PDiff index", "repo", ap.mirrorID, "path", diffIndex.Path(), "error", err)
+		return nil
+	}
+	idx, err := apt.ParsePDiffIndex(diffIndex.Path(), f)
+	_ = f.Close()
+	if err != nil {
+		slog.Warn("failed to parse PDiff index", "repo", ap.mirrorID, "path", diffIndex.Path(), "error", err)
+		return nil
+	}
+	return idx
+}
+
+// patchIndex tries to build target by applying PDiff patches of idx to
+// a past version of the index found in the current storage.  stored
+// lists the patch files that have been downloaded.
+//
+// It returns the stored target and the number of patches applied, or
+// nil if the index cannot be patched.
+func (ap *APTParser) patchIndex(httpClient *HTTPClient, target *apt.FileInfo,
+	idx *apt.PDiffIndex, stored []*apt.FileInfo, byhash bool) (*apt.FileInfo, int) {
+
+	if httpClient.current == nil || idx == nil {
+		return nil, 0
+	}
+
+	// Reuse the index as is if it has not changed.
+	if fi, _ := httpClient.current.Lookup(target, byhash); fi != nil {
+		return nil, 0
+	}
+
+	if !idx.Current().Same(target) {
+		slog.Debug("PDiff index is out of date", "repo", ap.mirrorID, "path", target.Path())
+		return nil, 0
+	}
+
+	// Prefer the most recent past version to apply fewer patches.
+	var old *apt.FileInfo
+	var oldPath string
+	history := idx.History()
+	for i := len(history) - 1; i >= 0; i-- {
+		if fi, fullpath := httpClient.current.Lookup(history[i], byhash); fi != nil {
+			old, oldPath = history[i], fullpath
+			break
+		}
+	}
+	if old == nil {
+		slog.Debug("no past version to patch", "repo", ap.mirrorID, "path", target.Path())
+		return nil, 0
+	}
+
+	patches, err := idx.PatchesFrom(old)
+	if err != nil {
+		slog.Warn("failed to find PDiff patches", "repo", ap.mirrorID, "path", target.Path(), "error", err)
+		return nil, 0
+	}
+
+	have := make(map[string]bool, len(stored))
+	for _, fi := range stored {
+		have[fi.Path()] = true
+	}
+	for _, p := range patches {
+		if !have[p.Path()] {
+			slog.Warn("some PDiff patches are missing", "repo", ap.mirrorID, "path", target.Path())
+			return nil, 0
+		}
+	}
+
+	err = ap.applyPatches(httpClient, target, oldPath, patches, byhash)
+	if err != nil {
+		slog.Warn("failed to apply PDiff patches", "repo", ap.mirrorID, "path", target.Path(), "error", err)
+		return nil, 0
+	}
+	return target, len(patches)
+}
+
+// applyPatches applies stored patches to the file at oldPath and stores
+// the result as target after verifying its checksums.
+func (ap *APTParser) applyPatches(httpClient *HTTPClient, target *apt.FileInfo,
+	oldPath string, patches []*apt.FileInfo, byhash bool) error {
+
+	src, err := os.Open(oldPath) // #nosec G304 - oldPath is returned by Storage.Lookup
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var readers []io.Reader
+	for _, p := range patches {
+		f, err := ap.openStored(p, byhash)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := apt.Decompress(p.Path(), f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(apt.PatchIndex(pw, src, readers...))
+	}()
+
+	err = ap.storeVerified(httpClient, pr, target, byhash)
+	_ = pr.Close()
+	<-done
+	return err
+}
+
+// storeDecompressed stores the uncompressed content of the stored
+// index fi as target after verifying its checksums.  If the current
+// storage already has target, it is reused instead.
+func (ap *APTParser) storeDecompressed(httpClient *HTTPClient, fi, target *apt.FileInfo, byhash bool) error {
+	if httpClient.current != nil {
+		if localfi, fullpath := httpClient.current.Lookup(target, byhash); localfi != nil {
+			return httpClient.storeLink(localfi, fullpath, byhash)
+		}
+	}
+
+	f, err := ap.openStored(fi, byhash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := apt.Decompress(fi.Path(), f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return ap.storeVerified(httpClient, r, target, byhash)
+}
+
+// storeVerified copies r to a temporary file and stores it as target
+// if the content matches the checksums of target.
+func (ap *APTParser) storeVerified(httpClient *HTTPClient, r io.Reader, target *apt.FileInfo, byhash bool) error {
+	tempfile, err := ap.storage.TempFile()
+	if err != nil {
+		return err
+	}
+	defer closeAndRemoveFile(tempfile)
+
+	fi, err := apt.CopyWithFileInfo(tempfile, r, target.Path())
+	if err != nil {
+		return err
+	}
+	if !target.Same(fi) {
+		return errors.New("checksum mismatch for " + target.Path())
+	}
+	return httpClient.storeLink(target, tempfile.Name(), byhash)
+}
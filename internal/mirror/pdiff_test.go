@@ -0,0 +1,258 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustFileInfo(t *testing.T, p string, data []byte) *apt.FileInfo {
+	t.Helper()
+	fi, err := makeFileInfo(p, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func pdiffLine(fi *apt.FileInfo, name string) string {
+	sha := filepath.Base(fi.SHA256Path())
+	return strings.TrimSpace(fmt.Sprintf("%s %d %s", sha, fi.Size(), name))
+}
+
+func TestDownloadIndicesWithPDiff(t *testing.T) {
+	t.Parallel()
+
+	const dir = "dists/test/main/binary-amd64/"
+	oldData := []byte("Package: a\nVersion: 1\n\nPackage: b\nVersion: 1\n")
+	newData := []byte("Package: a\nVersion: 2\n\nPackage: b\nVersion: 1\n")
+	patch := []byte("2c\nVersion: 2\n.\n")
+	patchGz := gzipBytes(t, patch)
+	newGz := gzipBytes(t, newData)
+
+	oldFi := mustFileInfo(t, dir+"Packages", oldData)
+	newFi := mustFileInfo(t, dir+"Packages", newData)
+	newGzFi := mustFileInfo(t, dir+"Packages.gz", newGz)
+	patchFi := mustFileInfo(t, dir+"Packages.diff/T-1", patch)
+	patchGzFi := mustFileInfo(t, dir+"Packages.diff/T-1.gz", patchGz)
+
+	index := []byte(fmt.Sprintf("SHA256-Current: %s\nSHA256-History:\n %s\nSHA256-Patches:\n %s\nSHA256-Download:\n %s\n",
+		pdiffLine(newFi, ""), pdiffLine(oldFi, "T-1"), pdiffLine(patchFi, "T-1"), pdiffLine(patchGzFi, "T-1.gz")))
+	indexFi := mustFileInfo(t, dir+"Packages.diff/Index", index)
+
+	server := NewDownloadTestServer()
+	defer server.Close()
+	server.AddResponse(dir+"Packages.diff/Index", http.StatusOK, index, 0)
+	server.AddResponse(dir+"Packages.diff/T-1.gz", http.StatusOK, patchGz, 0)
+	server.AddResponse(dir+"Packages.gz", http.StatusOK, newGz, 0)
+
+	indexMap := map[string][]*apt.FileInfo{
+		dir + "Packages":            {newFi},
+		dir + "Packages.gz":         {newGzFi},
+		dir + "Packages.diff/Index": {indexFi},
+	}
+
+	// withCurrent returns a mirror whose current storage has the old
+	// Packages.
+	withCurrent := func(t *testing.T) *Mirror {
+		m := setupTestMirror(t, server.URL())
+		current, err := NewStorage(t.TempDir(), "test-mirror")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := current.TempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeAndRemoveFile(f)
+		if _, err := f.Write(oldData); err != nil {
+			t.Fatal(err)
+		}
+		if err := current.StoreLink(oldFi, f.Name()); err != nil {
+			t.Fatal(err)
+		}
+		m.httpClient.current = current
+		return m
+	}
+
+	t.Run("patch", func(t *testing.T) {
+		m := withCurrent(t)
+
+		before := server.RequestCount()
+		indices, err := m.parser.downloadIndices(context.Background(), m.httpClient, indexMap, false, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The PDiff Index and a single patch, without the compressed
+		// variant.
+		if n := server.RequestCount() - before; n != 2 {
+			t.Errorf("expected 2 requests, got %d", n)
+		}
+
+		paths := make(map[string]bool)
+		for _, fi := range indices {
+			paths[fi.Path()] = true
+		}
+		for _, p := range []string{dir + "Packages", dir + "Packages.diff/Index", dir + "Packages.diff/T-1.gz"} {
+			if !paths[p] {
+				t.Errorf("%s is not in indices", p)
+			}
+		}
+
+		got, err := os.ReadFile(filepath.Join(m.storage.Dir(), "test-mirror", dir, "Packages"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, newData) {
+			t.Errorf("unexpected patched Packages: %q", got)
+		}
+
+		// Clients fall back to the uncompressed Packages.
+		if _, err := os.Stat(filepath.Join(m.storage.Dir(), "test-mirror", dir, "Packages.gz")); !os.IsNotExist(err) {
+			t.Errorf("expected no Packages.gz, got %v", err)
+		}
+	})
+
+	t.Run("all variants", func(t *testing.T) {
+		m := withCurrent(t)
+		m.mc.AllIndexVariants = true
+
+		if _, err := m.parser.downloadIndices(context.Background(), m.httpClient, indexMap, false, m); err != nil {
+			t.Fatal(err)
+		}
+		for p, want := range map[string][]byte{"Packages": newData, "Packages.gz": newGz} {
+			got, err := os.ReadFile(filepath.Join(m.storage.Dir(), "test-mirror", dir, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("unexpected %s: %q", p, got)
+			}
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		m := setupTestMirror(t, server.URL())
+
+		indices, err := m.parser.downloadIndices(context.Background(), m.httpClient, indexMap, false, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(indices) != 3 {
+			t.Errorf("expected 3 indices, got %d", len(indices))
+		}
+
+		// The uncompressed Packages is kept for the next update, and
+		// patches are mirrored for clients.
+		for _, p := range []string{"Packages", "Packages.gz", "Packages.diff/T-1.gz"} {
+			if _, err := os.Stat(filepath.Join(m.storage.Dir(), "test-mirror", dir, p)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestDownloadIndicesWithPDiff_History(t *testing.T) {
+	t.Parallel()
+
+	const dir = "dists/test/main/binary-amd64/"
+	data := [][]byte{
+		[]byte("Package: a\nVersion: 1\n"),
+		[]byte("Package: a\nVersion: 2\n"),
+		[]byte("Package: a\nVersion: 3\n"),
+	}
+	patches := [][]byte{
+		[]byte("2c\nVersion: 2\n.\n"),
+		[]byte("2c\nVersion: 3\n.\n"),
+	}
+
+	newFi := mustFileInfo(t, dir+"Packages", data[2])
+	newGz := gzipBytes(t, data[2])
+	newGzFi := mustFileInfo(t, dir+"Packages.gz", newGz)
+
+	server := NewDownloadTestServer()
+	defer server.Close()
+	server.AddResponse(dir+"Packages.gz", http.StatusOK, newGz, 0)
+
+	var history, patchLines, downloads []string
+	for i, patch := range patches {
+		name := fmt.Sprintf("T-%d", i)
+		patchGz := gzipBytes(t, patch)
+		history = append(history, " "+pdiffLine(mustFileInfo(t, dir+"Packages", data[i]), name))
+		patchLines = append(patchLines, " "+pdiffLine(mustFileInfo(t, dir+"Packages.diff/"+name, patch), name))
+		downloads = append(downloads, " "+pdiffLine(mustFileInfo(t, dir+"Packages.diff/"+name+".gz", patchGz), name+".gz"))
+		server.AddResponse(dir+"Packages.diff/"+name+".gz", http.StatusOK, patchGz, 0)
+	}
+	index := []byte(fmt.Sprintf("SHA256-Current: %s\nSHA256-History:\n%s\nSHA256-Patches:\n%s\nSHA256-Download:\n%s\n",
+		pdiffLine(newFi, ""), strings.Join(history, "\n"), strings.Join(patchLines, "\n"), strings.Join(downloads, "\n")))
+	indexFi := mustFileInfo(t, dir+"Packages.diff/Index", index)
+	server.AddResponse(dir+"Packages.diff/Index", http.StatusOK, index, 0)
+
+	indexMap := map[string][]*apt.FileInfo{
+		dir + "Packages":            {newFi},
+		dir + "Packages.gz":         {newGzFi},
+		dir + "Packages.diff/Index": {indexFi},
+	}
+
+	m := setupTestMirror(t, server.URL())
+
+	// The current mirror has the previous version, so only T-1 applies.
+	current, err := NewStorage(t.TempDir(), "test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := current.TempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAndRemoveFile(f)
+	if _, err := f.Write(data[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := current.StoreLinkWithHash(mustFileInfo(t, dir+"Packages", data[1]), f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	m.httpClient.current = current
+
+	if _, err := m.parser.downloadIndices(context.Background(), m.httpClient, indexMap, true, m); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(m.storage.Dir(), "test-mirror")
+	got, err := os.ReadFile(filepath.Join(root, dir, "Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[2]) {
+		t.Errorf("unexpected patched Packages: %q", got)
+	}
+
+	// Every patch of the Index is mirrored, and the patched index is
+	// stored with its by-hash path.
+	for _, p := range []string{"Packages.diff/T-0.gz", "Packages.diff/T-1.gz", newFi.SHA256Path()[len(dir):]} {
+		if _, err := os.Stat(filepath.Join(root, dir, p)); err != nil {
+			t.Error(err)
+		}
+	}
+}
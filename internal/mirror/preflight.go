@@ -0,0 +1,166 @@
+package mirror
+
+// This file implements the checks made before package files are
+// downloaded: the free space and inodes of the filesystem holding the
+// mirrors, and the max_size of each mirror.
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// diskFree returns the bytes available to unprivileged users and the
+// free inodes of the filesystem holding p.  inodes is -1 if the
+// filesystem does not limit them.
+func diskFree(p string) (bytes, inodes int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, 0, fmt.Errorf("failed to get free space of %s: %w", p, err)
+	}
+	bytes = int64(st.Bavail) * int64(st.Bsize) // #nosec G115 - block counts fit in int64
+	inodes = -1
+	if st.Files > 0 {
+		inodes = int64(st.Ffree) // #nosec G115 - inode counts fit in int64
+	}
+	return bytes, inodes, nil
+}
+
+// diskBudget accounts for the space that the syncs sharing a
+// filesystem are about to use.  Reservations count as used until the
+// downloads they were made for end, when the filesystem reports the
+// downloaded files as used instead.
+type diskBudget struct {
+	mu     sync.Mutex
+	dir    string
+	bytes  int64
+	inodes int64
+}
+
+// newDiskBudget returns a budget for the filesystem holding dir.
+func newDiskBudget(dir string) *diskBudget {
+	return &diskBudget{dir: dir}
+}
+
+// reserve reserves size bytes and files inodes for the new files of
+// mirror, or returns an error if the filesystem does not have them.
+// The returned function releases the reservation.
+func (b *diskBudget) reserve(mirror string, size, files int64) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	freeBytes, freeInodes, err := diskFree(b.dir)
+	if err != nil {
+		// Downloads fail by themselves if the space runs out
+		slog.Warn("cannot check free space", "repo", mirror, "error", err)
+		return func() {}, nil
+	}
+	if avail := freeBytes - b.bytes; size > avail {
+		return nil, errors.Newf("%s: not enough space in %s: the sync needs %s for %d new files, but only %s are available",
+			mirror, b.dir, formatSize(size), files, formatSize(avail))
+	}
+	if avail := freeInodes - b.inodes; freeInodes >= 0 && files > avail {
+		return nil, errors.Newf("%s: not enough inodes in %s: the sync needs %d for new files, but only %d are free",
+			mirror, b.dir, files, max(avail, 0))
+	}
+
+	b.bytes += size
+	b.inodes += files
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.bytes -= size
+		b.inodes -= files
+	}, nil
+}
+
+// maxSize returns the max_size of the mirror configuration mc in
+// bytes, or 0 if it has none.
+func (mc *MirrorConfig) maxSize() int64 {
+	if mc == nil {
+		return 0
+	}
+	size, err := parseSize(mc.MaxSize)
+	if err != nil {
+		// Check rejects invalid sizes
+		return 0
+	}
+	return size
+}
+
+// distinctFiles returns the files stored so far, and items that are
+// not stored.  Files with by-hash paths are stored once per path.
+func distinctFiles(stored, items map[string]*apt.FileInfo) map[*apt.FileInfo]bool {
+	files := make(map[*apt.FileInfo]bool, len(stored)+len(items))
+	for _, fi := range stored {
+		files[fi] = true
+	}
+	for p, fi := range items {
+		if _, ok := stored[p]; !ok {
+			files[fi] = true
+		}
+	}
+	return files
+}
+
+// checkMaxSize returns an error if the tree of m would grow past the
+// max_size of the mirror with items, files that are not stored yet.
+func (m *Mirror) checkMaxSize(items map[string]*apt.FileInfo) error {
+	limit := m.mc.maxSize()
+	if limit == 0 {
+		return nil
+	}
+
+	var size uint64
+	for fi := range distinctFiles(m.storage.infoCopy(), items) {
+		size += fi.Size()
+	}
+	if size > uint64(limit) { // #nosec G115 - sizes are never negative
+		return errors.Newf("%s: the mirror would grow to %s, past its max_size of %s",
+			m.id, FormatBytes(size), m.mc.MaxSize)
+	}
+	return nil
+}
+
+// preflight checks that the package files items of m fit in the
+// max_size of the mirror and on the filesystem, before they are
+// downloaded.  The returned function releases the space reserved for
+// them.
+func (m *Mirror) preflight(items []*apt.FileInfo, byhash bool) (func(), error) {
+	itemMap := make(map[string]*apt.FileInfo, len(items))
+	for _, fi := range items {
+		itemMap[fi.Path()] = fi
+	}
+	if err := m.checkMaxSize(itemMap); err != nil {
+		return nil, err
+	}
+
+	// Files found in the current tree are linked, not downloaded
+	var size, files int64
+	for _, fi := range items {
+		if local, _ := m.storage.Lookup(fi, byhash); local != nil {
+			continue
+		}
+		if m.current != nil {
+			if local, _ := m.current.Lookup(fi, byhash); local != nil {
+				continue
+			}
+		}
+		size += int64(fi.Size()) // #nosec G115 - sizes fit in int64
+		files++
+	}
+	if files == 0 {
+		return func() {}, nil
+	}
+
+	b := m.budget
+	if b == nil {
+		b = newDiskBudget(m.dir)
+	}
+	return b.reserve(m.id, size, files)
+}
@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskBudget(t *testing.T) {
+	dir := t.TempDir()
+	free, _, err := diskFree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newDiskBudget(dir)
+	if _, err := b.reserve("test-mirror", free+1<<30, 1); err == nil || !strings.Contains(err.Error(), "not enough space") {
+		t.Fatalf("expected a space error, got %v", err)
+	}
+
+	// Reservations of concurrent syncs count as used
+	release, err := b.reserve("test-mirror", free/2+1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve("other-mirror", free/2+1, 1); err == nil {
+		t.Error("expected the reservation of test-mirror to count")
+	}
+	release()
+	if _, err := b.reserve("other-mirror", free/2+1, 1); err != nil {
+		t.Errorf("expected the released space to be available: %v", err)
+	}
+
+	if _, inodes, _ := diskFree(dir); inodes >= 0 {
+		if _, err := b.reserve("test-mirror", 0, inodes+1); err == nil || !strings.Contains(err.Error(), "not enough inodes") {
+			t.Errorf("expected an inode error, got %v", err)
+		}
+	}
+}
+
+func TestMirrorConfig_MaxSize(t *testing.T) {
+	mc := &MirrorConfig{MaxSize: "1.5KiB"}
+	if size := mc.maxSize(); size != 1536 {
+		t.Errorf("unexpected max size: %d", size)
+	}
+	if size := (*MirrorConfig)(nil).maxSize(); size != 0 {
+		t.Errorf("unexpected max size: %d", size)
+	}
+
+	var u tomlURL
+	if err := u.UnmarshalText([]byte("http://example.com/debian")); err != nil {
+		t.Fatal(err)
+	}
+	mc = &MirrorConfig{URL: u, Suites: []string{"stable/"}, NoPGPCheck: true, MaxSize: "lots"}
+	if err := mc.Check(); err == nil || !strings.Contains(err.Error(), "max_size") {
+		t.Errorf("expected an invalid max_size, got %v", err)
+	}
+}
+
+func TestRunGates_MaxSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	mc := &MirrorConfig{MaxSize: "100B"}
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live")).WithMirrorConfigs(map[string]*MirrorConfig{"test-mirror": mc})
+	writeGateTestSnapshot(t, sm, "big")
+
+	// max_size guards every channel, including staging
+	err := sm.PublishSnapshotToStaging("test-mirror", "big")
+	var gateErr *GateError
+	if !errors.As(err, &gateErr) || len(gateErr.Failures) != 1 || gateErr.Failures[0].Gate != GateMaxSize {
+		t.Fatalf("expected the max_size gate to fail, got %v", err)
+	}
+
+	mc.MaxSize = "1MiB"
+	if err := sm.PublishSnapshotToStaging("test-mirror", "big"); err != nil {
+		t.Errorf("expected the snapshot to fit: %v", err)
+	}
+}
+
+func TestSync_MaxSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	repo := NewMockAPTRepository()
+	defer repo.Close()
+	setTestPackages(repo, map[string]string{"foo": "foo-1.0", "bar": "bar-1.0"})
+
+	var u tomlURL
+	if err := u.UnmarshalText([]byte(repo.URL())); err != nil {
+		t.Fatal(err)
+	}
+	mc := &MirrorConfig{
+		URL:           u,
+		Suites:        []string{"test"},
+		Sections:      []string{"main"},
+		Architectures: []string{"amd64"},
+		MaxSize:       "100B",
+	}
+	config := &Config{Dir: t.TempDir(), MaxConns: 5, Mirrors: map[string]*MirrorConfig{"test-mirror": mc}}
+
+	// Dry runs report the excess rather than failing
+	r, err := DryRun(config, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mu := r.Mirrors[0]; !mu.OverMaxSize || mu.MaxSize != 100 {
+		t.Errorf("expected the dry run to exceed max_size: %+v", mu)
+	}
+
+	err = Run(config, nil, true, true, false, false)
+	if err == nil || !strings.Contains(err.Error(), "past its max_size of 100B") {
+		t.Fatalf("expected the sync to fail on max_size, got %v", err)
+	}
+	if _, err := filepath.EvalSymlinks(filepath.Join(config.Dir, "test-mirror")); err == nil {
+		t.Error("expected the failed sync not to be published")
+	}
+
+	mc.MaxSize = "1MiB"
+	if err := Run(config, nil, true, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+}
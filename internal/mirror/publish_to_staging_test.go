@@ -31,11 +31,13 @@ func TestHandleSnapshotting_PublishToStaging(t *testing.T) {
 	_ = noStagingURL.UnmarshalText([]byte("https://example.com/no-staging"))
 
 	// Create test config
+	srv, received := webhookReceiver(t, 0)
 	config := &Config{
 		Dir: mirrorDir,
 		Snapshot: &SnapshotConfig{
 			DefaultNameFormat: "2006-01-02",
 		},
+		Notify: &NotifyConfig{Webhooks: []*WebhookConfig{{URL: srv.URL}}},
 		Mirrors: map[string]*MirrorConfig{
 			"test-mirror": {
 				URL:              *testURL,
@@ -75,11 +77,19 @@ func TestHandleSnapshotting_PublishToStaging(t *testing.T) {
 	_ = os.Symlink(testMirrorPath2, filepath.Join(mirrorDir, "no-staging-mirror"))
 
 	// Test handleSnapshotting with force=false
-	err := handleSnapshotting(config, mirrors, false)
+	staged, err := handleSnapshotting(config, mirrors, false)
 	if err != nil {
 		t.Errorf("handleSnapshotting should succeed: %v", err)
 	}
 
+	// The notification is returned to be sent once the lock is released
+	if len(staged) != 1 || staged[0].Event != NotifySnapshotStaged || staged[0].Mirror != "test-mirror" {
+		t.Errorf("unexpected notifications: %+v", staged)
+	}
+	if reqs := received(); len(reqs) != 0 {
+		t.Errorf("expected no delivery under the lock, got %d", len(reqs))
+	}
+
 	// Verify that staging snapshot was created for test-mirror
 	sm := NewSnapshotManager(config.Snapshot, mirrorDir)
 
@@ -166,13 +176,13 @@ func TestHandleSnapshotting_WithForce(t *testing.T) {
 	_ = os.Symlink(testMirrorPath, filepath.Join(mirrorDir, "test-mirror"))
 
 	// First call should succeed
-	err := handleSnapshotting(config, mirrors, false)
+	_, err := handleSnapshotting(config, mirrors, false)
 	if err != nil {
 		t.Errorf("first handleSnapshotting should succeed: %v", err)
 	}
 
 	// Second call without force should fail (snapshot already exists)
-	err = handleSnapshotting(config, mirrors, false)
+	_, err = handleSnapshotting(config, mirrors, false)
 	if err != nil {
 		// This is expected - the error should be logged but not returned
 		// since handleSnapshotting continues processing other mirrors
@@ -180,7 +190,7 @@ func TestHandleSnapshotting_WithForce(t *testing.T) {
 	}
 
 	// Second call WITH force should succeed (overwrite existing)
-	err = handleSnapshotting(config, mirrors, true)
+	_, err = handleSnapshotting(config, mirrors, true)
 	if err != nil {
 		t.Errorf("handleSnapshotting with force should succeed: %v", err)
 	}
@@ -227,7 +237,7 @@ func TestHandleSnapshotting_NoSnapshotConfig(t *testing.T) {
 
 	// In the real Run function, this condition prevents the call:
 	// if !dryRun && config.Snapshot != nil {
-	//     err = handleSnapshotting(config, updatedMirrors, force)
+	//     staged, err := handleSnapshotting(config, updatedMirrors, force)
 	// }
 	//
 	// So we verify that the condition works as expected
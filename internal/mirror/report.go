@@ -0,0 +1,406 @@
+package mirror
+
+// This file implements the structured output of read commands.  Every
+// report starts with its kind and schema version.  Within a schema
+// version, fields may be added but are never removed, renamed or
+// retyped, so scripts can rely on them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats.
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+)
+
+// Report kinds.
+const (
+	ReportSnapshotList = "snapshot-list"
+	ReportPrune        = "snapshot-prune"
+	ReportConfigCheck  = "config-check"
+	ReportTLSCheck     = "tls-check"
+	ReportDryRun       = "sync-dry-run"
+)
+
+// reportTypes maps report kinds to their schema version and type.
+var reportTypes = map[string]struct {
+	version int
+	typ     reflect.Type
+}{
+	ReportSnapshotList: {1, reflect.TypeFor[SnapshotListReport]()},
+	ReportPrune:        {1, reflect.TypeFor[PruneReport]()},
+	ReportConfigCheck:  {1, reflect.TypeFor[ConfigCheckReport]()},
+	ReportTLSCheck:     {1, reflect.TypeFor[TLSCheckReport]()},
+	ReportDryRun:       {1, reflect.TypeFor[DryRunReport]()},
+}
+
+// CheckOutputFormat returns an error if format is not an output format.
+func CheckOutputFormat(format string) error {
+	switch format {
+	case OutputTable, OutputJSON, OutputYAML:
+		return nil
+	}
+	return fmt.Errorf("invalid output format %q: must be %s, %s or %s", format, OutputTable, OutputJSON, OutputYAML)
+}
+
+// ReportHeader identifies the kind and schema version of a report.
+type ReportHeader struct {
+	Kind          string `json:"kind"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// newReportHeader returns the header of reports of kind.
+func newReportHeader(kind string) ReportHeader {
+	return ReportHeader{Kind: kind, SchemaVersion: reportTypes[kind].version}
+}
+
+// WriteReport writes report to w in the json or yaml format.  Reports
+// in the yaml format have the same fields as in the json format.
+func WriteReport(w io.Writer, format string, report any) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case OutputYAML:
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		// Decoding the JSON as YAML keeps the field names and order
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		plainYAMLStyle(&node)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("cannot write a report in the %s format", format)
+}
+
+// plainYAMLStyle resets the JSON flow style of n and its children.
+// Strings are still quoted where they would read as other types.
+func plainYAMLStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		plainYAMLStyle(c)
+	}
+}
+
+// ReportKinds returns the report kinds, sorted.
+func ReportKinds() []string {
+	kinds := make([]string, 0, len(reportTypes))
+	for kind := range reportTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// ReportSchema returns the JSON Schema of reports of kind.
+func ReportSchema(kind string) (map[string]any, error) {
+	rt, ok := reportTypes[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown report kind %q: must be one of %s", kind, strings.Join(ReportKinds(), ", "))
+	}
+	schema := typeSchema(rt.typ)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = fmt.Sprintf("mirrorctl %s report, schema version %d", kind, rt.version)
+	props := schema["properties"].(map[string]any)
+	props["kind"] = map[string]any{"const": kind}
+	props["schema_version"] = map[string]any{"const": rt.version}
+	return schema, nil
+}
+
+// typeSchema returns the JSON Schema of the JSON encoding of t.
+func typeSchema(t reflect.Type) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]any)
+		var required []string
+		addStructFields(t, props, &required)
+		schema := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
+
+// addStructFields adds the JSON fields of the struct t to props.
+// Fields that are always present are added to required.
+func addStructFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(f.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// SnapshotListReport lists the snapshots of mirrors.
+type SnapshotListReport struct {
+	ReportHeader
+	Mirrors []*MirrorSnapshots `json:"mirrors"`
+
+	// Usage is the disk usage of all snapshots.  It is only measured
+	// for detailed listings.
+	Usage *SnapshotsUsage `json:"usage,omitempty"`
+
+	detailed bool
+}
+
+// MirrorSnapshots lists the snapshots of a mirror, newest first.
+type MirrorSnapshots struct {
+	Mirror    string            `json:"mirror"`
+	Snapshots []*SnapshotReport `json:"snapshots"`
+}
+
+// SnapshotReport describes a snapshot.  Sizes are in bytes.
+type SnapshotReport struct {
+	Name          string            `json:"name"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Published     bool              `json:"published"`
+	Staged        bool              `json:"staged"`
+	Pinned        bool              `json:"pinned"`
+	Channels      []string          `json:"channels"`
+	Files         int               `json:"files"`
+	Size          int64             `json:"size"`
+	SharedSize    int64             `json:"shared_size"`
+	ExclusiveSize int64             `json:"exclusive_size"`
+	Metadata      *SnapshotMetadata `json:"metadata,omitempty"`
+}
+
+// SnapshotsUsage is the disk usage of all snapshots, in bytes.
+type SnapshotsUsage struct {
+	Files     int   `json:"files"`
+	Size      int64 `json:"size"`
+	Shared    int64 `json:"shared"`
+	Exclusive int64 `json:"exclusive"`
+}
+
+// NewSnapshotListReport returns an empty snapshot listing.  Detailed
+// listings include sizes and metadata in the table format.
+func NewSnapshotListReport(detailed bool) *SnapshotListReport {
+	return &SnapshotListReport{
+		ReportHeader: newReportHeader(ReportSnapshotList),
+		Mirrors:      []*MirrorSnapshots{},
+		detailed:     detailed,
+	}
+}
+
+// Detailed reports whether the listing is detailed.
+func (r *SnapshotListReport) Detailed() bool {
+	return r.detailed
+}
+
+// Add adds the snapshots of mirror to the listing.
+func (r *SnapshotListReport) Add(mirror string, snapshots []*SnapshotInfo) {
+	ms := &MirrorSnapshots{Mirror: mirror, Snapshots: make([]*SnapshotReport, 0, len(snapshots))}
+	for _, si := range snapshots {
+		ms.Snapshots = append(ms.Snapshots, NewSnapshotReport(si))
+	}
+	r.Mirrors = append(r.Mirrors, ms)
+}
+
+// SetUsage sets the disk usage of all snapshots.
+func (r *SnapshotListReport) SetUsage(usage DiskUsage) {
+	r.Usage = &SnapshotsUsage{
+		Files:     usage.Files,
+		Size:      usage.Size,
+		Shared:    usage.Shared(),
+		Exclusive: usage.Exclusive,
+	}
+}
+
+// NewSnapshotReport returns the report of si.
+func NewSnapshotReport(si *SnapshotInfo) *SnapshotReport {
+	channels := si.Channels
+	if channels == nil {
+		channels = []string{}
+	}
+	return &SnapshotReport{
+		Name:          si.Name,
+		CreatedAt:     si.CreatedAt,
+		Published:     si.IsPublished,
+		Staged:        si.IsStaged,
+		Pinned:        si.IsPinned,
+		Channels:      channels,
+		Files:         si.FileCount,
+		Size:          si.Size,
+		SharedSize:    si.SharedSize,
+		ExclusiveSize: si.ExclusiveSize,
+		Metadata:      si.Metadata,
+	}
+}
+
+// Status returns a human-readable status string for the snapshot.
+func (s *SnapshotReport) Status() string {
+	return snapshotStatus(s.Published, s.Staged, s.Pinned, s.Channels)
+}
+
+// PruneReport lists the snapshots a prune deletes and keeps.
+type PruneReport struct {
+	ReportHeader
+	DryRun  bool           `json:"dry_run"`
+	Mirrors []*MirrorPrune `json:"mirrors"`
+}
+
+// MirrorPrune lists the snapshots of a mirror a prune deletes and keeps.
+type MirrorPrune struct {
+	Mirror string        `json:"mirror"`
+	Delete []*PruneEntry `json:"delete"`
+	Keep   []*PruneEntry `json:"keep"`
+
+	// FreedSize is the space deleting the snapshots frees, in bytes.
+	// It is only measured for dry runs.
+	FreedSize int64 `json:"freed_size,omitempty"`
+}
+
+// PruneEntry is the decision on a snapshot.
+type PruneEntry struct {
+	Snapshot      string `json:"snapshot"`
+	ExclusiveSize int64  `json:"exclusive_size"`
+
+	// Reasons lists the rules that keep the snapshot.
+	Reasons []string `json:"reasons"`
+
+	// Evicted names the space limit that deletes the snapshot despite
+	// Reasons.
+	Evicted string `json:"evicted,omitempty"`
+}
+
+// NewPruneReport returns an empty prune report.
+func NewPruneReport(dryRun bool) *PruneReport {
+	return &PruneReport{ReportHeader: newReportHeader(ReportPrune), DryRun: dryRun, Mirrors: []*MirrorPrune{}}
+}
+
+// Add adds the decisions of a prune of mirror to the report.  For dry
+// runs, the space deleting the snapshots would free is measured.
+func (r *PruneReport) Add(mirror string, decisions []*PruneDecision) *MirrorPrune {
+	mp := &MirrorPrune{Mirror: mirror, Delete: []*PruneEntry{}, Keep: []*PruneEntry{}}
+	var paths []string
+	for _, d := range decisions {
+		e := &PruneEntry{
+			Snapshot:      d.Snapshot.Name,
+			ExclusiveSize: d.Snapshot.ExclusiveSize,
+			Reasons:       d.Reasons,
+			Evicted:       d.Evicted,
+		}
+		if e.Reasons == nil {
+			e.Reasons = []string{}
+		}
+		if d.Keep() {
+			mp.Keep = append(mp.Keep, e)
+		} else {
+			mp.Delete = append(mp.Delete, e)
+			paths = append(paths, d.Snapshot.Path)
+		}
+	}
+
+	// Snapshots may share files only among themselves, so the space
+	// freed is measured for all of them together
+	if r.DryRun && len(paths) > 0 {
+		mp.FreedSize = MeasureDiskUsage(paths...).Exclusive
+	}
+	r.Mirrors = append(r.Mirrors, mp)
+	return mp
+}
+
+// ConfigCheckReport is the result of validating a configuration file.
+type ConfigCheckReport struct {
+	ReportHeader
+	Path   string   `json:"path"`
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+
+	// Files are the configuration file and the files it includes, and
+	// Mirrors the mirrors of the merged configuration with the file
+	// defining them.  Both are missing if the configuration could not
+	// be read.
+	Files   []string        `json:"files,omitempty"`
+	Mirrors []*ConfigMirror `json:"mirrors,omitempty"`
+}
+
+// ConfigMirror is the definition of a mirror in a configuration.
+type ConfigMirror struct {
+	ID string `json:"id"`
+	ConfigPosition
+}
+
+// NewConfigCheckReport returns the validation result of the
+// configuration file at path with errs.
+func NewConfigCheckReport(path string, errs []error) *ConfigCheckReport {
+	r := &ConfigCheckReport{
+		ReportHeader: newReportHeader(ReportConfigCheck),
+		Path:         path,
+		Valid:        len(errs) == 0,
+		Errors:       make([]string, 0, len(errs)),
+	}
+	for _, err := range errs {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	return r
+}
+
+// WithSources adds the files read and the mirrors defined by them to r.
+func (r *ConfigCheckReport) WithSources(src *ConfigSources) *ConfigCheckReport {
+	r.Files = src.Files
+	r.Mirrors = make([]*ConfigMirror, 0, len(src.Mirrors))
+	for id, pos := range src.Mirrors {
+		r.Mirrors = append(r.Mirrors, &ConfigMirror{ID: id, ConfigPosition: pos})
+	}
+	sort.Slice(r.Mirrors, func(i, j int) bool {
+		return r.Mirrors[i].ID < r.Mirrors[j].ID
+	})
+	return r
+}
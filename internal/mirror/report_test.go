@@ -0,0 +1,153 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteReport(t *testing.T) {
+	r := NewConfigCheckReport("/etc/mirrorctl/mirror.toml", nil)
+
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, OutputJSON, r); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["kind"] != ReportConfigCheck || decoded["schema_version"] != 1.0 || decoded["valid"] != true {
+		t.Errorf("unexpected report: %s", buf.String())
+	}
+	if errs, ok := decoded["errors"].([]any); !ok || len(errs) != 0 {
+		t.Errorf("expected an empty error list, got %s", buf.String())
+	}
+
+	// YAML keeps the JSON field names and order, and quotes strings
+	// that would read as other types
+	buf.Reset()
+	list := NewSnapshotListReport(false)
+	list.Add("test-mirror", []*SnapshotInfo{{
+		Name:     "2024",
+		Channels: []string{ChannelLive},
+		Metadata: &SnapshotMetadata{Labels: map[string]string{"ticket": "true"}},
+	}})
+	if err := WriteReport(&buf, OutputYAML, list); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"kind: snapshot-list\nschema_version: 1\nmirrors:\n  - mirror: test-mirror\n",
+		`name: "2024"`,
+		"channels:\n          - live\n",
+		`ticket: "true"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+
+	if err := WriteReport(&buf, OutputTable, r); err == nil {
+		t.Error("expected an error for the table format")
+	}
+}
+
+func TestReportSchema(t *testing.T) {
+	for _, kind := range ReportKinds() {
+		if _, err := ReportSchema(kind); err != nil {
+			t.Errorf("%s: %v", kind, err)
+		}
+	}
+	if _, err := ReportSchema("unknown"); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+
+	schema, err := ReportSchema(ReportPrune)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := schema["properties"].(map[string]any)
+	if kind := props["kind"].(map[string]any); kind["const"] != ReportPrune {
+		t.Errorf("unexpected kind: %v", kind)
+	}
+	if required := schema["required"].([]string); !slices.Equal(required, []string{"dry_run", "kind", "mirrors", "schema_version"}) {
+		t.Errorf("unexpected required fields: %v", required)
+	}
+	mirror := props["mirrors"].(map[string]any)["items"].(map[string]any)
+	if _, ok := mirror["properties"].(map[string]any)["freed_size"]; !ok || slices.Contains(mirror["required"].([]string), "freed_size") {
+		t.Errorf("expected freed_size to be optional: %v", mirror)
+	}
+}
+
+func TestPruneReport(t *testing.T) {
+	tmpDir := t.TempDir()
+	old := filepath.Join(tmpDir, "old")
+	writeTestFile(t, filepath.Join(old, "pool/a.deb"), []byte("12345"))
+	decisions := []*PruneDecision{
+		{Snapshot: &SnapshotInfo{Name: "old", Path: old, ExclusiveSize: 5}},
+		{Snapshot: &SnapshotInfo{Name: "new"}, Reasons: []string{"last 1"}},
+	}
+
+	mp := NewPruneReport(true).Add("test-mirror", decisions)
+	if len(mp.Delete) != 1 || mp.Delete[0].Snapshot != "old" || mp.Delete[0].Reasons == nil || mp.FreedSize != 5 {
+		t.Errorf("unexpected deletions: %+v", mp)
+	}
+	if len(mp.Keep) != 1 || mp.Keep[0].Snapshot != "new" {
+		t.Errorf("unexpected kept snapshots: %+v", mp.Keep)
+	}
+
+	// Only dry runs measure the space freed
+	if mp := NewPruneReport(false).Add("test-mirror", decisions); mp.FreedSize != 0 {
+		t.Errorf("expected no freed size, got %d", mp.FreedSize)
+	}
+}
+
+func TestTLSCheckReport_WriteTable(t *testing.T) {
+	r := &TLSCheckReport{
+		Mirror: "test-mirror",
+		Host:   "example.com",
+		Port:   "443",
+		Versions: []*TLSVersionSupport{
+			{Version: "TLS 1.1", Error: "protocol version not supported"},
+			{Version: "TLS 1.3", Supported: true},
+		},
+		Connection: &TLSConnection{
+			Version:     "TLS 1.3",
+			CipherSuite: "TLS_AES_128_GCM_SHA256",
+			Certificates: []*TLSCertificate{
+				{Subject: "example.com", Issuer: "Example CA", NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `Checking TLS status for mirror 'test-mirror' (example.com:443)...
+
+[+] TLS Version Support:
+    TLS 1.1: Not Supported (protocol version not supported)
+    TLS 1.3: Supported
+
+[+] Connection Details:
+    Negotiated Version: TLS 1.3
+    Negotiated Cipher:  TLS_AES_128_GCM_SHA256
+
+[+] Server Certificate Chain:
+    - Cert 0:
+      Subject:  example.com
+      Issuer:   Example CA
+      Expires:  2030-01-01T00:00:00Z
+
+TLS check complete.
+`
+	if buf.String() != want {
+		t.Errorf("unexpected table:\n%s", buf.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -13,12 +14,31 @@ import (
 type SnapshotConfig struct {
 	DefaultNameFormat string              `toml:"default_name_format"`
 	Prune             SnapshotPruneConfig `toml:"prune"`
+
+	// Gates must pass before a snapshot of any mirror is published.
+	Gates []*GateConfig `toml:"gates,omitempty"`
 }
 
 // SnapshotPruneConfig defines retention policies
 type SnapshotPruneConfig struct {
 	KeepLast   int    `toml:"keep_last"`
 	KeepWithin string `toml:"keep_within"`
+
+	// Grandfather-father-son buckets keep the newest snapshot of
+	// each of the last N days, ISO weeks, months and years (in UTC)
+	// that have snapshots.
+	KeepDaily   int `toml:"keep_daily"`
+	KeepWeekly  int `toml:"keep_weekly"`
+	KeepMonthly int `toml:"keep_monthly"`
+	KeepYearly  int `toml:"keep_yearly"`
+
+	// Space limits delete the oldest snapshots that are not published,
+	// staged or pinned, even if other rules keep them.  MaxTotalSize
+	// limits the space used by the snapshots of a mirror beyond the
+	// live mirror, and MinFreeSpace the free space left on the
+	// filesystem holding the snapshots.  Sizes are like "500GiB".
+	MaxTotalSize string `toml:"max_total_size"`
+	MinFreeSpace string `toml:"min_free_space"`
 }
 
 // MirrorSnapshotConfig defines per-mirror snapshot overrides
@@ -27,6 +47,18 @@ type SnapshotPruneConfig struct {
 type MirrorSnapshotConfig struct {
 	DefaultNameFormat string               `toml:"default_name_format,omitempty"`
 	Prune             *SnapshotPruneConfig `toml:"prune,omitempty"`
+
+	// Channels are named symlinks to snapshots in addition to the
+	// built-in live and staging channels.
+	Channels map[string]*ChannelConfig `toml:"channels,omitempty"`
+
+	// Promotion is the order in which snapshots are promoted between
+	// channels.  It defaults to ["staging", "live"].
+	Promotion []string `toml:"promotion,omitempty"`
+
+	// Gates must pass before a snapshot of the mirror is published,
+	// in addition to the global gates.
+	Gates []*GateConfig `toml:"gates,omitempty"`
 }
 
 // SnapshotManager handles snapshot operations
@@ -34,6 +66,24 @@ type SnapshotManager struct {
 	config       *SnapshotConfig
 	livePath     string // Base path where live mirrors are symlinked (e.g., /var/www/apt)
 	snapshotPath string // Path where snapshots are stored (always .snapshots sibling to livePath)
+	reason       string // Reason recorded in the history for subsequent operations
+	user         string // User recorded in the history instead of the invoking user
+
+	// mirrors holds the configuration of channels and gates
+	mirrors map[string]*MirrorConfig
+
+	// overrideGates lets publications proceed when gates fail
+	overrideGates bool
+
+	// hooks are the global hooks; the hooks of mirrors are in mirrors
+	hooks []*HookConfig
+
+	// notifier delivers notifications of publications
+	notifier *Notifier
+
+	// pending, if set, collects the notifications instead of sending
+	// them
+	pending *[]*Notification
 }
 
 // SnapshotInfo represents a snapshot
@@ -44,19 +94,47 @@ type SnapshotInfo struct {
 	CreatedAt   time.Time
 	IsPublished bool
 	IsStaged    bool
-	Size        int64
+	IsPinned    bool
 	FileCount   int
+
+	// Channels lists the channels pointing to the snapshot, including
+	// live and staging.
+	Channels []string
+
+	// Size counts hard-linked files once.  ExclusiveSize is the part
+	// that deleting the snapshot would free, SharedSize the part also
+	// linked from other snapshots or the live mirror.
+	Size          int64
+	SharedSize    int64
+	ExclusiveSize int64
+
+	// Metadata is nil for snapshots created without a metadata file.
+	Metadata *SnapshotMetadata
 }
 
 // Status returns a human-readable status string for the snapshot
 func (s *SnapshotInfo) Status() string {
+	return snapshotStatus(s.IsPublished, s.IsStaged, s.IsPinned, s.Channels)
+}
+
+// snapshotStatus returns the status string of a snapshot, such as
+// "(published, on testing, pinned)", or "" for unused snapshots.
+func snapshotStatus(published, staged, pinned bool, channels []string) string {
 	var statusParts []string
-	if s.IsPublished {
+	if published {
 		statusParts = append(statusParts, "published")
 	}
-	if s.IsStaged {
+	if staged {
 		statusParts = append(statusParts, "staged")
 	}
+	for _, channel := range channels {
+		if channel != ChannelLive && channel != ChannelStaging {
+			statusParts = append(statusParts, "on "+channel)
+		}
+	}
+	if pinned {
+		statusParts = append(statusParts, "pinned")
+	}
 
 	if len(statusParts) == 0 {
 		return ""
@@ -281,12 +359,22 @@ func (sm *SnapshotManager) ListSnapshots(mirror string) ([]*SnapshotInfo, error)
 		return nil, fmt.Errorf("failed to list snapshots for mirror %s: %w", mirror, err)
 	}
 
+	channels, err := sm.ListChannels(mirror)
+	if err != nil {
+		return nil, err
+	}
+	onChannels := make(map[string][]string)
+	for _, ch := range channels {
+		if ch.Snapshot != "" {
+			onChannels[ch.Snapshot] = append(onChannels[ch.Snapshot], ch.Name)
+		}
+	}
+
 	var snapshots []*SnapshotInfo
-	currentlyPublished, _ := sm.GetCurrentlyPublished(mirror)
-	currentlyStaged, _ := sm.GetCurrentlyStaged(mirror)
 
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		// Skip files and hidden directories such as unfinished imports
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
 			continue
 		}
 
@@ -296,18 +384,28 @@ func (sm *SnapshotManager) ListSnapshots(mirror string) ([]*SnapshotInfo, error)
 			continue // Skip entries we can't stat
 		}
 
-		// Calculate size and file count
-		size, fileCount := sm.calculateSnapshotSize(snapshotPath)
+		usage := MeasureDiskUsage(snapshotPath)
 
 		snapshot := &SnapshotInfo{
-			Name:        entry.Name(),
-			Mirror:      mirror,
-			Path:        snapshotPath,
-			CreatedAt:   info.ModTime(),
-			IsPublished: entry.Name() == currentlyPublished,
-			IsStaged:    entry.Name() == currentlyStaged,
-			Size:        size,
-			FileCount:   fileCount,
+			Name:          entry.Name(),
+			Mirror:        mirror,
+			Path:          snapshotPath,
+			CreatedAt:     info.ModTime(),
+			IsPublished:   slices.Contains(onChannels[entry.Name()], ChannelLive),
+			IsStaged:      slices.Contains(onChannels[entry.Name()], ChannelStaging),
+			Channels:      onChannels[entry.Name()],
+			FileCount:     usage.Files,
+			Size:          usage.Size,
+			SharedSize:    usage.Shared(),
+			ExclusiveSize: usage.Exclusive,
+		}
+
+		// The metadata records the creation time more reliably
+		// than the modification time of the directory
+		if md, err := loadSnapshotMetadata(snapshotPath); err == nil {
+			snapshot.Metadata = md
+			snapshot.CreatedAt = md.CreatedAt
+			snapshot.IsPinned = md.Pinned
 		}
 
 		snapshots = append(snapshots, snapshot)
@@ -321,28 +419,15 @@ func (sm *SnapshotManager) ListSnapshots(mirror string) ([]*SnapshotInfo, error)
 	return snapshots, nil
 }
 
-// calculateSnapshotSize calculates the total size and file count of a snapshot
-func (sm *SnapshotManager) calculateSnapshotSize(path string) (int64, int) {
-	var totalSize int64
-	var fileCount int
-
-	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // Skip errors
-		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-			fileCount++
-		}
-		return nil
-	})
-
-	return totalSize, fileCount
-}
-
 // CreateSnapshot creates a new snapshot by hard-linking files from the live mirror
 // Returns the actual snapshot name that was used
 func (sm *SnapshotManager) CreateSnapshot(mirror, snapshotName string, force bool, mirrorConfig *MirrorSnapshotConfig) (string, error) {
+	return sm.CreateSnapshotWithOptions(mirror, snapshotName, force, mirrorConfig, SnapshotOptions{})
+}
+
+// CreateSnapshotWithOptions creates a new snapshot like CreateSnapshot
+// and records opts in its metadata.
+func (sm *SnapshotManager) CreateSnapshotWithOptions(mirror, snapshotName string, force bool, mirrorConfig *MirrorSnapshotConfig, opts SnapshotOptions) (string, error) {
 	if snapshotName == "" {
 		snapshotName = sm.GenerateSnapshotNameForMirror(mirrorConfig)
 	}
@@ -371,7 +456,7 @@ func (sm *SnapshotManager) CreateSnapshot(mirror, snapshotName string, force boo
 			return "", fmt.Errorf("snapshot %s already exists for mirror %s (use --force to overwrite)", snapshotName, mirror)
 		}
 		// Remove existing snapshot
-		if err := os.RemoveAll(snapshotPath); err != nil {
+		if err := removeSnapshotFiles(snapshotPath); err != nil {
 			return "", fmt.Errorf("failed to remove existing snapshot: %w", err)
 		}
 	}
@@ -390,6 +475,13 @@ func (sm *SnapshotManager) CreateSnapshot(mirror, snapshotName string, force boo
 		return "", fmt.Errorf("failed to create hard links: %w", err)
 	}
 
+	md := newSnapshotMetadata(mirror, snapshotName, resolvedLivePath, opts)
+	if err := saveSnapshotMetadata(snapshotPath, md); err != nil {
+		os.RemoveAll(snapshotPath) // #nosec G104 - cleanup on failure, ignore errors
+		return "", fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+	copySnapshotChecksums(resolvedLivePath, snapshotPath)
+
 	return snapshotName, nil
 }
 
@@ -428,147 +520,75 @@ func (sm *SnapshotManager) createHardLinks(src, dst string) error {
 }
 
 // PublishSnapshot makes a snapshot the live version by updating the symlink
-func (sm *SnapshotManager) PublishSnapshot(mirror, snapshotName string) error {
-	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+func (sm *SnapshotManager) PublishSnapshot(mirror, snapshotName string) (err error) {
+	oldTarget, _ := sm.GetCurrentlyPublished(mirror)
+	e := sm.publishEvent(HistoryPublish, mirror, snapshotName, ChannelLive, oldTarget)
+	defer func() { sm.postPublish(e, err) }()
+
+	overridden, err := sm.checkGates(mirror, ChannelLive, snapshotName)
 	if err != nil {
 		return err
 	}
-	livePath := sm.GetLivePath(mirror)
-
-	// Verify snapshot exists
-	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
-		return fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
-	}
-
-	// Create live directory if it doesn't exist
-	liveDir := filepath.Dir(livePath)
-	// #nosec G301 - 0755 needed for web server directory access
-	if err := os.MkdirAll(liveDir, 0755); err != nil {
-		return fmt.Errorf("failed to create live directory: %w", err)
-	}
-
-	// Create temporary symlink name
-	tempLink := livePath + ".tmp"
-
-	// Remove temporary link if it exists
-	os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors
-
-	// Create new symlink
-	if err := os.Symlink(snapshotPath, tempLink); err != nil {
-		return fmt.Errorf("failed to create temporary symlink: %w", err)
+	if err = sm.prePublish(e); err != nil {
+		return err
 	}
-
-	// Remove existing live symlink before renaming (ignore errors)
-	os.Remove(livePath) // #nosec G104 - cleanup operation, errors expected and ignored
-
-	// Atomically replace the live symlink
-	if err := os.Rename(tempLink, livePath); err != nil {
-		os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors // #nosec G104 - cleanup on failure, ignore errors
-		return fmt.Errorf("failed to update live symlink: %w", err)
+	if err = sm.publish(mirror, snapshotName); err != nil {
+		return err
 	}
-
+	sm.appendHistory(mirror, &HistoryEntry{
+		Action:          HistoryPublish,
+		Snapshot:        snapshotName,
+		OldTarget:       oldTarget,
+		NewTarget:       snapshotName,
+		OverriddenGates: overridden,
+	})
 	return nil
 }
 
+// publish atomically points the live symlink to a snapshot.
+func (sm *SnapshotManager) publish(mirror, snapshotName string) error {
+	return sm.link(mirror, snapshotName, sm.GetLivePath(mirror), ChannelLive)
+}
+
 // PublishSnapshotToStaging makes a snapshot the staged version by updating the staging symlink
-func (sm *SnapshotManager) PublishSnapshotToStaging(mirror, snapshotName string) error {
-	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+func (sm *SnapshotManager) PublishSnapshotToStaging(mirror, snapshotName string) (err error) {
+	oldTarget, _ := sm.GetCurrentlyStaged(mirror)
+	e := sm.publishEvent(HistoryStage, mirror, snapshotName, ChannelStaging, oldTarget)
+	defer func() { sm.postPublish(e, err) }()
+
+	overridden, err := sm.checkGates(mirror, ChannelStaging, snapshotName)
 	if err != nil {
 		return err
 	}
-	stagingPath := sm.GetStagingPath(mirror)
-
-	// Verify snapshot exists
-	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
-		return fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
-	}
-
-	// Create staging directory if it doesn't exist
-	stagingDir := filepath.Dir(stagingPath)
-	// #nosec G301 - 0755 needed for web server directory access
-	if err := os.MkdirAll(stagingDir, 0755); err != nil {
-		return fmt.Errorf("failed to create staging directory: %w", err)
-	}
-
-	// Create temporary symlink name
-	tempLink := stagingPath + ".tmp"
-
-	// Remove temporary link if it exists
-	os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors
-
-	// Create new symlink
-	if err := os.Symlink(snapshotPath, tempLink); err != nil {
-		return fmt.Errorf("failed to create temporary staging symlink: %w", err)
+	if err = sm.prePublish(e); err != nil {
+		return err
 	}
-
-	// Remove existing staging symlink before renaming (ignore errors)
-	os.Remove(stagingPath) // #nosec G104 - cleanup operation, errors expected and ignored
-
-	// Atomically replace the staging symlink
-	if err := os.Rename(tempLink, stagingPath); err != nil {
-		os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors // #nosec G104 - cleanup on failure, ignore errors
-		return fmt.Errorf("failed to update staging symlink: %w", err)
+	if err = sm.stage(mirror, snapshotName); err != nil {
+		return err
 	}
-
+	sm.appendHistory(mirror, &HistoryEntry{
+		Action:          HistoryStage,
+		Snapshot:        snapshotName,
+		OldTarget:       oldTarget,
+		NewTarget:       snapshotName,
+		OverriddenGates: overridden,
+	})
 	return nil
 }
 
-// PromoteSnapshot promotes the currently staged snapshot to production
-func (sm *SnapshotManager) PromoteSnapshot(mirror string) (string, error) {
-	stagingPath := sm.GetStagingPath(mirror)
-	livePath := sm.GetLivePath(mirror)
-
-	// Verify staging symlink exists
-	if _, err := os.Lstat(stagingPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("no snapshot is currently staged for mirror %s", mirror)
-	}
-
-	// Read the staging symlink target
-	target, err := os.Readlink(stagingPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read staging symlink for mirror %s: %w", mirror, err)
-	}
-
-	// Extract snapshot name for return value
-	snapshotName := filepath.Base(target)
-
-	// Verify the target snapshot actually exists
-	if _, err := os.Stat(target); os.IsNotExist(err) {
-		return "", fmt.Errorf("staged snapshot %s does not exist for mirror %s", snapshotName, mirror)
-	}
-
-	// Create live directory if it doesn't exist
-	liveDir := filepath.Dir(livePath)
-	// #nosec G301 - 0755 needed for web server directory access
-	if err := os.MkdirAll(liveDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create live directory: %w", err)
-	}
-
-	// Create temporary symlink name
-	tempLink := livePath + ".tmp"
-
-	// Remove temporary link if it exists
-	os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors
-
-	// Create new symlink pointing to the same target as staging
-	if err := os.Symlink(target, tempLink); err != nil {
-		return "", fmt.Errorf("failed to create temporary production symlink: %w", err)
-	}
-
-	// Remove existing production symlink before renaming (ignore errors)
-	os.Remove(livePath) // #nosec G104 - cleanup operation, errors expected and ignored
-
-	// Atomically replace the production symlink
-	if err := os.Rename(tempLink, livePath); err != nil {
-		os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors // #nosec G104 - cleanup on failure, ignore errors
-		return "", fmt.Errorf("failed to update production symlink: %w", err)
-	}
+// stage atomically points the staging symlink to a snapshot.
+func (sm *SnapshotManager) stage(mirror, snapshotName string) error {
+	return sm.link(mirror, snapshotName, sm.GetStagingPath(mirror), ChannelStaging)
+}
 
-	return snapshotName, nil
+// PromoteSnapshot promotes the currently staged snapshot to production,
+// regardless of the promotion chain of the mirror.
+func (sm *SnapshotManager) PromoteSnapshot(mirror string) (string, error) {
+	return sm.promote(mirror, ChannelStaging, ChannelLive)
 }
 
 // DeleteSnapshot removes a snapshot
-func (sm *SnapshotManager) DeleteSnapshot(mirror, snapshotName string, force bool) error {
+func (sm *SnapshotManager) DeleteSnapshot(mirror, snapshotName string, force bool) (err error) {
 	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
 	if err != nil {
 		return err
@@ -579,36 +599,67 @@ func (sm *SnapshotManager) DeleteSnapshot(mirror, snapshotName string, force boo
 		return fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
 	}
 
-	// Check if snapshot is currently published
-	currentlyPublished, err := sm.GetCurrentlyPublished(mirror)
-	if err == nil && currentlyPublished == snapshotName {
+	e := sm.publishEvent(HistoryDelete, mirror, snapshotName, "", "")
+	defer func() { sm.postPublish(e, err) }()
+
+	// Check if snapshot is currently on a channel
+	channels, err := sm.ListChannels(mirror)
+	if err != nil {
+		return err
+	}
+	var linked []*Channel
+	for _, ch := range channels {
+		if ch.Snapshot != snapshotName {
+			continue
+		}
 		if !force {
-			return fmt.Errorf("cannot delete snapshot %s as it is currently published for mirror %s (use --force to override)", snapshotName, mirror)
+			state := "on channel " + ch.Name
+			switch ch.Name {
+			case ChannelLive:
+				state = "published"
+			case ChannelStaging:
+				state = "staged"
+			}
+			return fmt.Errorf("cannot delete snapshot %s as it is currently %s for mirror %s (use --force to override)", snapshotName, state, mirror)
 		}
-		// With --force, remove the live symlink first
-		os.Remove(sm.GetLivePath(mirror)) // #nosec G104 - force cleanup, ignore errors
+		linked = append(linked, ch)
 	}
 
-	// Check if snapshot is currently staged
-	currentlyStaged, err := sm.GetCurrentlyStaged(mirror)
-	if err == nil && currentlyStaged == snapshotName {
-		if !force {
-			return fmt.Errorf("cannot delete snapshot %s as it is currently staged for mirror %s (use --force to override)", snapshotName, mirror)
-		}
-		// With --force, remove the staging symlink first
-		os.Remove(sm.GetStagingPath(mirror)) // #nosec G104 - force cleanup, ignore errors
+	if err = sm.prePublish(e); err != nil {
+		return err
+	}
+
+	// With --force, remove the symlinks first
+	var unlinked []string
+	for _, ch := range linked {
+		os.Remove(ch.Path) // #nosec G104 - force cleanup, ignore errors
+		unlinked = append(unlinked, ch.Name)
 	}
 
 	// Remove the snapshot directory
-	if err := os.RemoveAll(snapshotPath); err != nil {
+	if err = removeSnapshotFiles(snapshotPath); err != nil {
 		return fmt.Errorf("failed to delete snapshot: %w", err)
 	}
+	if err = os.Remove(metadataPath(snapshotPath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete snapshot metadata: %w", err)
+	}
+
+	sm.appendHistory(mirror, &HistoryEntry{
+		Action:   HistoryDelete,
+		Snapshot: snapshotName,
+		Unlinked: unlinked,
+	})
 
 	return nil
 }
 
 // ParseDuration parses a duration string like "30d", "1w", "2h", "2h30m"
 func (sm *SnapshotManager) ParseDuration(duration string) (time.Duration, error) {
+	return parseDuration(duration)
+}
+
+// parseDuration parses a duration string like "30d", "1w", "2h", "2h30m"
+func parseDuration(duration string) (time.Duration, error) {
 	if duration == "" {
 		return 0, nil
 	}
@@ -653,6 +704,24 @@ func (sm *SnapshotManager) GetPruneConfig(_ string, mirrorConfig *MirrorSnapshot
 		if mirrorConfig.Prune.KeepWithin != "" {
 			config.KeepWithin = mirrorConfig.Prune.KeepWithin
 		}
+		if mirrorConfig.Prune.KeepDaily > 0 {
+			config.KeepDaily = mirrorConfig.Prune.KeepDaily
+		}
+		if mirrorConfig.Prune.KeepWeekly > 0 {
+			config.KeepWeekly = mirrorConfig.Prune.KeepWeekly
+		}
+		if mirrorConfig.Prune.KeepMonthly > 0 {
+			config.KeepMonthly = mirrorConfig.Prune.KeepMonthly
+		}
+		if mirrorConfig.Prune.KeepYearly > 0 {
+			config.KeepYearly = mirrorConfig.Prune.KeepYearly
+		}
+		if mirrorConfig.Prune.MaxTotalSize != "" {
+			config.MaxTotalSize = mirrorConfig.Prune.MaxTotalSize
+		}
+		if mirrorConfig.Prune.MinFreeSpace != "" {
+			config.MinFreeSpace = mirrorConfig.Prune.MinFreeSpace
+		}
 	}
 
 	return config
@@ -670,67 +739,14 @@ func (sm *SnapshotManager) PruneSnapshots(mirror string, mirrorConfig *MirrorSna
 		config.KeepWithin = *keepWithin
 	}
 
-	// Get all snapshots for the mirror
-	snapshots, err := sm.ListSnapshots(mirror)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list snapshots: %w", err)
-	}
-
-	// Remove currently published and staged snapshots from deletion list
-	var candidates []*SnapshotInfo
-	for _, snapshot := range snapshots {
-		if !snapshot.IsPublished && !snapshot.IsStaged {
-			candidates = append(candidates, snapshot)
-		}
-	}
-
-	// Sort by creation time (oldest first for deletion)
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].CreatedAt.Before(candidates[j].CreatedAt)
-	})
-
-	// Apply keep-last rule
-	if config.KeepLast > 0 && len(candidates) > config.KeepLast {
-		// Keep the newest config.KeepLast snapshots, delete the rest (oldest)
-		// Since candidates is sorted oldest->newest, delete from beginning
-		candidates = candidates[:len(candidates)-config.KeepLast]
-	}
-	// If we have <= KeepLast candidates, don't delete any based on this rule alone
-
-	// Apply keep-within rule
-	if config.KeepWithin != "" {
-		duration, err := sm.ParseDuration(config.KeepWithin)
-		if err != nil {
-			return nil, fmt.Errorf("invalid keep_within duration: %w", err)
-		}
+	decisions, err := sm.PruneSnapshotsWithConfig(mirror, config, dryRun)
 
-		cutoff := time.Now().Add(-duration)
-		var filtered []*SnapshotInfo
-		for _, candidate := range candidates {
-			if candidate.CreatedAt.Before(cutoff) {
-				filtered = append(filtered, candidate)
-			}
-		}
-		candidates = filtered
-	}
-
-	// Collect names of snapshots to delete
+	// Collect names of snapshots deleted (or to delete)
 	var toDelete []string
-	for _, candidate := range candidates {
-		toDelete = append(toDelete, candidate.Name)
-	}
-
-	// If dry run, just return the list
-	if dryRun {
-		return toDelete, nil
-	}
-
-	// Actually delete the snapshots
-	for _, snapshotName := range toDelete {
-		if err := sm.DeleteSnapshot(mirror, snapshotName, false); err != nil {
-			return toDelete, fmt.Errorf("failed to delete snapshot %s: %w", snapshotName, err)
+	for _, d := range decisions {
+		if !d.Keep() {
+			toDelete = append(toDelete, d.Snapshot.Name)
 		}
 	}
-
-	return toDelete, nil
+	return toDelete, err
 }
@@ -0,0 +1,404 @@
+package mirror
+
+// This file implements named publish channels and the promotion chain.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Built-in channels of every mirror.
+const (
+	// ChannelLive is the production symlink, named after the mirror.
+	ChannelLive = "live"
+
+	// ChannelStaging is the staging symlink, "<mirror>-staging".
+	ChannelStaging = "staging"
+)
+
+// defaultPromotion is the promotion chain of mirrors that do not
+// configure one.
+var defaultPromotion = []string{ChannelStaging, ChannelLive}
+
+// ChannelConfig configures a publish channel of a mirror.
+type ChannelConfig struct {
+	// Path is the symlink of the channel relative to dir, such as
+	// "ubuntu-qa" or "lts/ubuntu-2026q3".  It defaults to
+	// "<mirror>-<channel>".
+	Path string `toml:"path,omitempty"`
+}
+
+// Check validates the per-mirror snapshot configuration.
+func (c *MirrorSnapshotConfig) Check() error {
+	if c.Prune != nil {
+		if err := c.Prune.Check(); err != nil {
+			return err
+		}
+	}
+
+	for name, ch := range c.Channels {
+		if err := validateSafeName(name, "channel name", false); err != nil {
+			return err
+		}
+		if name == ChannelLive || name == ChannelStaging {
+			return fmt.Errorf("channel %s is built in and cannot be configured", name)
+		}
+		if ch != nil && ch.Path != "" {
+			for _, component := range strings.Split(ch.Path, "/") {
+				if err := ValidatePathComponent(component); err != nil {
+					return fmt.Errorf("invalid path of channel %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range c.Promotion {
+		if _, ok := c.Channels[name]; !ok && name != ChannelLive && name != ChannelStaging {
+			return fmt.Errorf("promotion chain refers to unknown channel %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("channel %s appears twice in the promotion chain", name)
+		}
+		seen[name] = true
+	}
+
+	for _, g := range c.Gates {
+		if err := g.Check(); err != nil {
+			return err
+		}
+		for _, name := range g.Channels {
+			if _, ok := c.Channels[name]; !ok && name != ChannelLive && name != ChannelStaging {
+				return fmt.Errorf("gate %s refers to unknown channel %s", g.name(), name)
+			}
+		}
+	}
+	return nil
+}
+
+// Channel is a named symlink pointing to a snapshot of a mirror.
+type Channel struct {
+	Name string
+	Path string
+
+	// Snapshot is the snapshot the channel points to, or empty.
+	Snapshot string
+}
+
+// WithMirrorConfigs returns a copy of sm that knows the channels,
+// promotion chains and gates configured for mirrors.  Without it,
+// mirrors only have the live and staging channels.
+func (sm *SnapshotManager) WithMirrorConfigs(mirrors map[string]*MirrorConfig) *SnapshotManager {
+	c := *sm
+	c.mirrors = mirrors
+	return &c
+}
+
+// snapshotConfig returns the snapshot configuration of mirror, or nil.
+func (sm *SnapshotManager) snapshotConfig(mirror string) *MirrorSnapshotConfig {
+	if mc := sm.mirrors[mirror]; mc != nil {
+		return mc.Snapshot
+	}
+	return nil
+}
+
+// channelConfigs returns the configured channels of mirror.
+func (sm *SnapshotManager) channelConfigs(mirror string) map[string]*ChannelConfig {
+	if mc := sm.snapshotConfig(mirror); mc != nil {
+		return mc.Channels
+	}
+	return nil
+}
+
+// ChannelNames returns the channels of mirror: live, staging and the
+// configured channels in alphabetical order.
+func (sm *SnapshotManager) ChannelNames(mirror string) []string {
+	names := []string{ChannelLive, ChannelStaging}
+	var configured []string
+	for name := range sm.channelConfigs(mirror) {
+		configured = append(configured, name)
+	}
+	sort.Strings(configured)
+	return append(names, configured...)
+}
+
+// PromotionChain returns the order in which snapshots of mirror are
+// promoted between channels.
+func (sm *SnapshotManager) PromotionChain(mirror string) []string {
+	if mc := sm.snapshotConfig(mirror); mc != nil && len(mc.Promotion) > 0 {
+		return mc.Promotion
+	}
+	return defaultPromotion
+}
+
+// GetChannelPath returns the path of the symlink of a channel.
+func (sm *SnapshotManager) GetChannelPath(mirror, channel string) (string, error) {
+	if err := ValidatePathComponent(mirror); err != nil {
+		return "", fmt.Errorf("invalid mirror ID: %w", err)
+	}
+
+	switch channel {
+	case ChannelLive:
+		return sm.GetLivePath(mirror), nil
+	case ChannelStaging:
+		return sm.GetStagingPath(mirror), nil
+	}
+
+	ch, ok := sm.channelConfigs(mirror)[channel]
+	if !ok {
+		return "", fmt.Errorf("unknown channel %s for mirror %s", channel, mirror)
+	}
+	if ch == nil || ch.Path == "" {
+		return filepath.Join(sm.livePath, mirror+"-"+channel), nil
+	}
+	return filepath.Join(sm.livePath, filepath.FromSlash(ch.Path)), nil
+}
+
+// GetChannelSnapshot returns the name of the snapshot a channel points to.
+func (sm *SnapshotManager) GetChannelSnapshot(mirror, channel string) (string, error) {
+	linkPath, err := sm.GetChannelPath(mirror, channel)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no snapshot on channel %s for mirror %s", channel, mirror)
+		}
+		return "", fmt.Errorf("failed to read %s symlink for mirror %s: %w", channel, mirror, err)
+	}
+	return filepath.Base(target), nil
+}
+
+// ListChannels returns the channels of mirror and their snapshots.
+func (sm *SnapshotManager) ListChannels(mirror string) ([]*Channel, error) {
+	var channels []*Channel
+	for _, name := range sm.ChannelNames(mirror) {
+		linkPath, err := sm.GetChannelPath(mirror, name)
+		if err != nil {
+			return nil, err
+		}
+		snapshot, _ := sm.GetChannelSnapshot(mirror, name)
+		channels = append(channels, &Channel{Name: name, Path: linkPath, Snapshot: snapshot})
+	}
+	return channels, nil
+}
+
+// isLiveChannel reports whether channel is the live symlink of mirror,
+// either by name or because it is configured with the same path.
+func (sm *SnapshotManager) isLiveChannel(mirror, channel string) bool {
+	if channel == "" || channel == ChannelLive {
+		return true
+	}
+	p, err := sm.GetChannelPath(mirror, channel)
+	return err == nil && p == sm.GetLivePath(mirror)
+}
+
+// PublishToChannel points a channel to a snapshot.
+func (sm *SnapshotManager) PublishToChannel(mirror, channel, snapshotName string) (err error) {
+	switch channel {
+	case ChannelLive:
+		return sm.PublishSnapshot(mirror, snapshotName)
+	case ChannelStaging:
+		return sm.PublishSnapshotToStaging(mirror, snapshotName)
+	}
+
+	linkPath, err := sm.GetChannelPath(mirror, channel)
+	if err != nil {
+		return err
+	}
+	oldTarget, _ := sm.GetChannelSnapshot(mirror, channel)
+	e := sm.publishEvent(HistoryPublish, mirror, snapshotName, channel, oldTarget)
+	defer func() { sm.postPublish(e, err) }()
+
+	overridden, err := sm.checkGates(mirror, channel, snapshotName)
+	if err != nil {
+		return err
+	}
+	if err = sm.prePublish(e); err != nil {
+		return err
+	}
+	if err = sm.link(mirror, snapshotName, linkPath, channel); err != nil {
+		return err
+	}
+	sm.appendHistory(mirror, &HistoryEntry{
+		Action:          HistoryPublish,
+		Channel:         channel,
+		Snapshot:        snapshotName,
+		OldTarget:       oldTarget,
+		NewTarget:       snapshotName,
+		OverriddenGates: overridden,
+	})
+	return nil
+}
+
+// nextChannel returns the channel following from in the promotion chain.
+func (sm *SnapshotManager) nextChannel(mirror, from string) (string, error) {
+	chain := sm.PromotionChain(mirror)
+	i := slices.Index(chain, from)
+	switch {
+	case i < 0:
+		return "", fmt.Errorf("channel %s is not in the promotion chain of mirror %s (%s)", from, mirror, strings.Join(chain, " -> "))
+	case i == len(chain)-1:
+		return "", fmt.Errorf("channel %s is the end of the promotion chain of mirror %s", from, mirror)
+	}
+	return chain[i+1], nil
+}
+
+// PromoteChannel points channel to to the snapshot of channel from,
+// and returns the name of the snapshot.  to must follow from in the
+// promotion chain of the mirror; if it is empty, it is the channel
+// following from.
+func (sm *SnapshotManager) PromoteChannel(mirror, from, to string) (string, error) {
+	next, err := sm.nextChannel(mirror, from)
+	if err != nil {
+		return "", err
+	}
+	if to == "" {
+		to = next
+	}
+	if to != next {
+		return "", fmt.Errorf("cannot promote from %s to %s: the next channel in the promotion chain of mirror %s is %s", from, to, mirror, next)
+	}
+	return sm.promote(mirror, from, to)
+}
+
+// promote points channel to to the snapshot of channel from.
+func (sm *SnapshotManager) promote(mirror, from, to string) (_ string, err error) {
+	fromPath, err := sm.GetChannelPath(mirror, from)
+	if err != nil {
+		return "", err
+	}
+	toPath, err := sm.GetChannelPath(mirror, to)
+	if err != nil {
+		return "", err
+	}
+
+	// Verify the source symlink exists
+	if _, err := os.Lstat(fromPath); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("no snapshot is currently on channel %s for mirror %s", from, mirror)
+	}
+	snapshotName, err := sm.GetChannelSnapshot(mirror, from)
+	if err != nil {
+		return "", err
+	}
+	oldTarget, _ := sm.GetChannelSnapshot(mirror, to)
+	e := sm.publishEvent(HistoryPromote, mirror, snapshotName, to, oldTarget)
+	defer func() { sm.postPublish(e, err) }()
+
+	overridden, err := sm.checkGates(mirror, to, snapshotName)
+	if err != nil {
+		return "", err
+	}
+	if err = sm.prePublish(e); err != nil {
+		return "", err
+	}
+
+	if err = sm.link(mirror, snapshotName, toPath, to); err != nil {
+		return "", err
+	}
+
+	h := &HistoryEntry{
+		Action:          HistoryPromote,
+		Snapshot:        snapshotName,
+		OldTarget:       oldTarget,
+		NewTarget:       snapshotName,
+		OverriddenGates: overridden,
+	}
+	// The default promotion from staging to live is recorded without
+	// channels, as before channels existed
+	if from != ChannelStaging || to != ChannelLive {
+		h.FromChannel = from
+		h.Channel = to
+	}
+	sm.appendHistory(mirror, h)
+	return snapshotName, nil
+}
+
+// link atomically points the symlink at linkPath, the channel named
+// label, to a snapshot.
+func (sm *SnapshotManager) link(mirror, snapshotName, linkPath, label string) error {
+	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	// Verify snapshot exists
+	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
+		return fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
+	}
+
+	// Create the parent directory if it doesn't exist
+	if err := sm.mkdirChannelDir(filepath.Dir(linkPath)); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", label, err)
+	}
+
+	// Create temporary symlink name
+	tempLink := linkPath + ".tmp"
+
+	// Remove temporary link if it exists
+	os.Remove(tempLink) // #nosec G104 - cleanup operation, ignore errors
+
+	// Create new symlink
+	if err := os.Symlink(snapshotPath, tempLink); err != nil {
+		return fmt.Errorf("failed to create temporary %s symlink: %w", label, err)
+	}
+
+	// Remove existing symlink before renaming (ignore errors)
+	os.Remove(linkPath) // #nosec G104 - cleanup operation, errors expected and ignored
+
+	// Atomically replace the symlink
+	if err := os.Rename(tempLink, linkPath); err != nil {
+		os.Remove(tempLink) // #nosec G104 - cleanup on failure, ignore errors
+		return fmt.Errorf("failed to update %s symlink: %w", label, err)
+	}
+
+	return nil
+}
+
+// mkdirChannelDir creates dir, a directory holding channel symlinks,
+// and its parents up to the live path.  Unlike os.MkdirAll, it does not
+// follow symlinks, so that a channel is never written into the tree of
+// a mirror or snapshot.
+func (sm *SnapshotManager) mkdirChannelDir(dir string) error {
+	// #nosec G301 - 0755 needed for web server directory access
+	if err := os.MkdirAll(sm.livePath, 0755); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(sm.livePath, dir)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s is outside of %s", dir, sm.livePath)
+	}
+
+	p := sm.livePath
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, component)
+		info, err := os.Lstat(p)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// #nosec G301 - 0755 needed for web server directory access
+			if err := os.Mkdir(p, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("%s is a symlink", p)
+		case !info.IsDir():
+			return fmt.Errorf("%s is not a directory", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotManager_Channels(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath).WithMirrorConfigs(map[string]*MirrorConfig{
+		"test-mirror": {Snapshot: &MirrorSnapshotConfig{
+			Channels: map[string]*ChannelConfig{
+				"dev":        nil,
+				"qa":         {Path: "qa/test-mirror"},
+				"lts-2026q3": {},
+			},
+			Promotion: []string{"dev", "qa", ChannelLive},
+		}},
+	})
+
+	for _, name := range []string{"s1", "s2"} {
+		p, err := sm.GetSnapshotPath("test-mirror", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(p, "dists/Release"), []byte(name))
+	}
+
+	if got := sm.ChannelNames("test-mirror"); !reflect.DeepEqual(got, []string{"live", "staging", "dev", "lts-2026q3", "qa"}) {
+		t.Errorf("unexpected channels: %v", got)
+	}
+	if p, _ := sm.GetChannelPath("test-mirror", "qa"); p != filepath.Join(livePath, "qa", "test-mirror") {
+		t.Errorf("unexpected path of qa: %s", p)
+	}
+	if p, _ := sm.GetChannelPath("test-mirror", "dev"); p != filepath.Join(livePath, "test-mirror-dev") {
+		t.Errorf("unexpected path of dev: %s", p)
+	}
+	if _, err := sm.GetChannelPath("test-mirror", "prod"); err == nil {
+		t.Error("expected an error for an unknown channel")
+	}
+
+	if err := sm.PublishToChannel("test-mirror", "dev", "s1"); err != nil {
+		t.Fatalf("PublishToChannel failed: %v", err)
+	}
+	if err := sm.PublishToChannel("test-mirror", "lts-2026q3", "s2"); err != nil {
+		t.Fatalf("PublishToChannel failed: %v", err)
+	}
+
+	// Promotions follow the chain
+	if _, err := sm.PromoteChannel("test-mirror", "dev", ChannelLive); err == nil {
+		t.Error("expected an error when skipping qa")
+	}
+	if _, err := sm.PromoteChannel("test-mirror", ChannelLive, ""); err == nil {
+		t.Error("expected an error when promoting from the end of the chain")
+	}
+	if _, err := sm.PromoteSnapshot("test-mirror"); err == nil {
+		t.Error("expected an error without a staged snapshot")
+	}
+	for _, from := range []string{"dev", "qa"} {
+		name, err := sm.PromoteChannel("test-mirror", from, "")
+		if err != nil || name != "s1" {
+			t.Fatalf("PromoteChannel from %s = %s, %v", from, name, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(livePath, "test-mirror", "dists/Release"))
+	if err != nil || string(data) != "s1" {
+		t.Errorf("expected s1 to be live: %q, %v", data, err)
+	}
+
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshots {
+		switch s.Name {
+		case "s1":
+			if !s.IsPublished || !reflect.DeepEqual(s.Channels, []string{"live", "dev", "qa"}) || s.Status() != "(published, on dev, on qa)" {
+				t.Errorf("unexpected channels of s1: %v %s", s.Channels, s.Status())
+			}
+		case "s2":
+			if s.IsPublished || s.Status() != "(on lts-2026q3)" {
+				t.Errorf("unexpected channels of s2: %v %s", s.Channels, s.Status())
+			}
+		}
+	}
+
+	// Snapshots on a channel are protected from prune and deletion
+	decisions, err := sm.PruneSnapshotsWithConfig("test-mirror", SnapshotPruneConfig{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range decisions {
+		if !d.Keep() {
+			t.Errorf("expected %s to be kept", d.Snapshot.Name)
+		}
+	}
+	err = sm.DeleteSnapshot("test-mirror", "s2", false)
+	if err == nil || !strings.Contains(err.Error(), "on channel lts-2026q3") {
+		t.Errorf("expected deletion to be refused, got %v", err)
+	}
+	if err := sm.DeleteSnapshot("test-mirror", "s2", true); err != nil {
+		t.Fatalf("forced deletion failed: %v", err)
+	}
+	if _, err := sm.GetChannelSnapshot("test-mirror", "lts-2026q3"); err == nil {
+		t.Error("expected the lts channel to be unlinked")
+	}
+
+	entries, err := sm.ReadHistory("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action+" "+e.FromChannel+">"+e.Channel+" "+strings.Join(e.Unlinked, ","))
+	}
+	want := []string{"publish >dev ", "publish >lts-2026q3 ", "promote dev>qa ", "promote qa>live ", "delete > lts-2026q3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected history:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestMirrorSnapshotConfig_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MirrorSnapshotConfig
+		valid  bool
+	}{
+		{"empty", MirrorSnapshotConfig{}, true},
+		{"chain", MirrorSnapshotConfig{
+			Channels:  map[string]*ChannelConfig{"qa": {Path: "qa/ubuntu"}},
+			Promotion: []string{ChannelStaging, "qa", ChannelLive},
+		}, true},
+		{"unknown channel", MirrorSnapshotConfig{Promotion: []string{"qa", ChannelLive}}, false},
+		{"repeated channel", MirrorSnapshotConfig{Promotion: []string{ChannelLive, ChannelLive}}, false},
+		{"built-in channel", MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{"live": nil}}, false},
+		{"invalid name", MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{"QA": nil}}, false},
+		{"traversal", MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{"qa": {Path: "../qa"}}}, false},
+		{"absolute", MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{"qa": {Path: "/qa"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
+
+func TestConfig_CheckChannelPaths(t *testing.T) {
+	c := &Config{Mirrors: map[string]*MirrorConfig{
+		"ubuntu": {Snapshot: &MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{
+			"prod": {Path: "ubuntu"},
+			"qa":   nil,
+		}}},
+		"debian": {},
+	}}
+	if err := c.checkChannelPaths(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.Mirrors["debian"].Snapshot = &MirrorSnapshotConfig{Channels: map[string]*ChannelConfig{
+		"ubuntu": {Path: "ubuntu-qa"},
+	}}
+	if err := c.checkChannelPaths(); err == nil {
+		t.Error("expected an error for a shared channel path")
+	}
+
+	// Channels may share a directory, but not be nested in a symlink
+	c.Mirrors["debian"].Snapshot.Channels = map[string]*ChannelConfig{
+		"qa":   {Path: "lts/debian-qa"},
+		"prod": {Path: "lts/debian-prod"},
+	}
+	if err := c.checkChannelPaths(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, nested := range []string{"ubuntu/stable", "ubuntu-staging/stable", "ubuntu-qa/stable", "lts/debian-qa/stable", "lts"} {
+		c.Mirrors["debian"].Snapshot.Channels["stable"] = &ChannelConfig{Path: nested}
+		if err := c.checkChannelPaths(); err == nil {
+			t.Errorf("expected an error for %s", nested)
+		}
+	}
+
+	// A mirror named after the directory of a channel
+	delete(c.Mirrors["debian"].Snapshot.Channels, "stable")
+	c.Mirrors["lts"] = &MirrorConfig{}
+	if err := c.checkChannelPaths(); err == nil {
+		t.Error("expected an error for a mirror named after a channel directory")
+	}
+}
+
+func TestSnapshotManager_ChannelInSymlink(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath).WithMirrorConfigs(map[string]*MirrorConfig{
+		"test-mirror": {Snapshot: &MirrorSnapshotConfig{
+			Channels: map[string]*ChannelConfig{"stable": {Path: "ubuntu/stable"}},
+		}},
+	})
+
+	p, err := sm.GetSnapshotPath("test-mirror", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(p, "dists/Release"), []byte("s1"))
+
+	// The live tree of another mirror must not be written to
+	ubuntu := filepath.Join(tmpDir, "ubuntu-tree")
+	for _, dir := range []string{ubuntu, livePath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(ubuntu, filepath.Join(livePath, "ubuntu")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.PublishToChannel("test-mirror", "stable", "s1"); err == nil {
+		t.Error("expected an error for a channel inside a symlink")
+	}
+	if entries, _ := os.ReadDir(ubuntu); len(entries) != 0 {
+		t.Errorf("the channel was written through the symlink: %v", entries)
+	}
+}
@@ -0,0 +1,271 @@
+package mirror
+
+// This file implements delta archives, which hold only the files of a
+// snapshot that are missing from a base snapshot.  The far side
+// reconstructs the snapshot by hard-linking the other files from its
+// copy of the base snapshot.
+//
+// To match files without reading whole snapshots, every snapshot has a
+// checksums file next to it, built from the info.json of the storage
+// it was created from.  Files it does not cover are hashed.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// snapshotChecksumsExt is appended to the snapshot directory to name
+// its checksums file.
+const snapshotChecksumsExt = ".files.json"
+
+// checksumsPath returns the path of the checksums file of a snapshot.
+func checksumsPath(snapshotPath string) string {
+	return filepath.Clean(snapshotPath) + snapshotChecksumsExt
+}
+
+// removeSnapshotFiles removes the tree of a snapshot and its checksums
+// file.  The metadata file is left alone.
+func removeSnapshotFiles(snapshotPath string) error {
+	if err := os.RemoveAll(snapshotPath); err != nil {
+		return err
+	}
+	if err := os.Remove(checksumsPath(snapshotPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// saveSnapshotChecksums writes the checksums file of a snapshot.
+func saveSnapshotChecksums(snapshotPath string, files []*ExportFile) error {
+	sorted := make([]*ExportFile, 0, len(files))
+	for _, f := range files {
+		sorted = append(sorted, &ExportFile{Path: f.Path, Size: f.Size, SHA256: f.SHA256})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	return writeJSONFile(checksumsPath(snapshotPath), sorted)
+}
+
+// storageChecksums converts the info.json of the storage at storageDir
+// to checksums of files in the snapshot tree.
+func storageChecksums(storageDir string) ([]*ExportFile, error) {
+	var info map[string]*apt.FileInfo
+	if err := readJSONFile(filepath.Join(storageDir, infoJSON), &info); err != nil {
+		return nil, err
+	}
+
+	files := make([]*ExportFile, 0, len(info))
+	for p, fi := range info {
+		sum := fi.SHA256Sum()
+		if sum == nil {
+			continue
+		}
+		files = append(files, &ExportFile{Path: p, Size: int64(fi.Size()), SHA256: hex.EncodeToString(sum)})
+	}
+	return files, nil
+}
+
+// copySnapshotChecksums writes the checksums file of the snapshot at
+// snapshotPath, created from the tree at resolvedLivePath.  This is
+// best effort: without checksums, files are hashed when needed.
+func copySnapshotChecksums(resolvedLivePath, snapshotPath string) {
+	files, err := storageChecksums(filepath.Dir(resolvedLivePath))
+	if err != nil {
+		// The tree may be another snapshot
+		if err := readJSONFile(checksumsPath(resolvedLivePath), &files); err != nil {
+			return
+		}
+	}
+	saveSnapshotChecksums(snapshotPath, files) // #nosec G104 - best effort
+}
+
+// snapshotChecksums returns the recorded checksums of the files of the
+// snapshot at snapshotPath by path.  It falls back to the info.json of
+// the storage the snapshot was created from, if it still exists.
+func snapshotChecksums(snapshotPath string) map[string]*ExportFile {
+	var files []*ExportFile
+	if err := readJSONFile(checksumsPath(snapshotPath), &files); err != nil {
+		if md, err := loadSnapshotMetadata(snapshotPath); err == nil && md.Source != "" {
+			files, _ = storageChecksums(md.Source)
+		}
+	}
+
+	sums := make(map[string]*ExportFile, len(files))
+	for _, f := range files {
+		sums[f.Path] = f
+	}
+	return sums
+}
+
+// fileChecksum returns the SHA256 checksum of the file at p of size
+// bytes.  The recorded checksum known is trusted if its size matches.
+func fileChecksum(p string, size int64, known *ExportFile) (string, error) {
+	if known != nil && known.Size == size {
+		return known.SHA256, nil
+	}
+
+	f, err := os.Open(p) // #nosec G304 - path found by walking a snapshot tree
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// deltaReuse returns the reuseFunc of a delta archive of the snapshot
+// at targetPath from the snapshot base.  Files are taken from the base
+// snapshot if it has a file with the same checksum, preferably at the
+// same path.
+func (sm *SnapshotManager) deltaReuse(mirror, base, targetPath string) (reuseFunc, error) {
+	basePath, err := sm.GetSnapshotPath(mirror, base)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(basePath); err != nil {
+		return nil, fmt.Errorf("base snapshot %s does not exist for mirror %s", base, mirror)
+	}
+
+	known := snapshotChecksums(basePath)
+	baseSums := make(map[string]string)
+	bySum := make(map[string]string)
+	err = filepath.WalkDir(basePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := fileChecksum(p, info.Size(), known[rel])
+		if err != nil {
+			return err
+		}
+		baseSums[rel] = sum
+		if _, ok := bySum[sum]; !ok {
+			bySum[sum] = rel
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base snapshot %s: %w", base, err)
+	}
+
+	targetKnown := snapshotChecksums(targetPath)
+	return func(rel, p string, size int64) (*ExportFile, error) {
+		sum, err := fileChecksum(p, size, targetKnown[rel])
+		if err != nil {
+			return nil, err
+		}
+		if baseSums[rel] == sum {
+			return &ExportFile{Path: rel, Size: size, SHA256: sum, Base: rel}, nil
+		}
+		if bp, ok := bySum[sum]; ok {
+			return &ExportFile{Path: rel, Size: size, SHA256: sum, Base: bp}, nil
+		}
+		return nil, nil
+	}, nil
+}
+
+// ExportDelta writes a delta archive of the snapshot target of mirror
+// to dest in format.  The archive holds the metadata of target and
+// only the files missing from the snapshot base.
+func (sm *SnapshotManager) ExportDelta(mirror, base, target, dest, format string) (*ExportManifest, error) {
+	if base == target {
+		return nil, fmt.Errorf("base and target are both snapshot %s", base)
+	}
+	return sm.export(mirror, target, base, dest, format)
+}
+
+// ImportDelta imports a delta archive created by ExportDelta as a new
+// snapshot of mirror, and returns its name.
+//
+// The files not included in the archive are hard-linked from the local
+// copy of the base snapshot.  Every one of them is verified first: the
+// import is refused if the base snapshot does not match the one the
+// archive was created from.
+func (sm *SnapshotManager) ImportDelta(mirror, src string, opts ImportOptions) (string, error) {
+	return sm.importSnapshot(mirror, src, opts, true)
+}
+
+// linkBaseFiles hard-links the files of m taken from the snapshot base
+// into dir, after verifying their checksums.
+func (sm *SnapshotManager) linkBaseFiles(mirror, base string, m *ExportManifest, dir string) error {
+	basePath, err := sm.GetSnapshotPath(mirror, base)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(basePath); err != nil {
+		return fmt.Errorf("base snapshot %s does not exist for mirror %s", base, mirror)
+	}
+
+	var problems []string
+	for _, f := range m.Files {
+		if f.Base == "" {
+			continue
+		}
+		if err := validateArchivePath(f.Path); err != nil {
+			return err
+		}
+		if err := validateArchivePath(f.Base); err != nil {
+			return err
+		}
+
+		src := filepath.Join(basePath, filepath.FromSlash(f.Base))
+		info, err := os.Lstat(src)
+		switch {
+		case err != nil:
+			problems = append(problems, f.Base+" is missing")
+			continue
+		case !info.Mode().IsRegular():
+			problems = append(problems, f.Base+" is not a regular file")
+			continue
+		case info.Size() != f.Size:
+			problems = append(problems, f.Base+" does not match its checksum")
+			continue
+		}
+		sum, err := fileChecksum(src, info.Size(), nil)
+		if err != nil {
+			return err
+		}
+		if sum != f.SHA256 {
+			problems = append(problems, f.Base+" does not match its checksum")
+			continue
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(f.Path))
+		// #nosec G301 - 0755 needed for web server directory access
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(src, dst); err != nil {
+			return err
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	if len(problems) > 10 {
+		problems = append(problems[:10], fmt.Sprintf("and %d more", len(problems)-10))
+	}
+	return fmt.Errorf("base snapshot %s of mirror %s does not match the archive: %s", base, mirror, strings.Join(problems, ", "))
+}
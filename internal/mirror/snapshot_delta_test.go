@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+func TestSnapshotManager_ExportImportDelta(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "src", "live"))
+	dst := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "dst", "live"))
+
+	a, _ := src.GetSnapshotPath("test-mirror", "a")
+	writeTestFile(t, filepath.Join(a, "dists/noble/Release"), []byte("Codename: noble\nVersion: 1\n"))
+	writeTestFile(t, filepath.Join(a, "pool/main/f/foo_1.0_amd64.deb"), []byte("foo"))
+	b, _ := src.GetSnapshotPath("test-mirror", "b")
+	writeTestFile(t, filepath.Join(b, "dists/noble/Release"), []byte("Codename: noble\nVersion: 2\n"))
+	writeTestFile(t, filepath.Join(b, "pool/main/f/foo_1.0_amd64.deb"), []byte("foo"))
+	writeTestFile(t, filepath.Join(b, "pool/main/f/foo_1.0_arm64.deb"), []byte("foo"))
+	writeTestFile(t, filepath.Join(b, "pool/main/b/bar_1.0_amd64.deb"), []byte("bar"))
+	if err := saveSnapshotMetadata(b, &SnapshotMetadata{Mirror: "test-mirror", Name: "b", Note: "weekly"}); err != nil {
+		t.Fatal(err)
+	}
+
+	full := filepath.Join(tmpDir, "a.tar.zst")
+	if _, err := src.ExportSnapshot("test-mirror", "a", full, ExportTarZstd); err != nil {
+		t.Fatal(err)
+	}
+	delta := filepath.Join(tmpDir, "b-delta.tar.zst")
+	m, err := src.ExportDelta("test-mirror", "a", "b", delta, ExportTarZstd)
+	if err != nil {
+		t.Fatalf("delta export failed: %v", err)
+	}
+	if m.Base != "a" || len(m.Files) != 4 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	if files, size := m.IncludedSize(); files != 2 || size != 30 {
+		t.Errorf("expected Release and bar to be included, got %d files of %d bytes", files, size)
+	}
+	for _, f := range m.Files {
+		if f.Path == "pool/main/f/foo_1.0_arm64.deb" && f.Base != "pool/main/f/foo_1.0_amd64.deb" {
+			t.Errorf("expected the same contents to be taken from the base, got %+v", f)
+		}
+	}
+
+	if _, err := dst.ImportSnapshot("test-mirror", full, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.ImportSnapshot("test-mirror", delta, ImportOptions{}); err == nil || !strings.Contains(err.Error(), "delta archive") {
+		t.Errorf("expected the full import to reject a delta archive, got %v", err)
+	}
+	if _, err := dst.ImportDelta("test-mirror", full, ImportOptions{Name: "x"}); err == nil || !strings.Contains(err.Error(), "not a delta archive") {
+		t.Errorf("expected the delta import to reject a full archive, got %v", err)
+	}
+
+	name, err := dst.ImportDelta("test-mirror", delta, ImportOptions{})
+	if err != nil || name != "b" {
+		t.Fatalf("delta import failed: %s, %v", name, err)
+	}
+	ia, _ := dst.GetSnapshotPath("test-mirror", "a")
+	ib, _ := dst.GetSnapshotPath("test-mirror", "b")
+	for p, want := range map[string]string{
+		"dists/noble/Release":           "Codename: noble\nVersion: 2\n",
+		"pool/main/f/foo_1.0_arm64.deb": "foo",
+		"pool/main/b/bar_1.0_amd64.deb": "bar",
+	} {
+		data, err := os.ReadFile(filepath.Join(ib, p))
+		if err != nil || string(data) != want {
+			t.Errorf("unexpected contents of %s: %q, %v", p, data, err)
+		}
+	}
+	fa, err := os.Stat(filepath.Join(ia, "pool/main/f/foo_1.0_amd64.deb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(filepath.Join(ib, "pool/main/f/foo_1.0_amd64.deb"))
+	if err != nil || !os.SameFile(fa, fb) {
+		t.Errorf("expected unchanged files to be hard-linked from the base: %v", err)
+	}
+	if md, err := loadSnapshotMetadata(ib); err != nil || md.Note != "weekly" {
+		t.Errorf("unexpected metadata: %+v, %v", md, err)
+	}
+
+	// A base that differs from the exported one is refused
+	if _, err := dst.ImportSnapshot("test-mirror", full, ImportOptions{Name: "tampered"}); err != nil {
+		t.Fatal(err)
+	}
+	tp, _ := dst.GetSnapshotPath("test-mirror", "tampered")
+	writeTestFile(t, filepath.Join(tp, "pool/main/f/foo_1.0_amd64.deb"), []byte("oof"))
+	_, err = dst.ImportDelta("test-mirror", delta, ImportOptions{Name: "b2", Base: "tampered"})
+	if err == nil || !strings.Contains(err.Error(), "base snapshot tampered") || !strings.Contains(err.Error(), "foo_1.0_amd64.deb does not match") {
+		t.Errorf("expected the tampered base to be refused, got %v", err)
+	}
+	if _, err := dst.ImportDelta("test-mirror", delta, ImportOptions{Name: "b3", Base: "missing"}); err == nil {
+		t.Error("expected an error for a missing base")
+	}
+	snapshots, err := dst.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 {
+		t.Errorf("expected refused imports to leave no snapshot, got %d snapshots", len(snapshots))
+	}
+}
+
+func TestCopySnapshotChecksums(t *testing.T) {
+	tmpDir := t.TempDir()
+	storageDir := filepath.Join(tmpDir, "storage")
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStorage(storageDir, "test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("foo")
+	fi := apt.MakeFileInfoNoChecksum("pool/foo.deb", uint64(len(data)))
+	fi.CalcChecksums(data)
+	f := filepath.Join(tmpDir, "foo.deb")
+	writeTestFile(t, f, data)
+	if err := s.StoreLink(fi, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live"))
+	p, _ := sm.GetSnapshotPath("test-mirror", "s1")
+	if err := os.MkdirAll(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	copySnapshotChecksums(filepath.Join(storageDir, "test-mirror"), p)
+	sums := snapshotChecksums(p)
+	if got := sums["pool/foo.deb"]; got == nil || got.Size != 3 || got.SHA256 != hex.EncodeToString(fi.SHA256Sum()) {
+		t.Errorf("unexpected checksums: %+v", got)
+	}
+
+	// Snapshots of snapshots take over the checksums
+	p2, _ := sm.GetSnapshotPath("test-mirror", "s2")
+	copySnapshotChecksums(p, p2)
+	if got := snapshotChecksums(p2)["pool/foo.deb"]; got == nil || got.Size != 3 {
+		t.Errorf("unexpected checksums of the copy: %+v", got)
+	}
+
+	if err := removeSnapshotFiles(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checksumsPath(p)); !os.IsNotExist(err) {
+		t.Errorf("expected the checksums file to be removed: %v", err)
+	}
+}
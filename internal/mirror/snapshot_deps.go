@@ -0,0 +1,434 @@
+package mirror
+
+// This file checks that the dependencies of the binary packages of a
+// tree can be satisfied within the tree, like dose-distcheck.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/knqyf263/go-deb-version"
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// BrokenPackage is a binary package with dependencies that cannot be
+// satisfied within a tree.
+type BrokenPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+
+	// Unsatisfied lists the dependencies that cannot be satisfied,
+	// such as "Depends: libfoo (>= 2) | libbar".
+	Unsatisfied []string `json:"unsatisfied"`
+}
+
+// ArchDeps is the result of checking the packages of a suite on one
+// architecture.  Packages counts the checked packages, including the
+// "all" packages.
+type ArchDeps struct {
+	Suite        string           `json:"suite"`
+	Architecture string           `json:"architecture"`
+	Packages     int              `json:"packages"`
+	Broken       []*BrokenPackage `json:"broken"`
+}
+
+// DepsReport is the result of checking the dependencies of a tree of
+// a mirror.
+type DepsReport struct {
+	Mirror  string      `json:"mirror"`
+	Tree    string      `json:"tree"`
+	Results []*ArchDeps `json:"results"`
+}
+
+// BrokenCount returns the number of broken packages in r.
+func (r *DepsReport) BrokenCount() int {
+	n := 0
+	for _, a := range r.Results {
+		n += len(a.Broken)
+	}
+	return n
+}
+
+// CheckDependencies checks the Depends and Pre-Depends fields of the
+// binary packages in a tree of mirror, which is a snapshot name,
+// DiffLive or DiffStaging.
+//
+// Packages are checked per suite and architecture against the
+// packages of all components of the suite.  Packages of other
+// architectures satisfy dependencies if they are Multi-Arch: foreign,
+// or if the dependency names their architecture.
+func (sm *SnapshotManager) CheckDependencies(mirror, tree string) (*DepsReport, error) {
+	dir, err := sm.resolveDiffTree(mirror, tree)
+	if err != nil {
+		return nil, err
+	}
+	results, err := checkTreeDependencies(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DepsReport{Mirror: mirror, Tree: tree, Results: results}, nil
+}
+
+// depPackage is a binary package with parsed relationship fields.
+type depPackage struct {
+	*apt.Package
+
+	// depends holds the groups of Pre-Depends and Depends with the
+	// name of their field.
+	depends []depGroup
+
+	// provides is nil if a relationship field is invalid.
+	provides []apt.Relation
+
+	// err is set if a relationship field is invalid.
+	err error
+}
+
+// depGroup is a group of alternatives of a relationship field.
+type depGroup struct {
+	field        string
+	alternatives []apt.Relation
+}
+
+// String returns g the way it is reported in BrokenPackage.
+func (g depGroup) String() string {
+	s := make([]string, len(g.alternatives))
+	for i := range g.alternatives {
+		s[i] = g.alternatives[i].String()
+	}
+	return g.field + ": " + strings.Join(s, " | ")
+}
+
+// newDepPackage parses the relationship fields of pkg.
+func newDepPackage(pkg *apt.Package) *depPackage {
+	dp := &depPackage{Package: pkg}
+	for _, f := range []struct{ name, value string }{
+		{"Pre-Depends", pkg.PreDepends},
+		{"Depends", pkg.Depends},
+	} {
+		groups, err := apt.ParseRelations(f.value)
+		if err != nil {
+			dp.err = fmt.Errorf("invalid %s: %w", f.name, err)
+			return dp
+		}
+		for _, g := range groups {
+			dp.depends = append(dp.depends, depGroup{field: f.name, alternatives: g})
+		}
+	}
+	groups, err := apt.ParseRelations(dp.Provides)
+	if err != nil {
+		dp.err = fmt.Errorf("invalid Provides: %w", err)
+		return dp
+	}
+	for _, g := range groups {
+		dp.provides = append(dp.provides, g...)
+	}
+	return dp
+}
+
+// depUniverse indexes the binary packages of a suite.
+type depUniverse struct {
+	packages  []*depPackage
+	byName    map[string][]*depPackage
+	providers map[string][]depProvider
+}
+
+// depProvider is a package providing a virtual package.
+type depProvider struct {
+	pkg      *depPackage
+	provided apt.Relation
+}
+
+func newDepUniverse(packages []*depPackage) *depUniverse {
+	u := &depUniverse{
+		packages:  packages,
+		byName:    make(map[string][]*depPackage),
+		providers: make(map[string][]depProvider),
+	}
+	for _, p := range packages {
+		u.byName[p.Name] = append(u.byName[p.Name], p)
+		for _, r := range p.provides {
+			u.providers[r.Name] = append(u.providers[r.Name], depProvider{pkg: p, provided: r})
+		}
+	}
+	return u
+}
+
+// archMatches reports whether p can satisfy relation r of a package
+// installed on architecture arch.
+func archMatches(p *depPackage, r *apt.Relation, arch string) bool {
+	pArch := p.Architecture
+	if pArch == "all" {
+		pArch = arch
+	}
+	switch r.Arch {
+	case "":
+		return pArch == arch || p.MultiArch == "foreign"
+	case "native":
+		return pArch == arch
+	case "any":
+		return p.MultiArch == "allowed"
+	}
+	return pArch == r.Arch
+}
+
+// satisfies reports whether a package of the universe satisfies
+// relation r of a package installed on architecture arch.
+func (u *depUniverse) satisfies(r *apt.Relation, arch string) bool {
+	for _, p := range u.byName[r.Name] {
+		if archMatches(p, r, arch) && versionSatisfies(p.Version, r.Op, r.Version) {
+			return true
+		}
+	}
+	// Unversioned Provides only satisfy unversioned relations
+	for _, pr := range u.providers[r.Name] {
+		if !archMatches(pr.pkg, r, arch) {
+			continue
+		}
+		if r.Op == "" || (pr.provided.Op == "=" && versionSatisfies(pr.provided.Version, r.Op, r.Version)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks the packages of architecture arch and "all".
+func (u *depUniverse) check(suite, arch string) *ArchDeps {
+	result := &ArchDeps{Suite: suite, Architecture: arch, Broken: []*BrokenPackage{}}
+	for _, p := range u.packages {
+		if p.Architecture != arch && p.Architecture != "all" {
+			continue
+		}
+		result.Packages++
+
+		var unsatisfied []string
+		if p.err != nil {
+			unsatisfied = append(unsatisfied, p.err.Error())
+		}
+		for _, g := range p.depends {
+			applies, ok := false, false
+			for i := range g.alternatives {
+				r := &g.alternatives[i]
+				if !r.AppliesTo(arch) {
+					continue
+				}
+				applies = true
+				if u.satisfies(r, arch) {
+					ok = true
+					break
+				}
+			}
+			if applies && !ok {
+				unsatisfied = append(unsatisfied, g.String())
+			}
+		}
+		if len(unsatisfied) > 0 {
+			result.Broken = append(result.Broken, &BrokenPackage{
+				Name:         p.Name,
+				Version:      p.Version,
+				Architecture: p.Architecture,
+				Unsatisfied:  unsatisfied,
+			})
+		}
+	}
+	return result
+}
+
+// versionSatisfies reports whether Debian version v satisfies the
+// constraint op want.  An empty op is always satisfied.
+func versionSatisfies(v, op, want string) bool {
+	if op == "" {
+		return true
+	}
+
+	var c int
+	v1, err1 := version.NewVersion(v)
+	v2, err2 := version.NewVersion(want)
+	if err1 != nil || err2 != nil {
+		// Fallback to string comparison if version parsing fails
+		c = strings.Compare(v, want)
+	} else {
+		c = v1.Compare(v2)
+	}
+
+	switch op {
+	case "<<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "=":
+		return c == 0
+	case ">=":
+		return c >= 0
+	case ">>":
+		return c > 0
+	}
+	return false
+}
+
+// checkTreeDependencies checks the dependencies of the binary packages
+// under dir, sorted by suite and architecture.
+func checkTreeDependencies(dir string) ([]*ArchDeps, error) {
+	indices, err := findPackageIndices(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(indices))
+	for k := range indices {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	type suiteIndex struct {
+		packages []*depPackage
+		seen     map[[3]string]bool
+		archs    map[string]bool
+	}
+	suites := make(map[string]*suiteIndex)
+	var suiteNames []string
+	for _, k := range keys {
+		if path.Base(k) != "Packages" {
+			continue
+		}
+		suite, component, arch := splitIndexPath(k)
+		// udebs only depend on each other and are installed by
+		// debian-installer, not apt
+		if strings.HasSuffix(component, "/debian-installer") {
+			continue
+		}
+
+		s := suites[suite]
+		if s == nil {
+			s = &suiteIndex{seen: make(map[[3]string]bool), archs: make(map[string]bool)}
+			suites[suite] = s
+			suiteNames = append(suiteNames, suite)
+		}
+		if arch != "" && arch != "all" {
+			s.archs[arch] = true
+		}
+
+		packages, err := readBinaryPackages(dir, indices[k])
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range packages {
+			// "all" packages may be listed in the index of every
+			// architecture
+			id := [3]string{pkg.Name, pkg.Version, pkg.Architecture}
+			if pkg.Name == "" || s.seen[id] {
+				continue
+			}
+			s.seen[id] = true
+			if pkg.Architecture != "all" {
+				s.archs[pkg.Architecture] = true
+			}
+			s.packages = append(s.packages, newDepPackage(pkg))
+		}
+	}
+	sort.Strings(suiteNames)
+
+	var results []*ArchDeps
+	for _, name := range suiteNames {
+		s := suites[name]
+		sort.Slice(s.packages, func(i, j int) bool {
+			a, b := s.packages[i], s.packages[j]
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			if a.Architecture != b.Architecture {
+				return a.Architecture < b.Architecture
+			}
+			return versionGreater(b.Version, a.Version)
+		})
+
+		archs := make([]string, 0, len(s.archs))
+		for a := range s.archs {
+			archs = append(archs, a)
+		}
+		sort.Strings(archs)
+		if len(archs) == 0 {
+			archs = []string{"all"}
+		}
+
+		u := newDepUniverse(s.packages)
+		for _, arch := range archs {
+			results = append(results, u.check(name, arch))
+		}
+	}
+	return results, nil
+}
+
+// readBinaryPackages reads the Packages index at rel in dir.
+func readBinaryPackages(dir, rel string) ([]*apt.Package, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel))) // #nosec G304 - path found by walking the snapshot tree
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", rel, err)
+	}
+	defer f.Close()
+
+	packages, err := apt.ExtractPackages(rel, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", rel, err)
+	}
+	return packages, nil
+}
+
+// checkDependencies is the built-in gate that fails if a binary
+// package has unsatisfiable dependencies.
+func checkDependencies(t *gateTarget) error {
+	results, err := checkTreeDependencies(t.path)
+	if err != nil {
+		return err
+	}
+
+	var broken []string
+	for _, a := range results {
+		for _, p := range a.Broken {
+			broken = append(broken, fmt.Sprintf("%s/%s %s:%s (%s)", a.Suite, a.Architecture, p.Name, p.Version, strings.Join(p.Unsatisfied, "; ")))
+		}
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+	n := len(broken)
+	if n > 10 {
+		broken = append(broken[:10], fmt.Sprintf("and %d more", n-10))
+	}
+	return fmt.Errorf("%d packages have unsatisfiable dependencies: %s", n, strings.Join(broken, ", "))
+}
+
+// WriteJSON writes r as indented JSON.
+func (r *DepsReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	// Keep version constraints such as ">=" readable
+	enc.SetEscapeHTML(false)
+	return enc.Encode(r)
+}
+
+// WriteText writes r in a human-readable form.
+func (r *DepsReport) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("Dependencies of mirror '%s' (%s):\n", r.Mirror, r.Tree)
+	if len(r.Results) == 0 {
+		ew.printf("  No binary packages\n")
+		return ew.err
+	}
+	for _, a := range r.Results {
+		ew.printf("\n%s/%s: %d packages, %d broken\n", a.Suite, a.Architecture, a.Packages, len(a.Broken))
+		for _, p := range a.Broken {
+			ew.printf("  %s:%s %s\n", p.Name, p.Architecture, p.Version)
+			for _, u := range p.Unsatisfied {
+				ew.printf("    %s\n", u)
+			}
+		}
+	}
+	return ew.err
+}
@@ -0,0 +1,113 @@
+package mirror
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// depsStanza returns a Packages stanza with extra fields.
+func depsStanza(name, ver, arch string, fields ...string) string {
+	s := packagesStanza(name, ver, arch)
+	return strings.TrimSuffix(s, "\n") + strings.Join(fields, "\n") + "\n\n"
+}
+
+func TestSnapshotManager_CheckDependencies(t *testing.T) {
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(t.TempDir(), "live"))
+	p, err := sm.GetSnapshotPath("test-mirror", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(p, "dists/noble/main/binary-amd64/Packages"), []byte(
+		depsStanza("libc6", "2.39-0ubuntu8", "amd64", "Multi-Arch: same")+
+			depsStanza("python3", "3.12.3-0ubuntu1", "amd64", "Multi-Arch: allowed", "Depends: libc6 (>= 2.38)")+
+			depsStanza("perl-base", "5.38.2-3", "amd64", "Multi-Arch: foreign", "Pre-Depends: libc6 (>= 2.38)")+
+			depsStanza("postfix", "3.8.6-1", "amd64", "Provides: mail-transport-agent, default-mta (= 3.8.6-1)")+
+			depsStanza("tool", "1.0", "amd64", "Depends: python3:any, perl-base:native, mailer | mail-transport-agent, helper (>= 1.0)")+
+			depsStanza("old-tool", "1.0", "amd64", "Depends: libc6 (>> 3), default-mta (>= 4) | mta-ng, win-only [!amd64]")+
+			depsStanza("needs-i386", "1.0", "amd64", "Depends: libc6:i386 (>= 2.40)")+
+			depsStanza("bad-field", "1.0", "amd64", "Depends: foo (~ 1)")+
+			depsStanza("data", "1.0", "all", "Depends: python3")))
+	// python3:any is satisfied by python3:amd64, which is Multi-Arch: allowed
+	writeTestFile(t, filepath.Join(p, "dists/noble/main/binary-i386/Packages"), []byte(
+		depsStanza("libc6", "2.39-0ubuntu8", "i386", "Multi-Arch: same")+
+			depsStanza("tool", "1.0", "i386", "Depends: python3:any")+
+			depsStanza("data", "1.0", "all", "Depends: python3")))
+	// Dependencies are resolved across components of a suite, but not
+	// across suites
+	writeTestFile(t, filepath.Join(p, "dists/noble/universe/binary-amd64/Packages"), []byte(
+		depsStanza("helper", "1.2", "amd64", "Depends: perl-base")))
+	writeTestFile(t, filepath.Join(p, "dists/noble-updates/main/binary-amd64/Packages"), []byte(
+		depsStanza("tool", "1.1", "amd64", "Depends: libc6")))
+
+	report, err := sm.CheckDependencies("test-mirror", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		suite, arch string
+		packages    int
+		broken      map[string][]string
+	}
+	var got []result
+	for _, a := range report.Results {
+		r := result{a.Suite, a.Architecture, a.Packages, map[string][]string{}}
+		for _, b := range a.Broken {
+			r.broken[b.Name+":"+b.Architecture] = b.Unsatisfied
+		}
+		got = append(got, r)
+	}
+	want := []result{
+		{"noble", "amd64", 10, map[string][]string{
+			"old-tool:amd64":   {"Depends: libc6 (>> 3)", "Depends: default-mta (>= 4) | mta-ng"},
+			"needs-i386:amd64": {"Depends: libc6:i386 (>= 2.40)"},
+			"bad-field:amd64":  {"invalid Depends: invalid version constraint: foo (~ 1)"},
+		}},
+		{"noble", "i386", 3, map[string][]string{
+			"data:all": {"Depends: python3"},
+		}},
+		{"noble-updates", "amd64", 1, map[string][]string{
+			"tool:amd64": {"Depends: libc6"},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected results:\n got: %+v\nwant: %+v", got, want)
+	}
+	if report.BrokenCount() != 5 {
+		t.Errorf("expected 5 broken packages, got %d", report.BrokenCount())
+	}
+
+	// The dependencies gate
+	sm = sm.WithMirrorConfigs(map[string]*MirrorConfig{"test-mirror": {Snapshot: &MirrorSnapshotConfig{
+		Gates: []*GateConfig{{Builtin: GateDependencies}},
+	}}})
+	err = sm.PublishSnapshot("test-mirror", "s1")
+	var gateErr *GateError
+	if !errors.As(err, &gateErr) || !strings.Contains(err.Error(), "5 packages have unsatisfiable dependencies") {
+		t.Errorf("expected the dependencies gate to fail, got %v", err)
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	tests := []struct {
+		v, op, want string
+		ok          bool
+	}{
+		{"1.0", "", "", true},
+		{"1.0-1", ">=", "1.0", true},
+		{"1.0~rc1", ">=", "1.0", false},
+		{"1:0.9", ">>", "2.0", true},
+		{"2.0", "<<", "2.0", false},
+		{"2.0", "<=", "2.0", true},
+		{"2.0-1", "=", "2.0-1", true},
+	}
+	for _, tt := range tests {
+		if got := versionSatisfies(tt.v, tt.op, tt.want); got != tt.ok {
+			t.Errorf("%s %s %s: got %v", tt.v, tt.op, tt.want, got)
+		}
+	}
+}
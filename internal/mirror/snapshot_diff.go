@@ -0,0 +1,406 @@
+package mirror
+
+// This file implements comparing the packages of two snapshots.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// Special snapshot names accepted by DiffSnapshots that refer to the
+// trees currently served by the live and staging symlinks.
+const (
+	DiffLive    = "live"
+	DiffStaging = "staging"
+)
+
+// PackageChange describes a package whose version differs between
+// two trees.  OldVersion is empty for added packages, and NewVersion
+// is empty for removed ones.
+type PackageChange struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture"`
+	OldVersion   string `json:"old_version,omitempty"`
+	NewVersion   string `json:"new_version,omitempty"`
+}
+
+// IndexDiff lists the package changes of a single Packages or Sources
+// index.  Component and Architecture are empty for flat repositories.
+type IndexDiff struct {
+	Suite        string           `json:"suite"`
+	Component    string           `json:"component,omitempty"`
+	Architecture string           `json:"architecture,omitempty"`
+	Added        []*PackageChange `json:"added"`
+	Removed      []*PackageChange `json:"removed"`
+	Upgraded     []*PackageChange `json:"upgraded"`
+	Downgraded   []*PackageChange `json:"downgraded"`
+}
+
+// Name returns the location of the index as "suite/component/arch".
+func (d *IndexDiff) Name() string {
+	parts := []string{d.Suite}
+	if d.Component != "" {
+		parts = append(parts, d.Component)
+	}
+	if d.Architecture != "" {
+		parts = append(parts, d.Architecture)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Empty returns true if the index has no changes.
+func (d *IndexDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Upgraded)+len(d.Downgraded) == 0
+}
+
+// SnapshotDiff is the result of comparing two trees of a mirror.
+// Only indices with changes are listed.
+type SnapshotDiff struct {
+	Mirror  string       `json:"mirror"`
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Indices []*IndexDiff `json:"indices"`
+}
+
+// resolveDiffTree returns the directory of the tree named name, which
+// is a snapshot name, DiffLive or DiffStaging.
+func (sm *SnapshotManager) resolveDiffTree(mirror, name string) (string, error) {
+	if err := ValidatePathComponent(mirror); err != nil {
+		return "", fmt.Errorf("invalid mirror ID: %w", err)
+	}
+
+	var link string
+	switch name {
+	case DiffLive:
+		link = sm.GetLivePath(mirror)
+	case DiffStaging:
+		link = sm.GetStagingPath(mirror)
+	default:
+		p, err := sm.GetSnapshotPath(mirror, name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("snapshot %s does not exist for mirror %s", name, mirror)
+		}
+		return p, nil
+	}
+
+	p, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no %s tree for mirror %s", name, mirror)
+		}
+		return "", fmt.Errorf("failed to resolve %s tree for mirror %s: %w", name, mirror, err)
+	}
+	return p, nil
+}
+
+// DiffSnapshots compares the packages listed in the Packages and
+// Sources indices of two trees of a mirror.  Either side may be
+// DiffLive or DiffStaging instead of a snapshot name.
+//
+// Packages are identified by name and architecture.  When an index
+// keeps several versions of a package, the highest ones are compared.
+func (sm *SnapshotManager) DiffSnapshots(mirror, from, to string) (*SnapshotDiff, error) {
+	fromDir, err := sm.resolveDiffTree(mirror, from)
+	if err != nil {
+		return nil, err
+	}
+	toDir, err := sm.resolveDiffTree(mirror, to)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, err := diffTrees(fromDir, toDir)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotDiff{Mirror: mirror, From: from, To: to, Indices: indices}, nil
+}
+
+// diffTrees compares the package indices of the trees at fromDir and
+// toDir, and returns the indices with changes.  An empty fromDir is an
+// empty tree.
+func diffTrees(fromDir, toDir string) ([]*IndexDiff, error) {
+	oldIndices := make(map[string]string)
+	if fromDir != "" {
+		var err error
+		if oldIndices, err = findPackageIndices(fromDir); err != nil {
+			return nil, err
+		}
+	}
+	newIndices, err := findPackageIndices(toDir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for k := range oldIndices {
+		keys[k] = true
+	}
+	for k := range newIndices {
+		keys[k] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+
+	indices := []*IndexDiff{}
+	for _, k := range sortedKeys {
+		oldVersions, err := readPackageVersions(fromDir, oldIndices[k])
+		if err != nil {
+			return nil, err
+		}
+		newVersions, err := readPackageVersions(toDir, newIndices[k])
+		if err != nil {
+			return nil, err
+		}
+
+		d := diffPackageVersions(oldVersions, newVersions)
+		if d.Empty() {
+			continue
+		}
+		d.Suite, d.Component, d.Architecture = splitIndexPath(k)
+		indices = append(indices, d)
+	}
+	return indices, nil
+}
+
+// findPackageIndices returns the Packages and Sources indices under
+// dir.  The keys are the index paths without compression extension,
+// and the values are the paths of one readable variant of each.
+func findPackageIndices(dir string) (map[string]string, error) {
+	indices := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// The pool of a regular repository has no indices.
+			isPool := info.Name() == "pool" && filepath.Dir(p) == dir
+			if isPool || info.Name() == "by-hash" || strings.HasSuffix(info.Name(), ".diff") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !apt.IsPackageIndex(rel) || !apt.IsSupported(rel) {
+			return nil
+		}
+
+		// Prefer the variant that is the cheapest to decompress.
+		key := apt.TrimCompressionExt(rel)
+		if cur, ok := indices[key]; !ok || compressionRank(rel) < compressionRank(cur) {
+			indices[key] = rel
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find package indices in %s: %w", dir, err)
+	}
+	return indices, nil
+}
+
+// compressionRank orders index variants by decompression cost.
+func compressionRank(p string) int {
+	switch path.Ext(p) {
+	case "":
+		return 0
+	case ".gz":
+		return 1
+	case ".zst":
+		return 2
+	case ".xz":
+		return 3
+	}
+	return 4
+}
+
+// readPackageVersions reads the index at rel in dir and returns the
+// highest version of each package keyed by name and architecture.
+// An empty rel yields an empty map.
+func readPackageVersions(dir, rel string) (map[[2]string]string, error) {
+	versions := make(map[[2]string]string)
+	if rel == "" {
+		return versions, nil
+	}
+
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel))) // #nosec G304 - path found by walking the snapshot tree
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", rel, err)
+	}
+	defer f.Close()
+
+	packages, err := apt.ExtractPackages(rel, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", rel, err)
+	}
+	for _, pkg := range packages {
+		if pkg.Name == "" {
+			continue
+		}
+		k := [2]string{pkg.Name, pkg.Architecture}
+		if cur, ok := versions[k]; !ok || versionGreater(pkg.Version, cur) {
+			versions[k] = pkg.Version
+		}
+	}
+	return versions, nil
+}
+
+// diffPackageVersions classifies the differences between two maps
+// returned by readPackageVersions.
+func diffPackageVersions(oldVersions, newVersions map[[2]string]string) *IndexDiff {
+	d := &IndexDiff{
+		Added:      []*PackageChange{},
+		Removed:    []*PackageChange{},
+		Upgraded:   []*PackageChange{},
+		Downgraded: []*PackageChange{},
+	}
+
+	for k, nv := range newVersions {
+		c := &PackageChange{Name: k[0], Architecture: k[1], NewVersion: nv}
+		ov, ok := oldVersions[k]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, c)
+		case ov == nv:
+		case versionGreater(nv, ov):
+			c.OldVersion = ov
+			d.Upgraded = append(d.Upgraded, c)
+		default:
+			c.OldVersion = ov
+			d.Downgraded = append(d.Downgraded, c)
+		}
+	}
+	for k, ov := range oldVersions {
+		if _, ok := newVersions[k]; !ok {
+			d.Removed = append(d.Removed, &PackageChange{Name: k[0], Architecture: k[1], OldVersion: ov})
+		}
+	}
+
+	for _, l := range [][]*PackageChange{d.Added, d.Removed, d.Upgraded, d.Downgraded} {
+		sort.Slice(l, func(i, j int) bool {
+			if l[i].Name != l[j].Name {
+				return l[i].Name < l[j].Name
+			}
+			return l[i].Architecture < l[j].Architecture
+		})
+	}
+	return d
+}
+
+// splitIndexPath splits the path of an index without compression
+// extension into suite, component and architecture.
+//
+// "dists/noble/main/binary-amd64/Packages" yields "noble", "main" and
+// "amd64"; "dists/noble/main/source/Sources" yields "noble", "main"
+// and "source".  Indices outside dists/ belong to flat repositories
+// and only have a suite.
+func splitIndexPath(p string) (suite, component, arch string) {
+	dir := path.Dir(p)
+	rest, ok := strings.CutPrefix(dir, "dists/")
+	if !ok {
+		return dir, "", ""
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) < 3 {
+		return rest, "", ""
+	}
+	suite = parts[0]
+	component = strings.Join(parts[1:len(parts)-1], "/")
+	arch = strings.TrimPrefix(parts[len(parts)-1], "binary-")
+	return suite, component, arch
+}
+
+// WriteJSON writes d as indented JSON.
+func (d *SnapshotDiff) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// WriteText writes d in a human-readable form.
+func (d *SnapshotDiff) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("Changes for mirror '%s' from %s to %s:\n", d.Mirror, d.From, d.To)
+	if len(d.Indices) == 0 {
+		ew.printf("  No changes\n")
+		return ew.err
+	}
+	for _, idx := range d.Indices {
+		ew.printf("\n%s:\n", idx.Name())
+		for _, c := range idx.Added {
+			ew.printf("  + %s:%s %s\n", c.Name, c.Architecture, c.NewVersion)
+		}
+		for _, c := range idx.Removed {
+			ew.printf("  - %s:%s %s\n", c.Name, c.Architecture, c.OldVersion)
+		}
+		for _, c := range idx.Upgraded {
+			ew.printf("  ^ %s:%s %s -> %s\n", c.Name, c.Architecture, c.OldVersion, c.NewVersion)
+		}
+		for _, c := range idx.Downgraded {
+			ew.printf("  v %s:%s %s -> %s\n", c.Name, c.Architecture, c.OldVersion, c.NewVersion)
+		}
+	}
+	return ew.err
+}
+
+// WriteMarkdown writes d as a Markdown document with a table per index.
+func (d *SnapshotDiff) WriteMarkdown(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("# Changes for mirror `%s` from `%s` to `%s`\n", d.Mirror, d.From, d.To)
+	if len(d.Indices) == 0 {
+		ew.printf("\nNo changes.\n")
+		return ew.err
+	}
+	for _, idx := range d.Indices {
+		ew.printf("\n## %s\n\n", idx.Name())
+		ew.printf("| Change | Package | Architecture | Old version | New version |\n")
+		ew.printf("|---|---|---|---|---|\n")
+		for _, g := range []struct {
+			label   string
+			changes []*PackageChange
+		}{
+			{"added", idx.Added},
+			{"removed", idx.Removed},
+			{"upgraded", idx.Upgraded},
+			{"downgraded", idx.Downgraded},
+		} {
+			for _, c := range g.changes {
+				ew.printf("| %s | %s | %s | %s | %s |\n", g.label, c.Name, c.Architecture, c.OldVersion, c.NewVersion)
+			}
+		}
+	}
+	return ew.err
+}
+
+// errWriter remembers the first write error so that formatted output
+// can be written without checking every call.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,153 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFile creates a file and its parent directories.
+func writeTestFile(t *testing.T, p string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func packagesStanza(name, ver, arch string) string {
+	return "Package: " + name + "\nVersion: " + ver + "\nArchitecture: " + arch +
+		"\nFilename: pool/main/" + name + "_" + ver + "_" + arch + ".deb\nSize: 1\nSHA256: 00\n\n"
+}
+
+func TestSnapshotManager_DiffSnapshots(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath)
+
+	oldPath, err := sm.GetSnapshotPath("test-mirror", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPath, err := sm.GetSnapshotPath("test-mirror", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const idx = "dists/noble/main/binary-amd64/Packages"
+	writeTestFile(t, filepath.Join(oldPath, idx), []byte(
+		packagesStanza("bar", "1.0", "amd64")+
+			packagesStanza("baz", "2.0", "amd64")+
+			packagesStanza("foo", "1.0", "amd64")+
+			packagesStanza("same", "1.0", "all")))
+	writeTestFile(t, filepath.Join(newPath, idx+".gz"), gzipBytes(t, []byte(
+		packagesStanza("bar", "1.0", "amd64")+
+			packagesStanza("baz", "1:1.0", "amd64")+
+			packagesStanza("foo", "1.0", "amd64")+
+			packagesStanza("foo", "1.1", "amd64")+
+			packagesStanza("qux", "0.1", "amd64")+
+			packagesStanza("same", "1.0", "all"))))
+	writeTestFile(t, filepath.Join(newPath, "dists/noble/main/source/Sources"), []byte(
+		"Package: foo\nVersion: 1.1\nFiles:\n 00 1 foo_1.1.dsc\nDirectory: pool/main/f/foo\n\n"))
+
+	if err := os.MkdirAll(livePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(newPath, sm.GetStagingPath("test-mirror")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := sm.DiffSnapshots("test-mirror", "old", DiffStaging)
+	if err != nil {
+		t.Fatalf("DiffSnapshots failed: %v", err)
+	}
+	if len(d.Indices) != 2 {
+		t.Fatalf("expected 2 changed indices, got %d", len(d.Indices))
+	}
+
+	bin := d.Indices[0]
+	if bin.Name() != "noble/main/amd64" {
+		t.Errorf("unexpected index name %s", bin.Name())
+	}
+	if len(bin.Added) != 1 || bin.Added[0].Name != "qux" || bin.Added[0].NewVersion != "0.1" {
+		t.Errorf("unexpected added packages: %+v", bin.Added)
+	}
+	if len(bin.Removed) != 0 {
+		t.Errorf("unexpected removed packages: %+v", bin.Removed)
+	}
+	if len(bin.Upgraded) != 2 || bin.Upgraded[0].Name != "baz" || bin.Upgraded[1].Name != "foo" ||
+		bin.Upgraded[1].OldVersion != "1.0" || bin.Upgraded[1].NewVersion != "1.1" {
+		t.Errorf("unexpected upgraded packages: %+v", bin.Upgraded)
+	}
+
+	src := d.Indices[1]
+	if src.Name() != "noble/main/source" || len(src.Added) != 1 || src.Added[0].Architecture != "source" {
+		t.Errorf("unexpected source index diff: %s %+v", src.Name(), src.Added)
+	}
+
+	// The reverse direction turns additions into removals.
+	rev, err := sm.DiffSnapshots("test-mirror", "new", "old")
+	if err != nil {
+		t.Fatalf("DiffSnapshots failed: %v", err)
+	}
+	if len(rev.Indices[0].Removed) != 1 || len(rev.Indices[0].Downgraded) != 2 {
+		t.Errorf("unexpected reverse diff: %+v", rev.Indices[0])
+	}
+
+	var buf bytes.Buffer
+	if err := d.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "^ foo:amd64 1.0 -> 1.1") {
+		t.Errorf("unexpected text output:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := d.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "| added | qux | amd64 |  | 0.1 |") {
+		t.Errorf("unexpected markdown output:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := d.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded SnapshotDiff
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON output: %v", err)
+	}
+	if decoded.To != DiffStaging || len(decoded.Indices) != 2 {
+		t.Errorf("unexpected JSON output: %+v", decoded)
+	}
+
+	if _, err := sm.DiffSnapshots("test-mirror", "old", DiffLive); err == nil {
+		t.Error("expected an error without a live tree")
+	}
+	if _, err := sm.DiffSnapshots("test-mirror", "old", "missing"); err == nil {
+		t.Error("expected an error for a missing snapshot")
+	}
+}
+
+func TestSplitIndexPath(t *testing.T) {
+	tests := []struct {
+		path, suite, component, arch string
+	}{
+		{"dists/noble/main/binary-amd64/Packages", "noble", "main", "amd64"},
+		{"dists/noble/main/source/Sources", "noble", "main", "source"},
+		{"dists/bookworm/main/debian-installer/binary-arm64/Packages", "bookworm", "main/debian-installer", "arm64"},
+		{"experimental/Packages", "experimental", "", ""},
+	}
+	for _, tt := range tests {
+		suite, component, arch := splitIndexPath(tt.path)
+		if suite != tt.suite || component != tt.component || arch != tt.arch {
+			t.Errorf("splitIndexPath(%s) = %s, %s, %s", tt.path, suite, component, arch)
+		}
+	}
+}
@@ -0,0 +1,841 @@
+package mirror
+
+// This file implements the export of snapshots to portable archives and
+// their import, for sites without network access to the upstream mirror.
+//
+// An archive is a tar stream, optionally compressed with zstd.  The files
+// of the snapshot are stored under "snapshot/", followed by a manifest
+// named "manifest.json" that holds the snapshot metadata and the size and
+// SHA256 checksum of every file.  An OCI image layout directory holds the
+// same archive as its only layer, with the manifest as image config.
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// Export formats.
+const (
+	// ExportTar is an uncompressed tar file.
+	ExportTar = "tar"
+
+	// ExportTarZstd is a tar file compressed with zstd.
+	ExportTarZstd = "tar.zst"
+
+	// ExportOCI is an OCI image layout directory.
+	ExportOCI = "oci"
+)
+
+const (
+	// exportFormatVersion is the version of the archive format.
+	exportFormatVersion = 1
+
+	// exportTreeDir is the directory of the snapshot files in archives.
+	exportTreeDir = "snapshot"
+
+	// exportManifestName is the name of the manifest in archives.
+	exportManifestName = "manifest.json"
+)
+
+// Media types of OCI image layouts.
+const (
+	ociLayoutVersion     = "1.0.0"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	ociArtifactType      = "application/vnd.mirrorctl.snapshot.v1"
+	ociConfigMediaType   = "application/vnd.mirrorctl.snapshot.manifest.v1+json"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	ociCreatedAnnotation = "org.opencontainers.image.created"
+)
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ExportFile is a file of an exported snapshot.
+type ExportFile struct {
+	// Path is the slash-separated path of the file in the snapshot.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// Base is set in delta archives for files that are not included
+	// but taken from the base snapshot.  It is the path of the file in
+	// the base snapshot.
+	Base string `json:"base,omitempty"`
+}
+
+// ExportManifest describes the contents of a snapshot archive.
+type ExportManifest struct {
+	FormatVersion int               `json:"format_version"`
+	Mirror        string            `json:"mirror"`
+	Snapshot      string            `json:"snapshot"`
+	ExportedAt    time.Time         `json:"exported_at"`
+	Metadata      *SnapshotMetadata `json:"metadata,omitempty"`
+
+	// Base is the name of the base snapshot of a delta archive.
+	Base string `json:"base,omitempty"`
+
+	Files []*ExportFile `json:"files"`
+}
+
+// TotalSize returns the total size of the files in m.
+func (m *ExportManifest) TotalSize() int64 {
+	var n int64
+	for _, f := range m.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// IncludedSize returns the number and total size of the files included
+// in the archive, that is the files not taken from the base snapshot.
+func (m *ExportManifest) IncludedSize() (int, int64) {
+	var files int
+	var n int64
+	for _, f := range m.Files {
+		if f.Base == "" {
+			files++
+			n += f.Size
+		}
+	}
+	return files, n
+}
+
+// reuseFunc decides whether the file rel of size bytes at p is taken
+// from the base snapshot of a delta archive.  It returns nil if the
+// file must be included in the archive.
+type reuseFunc func(rel, p string, size int64) (*ExportFile, error)
+
+// ExportFormatFromPath returns the export format implied by the name
+// of the destination: ExportTarZstd for ".tar.zst" and ".tzst",
+// ExportTar for ".tar", and ExportOCI otherwise.
+func ExportFormatFromPath(p string) string {
+	switch {
+	case strings.HasSuffix(p, ".tar.zst"), strings.HasSuffix(p, ".tzst"):
+		return ExportTarZstd
+	case strings.HasSuffix(p, ".tar"):
+		return ExportTar
+	}
+	return ExportOCI
+}
+
+// ExportSnapshot writes a snapshot of mirror to dest in format, which
+// is one of ExportTar, ExportTarZstd and ExportOCI.  The OCI layout
+// directory dest must not exist or be empty.
+func (sm *SnapshotManager) ExportSnapshot(mirror, snapshotName, dest, format string) (*ExportManifest, error) {
+	return sm.export(mirror, snapshotName, "", dest, format)
+}
+
+// export writes a snapshot of mirror to dest.  If base is set, the
+// archive is a delta from the snapshot base.
+func (sm *SnapshotManager) export(mirror, snapshotName, base, dest, format string) (*ExportManifest, error) {
+	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(snapshotPath); err != nil {
+		return nil, fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
+	}
+
+	m := &ExportManifest{
+		FormatVersion: exportFormatVersion,
+		Mirror:        mirror,
+		Snapshot:      snapshotName,
+		ExportedAt:    time.Now().UTC(),
+		Files:         []*ExportFile{},
+	}
+	if md, err := loadSnapshotMetadata(snapshotPath); err == nil {
+		m.Metadata = md
+	}
+
+	var reuse reuseFunc
+	if base != "" {
+		if reuse, err = sm.deltaReuse(mirror, base, snapshotPath); err != nil {
+			return nil, err
+		}
+		m.Base = base
+	}
+
+	switch format {
+	case ExportTar, ExportTarZstd:
+		_, _, err = writeExportFile(dest, format == ExportTarZstd, func(w io.Writer) error {
+			return writeExportArchive(w, snapshotPath, m, reuse)
+		})
+	case ExportOCI:
+		err = writeOCILayout(dest, snapshotPath, m, reuse)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to export snapshot %s of mirror %s: %w", snapshotName, mirror, err)
+	}
+	return m, nil
+}
+
+// writeExportFile atomically creates the file p with the output of
+// write, compressed with zstd if compress is set, and returns the OCI
+// digest and the size of the file.
+func writeExportFile(p string, compress bool, write func(io.Writer) error) (string, int64, error) {
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp) // #nosec G304 - the destination is chosen by the user
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp) // #nosec G104 - no-op after the rename
+
+	dw := newDigestWriter()
+	bw := bufio.NewWriter(io.MultiWriter(f, dw))
+	if err := writeMaybeCompressed(bw, compress, write); err != nil {
+		f.Close() // #nosec G104 - cleanup on failure, ignore errors
+		return "", 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close() // #nosec G104 - cleanup on failure, ignore errors
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return "", 0, err
+	}
+	return dw.digest(), dw.size, nil
+}
+
+// writeMaybeCompressed calls write with w, or with a zstd encoder
+// writing to w if compress is set.
+func writeMaybeCompressed(w io.Writer, compress bool, write func(io.Writer) error) error {
+	if !compress {
+		return write(w)
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := write(zw); err != nil {
+		zw.Close() // #nosec G104 - cleanup on failure, ignore errors
+		return err
+	}
+	return zw.Close()
+}
+
+// writeExportArchive writes the files of the snapshot at snapshotPath
+// and then m, completed with the files, as a tar stream to w.  Files
+// that reuse takes from the base snapshot are only listed in m.
+func writeExportArchive(w io.Writer, snapshotPath string, m *ExportManifest, reuse reuseFunc) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(snapshotPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(snapshotPath, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     path.Join(exportTreeDir, rel) + "/",
+				Mode:     0755,
+				ModTime:  info.ModTime(),
+			})
+		case !info.Mode().IsRegular():
+			// Snapshots only hold directories and regular files
+			return nil
+		}
+
+		if reuse != nil {
+			f, err := reuse(rel, p, info.Size())
+			if err != nil {
+				return err
+			}
+			if f != nil {
+				m.Files = append(m.Files, f)
+				return nil
+			}
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(exportTreeDir, rel),
+			Mode:     0644,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}); err != nil {
+			return err
+		}
+		f, err := os.Open(p) // #nosec G304 - path found by walking the snapshot tree
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+			return err
+		}
+		m.Files = append(m.Files, &ExportFile{Path: rel, Size: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     exportManifestName,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  m.ExportedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest or image index.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *ociDescriptor    `json:"config,omitempty"`
+	Layers        []*ociDescriptor  `json:"layers,omitempty"`
+	Manifests     []*ociDescriptor  `json:"manifests,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// digestWriter computes the digest and size of the data written to it.
+type digestWriter struct {
+	h    hash.Hash
+	size int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{h: sha256.New()}
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	dw.size += int64(len(p))
+	return dw.h.Write(p)
+}
+
+// digest returns the OCI digest of the data.
+func (dw *digestWriter) digest() string {
+	return "sha256:" + hex.EncodeToString(dw.h.Sum(nil))
+}
+
+// writeOCILayout writes the snapshot at snapshotPath as an OCI image
+// layout directory at dest.
+func writeOCILayout(dest, snapshotPath string, m *ExportManifest, reuse reuseFunc) error {
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dest)
+	}
+	blobs := filepath.Join(dest, "blobs", "sha256")
+	// #nosec G301 - 0755 so that the layout can be served
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+
+	// The layer is written to a temporary file until its digest is known
+	tmp := filepath.Join(blobs, "layer")
+	digest, size, err := writeExportFile(tmp, true, func(w io.Writer) error {
+		return writeExportArchive(w, snapshotPath, m, reuse)
+	})
+	if err != nil {
+		return err
+	}
+	layer := &ociDescriptor{
+		MediaType: ociLayerMediaType,
+		Digest:    digest,
+		Size:      size,
+		Annotations: map[string]string{
+			"org.opencontainers.image.title": m.Mirror + "_" + m.Snapshot + ".tar.zst",
+		},
+	}
+	if err := os.Rename(tmp, ociBlobPath(dest, layer.Digest)); err != nil {
+		return err
+	}
+
+	config, err := writeOCIBlob(dest, ociConfigMediaType, m)
+	if err != nil {
+		return err
+	}
+	manifest, err := writeOCIBlob(dest, ociManifestMediaType, &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ociArtifactType,
+		Config:        config,
+		Layers:        []*ociDescriptor{layer},
+		Annotations: map[string]string{
+			ociCreatedAnnotation: m.ExportedAt.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	manifest.ArtifactType = ociArtifactType
+	manifest.Annotations = map[string]string{ociRefNameAnnotation: m.Snapshot}
+
+	if err := writeJSONFile(filepath.Join(dest, "index.json"), &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []*ociDescriptor{manifest},
+	}); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dest, "oci-layout"), map[string]string{"imageLayoutVersion": ociLayoutVersion})
+}
+
+// ociBlobPath returns the path of the blob with digest in the layout
+// at dir.  The digest must have been validated.
+func ociBlobPath(dir, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// writeOCIBlob writes v as JSON blob to the layout at dir.
+func writeOCIBlob(dir, mediaType string, v interface{}) (*ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	d := &ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+	// #nosec G306 - 0644 so that the layout can be served
+	if err := os.WriteFile(ociBlobPath(dir, d.Digest), data, 0644); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ImportOptions controls ImportSnapshot and ImportDelta.
+type ImportOptions struct {
+	// Name is the name of the imported snapshot.  It defaults to the
+	// name of the exported snapshot.
+	Name string
+
+	// Force replaces an existing snapshot with the same name.
+	Force bool
+
+	// Base is the local name of the base snapshot of a delta archive.
+	// It defaults to the name recorded in the archive.
+	Base string
+}
+
+// ImportSnapshot imports the archive or OCI image layout directory at
+// src as a snapshot of mirror, and returns its name.
+//
+// Every file is checked against the manifest of the archive, and the
+// archive is rejected if a file is missing, unlisted, does not match
+// its checksum, or has an unsafe path.  The snapshot appears only
+// once it has been verified.  Delta archives are rejected; see
+// ImportDelta.
+func (sm *SnapshotManager) ImportSnapshot(mirror, src string, opts ImportOptions) (string, error) {
+	return sm.importSnapshot(mirror, src, opts, false)
+}
+
+// importSnapshot imports a full archive, or a delta archive if delta
+// is set.
+func (sm *SnapshotManager) importSnapshot(mirror, src string, opts ImportOptions, delta bool) (string, error) {
+	if opts.Name != "" && !opts.Force {
+		if err := sm.checkSnapshotAbsent(mirror, opts.Name); err != nil {
+			return "", err
+		}
+	}
+
+	mirrorPath, err := sm.GetMirrorSnapshotsPath(mirror)
+	if err != nil {
+		return "", err
+	}
+	// #nosec G301 - 0755 needed for web server directory access
+	if err := os.MkdirAll(mirrorPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	// Files are extracted to a hidden directory first, which is not
+	// listed as a snapshot
+	tmp, err := os.MkdirTemp(mirrorPath, ".import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) // #nosec G104 - no-op after the rename
+
+	m, err := importArchive(src, tmp)
+	if err != nil {
+		return "", fmt.Errorf("failed to import %s: %w", src, err)
+	}
+
+	switch {
+	case delta && m.Base == "":
+		return "", fmt.Errorf("%s is not a delta archive", src)
+	case !delta && m.Base != "":
+		return "", fmt.Errorf("%s is a delta archive from snapshot %s (use import-delta)", src, m.Base)
+	case delta:
+		base := opts.Base
+		if base == "" {
+			base = m.Base
+		}
+		if err := sm.linkBaseFiles(mirror, base, m, tmp); err != nil {
+			return "", err
+		}
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = m.Snapshot
+	}
+	snapshotPath, err := sm.GetSnapshotPath(mirror, name)
+	if err != nil {
+		return "", err
+	}
+	if !opts.Force {
+		if err := sm.checkSnapshotAbsent(mirror, name); err != nil {
+			return "", err
+		}
+	} else if err := removeSnapshotFiles(snapshotPath); err != nil {
+		return "", fmt.Errorf("failed to remove existing snapshot: %w", err)
+	}
+
+	md := m.Metadata
+	if md == nil {
+		md = &SnapshotMetadata{CreatedAt: m.ExportedAt}
+	}
+	md.Mirror = mirror
+	md.Name = name
+	md.ImportedAt = time.Now().UTC()
+	if md.ImportedFrom, err = filepath.Abs(src); err != nil {
+		md.ImportedFrom = src
+	}
+	// Pins are local to a site
+	md.Pinned = false
+
+	// #nosec G302 - 0755 needed for web server directory access
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, snapshotPath); err != nil {
+		return "", fmt.Errorf("failed to move imported snapshot into place: %w", err)
+	}
+	if err := saveSnapshotMetadata(snapshotPath, md); err != nil {
+		os.RemoveAll(snapshotPath) // #nosec G104 - cleanup on failure, ignore errors
+		return "", fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+	saveSnapshotChecksums(snapshotPath, m.Files) // #nosec G104 - best effort
+	return name, nil
+}
+
+// checkSnapshotAbsent returns an error if the snapshot name exists.
+func (sm *SnapshotManager) checkSnapshotAbsent(mirror, name string) error {
+	snapshotPath, err := sm.GetSnapshotPath(mirror, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(snapshotPath); err == nil {
+		return fmt.Errorf("snapshot %s already exists for mirror %s (use --force to overwrite)", name, mirror)
+	}
+	return nil
+}
+
+// importArchive extracts the archive or OCI image layout at src into
+// dir, verifies it and returns its manifest.
+func importArchive(src, dir string) (*ExportManifest, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(src) // #nosec G304 - the source is chosen by the user
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return extractArchive(f, dir)
+	}
+
+	layer, err := readOCILayer(src)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(ociBlobPath(src, layer.Digest)) // #nosec G304 - digest validated by readOCILayer
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dw := newDigestWriter()
+	m, err := extractArchive(io.TeeReader(f, dw), dir)
+	if err != nil {
+		return nil, err
+	}
+	// Consume any padding so that the digest covers the whole blob
+	if _, err := io.Copy(dw, f); err != nil {
+		return nil, err
+	}
+	if dw.digest() != layer.Digest || dw.size != layer.Size {
+		return nil, fmt.Errorf("layer %s does not match its digest", layer.Digest)
+	}
+	return m, nil
+}
+
+// readOCILayer returns the layer of the snapshot image in the OCI
+// image layout at dir.
+func readOCILayer(dir string) (*ociDescriptor, error) {
+	index := &ociManifest{}
+	if err := readJSONFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return nil, fmt.Errorf("not an OCI image layout: %w", err)
+	}
+
+	var descs []*ociDescriptor
+	for _, d := range index.Manifests {
+		if d.ArtifactType == ociArtifactType {
+			descs = append(descs, d)
+		}
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("expected one snapshot image in %s, found %d", dir, len(descs))
+	}
+
+	manifest := &ociManifest{}
+	if err := readOCIBlob(dir, descs[0], manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != ociLayerMediaType {
+		return nil, errors.New("unexpected layers in snapshot image")
+	}
+	layer := manifest.Layers[0]
+	if err := validateDigest(layer.Digest); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// readOCIBlob verifies the JSON blob described by d in the layout at
+// dir and decodes it into v.
+func readOCIBlob(dir string, d *ociDescriptor, v interface{}) error {
+	if err := validateDigest(d.Digest); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(ociBlobPath(dir, d.Digest)) // #nosec G304 - digest validated above
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != d.Digest {
+		return fmt.Errorf("blob %s does not match its digest", d.Digest)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// validateDigest checks that digest is a SHA256 digest, which is safe
+// to use as file name.
+func validateDigest(digest string) error {
+	h, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(h) != sha256.Size*2 {
+		return fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(h); err != nil || strings.ToLower(h) != h {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+// extractArchive extracts the files of the snapshot archive r, which
+// may be compressed with zstd, into dir and verifies them against
+// the manifest.
+func extractArchive(r io.Reader, dir string) (*ExportManifest, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var m *ExportManifest
+	extracted := make(map[string]*ExportFile)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == exportManifestName {
+			if m != nil {
+				return nil, errors.New("duplicate manifest")
+			}
+			m = &ExportManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("failed to parse manifest: %w", err)
+			}
+			continue
+		}
+
+		rel, ok := strings.CutPrefix(strings.TrimSuffix(hdr.Name, "/"), exportTreeDir+"/")
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		if err := validateArchivePath(rel); err != nil {
+			return nil, err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// #nosec G301 - 0755 needed for web server directory access
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			if _, ok := extracted[rel]; ok {
+				return nil, fmt.Errorf("duplicate entry %q", hdr.Name)
+			}
+			f, err := extractFile(tr, target)
+			if err != nil {
+				return nil, err
+			}
+			f.Path = rel
+			extracted[rel] = f
+		default:
+			return nil, fmt.Errorf("unsupported type of entry %q", hdr.Name)
+		}
+	}
+
+	if m == nil {
+		return nil, errors.New("no manifest found")
+	}
+	if m.FormatVersion != exportFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %d", m.FormatVersion)
+	}
+	if err := verifyExtractedFiles(m, extracted); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validateArchivePath checks that rel, a path in an archive, is a
+// canonical relative path inside the snapshot tree.
+func validateArchivePath(rel string) error {
+	if err := apt.ValidateRepositoryPath(rel); err != nil {
+		return err
+	}
+	if path.Clean(rel) != rel {
+		return fmt.Errorf("non-canonical path %q", rel)
+	}
+	return nil
+}
+
+// extractFile writes the contents of r to the new file p and returns
+// its size and checksum.
+func extractFile(r io.Reader, p string) (*ExportFile, error) {
+	// #nosec G301 - 0755 needed for web server directory access
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	// #nosec G302,G304 - path validated by the caller, 0644 needed for web server access
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &ExportFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// verifyExtractedFiles checks that the extracted files are exactly the
+// files listed in m.
+func verifyExtractedFiles(m *ExportManifest, extracted map[string]*ExportFile) error {
+	var problems []string
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		listed[f.Path] = true
+		got, ok := extracted[f.Path]
+		switch {
+		case f.Base != "":
+			if ok {
+				problems = append(problems, f.Path+" is included although it is taken from the base snapshot")
+			}
+		case !ok:
+			problems = append(problems, f.Path+" is missing")
+		case got.Size != f.Size || got.SHA256 != f.SHA256:
+			problems = append(problems, f.Path+" does not match its checksum")
+		}
+	}
+	for p := range extracted {
+		if !listed[p] {
+			problems = append(problems, p+" is not listed in the manifest")
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	if len(problems) > 10 {
+		problems = append(problems[:10], fmt.Sprintf("and %d more", len(problems)-10))
+	}
+	return fmt.Errorf("verification failed: %s", strings.Join(problems, ", "))
+}
@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotManager_ExportImport(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "src", "live"))
+	dst := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "dst", "live"))
+
+	p, err := src.GetSnapshotPath("test-mirror", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(p, "dists/noble/Release"), []byte("Codename: noble\n"))
+	writeTestFile(t, filepath.Join(p, "pool/main/f/foo_1.0_amd64.deb"), []byte("deb"))
+	if err := os.MkdirAll(filepath.Join(p, "pool/empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSnapshotMetadata(p, &SnapshotMetadata{Mirror: "test-mirror", Name: "s1", Note: "exported", Pinned: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dest := range []string{"s1.tar", "s1.tar.zst", "s1-oci"} {
+		dest = filepath.Join(tmpDir, dest)
+		format := ExportFormatFromPath(dest)
+		m, err := src.ExportSnapshot("test-mirror", "s1", dest, format)
+		if err != nil {
+			t.Fatalf("%s: export failed: %v", format, err)
+		}
+		if len(m.Files) != 2 || m.TotalSize() != 19 {
+			t.Errorf("%s: unexpected manifest: %+v", format, m.Files)
+		}
+
+		name := "imported-" + strings.ReplaceAll(format, ".", "-")
+		got, err := dst.ImportSnapshot("other-mirror", dest, ImportOptions{Name: name})
+		if err != nil || got != name {
+			t.Fatalf("%s: import failed: %s, %v", format, got, err)
+		}
+		ip, _ := dst.GetSnapshotPath("other-mirror", name)
+		data, err := os.ReadFile(filepath.Join(ip, "pool/main/f/foo_1.0_amd64.deb"))
+		if err != nil || string(data) != "deb" {
+			t.Errorf("%s: unexpected contents: %q, %v", format, data, err)
+		}
+		if _, err := os.Stat(filepath.Join(ip, "pool/empty")); err != nil {
+			t.Errorf("%s: empty directory not imported: %v", format, err)
+		}
+		md, err := loadSnapshotMetadata(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Mirror != "other-mirror" || md.Name != name || md.Note != "exported" || md.Pinned || md.ImportedFrom != dest || md.ImportedAt.IsZero() {
+			t.Errorf("%s: unexpected metadata: %+v", format, md)
+		}
+
+		if _, err := dst.ImportSnapshot("other-mirror", dest, ImportOptions{Name: name}); err == nil {
+			t.Errorf("%s: expected an error for an existing snapshot", format)
+		}
+		if _, err := dst.ImportSnapshot("other-mirror", dest, ImportOptions{Name: name, Force: true}); err != nil {
+			t.Errorf("%s: forced import failed: %v", format, err)
+		}
+	}
+
+	// Imported snapshots are listed like native ones, but not the
+	// directories of unfinished imports
+	snapshots, err := dst.ListSnapshots("other-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 {
+		t.Errorf("expected 3 snapshots, got %d", len(snapshots))
+	}
+	if err := dst.PublishSnapshot("other-mirror", "imported-oci"); err != nil {
+		t.Errorf("failed to publish an imported snapshot: %v", err)
+	}
+
+	if _, err := src.ExportSnapshot("test-mirror", "s1", filepath.Join(tmpDir, "s1-oci"), ExportOCI); err == nil {
+		t.Error("expected an error when exporting to a non-empty directory")
+	}
+}
+
+// writeTestArchive writes a snapshot archive with the given entries
+// and a manifest listing files.
+func writeTestArchive(t *testing.T, p string, entries map[string]string, files []*ExportFile) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range entries {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := json.Marshal(&ExportManifest{FormatVersion: exportFormatVersion, Snapshot: "s1", Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: exportManifestName, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, p, buf.Bytes())
+}
+
+func TestSnapshotManager_ImportRejects(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live"))
+
+	// sha256("deb")
+	const debSum = "9cfa1468c93fc18652e34a000f0c6614b0fa18f6f4887477ad9b0d36ca6a7eaa"
+	good := &ExportFile{Path: "pool/foo.deb", Size: 3, SHA256: debSum}
+
+	tests := []struct {
+		name    string
+		entries map[string]string
+		files   []*ExportFile
+		want    string
+	}{
+		{"traversal", map[string]string{"snapshot/../../evil": "x"}, nil, "directory traversal"},
+		{"outside", map[string]string{"evil": "x"}, nil, "unexpected entry"},
+		{"mismatch", map[string]string{"snapshot/pool/foo.deb": "bad"}, []*ExportFile{good}, "does not match its checksum"},
+		{"missing", map[string]string{}, []*ExportFile{good}, "is missing"},
+		{"unlisted", map[string]string{"snapshot/pool/bar.deb": "x"}, nil, "not listed in the manifest"},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(tmpDir, tt.name+".tar")
+		writeTestArchive(t, p, tt.entries, tt.files)
+		_, err := sm.ImportSnapshot("test-mirror", p, ImportOptions{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "live", "..", ".snapshots", "test-mirror", "s1")); !os.IsNotExist(err) {
+		t.Errorf("rejected archives must not create snapshots: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(tmpDir, ".snapshots", "test-mirror"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected temporary directories to be removed: %v, %v", entries, err)
+	}
+}
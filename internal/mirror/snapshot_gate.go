@@ -0,0 +1,572 @@
+package mirror
+
+// This file implements the gates that must pass before a snapshot is
+// published to a channel.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+// Built-in gates.
+const (
+	// GateSignatures verifies the InRelease or Release.gpg signature
+	// of every suite with the pgp_key_path of the mirror.
+	GateSignatures = "signatures"
+
+	// GateCompleteness checks that the indices listed in Release files
+	// match their checksums, and that the files listed in the indices
+	// exist with the right size.
+	GateCompleteness = "completeness"
+
+	// GateDependencies checks that the dependencies of every binary
+	// package can be satisfied within the snapshot.
+	GateDependencies = "dependencies"
+)
+
+// GateMaxSize names the failure of snapshots larger than the max_size
+// of their mirror.  It is checked without being configured.
+const GateMaxSize = "max_size"
+
+// defaultGateTimeout limits the run time of gate commands.
+const defaultGateTimeout = 10 * time.Minute
+
+// maxGateOutput is the number of bytes of the output of a failed gate
+// or hook command that is reported.
+const maxGateOutput = 1024
+
+// GateConfig configures a gate.  A gate is either a built-in check or
+// an external command, which passes if it exits with status 0.
+type GateConfig struct {
+	// Name identifies the gate in messages.  It defaults to the
+	// built-in check or the command.
+	Name    string   `toml:"name,omitempty"`
+	Builtin string   `toml:"builtin,omitempty"`
+	Command []string `toml:"command,omitempty"`
+	Timeout string   `toml:"timeout,omitempty"`
+
+	// Channels lists the channels the gate guards.  By default, a gate
+	// guards every channel but staging.
+	Channels []string `toml:"channels,omitempty"`
+}
+
+// name returns the name of the gate.
+func (g *GateConfig) name() string {
+	switch {
+	case g.Name != "":
+		return g.Name
+	case g.Builtin != "":
+		return g.Builtin
+	case len(g.Command) > 0:
+		return filepath.Base(g.Command[0])
+	}
+	return "gate"
+}
+
+// guards reports whether the gate applies to publications to channel.
+func (g *GateConfig) guards(channel string) bool {
+	if len(g.Channels) == 0 {
+		return channel != ChannelStaging
+	}
+	return slices.Contains(g.Channels, channel)
+}
+
+// Check validates the gate configuration.
+func (g *GateConfig) Check() error {
+	switch {
+	case g.Builtin != "" && len(g.Command) > 0:
+		return fmt.Errorf("gate %s: builtin and command are mutually exclusive", g.name())
+	case g.Builtin != "":
+		if _, ok := builtinGates[g.Builtin]; !ok {
+			return fmt.Errorf("gate %s: unknown builtin %q", g.name(), g.Builtin)
+		}
+	case len(g.Command) == 0:
+		return fmt.Errorf("gate %s: either builtin or command is required", g.name())
+	}
+	if _, err := parseDuration(g.Timeout); err != nil {
+		return fmt.Errorf("gate %s: timeout: %w", g.name(), err)
+	}
+	return nil
+}
+
+// gateTarget is the publication a gate checks.
+type gateTarget struct {
+	mirror   string
+	snapshot string
+	channel  string
+	path     string
+	config   *MirrorConfig
+}
+
+// builtinGates maps the names of built-in gates to their checks.
+var builtinGates = map[string]func(t *gateTarget) error{
+	GateSignatures:   checkSignatures,
+	GateCompleteness: checkCompleteness,
+	GateDependencies: checkDependencies,
+}
+
+// GateFailure is a gate that failed.
+type GateFailure struct {
+	Gate string
+	Err  error
+}
+
+// GateError is returned when gates block a publication.
+type GateError struct {
+	Mirror   string
+	Snapshot string
+	Channel  string
+	Failures []GateFailure
+}
+
+func (e *GateError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = fmt.Sprintf("gate %s: %v", f.Gate, f.Err)
+	}
+	return fmt.Sprintf("cannot publish snapshot %s of mirror %s to %s: %s (use --override-gates to override)",
+		e.Snapshot, e.Mirror, e.Channel, strings.Join(msgs, "; "))
+}
+
+// WithOverrideGates returns a copy of sm that publishes snapshots even
+// if gates fail.  The failed gates are recorded in the history.
+func (sm *SnapshotManager) WithOverrideGates() *SnapshotManager {
+	c := *sm
+	c.overrideGates = true
+	return &c
+}
+
+// gates returns the global and per-mirror gates guarding channel.
+func (sm *SnapshotManager) gates(mirror, channel string) []*GateConfig {
+	var all []*GateConfig
+	all = append(all, sm.config.Gates...)
+	if mc := sm.snapshotConfig(mirror); mc != nil {
+		all = append(all, mc.Gates...)
+	}
+
+	var gates []*GateConfig
+	for _, g := range all {
+		if g.guards(channel) {
+			gates = append(gates, g)
+		}
+	}
+	return gates
+}
+
+// RunGates runs the gates guarding the publication of a snapshot to
+// channel and returns the failures.  Snapshots larger than the
+// max_size of the mirror fail on every channel.
+func (sm *SnapshotManager) RunGates(mirror, channel, snapshotName string) ([]GateFailure, error) {
+	gates := sm.gates(mirror, channel)
+	maxSize := sm.mirrors[mirror].maxSize()
+	if len(gates) == 0 && maxSize == 0 {
+		return nil, nil
+	}
+
+	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
+	}
+	t := &gateTarget{
+		mirror:   mirror,
+		snapshot: snapshotName,
+		channel:  channel,
+		path:     snapshotPath,
+		config:   sm.mirrors[mirror],
+	}
+
+	var failures []GateFailure
+	if maxSize > 0 {
+		if size := MeasureDiskUsage(snapshotPath).Size; size > maxSize {
+			err := fmt.Errorf("snapshot size %s exceeds %s", formatSize(size), sm.mirrors[mirror].MaxSize)
+			failures = append(failures, GateFailure{Gate: GateMaxSize, Err: err})
+		}
+	}
+	for _, g := range gates {
+		slog.Info("running gate", "mirror", mirror, "snapshot", snapshotName, "channel", channel, "gate", g.name())
+		var err error
+		if g.Builtin != "" {
+			check, ok := builtinGates[g.Builtin]
+			if !ok {
+				err = fmt.Errorf("unknown builtin %q", g.Builtin)
+			} else {
+				err = check(t)
+			}
+		} else {
+			err = runGateCommand(g, t)
+		}
+		if err != nil {
+			failures = append(failures, GateFailure{Gate: g.name(), Err: err})
+		}
+	}
+	return failures, nil
+}
+
+// checkGates runs the gates guarding the publication of a snapshot to
+// channel.  If gates fail, it returns a *GateError, or the names of the
+// failed gates if they are overridden.
+func (sm *SnapshotManager) checkGates(mirror, channel, snapshotName string) ([]string, error) {
+	failures, err := sm.RunGates(mirror, channel, snapshotName)
+	if err != nil || len(failures) == 0 {
+		return nil, err
+	}
+
+	if !sm.overrideGates {
+		return nil, &GateError{Mirror: mirror, Snapshot: snapshotName, Channel: channel, Failures: failures}
+	}
+
+	names := make([]string, len(failures))
+	for i, f := range failures {
+		names[i] = f.Gate
+		slog.Warn("overriding failed gate", "mirror", mirror, "snapshot", snapshotName, "channel", channel, "gate", f.Gate, "error", f.Err)
+	}
+	return names, nil
+}
+
+// runGateCommand runs the command of g.  The command runs in the
+// snapshot directory, and gets the publication in its environment.
+func runGateCommand(g *GateConfig, t *gateTarget) error {
+	timeout := defaultGateTimeout
+	if g.Timeout != "" {
+		d, err := parseDuration(g.Timeout)
+		if err != nil {
+			return err
+		}
+		timeout = d
+	}
+	return runCommand(g.Command, timeout, t.path, gateEnv(t), nil)
+}
+
+// runCommand runs a configured command with additional environment
+// variables env and stdin as standard input.  If the command fails,
+// the error includes the end of its output.
+func runCommand(command []string, timeout time.Duration, dir string, env []string, stdin io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...) // #nosec G204 - commands come from the configuration
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		output := bytes.TrimSpace(out.Bytes())
+		if len(output) > maxGateOutput {
+			output = output[len(output)-maxGateOutput:]
+		}
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// gateEnv returns the environment variables describing the publication
+// to gate commands.
+func gateEnv(t *gateTarget) []string {
+	env := []string{
+		"MIRRORCTL_MIRROR=" + t.mirror,
+		"MIRRORCTL_SNAPSHOT=" + t.snapshot,
+		"MIRRORCTL_SNAPSHOT_PATH=" + t.path,
+		"MIRRORCTL_CHANNEL=" + t.channel,
+	}
+
+	md, err := loadSnapshotMetadata(t.path)
+	if err != nil {
+		return env
+	}
+	env = append(env,
+		"MIRRORCTL_METADATA="+metadataPath(t.path),
+		"MIRRORCTL_CREATED_AT="+md.CreatedAt.Format(time.RFC3339),
+	)
+	if md.Note != "" {
+		env = append(env, "MIRRORCTL_NOTE="+md.Note)
+	}
+
+	keys := make([]string, 0, len(md.Labels))
+	for k := range md.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+				return r
+			}
+			return '_'
+		}, k)
+		env = append(env, "MIRRORCTL_LABEL_"+name+"="+md.Labels[k])
+	}
+	return env
+}
+
+// findReleaseDirs returns the directories of dir, relative to it, that
+// hold a Release or InRelease file.
+func findReleaseDirs(dir string) ([]string, error) {
+	found := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "by-hash" || strings.HasSuffix(d.Name(), ".diff") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "Release" && d.Name() != "InRelease" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		found[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0, len(found))
+	for d := range found {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	if len(dirs) == 0 {
+		return nil, errors.New("no Release files found")
+	}
+	return dirs, nil
+}
+
+// checkSignatures verifies the Release signatures of every suite.
+func checkSignatures(t *gateTarget) error {
+	if t.config == nil || t.config.PGPKeyPath == "" {
+		return errors.New("pgp_key_path is not set for the mirror")
+	}
+	publicKey, err := loadPGPKey(t.config.PGPKeyPath)
+	if err != nil {
+		return err
+	}
+	verifier, err := NewAPTParser(nil, t.config, t.mirror).pgp.Verify().VerificationKey(publicKey).New()
+	if err != nil {
+		return errors.Wrap(err, "failed to create verifier")
+	}
+
+	dirs, err := findReleaseDirs(t.path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		base := filepath.Join(t.path, filepath.FromSlash(dir))
+
+		// Missing files are left to verifyReleaseSignature
+		inRelease, _ := os.ReadFile(filepath.Join(base, "InRelease")) // #nosec G304 - path is within the snapshot
+		var release, sig []byte
+		if inRelease == nil {
+			release, _ = os.ReadFile(filepath.Join(base, "Release")) // #nosec G304 - path is within the snapshot
+			sig, _ = os.ReadFile(filepath.Join(base, "Release.gpg")) // #nosec G304 - path is within the snapshot
+		}
+		if _, err := verifyReleaseSignature(verifier, inRelease, release, sig); err != nil {
+			return errors.Wrap(err, dir)
+		}
+	}
+	return nil
+}
+
+// checkCompleteness checks the indices listed in the Release files and
+// the files listed in the package indices, except those that the
+// filters of the mirror skip.
+func checkCompleteness(t *gateTarget) error {
+	dirs, err := findReleaseDirs(t.path)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, dir := range dirs {
+		name := "InRelease"
+		if _, err := os.Stat(filepath.Join(t.path, filepath.FromSlash(dir), name)); err != nil {
+			name = "Release"
+		}
+		files, err := readIndexFileInfos(t.path, path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		// Only one compression variant of an index needs to exist
+		for _, fi := range files {
+			same, err := matchesFileInfo(t.path, fi)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !same {
+				problems = append(problems, fi.Path()+" does not match its checksum")
+			}
+		}
+	}
+
+	indices, err := findPackageIndices(t.path)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(indices))
+	for k := range indices {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Files skipped by the filters of the mirror are not missing.  Sync
+	// filters the packages of each suite together, so do they.
+	suites := make(map[string][]string)
+	var order []string
+	for _, k := range keys {
+		suite := indexSuite(dirs, indices[k])
+		if _, ok := suites[suite]; !ok {
+			order = append(order, suite)
+		}
+		suites[suite] = append(suites[suite], indices[k])
+	}
+	for _, suite := range order {
+		files, err := listedPoolFiles(t, suites[suite])
+		if err != nil {
+			return err
+		}
+		paths := make([]string, 0, len(files))
+		for p := range files {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			info, err := os.Stat(filepath.Join(t.path, filepath.FromSlash(p)))
+			switch {
+			case err != nil:
+				problems = append(problems, p+" is missing")
+			case uint64(info.Size()) != files[p].Size(): // #nosec G115 - file sizes are never negative
+				problems = append(problems, p+" has the wrong size")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		if len(problems) > 10 {
+			problems = append(problems[:10], fmt.Sprintf("and %d more", len(problems)-10))
+		}
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// indexSuite returns the directory of the Release file that lists the
+// index at rel, among dirs, or the directory of rel.
+func indexSuite(dirs []string, rel string) string {
+	suite := path.Dir(rel)
+	best := ""
+	for _, dir := range dirs {
+		if strings.HasPrefix(rel, dir+"/") && len(dir) > len(best) {
+			best = dir
+		}
+	}
+	if best != "" {
+		return best
+	}
+	return suite
+}
+
+// listedPoolFiles returns the files listed in the package indices of a
+// suite, by path, that the filters of the mirror of t keep.
+func listedPoolFiles(t *gateTarget, indices []string) (map[string]*apt.FileInfo, error) {
+	itemMap := make(map[string]*apt.FileInfo)
+	var packages []*apt.Package
+	for _, rel := range indices {
+		f, err := os.Open(filepath.Join(t.path, filepath.FromSlash(rel))) // #nosec G304 - path is within the snapshot
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err := apt.ExtractPackages(rel, f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", rel, err)
+		}
+
+		for _, pkg := range pkgs {
+			for i, fi := range pkg.Files {
+				// Flat repositories list files relative to the index
+				if dir := path.Dir(rel); !strings.HasPrefix(rel, "dists/") && dir != "." {
+					fi = fi.AddPrefix(dir)
+					pkg.Files[i] = fi
+				}
+				itemMap[fi.Path()] = fi
+			}
+		}
+		packages = append(packages, pkgs...)
+	}
+
+	if t.config == nil {
+		return itemMap, nil
+	}
+	return NewAPTParser(nil, t.config, t.mirror).applyPackageFilters(itemMap, packages), nil
+}
+
+// readIndexFileInfos returns the files listed in the index at rel.
+func readIndexFileInfos(dir, rel string) ([]*apt.FileInfo, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel))) // #nosec G304 - path is within the snapshot
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files, _, err := apt.ExtractFileInfo(rel, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", rel, err)
+	}
+	return files, nil
+}
+
+// matchesFileInfo checks the file at fi.Path() in dir against fi.
+func matchesFileInfo(dir string, fi *apt.FileInfo) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(fi.Path()))) // #nosec G304 - path is within the snapshot
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	actual, err := apt.CopyWithFileInfo(io.Discard, f, fi.Path())
+	if err != nil {
+		return false, err
+	}
+	return fi.Same(actual), nil
+}
@@ -0,0 +1,183 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeGateTestSnapshot creates a snapshot with a Release file listing
+// a Packages index, which lists a single package.
+func writeGateTestSnapshot(t *testing.T, sm *SnapshotManager, name string) string {
+	t.Helper()
+	p, err := sm.GetSnapshotPath("test-mirror", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := []byte("Package: foo\nVersion: 1.0\nArchitecture: amd64\nFilename: pool/main/f/foo_1.0_amd64.deb\nSize: 3\nSHA256: 00\n\n")
+	sum := sha256.Sum256(pkgs)
+	release := fmt.Sprintf("Codename: noble\nSHA256:\n %s %d main/binary-amd64/Packages\n %s 10 main/binary-amd64/Packages.gz\n",
+		hex.EncodeToString(sum[:]), len(pkgs), strings.Repeat("0", 64))
+
+	writeTestFile(t, filepath.Join(p, "dists/noble/Release"), []byte(release))
+	writeTestFile(t, filepath.Join(p, "dists/noble/main/binary-amd64/Packages"), pkgs)
+	writeTestFile(t, filepath.Join(p, "pool/main/f/foo_1.0_amd64.deb"), []byte("deb"))
+	return p
+}
+
+func TestSnapshotManager_Gates(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &SnapshotConfig{Gates: []*GateConfig{{Builtin: GateCompleteness}}}
+	sm := NewSnapshotManager(config, filepath.Join(tmpDir, "live")).WithMirrorConfigs(map[string]*MirrorConfig{
+		"test-mirror": {Snapshot: &MirrorSnapshotConfig{Gates: []*GateConfig{{
+			Name:    "smoke",
+			Command: []string{"sh", "-c", `test -f dists/noble/Release && test -f "$MIRRORCTL_SNAPSHOT_PATH/pool/main/f/foo_1.0_amd64.deb" && test "$MIRRORCTL_LABEL_TICKET" = OPS-1 || { echo "smoke test failed for $MIRRORCTL_SNAPSHOT" >&2; exit 1; }`},
+		}}}},
+	})
+
+	good := writeGateTestSnapshot(t, sm, "good")
+	if err := saveSnapshotMetadata(good, &SnapshotMetadata{Mirror: "test-mirror", Name: "good", Labels: map[string]string{"ticket": "OPS-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	bad := writeGateTestSnapshot(t, sm, "bad")
+	if err := os.Remove(filepath.Join(bad, "pool/main/f/foo_1.0_amd64.deb")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.PublishSnapshot("test-mirror", "good"); err != nil {
+		t.Fatalf("expected gates to pass: %v", err)
+	}
+
+	// Gates do not guard staging by default
+	if err := sm.PublishSnapshotToStaging("test-mirror", "bad"); err != nil {
+		t.Fatalf("expected staging to be unguarded: %v", err)
+	}
+
+	_, err := sm.PromoteSnapshot("test-mirror")
+	var gateErr *GateError
+	if !errors.As(err, &gateErr) {
+		t.Fatalf("expected a gate error, got %v", err)
+	}
+	if len(gateErr.Failures) != 2 || gateErr.Failures[0].Gate != GateCompleteness || gateErr.Failures[1].Gate != "smoke" {
+		t.Fatalf("unexpected failures: %+v", gateErr.Failures)
+	}
+	if !strings.Contains(err.Error(), "foo_1.0_amd64.deb is missing") || !strings.Contains(err.Error(), "smoke test failed for bad") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	if current, _ := sm.GetCurrentlyPublished("test-mirror"); current != "good" {
+		t.Errorf("failed gates should keep good live, got %s", current)
+	}
+
+	if _, err := sm.WithOverrideGates().WithReason("hotfix").PromoteSnapshot("test-mirror"); err != nil {
+		t.Fatalf("expected the override to promote: %v", err)
+	}
+	entries, err := sm.ReadHistory("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if last.Action != HistoryPromote || !reflect.DeepEqual(last.OverriddenGates, []string{GateCompleteness, "smoke"}) || last.Reason != "hotfix" {
+		t.Errorf("unexpected history entry: %+v", last)
+	}
+}
+
+func TestCheckCompleteness(t *testing.T) {
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(t.TempDir(), "live"))
+	p := writeGateTestSnapshot(t, sm, "s")
+	target := &gateTarget{mirror: "test-mirror", snapshot: "s", path: p}
+
+	if err := checkCompleteness(target); err != nil {
+		t.Fatalf("expected a complete snapshot: %v", err)
+	}
+
+	writeTestFile(t, filepath.Join(p, "dists/noble/main/binary-amd64/Packages"), []byte("Package: foo\nVersion: 1.1\nFilename: pool/main/f/foo_1.0_amd64.deb\nSize: 3\n\n"))
+	if err := checkCompleteness(target); err == nil || !strings.Contains(err.Error(), "does not match its checksum") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestCheckCompleteness_Filters(t *testing.T) {
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(t.TempDir(), "live"))
+	p, err := sm.GetSnapshotPath("test-mirror", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sync kept only the newest foo and skipped bar
+	var pkgs []byte
+	for _, pkg := range []string{"foo_1.0", "foo_2.0", "bar_1.0"} {
+		name, version, _ := strings.Cut(pkg, "_")
+		pkgs = append(pkgs, fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: amd64\nFilename: pool/main/%s_amd64.deb\nSize: 3\n\n",
+			name, version, pkg)...)
+	}
+	sum := sha256.Sum256(pkgs)
+	writeTestFile(t, filepath.Join(p, "dists/noble/Release"),
+		[]byte(fmt.Sprintf("SHA256:\n %s %d main/binary-amd64/Packages\n", hex.EncodeToString(sum[:]), len(pkgs))))
+	writeTestFile(t, filepath.Join(p, "dists/noble/main/binary-amd64/Packages"), pkgs)
+	writeTestFile(t, filepath.Join(p, "pool/main/foo_2.0_amd64.deb"), []byte("deb"))
+
+	target := &gateTarget{mirror: "test-mirror", snapshot: "s", path: p, config: &MirrorConfig{}}
+	if err := checkCompleteness(target); err == nil || !strings.Contains(err.Error(), "pool/main/bar_1.0_amd64.deb is missing") {
+		t.Errorf("expected missing files without filters, got %v", err)
+	}
+
+	target.config.Filters = &PackageFilters{KeepVersions: 1, ExcludePatterns: []string{"bar"}}
+	if err := checkCompleteness(target); err != nil {
+		t.Errorf("expected the filtered snapshot to be complete: %v", err)
+	}
+}
+
+func TestCheckSignatures(t *testing.T) {
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(t.TempDir(), "live"))
+	p, err := sm.GetSnapshotPath("test-mirror", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inRelease, err := os.ReadFile("testdata/pgp/InRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(p, "dists/noble/InRelease"), inRelease)
+
+	target := &gateTarget{mirror: "test-mirror", snapshot: "s", path: p, config: &MirrorConfig{PGPKeyPath: "testdata/pgp/public-key.asc"}}
+	if err := checkSignatures(target); err != nil {
+		t.Errorf("expected a valid signature: %v", err)
+	}
+
+	target.config.PGPKeyPath = "testdata/pgp/wrong-public-key.asc"
+	if err := checkSignatures(target); err == nil {
+		t.Error("expected verification with the wrong key to fail")
+	}
+
+	target.config = nil
+	if err := checkSignatures(target); err == nil {
+		t.Error("expected an error without pgp_key_path")
+	}
+}
+
+func TestGateConfig_Check(t *testing.T) {
+	tests := []struct {
+		name  string
+		gate  GateConfig
+		valid bool
+	}{
+		{"builtin", GateConfig{Builtin: GateSignatures}, true},
+		{"command", GateConfig{Command: []string{"true"}, Timeout: "5m"}, true},
+		{"unknown builtin", GateConfig{Builtin: "magic"}, false},
+		{"both", GateConfig{Builtin: GateSignatures, Command: []string{"true"}}, false},
+		{"neither", GateConfig{Name: "empty"}, false},
+		{"bad timeout", GateConfig{Command: []string{"true"}, Timeout: "soon"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.gate.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
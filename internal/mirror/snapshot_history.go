@@ -0,0 +1,246 @@
+package mirror
+
+// This file implements the audit log of snapshot operations.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// historyFile is the append-only audit log in the snapshot directory
+// of each mirror.  The leading dot keeps it apart from snapshot names.
+const historyFile = ".history.jsonl"
+
+// Actions recorded in the history.
+const (
+	HistoryPublish  = "publish"
+	HistoryStage    = "stage"
+	HistoryPromote  = "promote"
+	HistoryDelete   = "delete"
+	HistoryRollback = "rollback"
+)
+
+// HistoryEntry is a single operation in the audit log of a mirror.
+//
+// OldTarget and NewTarget are the snapshots the affected symlink
+// pointed to before and after the operation.  They are empty for
+// deletions, which list the channels removed with --force in Unlinked.
+//
+// Channel is the channel the operation changed, and FromChannel the
+// channel a promotion copied.  They are empty for the live and staging
+// channels of publish, stage, promote and rollback.
+type HistoryEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Channel     string    `json:"channel,omitempty"`
+	FromChannel string    `json:"from_channel,omitempty"`
+	Snapshot    string    `json:"snapshot"`
+	OldTarget   string    `json:"old_target,omitempty"`
+	NewTarget   string    `json:"new_target,omitempty"`
+	Unlinked    []string  `json:"unlinked,omitempty"`
+	User        string    `json:"user"`
+	Host        string    `json:"host"`
+	Reason      string    `json:"reason,omitempty"`
+
+	// OverriddenGates lists the gates that failed but were overridden.
+	OverriddenGates []string `json:"overridden_gates,omitempty"`
+}
+
+// WithReason returns a copy of sm that records reason in the history
+// of the operations it performs.
+func (sm *SnapshotManager) WithReason(reason string) *SnapshotManager {
+	c := *sm
+	c.reason = reason
+	return &c
+}
+
+// WithUser returns a copy of sm that records user in the history of the
+// operations it performs instead of the invoking user.
+func (sm *SnapshotManager) WithUser(user string) *SnapshotManager {
+	c := *sm
+	c.user = user
+	return &c
+}
+
+// historyPath returns the path of the audit log of mirror.
+func (sm *SnapshotManager) historyPath(mirror string) (string, error) {
+	dir, err := sm.GetMirrorSnapshotsPath(mirror)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, historyFile), nil
+}
+
+// currentUser returns the name of the invoking user.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// recordHistory appends an operation that moved a symlink from
+// oldTarget to newTarget.
+func (sm *SnapshotManager) recordHistory(mirror, action, snapshot, oldTarget, newTarget string) {
+	sm.appendHistory(mirror, &HistoryEntry{
+		Action:    action,
+		Snapshot:  snapshot,
+		OldTarget: oldTarget,
+		NewTarget: newTarget,
+	})
+}
+
+// appendHistory fills in the time, user, host and reason of e and
+// appends it to the audit log of mirror.  The operation has already
+// happened, so failures are logged rather than returned.
+func (sm *SnapshotManager) appendHistory(mirror string, e *HistoryEntry) {
+	e.Time = time.Now().UTC()
+	e.User = sm.user
+	if e.User == "" {
+		e.User = currentUser()
+	}
+	e.Host, _ = os.Hostname()
+	e.Reason = sm.reason
+
+	if err := sm.writeHistory(mirror, e); err != nil {
+		slog.Warn("failed to record snapshot history", "mirror", mirror, "action", e.Action, "error", err)
+	}
+}
+
+func (sm *SnapshotManager) writeHistory(mirror string, e *HistoryEntry) error {
+	p, err := sm.historyPath(mirror)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// #nosec G301 - 0755 needed for web server directory access
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644) // #nosec G302,G304 - path built from validated mirror ID
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close() // #nosec G104 - already failing, ignore errors
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the audit log of mirror, oldest first.
+func (sm *SnapshotManager) ReadHistory(mirror string) ([]*HistoryEntry, error) {
+	p, err := sm.historyPath(mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p) // #nosec G304 - path built from validated mirror ID
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*HistoryEntry{}, nil
+		}
+		return nil, fmt.Errorf("failed to read history for mirror %s: %w", mirror, err)
+	}
+	defer f.Close()
+
+	entries := []*HistoryEntry{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		e := &HistoryEntry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("invalid history entry at %s:%d: %w", p, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history for mirror %s: %w", mirror, err)
+	}
+	return entries, nil
+}
+
+// publishedStack replays the history and returns the snapshots that
+// have been published to production, most recent last.  Rollbacks pop
+// the snapshots they rolled back from, so that repeated rollbacks go
+// further back in time.
+func publishedStack(entries []*HistoryEntry) []string {
+	var stack []string
+	for _, e := range entries {
+		switch e.Action {
+		case HistoryPublish, HistoryPromote:
+			if len(stack) == 0 && e.OldTarget != "" && e.OldTarget != e.NewTarget {
+				stack = append(stack, e.OldTarget)
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != e.NewTarget {
+				stack = append(stack, e.NewTarget)
+			}
+		case HistoryRollback:
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] == e.NewTarget {
+					stack = stack[:i+1]
+					break
+				}
+			}
+		}
+	}
+	return stack
+}
+
+// RollbackSnapshot re-publishes the snapshot that was published steps
+// publications before the current one, and returns its name.  Gates are
+// not run, as the snapshot has been live before.
+func (sm *SnapshotManager) RollbackSnapshot(mirror string, steps int) (_ string, err error) {
+	if steps < 1 {
+		return "", errors.New("steps must be at least 1")
+	}
+
+	entries, err := sm.ReadHistory(mirror)
+	if err != nil {
+		return "", err
+	}
+	// Only operations on the live symlink matter
+	var live []*HistoryEntry
+	for _, e := range entries {
+		if sm.isLiveChannel(mirror, e.Channel) {
+			live = append(live, e)
+		}
+	}
+	stack := publishedStack(live)
+
+	current, err := sm.GetCurrentlyPublished(mirror)
+	if err != nil {
+		return "", err
+	}
+	if len(stack) == 0 || stack[len(stack)-1] != current {
+		return "", fmt.Errorf("the published snapshot %s of mirror %s does not match its history", current, mirror)
+	}
+	if steps >= len(stack) {
+		return "", fmt.Errorf("mirror %s has only %d previously published snapshots in its history", mirror, len(stack)-1)
+	}
+
+	target := stack[len(stack)-1-steps]
+	e := sm.publishEvent(HistoryRollback, mirror, target, ChannelLive, current)
+	defer func() { sm.postPublish(e, err) }()
+	if err = sm.prePublish(e); err != nil {
+		return "", err
+	}
+	if err = sm.publish(mirror, target); err != nil {
+		return "", err
+	}
+	sm.recordHistory(mirror, HistoryRollback, target, current, target)
+	return target, nil
+}
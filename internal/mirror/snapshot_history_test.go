@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotManager_HistoryAndRollback(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath)
+
+	for _, name := range []string{"a", "b", "c"} {
+		p, err := sm.GetSnapshotPath("test-mirror", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sm.PublishSnapshot("test-mirror", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.PublishSnapshot("test-mirror", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.PublishSnapshotToStaging("test-mirror", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.WithReason("weekly update").PromoteSnapshot("test-mirror"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := sm.ReadHistory("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{HistoryPublish, HistoryPublish, HistoryStage, HistoryPromote}) {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+	promote := entries[3]
+	if promote.OldTarget != "b" || promote.NewTarget != "c" || promote.Reason != "weekly update" || promote.User == "" {
+		t.Errorf("unexpected promote entry: %+v", promote)
+	}
+	if entries[0].Reason != "" {
+		t.Errorf("reason should only apply to the manager returned by WithReason")
+	}
+
+	// Rollbacks go further back each time.
+	name, err := sm.RollbackSnapshot("test-mirror", 1)
+	if err != nil || name != "b" {
+		t.Fatalf("RollbackSnapshot = %s, %v; want b", name, err)
+	}
+	name, err = sm.RollbackSnapshot("test-mirror", 1)
+	if err != nil || name != "a" {
+		t.Fatalf("RollbackSnapshot = %s, %v; want a", name, err)
+	}
+	if published, _ := sm.GetCurrentlyPublished("test-mirror"); published != "a" {
+		t.Errorf("expected a to be published, got %s", published)
+	}
+	if _, err := sm.RollbackSnapshot("test-mirror", 1); err == nil {
+		t.Error("expected an error when there is nothing to roll back to")
+	}
+
+	// Publishing again makes the stack grow from the current snapshot.
+	if err := sm.PublishSnapshot("test-mirror", "c"); err != nil {
+		t.Fatal(err)
+	}
+	name, err = sm.RollbackSnapshot("test-mirror", 1)
+	if err != nil || name != "a" {
+		t.Fatalf("RollbackSnapshot = %s, %v; want a", name, err)
+	}
+
+	if err := sm.DeleteSnapshot("test-mirror", "c", true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = sm.ReadHistory("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if last.Action != HistoryDelete || last.Snapshot != "c" || !reflect.DeepEqual(last.Unlinked, []string{"staging"}) {
+		t.Errorf("unexpected delete entry: %+v", last)
+	}
+
+	// Snapshot listings are not confused by the history file.
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Errorf("expected 2 snapshots, got %d", len(snapshots))
+	}
+}
+
+func TestPublishedStack(t *testing.T) {
+	entries := []*HistoryEntry{
+		{Action: HistoryPublish, OldTarget: "old", NewTarget: "a"},
+		{Action: HistoryStage, NewTarget: "b"},
+		{Action: HistoryPromote, OldTarget: "a", NewTarget: "b"},
+		{Action: HistoryPublish, OldTarget: "b", NewTarget: "b"},
+		{Action: HistoryPublish, OldTarget: "b", NewTarget: "c"},
+		{Action: HistoryRollback, OldTarget: "c", NewTarget: "a"},
+	}
+	got := publishedStack(entries)
+	if !reflect.DeepEqual(got, []string{"old", "a"}) {
+		t.Errorf("publishedStack = %v", got)
+	}
+}
@@ -0,0 +1,266 @@
+package mirror
+
+// This file implements the provenance records of syncs and snapshots.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mirrorctl/mirrorctl/internal/apt"
+)
+
+const (
+	// syncJSON is the file in a storage directory that records how
+	// the mirror was synchronized.
+	syncJSON = "sync.json"
+
+	// snapshotMetadataExt is appended to the snapshot directory to
+	// name its metadata file.  The file is kept next to the snapshot
+	// rather than inside it so that it is not served to clients.
+	snapshotMetadataExt = ".json"
+)
+
+// Version is the mirrorctl version recorded in snapshot metadata.
+// The command sets it at startup.
+var Version = "dev"
+
+// SuiteRelease holds the fields of the upstream Release file of a suite.
+type SuiteRelease struct {
+	Date     string `json:"date,omitempty"`
+	Codename string `json:"codename,omitempty"`
+	Version  string `json:"version,omitempty"`
+
+	// SigningKey is the fingerprint of the key that verified the
+	// Release signature, or empty if verification was disabled.
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+// SyncRecord records a sync of a mirror.  It is saved as sync.json
+// in the storage directory.
+type SyncRecord struct {
+	StartedAt  time.Time                `json:"started_at"`
+	FinishedAt time.Time                `json:"finished_at,omitzero"`
+	Suites     map[string]*SuiteRelease `json:"suites,omitempty"`
+}
+
+// suite returns the release information of suite, creating it as needed.
+func (r *SyncRecord) suite(suite string) *SuiteRelease {
+	if r.Suites == nil {
+		r.Suites = make(map[string]*SuiteRelease)
+	}
+	sr, ok := r.Suites[suite]
+	if !ok {
+		sr = &SuiteRelease{}
+		r.Suites[suite] = sr
+	}
+	return sr
+}
+
+// setRelease records the fields of the Release paragraph of suite.
+func (r *SyncRecord) setRelease(suite string, d apt.Paragraph) {
+	if r == nil || d == nil {
+		return
+	}
+	sr := r.suite(suite)
+	sr.Date = firstField(d, "Date")
+	sr.Codename = firstField(d, "Codename")
+	sr.Version = firstField(d, "Version")
+}
+
+// setSigningKey records the fingerprint of the key that signed suite.
+func (r *SyncRecord) setSigningKey(suite, fingerprint string) {
+	if r == nil {
+		return
+	}
+	r.suite(suite).SigningKey = fingerprint
+}
+
+// firstField returns the first value of field in d, or an empty string.
+func firstField(d apt.Paragraph, field string) string {
+	if v := d[field]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// save writes r as sync.json in dir.
+func (r *SyncRecord) save(dir string) error {
+	return writeJSONFile(filepath.Join(dir, syncJSON), r)
+}
+
+// loadSyncRecord reads sync.json from dir.
+func loadSyncRecord(dir string) (*SyncRecord, error) {
+	r := &SyncRecord{}
+	if err := readJSONFile(filepath.Join(dir, syncJSON), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SnapshotOptions holds user-supplied information recorded in the
+// metadata of a new snapshot.
+type SnapshotOptions struct {
+	Labels map[string]string
+	Note   string
+}
+
+// SnapshotMetadata describes the provenance of a snapshot.
+type SnapshotMetadata struct {
+	Mirror    string    `json:"mirror"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Source is the storage directory the snapshot was created from.
+	Source         string                   `json:"source"`
+	SyncStartedAt  time.Time                `json:"sync_started_at,omitzero"`
+	SyncFinishedAt time.Time                `json:"sync_finished_at,omitzero"`
+	Suites         map[string]*SuiteRelease `json:"suites,omitempty"`
+
+	MirrorctlVersion string            `json:"mirrorctl_version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Note             string            `json:"note,omitempty"`
+
+	// Pinned snapshots are never removed by prune.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// ImportedAt and ImportedFrom are set for snapshots imported from
+	// an archive.  See ImportSnapshot.
+	ImportedAt   time.Time `json:"imported_at,omitzero"`
+	ImportedFrom string    `json:"imported_from,omitempty"`
+}
+
+// Match reports whether the metadata matches a filter.  The filter
+// key is one of "label.<name>", "codename", "version", "source",
+// "mirrorctl_version" and "note".  Notes match by substring, and
+// codename and version match if any suite has the value.
+func (md *SnapshotMetadata) Match(key, value string) bool {
+	if md == nil {
+		return false
+	}
+
+	if name, ok := strings.CutPrefix(key, "label."); ok {
+		v, ok := md.Labels[name]
+		return ok && v == value
+	}
+
+	switch key {
+	case "codename", "version":
+		for _, sr := range md.Suites {
+			if (key == "codename" && sr.Codename == value) || (key == "version" && sr.Version == value) {
+				return true
+			}
+		}
+		return false
+	case "source":
+		return md.Source == value
+	case "mirrorctl_version":
+		return md.MirrorctlVersion == value
+	case "note":
+		return strings.Contains(md.Note, value)
+	}
+	return false
+}
+
+// ValidateMetadataFilter checks that key can be used with Match.
+func ValidateMetadataFilter(key string) error {
+	if name, ok := strings.CutPrefix(key, "label."); ok {
+		if name == "" {
+			return fmt.Errorf("empty label name in filter %q", key)
+		}
+		return nil
+	}
+	switch key {
+	case "codename", "version", "source", "mirrorctl_version", "note":
+		return nil
+	}
+	return fmt.Errorf("unknown filter key %q", key)
+}
+
+// metadataPath returns the path of the metadata file of a snapshot.
+func metadataPath(snapshotPath string) string {
+	return filepath.Clean(snapshotPath) + snapshotMetadataExt
+}
+
+// newSnapshotMetadata builds the metadata of a snapshot of the tree
+// at resolvedLivePath.
+//
+// If the tree is a synced storage, its sync.json provides the sync
+// information.  If it is another snapshot, the information is taken
+// over from the metadata of that snapshot.
+func newSnapshotMetadata(mirror, name, resolvedLivePath string, opts SnapshotOptions) *SnapshotMetadata {
+	md := &SnapshotMetadata{
+		Mirror:           mirror,
+		Name:             name,
+		CreatedAt:        time.Now().UTC(),
+		Source:           resolvedLivePath,
+		MirrorctlVersion: Version,
+		Labels:           opts.Labels,
+		Note:             opts.Note,
+	}
+
+	storageDir := filepath.Dir(resolvedLivePath)
+	if r, err := loadSyncRecord(storageDir); err == nil {
+		md.Source = storageDir
+		md.SyncStartedAt = r.StartedAt
+		md.SyncFinishedAt = r.FinishedAt
+		md.Suites = r.Suites
+		return md
+	}
+
+	if prev, err := loadSnapshotMetadata(resolvedLivePath); err == nil {
+		md.Source = prev.Source
+		md.SyncStartedAt = prev.SyncStartedAt
+		md.SyncFinishedAt = prev.SyncFinishedAt
+		md.Suites = prev.Suites
+	}
+	return md
+}
+
+// loadSnapshotMetadata reads the metadata of the snapshot at snapshotPath.
+func loadSnapshotMetadata(snapshotPath string) (*SnapshotMetadata, error) {
+	md := &SnapshotMetadata{}
+	if err := readJSONFile(metadataPath(snapshotPath), md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// saveSnapshotMetadata writes the metadata of the snapshot at snapshotPath.
+func saveSnapshotMetadata(snapshotPath string, md *SnapshotMetadata) error {
+	return writeJSONFile(metadataPath(snapshotPath), md)
+}
+
+// readJSONFile decodes the JSON file at p into v.
+func readJSONFile(p string, v interface{}) error {
+	data, err := os.ReadFile(p) // #nosec G304 - p is built from validated snapshot or storage paths
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	return nil
+}
+
+// writeJSONFile atomically writes v as indented JSON to p.
+func writeJSONFile(p string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	// #nosec G306 - 0644 matches info.json
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp) // #nosec G104 - cleanup on failure, ignore errors
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotManager_Metadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	storageDir := filepath.Join(livePath, ".test-mirror.20240115_103000.000000")
+	writeTestFile(t, filepath.Join(storageDir, "test-mirror", "dists/noble/Release"), []byte("Codename: noble\n"))
+
+	started := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	record := &SyncRecord{StartedAt: started, FinishedAt: started.Add(time.Hour)}
+	record.setRelease("noble", map[string][]string{
+		"Date":     {"Mon, 15 Jan 2024 09:00:00 UTC"},
+		"Codename": {"noble"},
+		"Version":  {"24.04"},
+	})
+	record.setSigningKey("noble", "F6ECB3762474EDA9D21B7022871920D1991BC93C")
+	if err := record.save(storageDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(storageDir, "test-mirror"), filepath.Join(livePath, "test-mirror")); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath)
+	opts := SnapshotOptions{Labels: map[string]string{"ticket": "OPS-1"}, Note: "before kernel upgrade"}
+	if _, err := sm.CreateSnapshotWithOptions("test-mirror", "snap1", false, nil, opts); err != nil {
+		t.Fatalf("CreateSnapshotWithOptions failed: %v", err)
+	}
+
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Metadata == nil {
+		t.Fatalf("expected one snapshot with metadata, got %+v", snapshots)
+	}
+	md := snapshots[0].Metadata
+	if md.Source != storageDir || !md.SyncStartedAt.Equal(started) || md.MirrorctlVersion != Version {
+		t.Errorf("unexpected provenance: %+v", md)
+	}
+	if !snapshots[0].CreatedAt.Equal(md.CreatedAt) {
+		t.Errorf("CreatedAt should come from metadata")
+	}
+	sr := md.Suites["noble"]
+	if sr == nil || sr.Codename != "noble" || sr.Version != "24.04" || sr.SigningKey == "" {
+		t.Errorf("unexpected suite info: %+v", sr)
+	}
+
+	tests := []struct {
+		key, value string
+		want       bool
+	}{
+		{"label.ticket", "OPS-1", true},
+		{"label.ticket", "OPS-2", false},
+		{"label.missing", "", false},
+		{"codename", "noble", true},
+		{"version", "22.04", false},
+		{"note", "kernel", true},
+		{"source", storageDir, true},
+	}
+	for _, tt := range tests {
+		if got := md.Match(tt.key, tt.value); got != tt.want {
+			t.Errorf("Match(%s, %s) = %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+	if err := ValidateMetadataFilter("size"); err == nil {
+		t.Error("expected an error for an unknown filter key")
+	}
+
+	// A snapshot of a published snapshot takes over its provenance.
+	if err := sm.PublishSnapshot("test-mirror", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.CreateSnapshot("test-mirror", "snap2", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	snap2Path, _ := sm.GetSnapshotPath("test-mirror", "snap2")
+	md2, err := loadSnapshotMetadata(snap2Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md2.Source != storageDir || md2.Suites["noble"] == nil || len(md2.Labels) != 0 {
+		t.Errorf("unexpected inherited metadata: %+v", md2)
+	}
+
+	if err := sm.DeleteSnapshot("test-mirror", "snap2", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(metadataPath(snap2Path)); !os.IsNotExist(err) {
+		t.Error("metadata file should be removed with the snapshot")
+	}
+}
@@ -0,0 +1,354 @@
+package mirror
+
+// This file implements retention rules and pinning of snapshots.
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Actions recorded in the history for pinning.
+const (
+	HistoryPin   = "pin"
+	HistoryUnpin = "unpin"
+)
+
+// Check validates the retention policy.
+func (c SnapshotPruneConfig) Check() error {
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"keep_last", c.KeepLast},
+		{"keep_daily", c.KeepDaily},
+		{"keep_weekly", c.KeepWeekly},
+		{"keep_monthly", c.KeepMonthly},
+		{"keep_yearly", c.KeepYearly},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("prune.%s must not be negative", v.name)
+		}
+	}
+	if _, err := parseDuration(c.KeepWithin); err != nil {
+		return fmt.Errorf("prune.keep_within: %w", err)
+	}
+	if _, err := parseSize(c.MaxTotalSize); err != nil {
+		return fmt.Errorf("prune.max_total_size: %w", err)
+	}
+	if _, err := parseSize(c.MinFreeSpace); err != nil {
+		return fmt.Errorf("prune.min_free_space: %w", err)
+	}
+	return nil
+}
+
+// PruneDecision tells whether a snapshot is kept by prune and why.
+type PruneDecision struct {
+	Snapshot *SnapshotInfo
+
+	// Reasons lists the rules that keep the snapshot, such as
+	// "published", "last 5" or "monthly 2024-01".  The snapshot is
+	// deleted if it is empty.
+	Reasons []string
+
+	// Evicted names the space limit, such as "min_free_space 50GiB",
+	// that deletes the snapshot despite Reasons.
+	Evicted string
+}
+
+// Keep returns true if the snapshot is kept.
+func (d *PruneDecision) Keep() bool {
+	return len(d.Reasons) > 0 && d.Evicted == ""
+}
+
+// protected returns true if prune never deletes the snapshot.
+func (s *SnapshotInfo) protected() bool {
+	return s.IsPublished || s.IsStaged || s.IsPinned || len(s.Channels) > 0
+}
+
+// gfsBucket is a grandfather-father-son retention rule.
+type gfsBucket struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+func gfsBuckets(config SnapshotPruneConfig) []gfsBucket {
+	return []gfsBucket{
+		{"daily", config.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", config.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", config.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", config.KeepYearly, func(t time.Time) string { return strconv.Itoa(t.Year()) }},
+	}
+}
+
+// planPrune decides which snapshots are kept by config.  snapshots
+// must be sorted newest first, as returned by ListSnapshots.
+//
+// Published, staged and pinned snapshots and snapshots on a channel are
+// always kept.  They do not count towards keep_last, which is the number
+// of other snapshots to keep, but can be the snapshot kept for a
+// period.  As before the period rules existed, keep_last only applies
+// if there are more other snapshots than that; otherwise they are left
+// to the other rules.  A snapshot is kept if any rule keeps it.
+func planPrune(snapshots []*SnapshotInfo, config SnapshotPruneConfig, now time.Time) ([]*PruneDecision, error) {
+	var cutoff time.Time
+	if config.KeepWithin != "" {
+		duration, err := parseDuration(config.KeepWithin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep_within duration: %w", err)
+		}
+		cutoff = now.Add(-duration)
+	}
+
+	decisions := make([]*PruneDecision, len(snapshots))
+	candidates := 0
+	for i, snapshot := range snapshots {
+		d := &PruneDecision{Snapshot: snapshot}
+		decisions[i] = d
+
+		if snapshot.IsPublished {
+			d.Reasons = append(d.Reasons, "published")
+		}
+		if snapshot.IsStaged {
+			d.Reasons = append(d.Reasons, "staged")
+		}
+		for _, channel := range snapshot.Channels {
+			if channel != ChannelLive && channel != ChannelStaging {
+				d.Reasons = append(d.Reasons, "channel "+channel)
+			}
+		}
+		if snapshot.IsPinned {
+			d.Reasons = append(d.Reasons, "pinned")
+		}
+		if !snapshot.protected() {
+			candidates++
+		}
+	}
+
+	slots := config.KeepLast
+	if candidates <= slots {
+		slots = 0
+	}
+	for _, d := range decisions {
+		if !d.Keep() && slots > 0 {
+			slots--
+			d.Reasons = append(d.Reasons, fmt.Sprintf("last %d", config.KeepLast))
+		}
+		if !cutoff.IsZero() && d.Snapshot.CreatedAt.After(cutoff) {
+			d.Reasons = append(d.Reasons, "within "+config.KeepWithin)
+		}
+	}
+
+	// Keep the newest snapshot of each period, for as many periods
+	// as configured
+	for _, b := range gfsBuckets(config) {
+		kept := 0
+		last := ""
+		for _, d := range decisions {
+			if kept >= b.count {
+				break
+			}
+			key := b.key(d.Snapshot.CreatedAt.UTC())
+			if key == last {
+				continue
+			}
+			last = key
+			kept++
+			d.Reasons = append(d.Reasons, b.name+" "+key)
+		}
+	}
+
+	return decisions, nil
+}
+
+// PruneSnapshotsWithConfig removes the snapshots of mirror that are not
+// kept by config, and returns the decision for every snapshot.
+// In dry-run mode, nothing is deleted.
+func (sm *SnapshotManager) PruneSnapshotsWithConfig(mirror string, config SnapshotPruneConfig, dryRun bool) ([]*PruneDecision, error) {
+	return sm.prune(mirror, config, dryRun, false)
+}
+
+// prune implements PruneSnapshotsWithConfig.  If spaceOnly is true,
+// the retention rules keep every snapshot, leaving the decisions to
+// the space limits.
+func (sm *SnapshotManager) prune(mirror string, config SnapshotPruneConfig, dryRun, spaceOnly bool) ([]*PruneDecision, error) {
+	snapshots, err := sm.ListSnapshots(mirror)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	decisions, err := planPrune(snapshots, config, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if spaceOnly {
+		for _, d := range decisions {
+			if len(d.Reasons) == 0 {
+				d.Reasons = append(d.Reasons, "space limits only")
+			}
+		}
+	}
+	if err := sm.planSpace(mirror, decisions, config); err != nil {
+		return nil, err
+	}
+
+	// Present decisions oldest first, the order of deletion
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Snapshot.CreatedAt.Before(decisions[j].Snapshot.CreatedAt)
+	})
+
+	if dryRun {
+		return decisions, nil
+	}
+
+	for _, d := range decisions {
+		if d.Keep() {
+			continue
+		}
+		if err := sm.DeleteSnapshot(mirror, d.Snapshot.Name, false); err != nil {
+			return decisions, fmt.Errorf("failed to delete snapshot %s: %w", d.Snapshot.Name, err)
+		}
+	}
+	return decisions, nil
+}
+
+// planSpace evicts the oldest snapshots kept by decisions that are not
+// published, staged or pinned, until the space limits of config are
+// met.  decisions must be sorted newest first.
+//
+// The space freed is computed from the inodes exclusive to the deleted
+// snapshots, as files shared with the live mirror or with the remaining
+// snapshots stay on disk.
+func (sm *SnapshotManager) planSpace(mirror string, decisions []*PruneDecision, config SnapshotPruneConfig) error {
+	maxTotal, err := parseSize(config.MaxTotalSize)
+	if err != nil {
+		return fmt.Errorf("invalid max_total_size: %w", err)
+	}
+	minFree, err := parseSize(config.MinFreeSpace)
+	if err != nil {
+		return fmt.Errorf("invalid min_free_space: %w", err)
+	}
+	if (maxTotal == 0 && minFree == 0) || len(decisions) == 0 {
+		return nil
+	}
+
+	var available int64
+	if minFree > 0 {
+		available, err = availableSpace(filepath.Dir(decisions[0].Snapshot.Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	paths := make([]string, len(decisions))
+	for i, d := range decisions {
+		paths[i] = d.Snapshot.Path
+	}
+	x := newLinkIndex(paths...)
+	total := x.usage().Exclusive
+	for _, d := range decisions {
+		if !d.Keep() {
+			x.remove(d.Snapshot.Path)
+		}
+	}
+
+	// violated returns the limit that is not met, if any
+	violated := func() string {
+		switch {
+		case maxTotal > 0 && total-x.freed > maxTotal:
+			return "max_total_size " + config.MaxTotalSize
+		case minFree > 0 && available+x.freed < minFree:
+			return "min_free_space " + config.MinFreeSpace
+		}
+		return ""
+	}
+
+	for i := len(decisions) - 1; i >= 0; i-- {
+		limit := violated()
+		if limit == "" {
+			return nil
+		}
+		d := decisions[i]
+		if !d.Keep() || d.Snapshot.protected() {
+			continue
+		}
+		d.Evicted = limit
+		x.remove(d.Snapshot.Path)
+	}
+
+	if limit := violated(); limit != "" {
+		slog.Warn("cannot meet snapshot space limit without deleting published, staged or pinned snapshots",
+			"mirror", mirror, "limit", limit)
+	}
+	return nil
+}
+
+// EnforceSpaceLimits deletes the oldest snapshots of mirror that are
+// not published, staged or pinned until the space limits of config are
+// met, ignoring the other retention rules.  It returns the names of
+// the deleted snapshots.
+func (sm *SnapshotManager) EnforceSpaceLimits(mirror string, config SnapshotPruneConfig) ([]string, error) {
+	if config.MaxTotalSize == "" && config.MinFreeSpace == "" {
+		return nil, nil
+	}
+
+	spaceOnly := SnapshotPruneConfig{
+		MaxTotalSize: config.MaxTotalSize,
+		MinFreeSpace: config.MinFreeSpace,
+	}
+	decisions, err := sm.prune(mirror, spaceOnly, false, true)
+
+	var deleted []string
+	for _, d := range decisions {
+		if !d.Keep() {
+			deleted = append(deleted, d.Snapshot.Name)
+		}
+	}
+	return deleted, err
+}
+
+// PinSnapshot pins or unpins a snapshot.  Pinned snapshots are never
+// removed by prune.
+func (sm *SnapshotManager) PinSnapshot(mirror, snapshotName string, pinned bool) error {
+	snapshotPath, err := sm.GetSnapshotPath(mirror, snapshotName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("snapshot %s does not exist for mirror %s", snapshotName, mirror)
+	}
+
+	md, err := loadSnapshotMetadata(snapshotPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Snapshots created before metadata was introduced
+		md = &SnapshotMetadata{Mirror: mirror, Name: snapshotName, CreatedAt: info.ModTime().UTC()}
+	case err != nil:
+		return err
+	}
+	if md.Pinned == pinned {
+		return nil
+	}
+
+	md.Pinned = pinned
+	if err := saveSnapshotMetadata(snapshotPath, md); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+
+	action := HistoryUnpin
+	if pinned {
+		action = HistoryPin
+	}
+	sm.appendHistory(mirror, &HistoryEntry{Action: action, Snapshot: snapshotName})
+	return nil
+}
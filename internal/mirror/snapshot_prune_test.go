@@ -0,0 +1,253 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanPrune(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	// Two snapshots a day for the last 60 days, newest first
+	var snapshots []*SnapshotInfo
+	for i := 0; i < 120; i++ {
+		snapshots = append(snapshots, &SnapshotInfo{
+			Name:      now.Add(-time.Duration(i) * 12 * time.Hour).Format("2006-01-02T15"),
+			CreatedAt: now.Add(-time.Duration(i) * 12 * time.Hour),
+		})
+	}
+	snapshots[0].IsPublished = true
+	snapshots[119].IsPinned = true
+
+	// The published and pinned snapshots do not take keep_last slots
+
+	decisions, err := planPrune(snapshots, SnapshotPruneConfig{
+		KeepLast:    3,
+		KeepDaily:   3,
+		KeepWeekly:  2,
+		KeepMonthly: 3,
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := make(map[string][]string)
+	for _, d := range decisions {
+		if d.Keep() {
+			reasons[d.Snapshot.Name] = d.Reasons
+		}
+	}
+
+	want := map[string][]string{
+		"2024-03-15T12":     {"published", "daily 2024-03-15", "weekly 2024-W11", "monthly 2024-03"},
+		"2024-03-15T00":     {"last 3"},
+		"2024-03-14T12":     {"last 3", "daily 2024-03-14"},
+		"2024-03-14T00":     {"last 3"},
+		"2024-03-13T12":     {"daily 2024-03-13"},
+		"2024-03-10T12":     {"weekly 2024-W10"},
+		"2024-02-29T12":     {"monthly 2024-02"},
+		"2024-01-31T12":     {"monthly 2024-01"},
+		snapshots[119].Name: {"pinned"},
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("unexpected decisions:\n got: %v\nwant: %v", reasons, want)
+	}
+
+	// keep_last keeps as many snapshots besides the published one, and
+	// only applies when there are more of them
+	for _, tt := range []struct {
+		n       int
+		deleted []string
+	}{
+		{7, []string{snapshots[6].Name}},
+		{6, []string{snapshots[1].Name, snapshots[2].Name, snapshots[3].Name, snapshots[4].Name, snapshots[5].Name}},
+	} {
+		decisions, err = planPrune(snapshots[:tt.n], SnapshotPruneConfig{KeepLast: 5}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var deleted []string
+		for _, d := range decisions {
+			if !d.Keep() {
+				deleted = append(deleted, d.Snapshot.Name)
+			}
+		}
+		if !reflect.DeepEqual(deleted, tt.deleted) {
+			t.Errorf("%d snapshots: deleted %v, want %v", tt.n, deleted, tt.deleted)
+		}
+	}
+
+	// keep_within keeps everything recent enough
+	decisions, err = planPrune(snapshots[:10], SnapshotPruneConfig{KeepWithin: "2d"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	for _, d := range decisions {
+		if d.Keep() {
+			kept++
+		}
+	}
+	if kept != 4 {
+		t.Errorf("expected 4 snapshots within 2d, got %d", kept)
+	}
+
+	if _, err := planPrune(snapshots, SnapshotPruneConfig{KeepWithin: "soon"}, now); err == nil {
+		t.Error("expected an error for an invalid keep_within")
+	}
+}
+
+func TestSnapshotPruneConfig_Check(t *testing.T) {
+	if err := (SnapshotPruneConfig{KeepLast: 5, KeepWithin: "30d", KeepDaily: 7}).Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (SnapshotPruneConfig{KeepWeekly: -1}).Check(); err == nil {
+		t.Error("expected an error for a negative keep_weekly")
+	}
+	if err := (SnapshotPruneConfig{KeepWithin: "1 month"}).Check(); err == nil {
+		t.Error("expected an error for an invalid keep_within")
+	}
+}
+
+func TestSnapshotManager_PinSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(&SnapshotConfig{}, tmpDir+"/live")
+
+	for _, name := range []string{"old", "new"} {
+		p, err := sm.GetSnapshotPath("test-mirror", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath, _ := sm.GetSnapshotPath("test-mirror", "old")
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldPath, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.PinSnapshot("test-mirror", "old", true); err != nil {
+		t.Fatalf("PinSnapshot failed: %v", err)
+	}
+
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[1].Name != "old" || !snapshots[1].IsPinned {
+		t.Fatalf("expected old to be listed last and pinned: %+v", snapshots)
+	}
+	if snapshots[1].CreatedAt.Sub(past).Abs() > time.Second {
+		t.Errorf("pinning should keep the creation time, got %v", snapshots[1].CreatedAt)
+	}
+
+	decisions, err := sm.PruneSnapshotsWithConfig("test-mirror", SnapshotPruneConfig{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 2 || !decisions[0].Keep() || decisions[1].Keep() {
+		t.Errorf("expected only the pinned snapshot to be kept: %+v", decisions)
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Error("pinned snapshot should not be deleted")
+	}
+
+	if err := sm.PinSnapshot("test-mirror", "old", false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := sm.ReadHistory("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{HistoryPin, HistoryDelete, HistoryUnpin}) {
+		t.Errorf("unexpected history: %v", actions)
+	}
+
+	if err := sm.PinSnapshot("test-mirror", "missing", true); err == nil {
+		t.Error("expected an error for a missing snapshot")
+	}
+}
+
+func TestSnapshotManager_SpaceLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(&SnapshotConfig{}, filepath.Join(tmpDir, "live"))
+
+	// Three snapshots, oldest first, each with a 100 byte file of its
+	// own and sharing a 1000 byte file.
+	names := []string{"s1", "s2", "s3"}
+	for i, name := range names {
+		p, err := sm.GetSnapshotPath("test-mirror", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(p, "pool/own.deb"), make([]byte, 100))
+		if i == 0 {
+			writeTestFile(t, filepath.Join(p, "pool/shared.deb"), make([]byte, 1000))
+		} else {
+			first, _ := sm.GetSnapshotPath("test-mirror", names[0])
+			if err := os.Link(filepath.Join(first, "pool/shared.deb"), filepath.Join(p, "pool/shared.deb")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mtime := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every rule keeps all snapshots, but min_free_space cannot be met
+	if err := sm.PinSnapshot("test-mirror", "s3", true); err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := sm.PruneSnapshotsWithConfig("test-mirror", SnapshotPruneConfig{
+		KeepWithin:   "1d",
+		MinFreeSpace: "1000TiB",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range decisions {
+		want := ""
+		if d.Snapshot.Name != "s3" {
+			want = "min_free_space 1000TiB"
+		}
+		if d.Evicted != want || d.Keep() != (want == "") {
+			t.Errorf("unexpected decision for %s: %+v", d.Snapshot.Name, d)
+		}
+	}
+	if err := sm.PinSnapshot("test-mirror", "s3", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting s1 frees only its own file, as s2 and s3 still link
+	// the shared one, so s2 must go as well.
+	deleted, err := sm.EnforceSpaceLimits("test-mirror", SnapshotPruneConfig{MaxTotalSize: "1150"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"s1", "s2"}) {
+		t.Errorf("expected s1 and s2 to be deleted, got %v", deleted)
+	}
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != "s3" || snapshots[0].ExclusiveSize != 1100 {
+		t.Errorf("expected only s3 to remain: %+v", snapshots)
+	}
+
+	// Limits already met delete nothing
+	deleted, err = sm.EnforceSpaceLimits("test-mirror", SnapshotPruneConfig{MaxTotalSize: "1100"})
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("expected nothing to be deleted, got %v, %v", deleted, err)
+	}
+}
@@ -0,0 +1,196 @@
+package mirror
+
+// This file implements the disk usage accounting of hard-linked snapshots.
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DiskUsage is the disk space used by trees of hard-linked files.
+//
+// Snapshots hard-link the files of the mirror they were taken from,
+// so summing file sizes counts the same data many times.  DiskUsage
+// counts every inode once instead.
+type DiskUsage struct {
+	// Files is the number of regular files, counting each link.
+	Files int
+
+	// Size is the number of bytes of distinct files.
+	Size int64
+
+	// Exclusive is the number of bytes of files that have no links
+	// outside the trees, that is, the space deleting them would free.
+	Exclusive int64
+}
+
+// Shared returns the number of bytes of files that are also linked
+// from outside the trees, such as other snapshots or the live mirror.
+func (u DiskUsage) Shared() int64 {
+	return u.Size - u.Exclusive
+}
+
+// fileID identifies an inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// inodeUsage holds the size of an inode, its number of links, and
+// how many of them are in the indexed trees and in removed trees.
+type inodeUsage struct {
+	size    int64
+	nlink   uint64
+	links   uint64
+	removed uint64
+}
+
+// linkIndex records the inodes linked from a set of trees, to compute
+// the space freed by removing some of them.
+type linkIndex struct {
+	inodes map[fileID]*inodeUsage
+	trees  map[string]map[fileID]uint64
+	files  int
+	freed  int64
+}
+
+// newLinkIndex walks the trees at paths.  Files that cannot be read
+// are skipped.
+func newLinkIndex(paths ...string) *linkIndex {
+	x := &linkIndex{
+		inodes: make(map[fileID]*inodeUsage),
+		trees:  make(map[string]map[fileID]uint64),
+	}
+	var unknown uint64
+
+	for _, p := range paths {
+		tree := make(map[fileID]uint64)
+		x.trees[p] = tree
+
+		_ = filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil // Skip errors, directories and symlinks
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			x.files++
+
+			var id fileID
+			nlink := uint64(1)
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				id = fileID{dev: uint64(st.Dev), ino: st.Ino}
+				nlink = uint64(st.Nlink)
+			} else {
+				// Without inode numbers, every file is distinct
+				unknown++
+				id = fileID{dev: ^uint64(0), ino: unknown}
+			}
+
+			iu, ok := x.inodes[id]
+			if !ok {
+				iu = &inodeUsage{size: info.Size(), nlink: nlink}
+				x.inodes[id] = iu
+			}
+			iu.links++
+			tree[id]++
+			return nil
+		})
+	}
+	return x
+}
+
+// usage returns the disk usage of all indexed trees.
+func (x *linkIndex) usage() DiskUsage {
+	u := DiskUsage{Files: x.files}
+	for _, iu := range x.inodes {
+		u.Size += iu.size
+		if iu.links >= iu.nlink {
+			u.Exclusive += iu.size
+		}
+	}
+	return u
+}
+
+// remove marks the tree at p as removed, and returns the number of
+// bytes freed by removing it.
+func (x *linkIndex) remove(p string) int64 {
+	var freed int64
+	for id, n := range x.trees[p] {
+		iu := x.inodes[id]
+		iu.removed += n
+		if iu.removed >= iu.nlink && iu.removed-n < iu.nlink {
+			freed += iu.size
+		}
+	}
+	delete(x.trees, p)
+	x.freed += freed
+	return freed
+}
+
+// MeasureDiskUsage returns the disk usage of the trees at paths taken
+// together.  Files that cannot be read are skipped.
+func MeasureDiskUsage(paths ...string) DiskUsage {
+	return newLinkIndex(paths...).usage()
+}
+
+// SnapshotsDiskUsage returns the disk usage of the whole snapshot
+// directory, across all mirrors.  Shared bytes are those also linked
+// from the live mirrors.
+func (sm *SnapshotManager) SnapshotsDiskUsage() DiskUsage {
+	return MeasureDiskUsage(sm.snapshotPath)
+}
+
+// availableSpace returns the number of bytes available to unprivileged
+// users on the filesystem holding p.
+func availableSpace(p string) (int64, error) {
+	bytes, _, err := diskFree(p)
+	return bytes, err
+}
+
+// sizeUnits maps size suffixes to their multipliers.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1e3,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1e6,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1e9,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1e12,
+}
+
+// parseSize parses a size like "500GiB", "1.5T" or "200GB".  Single
+// letter units are binary.  An empty string is zero.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	if s == "" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit: %s", size)
+	}
+	return int64(value * unit), nil
+}
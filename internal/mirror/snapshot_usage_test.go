@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasureDiskUsage(t *testing.T) {
+	tmpDir := t.TempDir()
+	livePath := filepath.Join(tmpDir, "live")
+	sm := NewSnapshotManager(&SnapshotConfig{}, livePath)
+
+	s1, err := sm.GetSnapshotPath("test-mirror", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := sm.GetSnapshotPath("test-mirror", "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// s1 and s2 share a 100 byte file, the live mirror shares a 10
+	// byte file with s2, and each snapshot has a file of its own.
+	writeTestFile(t, filepath.Join(s1, "pool/shared.deb"), make([]byte, 100))
+	writeTestFile(t, filepath.Join(s1, "pool/own.deb"), make([]byte, 1))
+	writeTestFile(t, filepath.Join(s2, "pool/own.deb"), make([]byte, 2))
+	writeTestFile(t, filepath.Join(livePath, "pool/live.deb"), make([]byte, 10))
+	if err := os.Link(filepath.Join(s1, "pool/shared.deb"), filepath.Join(s2, "pool/shared.deb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(livePath, "pool/live.deb"), filepath.Join(s2, "pool/live.deb")); err != nil {
+		t.Fatal(err)
+	}
+	// Links within a snapshot are counted once and stay exclusive.
+	if err := os.Link(filepath.Join(s1, "pool/own.deb"), filepath.Join(s1, "pool/again.deb")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  DiskUsage
+	}{
+		{"s1", []string{s1}, DiskUsage{Files: 3, Size: 101, Exclusive: 1}},
+		{"s2", []string{s2}, DiskUsage{Files: 3, Size: 112, Exclusive: 2}},
+		{"both", []string{s1, s2}, DiskUsage{Files: 6, Size: 113, Exclusive: 103}},
+	}
+	for _, tt := range tests {
+		if got := MeasureDiskUsage(tt.paths...); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	snapshots, err := sm.ListSnapshots("test-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshots {
+		if s.Name == "s2" && (s.Size != 112 || s.SharedSize != 110 || s.ExclusiveSize != 2 || s.FileCount != 3) {
+			t.Errorf("unexpected usage of s2: %+v", s)
+		}
+	}
+
+	total := sm.SnapshotsDiskUsage()
+	if total.Size != 113 || total.Shared() != 10 {
+		t.Errorf("unexpected total usage: %+v", total)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"", 0, false},
+		{"1024", 1024, false},
+		{"10K", 10 << 10, false},
+		{"1.5GiB", 3 << 29, false},
+		{"2 GB", 2e9, false},
+		{"1t", 1 << 40, false},
+		{"GiB", 0, true},
+		{"10 parsecs", 0, true},
+		{"-1G", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package mirror
 
 import (
 	"encoding/json"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cockroachdb/errors"
 
@@ -13,7 +16,8 @@ import (
 )
 
 const (
-	infoJSON = "info.json"
+	infoJSON   = "info.json"
+	byhashJSON = "byhash.json"
 )
 
 // validatePath validates that a path is safe for use within the storage directory.
@@ -46,6 +50,20 @@ type Storage struct {
 
 	mu   sync.RWMutex
 	info map[string]*apt.FileInfo
+
+	// retired records by-hash files carried forward from
+	// previous generations.  See CarryForwardByHash.
+	retired map[string]*retiredHash
+}
+
+// retiredHash describes a by-hash file that is no longer referenced
+// by the current indices.
+type retiredHash struct {
+	// Generation is the number of syncs since the file was retired.
+	Generation int `json:"generation"`
+
+	// Since is when the file was retired.
+	Since time.Time `json:"since"`
 }
 
 // NewStorage constructs Storage.
@@ -67,9 +85,10 @@ func NewStorage(dir, prefix string) (*Storage, error) {
 	}
 
 	return &Storage{
-		dir:    dir,
-		prefix: prefix,
-		info:   make(map[string]*apt.FileInfo),
+		dir:     dir,
+		prefix:  prefix,
+		info:    make(map[string]*apt.FileInfo),
+		retired: make(map[string]*retiredHash),
 	}, nil
 }
 
@@ -101,6 +120,19 @@ func (s *Storage) Load() error {
 	if err != nil {
 		return errors.Wrap(err, "Storage.Load: "+infoPath)
 	}
+
+	byhashPath := filepath.Join(s.dir, byhashJSON)
+	data, err := os.ReadFile(byhashPath) // #nosec G304 - byhashPath is constructed from validated config.Dir and constant byhashJSON
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	err = json.Unmarshal(data, &s.retired)
+	if err != nil {
+		return errors.Wrap(err, "Storage.Load: "+byhashPath)
+	}
 	return nil
 }
 
@@ -136,6 +168,19 @@ func (s *Storage) Save() error {
 	}
 
 	_ = f.Sync()
+
+	if len(s.retired) > 0 {
+		data, err := json.Marshal(s.retired)
+		if err != nil {
+			return err
+		}
+		// #nosec G306 - 0644 needed for web server access, same as info.json
+		err = os.WriteFile(filepath.Join(s.dir, byhashJSON), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = DirSyncTree(s.dir)
 	if err != nil {
 		return errors.Wrap(err, "DirSyncTree(s.dir)")
@@ -254,19 +299,95 @@ func (s *Storage) StoreLinkWithHash(fi *apt.FileInfo, fullpath string) error {
 	s.mu.Unlock()
 
 	for _, fp := range fpl {
-		d := filepath.Dir(fp)
-		err := os.MkdirAll(d, 0750)
-		if err != nil {
-			return errors.Wrap(err, "StoreLinkWithHash: "+fp)
-		}
-		err = os.Link(fullpath, fp)
-		if err != nil && !os.IsExist(err) {
-			return errors.Wrap(err, "StoreLinkWithHash: "+fp)
+		if err := linkFile(fullpath, fp); err != nil {
+			return errors.Wrap(err, "StoreLinkWithHash")
 		}
 	}
 	return nil
 }
 
+// linkFile creates a hard link fp to fullpath, creating parent
+// directories as needed.  An existing fp is left as it is.
+func linkFile(fullpath, fp string) error {
+	err := os.MkdirAll(filepath.Dir(fp), 0750)
+	if err != nil {
+		return errors.Wrap(err, fp)
+	}
+	err = os.Link(fullpath, fp)
+	if err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, fp)
+	}
+	return nil
+}
+
+// isByHashPath returns true if p is a by-hash path of a file.
+func isByHashPath(p string) bool {
+	return path.Base(path.Dir(path.Dir(p))) == "by-hash"
+}
+
+// CarryForwardByHash hard links by-hash files of indices from prev,
+// the storage of the previous sync, that are not stored in s.
+//
+// Clients that fetched InRelease just before the mirror was switched
+// request the old indices by their hashes.  Files retired from the
+// indices are kept for the given number of generations, but not
+// longer than grace if it is positive.  It returns the number of
+// files carried forward.
+func (s *Storage) CarryForwardByHash(prev *Storage, generations int, grace time.Duration, now time.Time) (int, error) {
+	if generations <= 0 {
+		return 0, nil
+	}
+
+	prev.mu.RLock()
+	defer prev.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for p, fi := range prev.info {
+		if !isByHashPath(p) || !isIndexPath(fi.Path()) {
+			continue
+		}
+		if _, ok := s.info[p]; ok {
+			continue
+		}
+		if err := validatePath(p); err != nil {
+			continue
+		}
+
+		r := &retiredHash{Generation: 1, Since: now}
+		if old, ok := prev.retired[p]; ok {
+			r = &retiredHash{Generation: old.Generation + 1, Since: old.Since}
+		}
+		if r.Generation > generations || (grace > 0 && now.Sub(r.Since) >= grace) {
+			continue
+		}
+
+		src := filepath.Join(prev.dir, prev.prefix, filepath.Clean(p))
+		dst := filepath.Join(s.dir, s.prefix, filepath.Clean(p))
+		if err := linkFile(src, dst); err != nil {
+			return n, errors.Wrap(err, "CarryForwardByHash")
+		}
+		s.info[p] = fi
+		s.retired[p] = r
+		n++
+	}
+	return n, nil
+}
+
+// isIndexPath returns true if p is an index of a repository rather
+// than a package file.
+func isIndexPath(p string) bool {
+	return strings.HasPrefix(p, "dists/") || strings.Contains(p, "/dists/") || apt.IsMeta(p) || apt.IsPDiff(p)
+}
+
+// infoCopy returns a copy of the files stored in this storage by path.
+func (s *Storage) infoCopy() map[string]*apt.FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.info)
+}
+
 // Lookup looks up a file in this storage.
 //
 // If a file matching fi exists, its info and full path is returned.
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mirrorctl/mirrorctl/internal/apt"
 )
@@ -215,9 +216,100 @@ func testStorageStore(t *testing.T) {
 	}
 }
 
+func testStorageCarryForwardByHash(t *testing.T) {
+	t.Parallel()
+
+	const packages = "dists/stable/main/binary-amd64/Packages"
+	now := time.Now()
+
+	// sync stores a new generation of Packages and a package file with
+	// by-hash, and carries forward the by-hash files of prev.
+	sync := func(prev *Storage, data string, grace time.Duration, at time.Time) (*Storage, int) {
+		t.Helper()
+
+		s, err := NewStorage(t.TempDir(), "pre")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{packages, "pool/main/f/foo/foo_" + data + ".deb"} {
+			tempfile, err := s.TempFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := apt.CopyWithFileInfo(tempfile, strings.NewReader(data), p)
+			tempfile.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.StoreLinkWithHash(fi, tempfile.Name()); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(tempfile.Name())
+		}
+
+		var n int
+		if prev != nil {
+			n, err = s.CarryForwardByHash(prev, 2, grace, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Reload to check that generations are persisted.
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+		s2, err := NewStorage(s.Dir(), "pre")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s2.Load(); err != nil {
+			t.Fatal(err)
+		}
+		return s2, n
+	}
+
+	found := func(s *Storage, data string) bool {
+		fi, err := makeFileInfo(packages, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, fullpath := s.Lookup(fi, true)
+		if found == nil {
+			return false
+		}
+		_, err = os.Stat(fullpath)
+		return err == nil
+	}
+
+	s1, _ := sync(nil, "v1", 0, now)
+	s2, n := sync(s1, "v2", 0, now)
+	// MD5Sum, SHA1, SHA256 and SHA512 of the old Packages only.
+	if n != 4 {
+		t.Errorf("expected 4 files carried forward, got %d", n)
+	}
+	s3, _ := sync(s2, "v3", 0, now)
+	if !found(s3, "v1") || !found(s3, "v2") {
+		t.Error("previous generations are not kept")
+	}
+	s4, _ := sync(s3, "v4", 0, now)
+	if found(s4, "v1") {
+		t.Error("v1 is kept beyond 2 generations")
+	}
+	if !found(s4, "v2") || !found(s4, "v3") {
+		t.Error("previous generations are not kept")
+	}
+
+	s5, n := sync(s4, "v5", time.Hour, now.Add(2*time.Hour))
+	if n != 4 || found(s5, "v2") || !found(s5, "v4") {
+		t.Errorf("grace period is not honored: %d files carried forward", n)
+	}
+}
+
 func TestStorage(t *testing.T) {
 	t.Parallel()
 	t.Run("BadConstruction", testStorageBadConstruction)
 	t.Run("Lookup", testStorageLookup)
 	t.Run("Store", testStorageStore)
+	t.Run("CarryForwardByHash", testStorageCarryForwardByHash)
 }
@@ -0,0 +1,172 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLSCheckReport is the TLS status of the host of a mirror.
+type TLSCheckReport struct {
+	ReportHeader
+	Mirror   string               `json:"mirror"`
+	Host     string               `json:"host"`
+	Port     string               `json:"port"`
+	Versions []*TLSVersionSupport `json:"versions"`
+
+	// Connection is the connection negotiated with the TLS
+	// configuration.  It is nil if the connection failed.
+	Connection *TLSConnection `json:"connection,omitempty"`
+
+	// Error is the reason the connection failed.
+	Error string `json:"error,omitempty"`
+}
+
+// TLSVersionSupport reports whether the host supports a TLS version.
+type TLSVersionSupport struct {
+	Version   string `json:"version"`
+	Supported bool   `json:"supported"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TLSConnection is a negotiated TLS connection.
+type TLSConnection struct {
+	Version      string            `json:"version"`
+	CipherSuite  string            `json:"cipher_suite"`
+	Certificates []*TLSCertificate `json:"certificates"`
+}
+
+// TLSCertificate is a certificate of the chain presented by a host.
+type TLSCertificate struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// tlsVersions are the TLS versions CheckTLS probes.
+var tlsVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// CheckTLS probes the TLS versions host:port of mirror supports with the
+// settings of tlsConfig, then connects with the best negotiated settings.
+func CheckTLS(tlsConfig *TLSConfig, mirror, host, port string) *TLSCheckReport {
+	r := &TLSCheckReport{
+		ReportHeader: newReportHeader(ReportTLSCheck),
+		Mirror:       mirror,
+		Host:         host,
+		Port:         port,
+		Versions:     make([]*TLSVersionSupport, 0, len(tlsVersions)),
+	}
+	addr := net.JoinHostPort(host, port)
+
+	for _, version := range tlsVersions {
+		vs := &TLSVersionSupport{Version: tlsVersionString(version)}
+		r.Versions = append(r.Versions, vs)
+
+		// Build TLS config from user's global settings
+		tlsConf, err := tlsConfig.BuildTLSConfig()
+		if err != nil {
+			vs.Error = fmt.Sprintf("building TLS config: %v", err)
+			continue
+		}
+
+		// Override version settings to test specific version
+		tlsConf.MinVersion = version
+		tlsConf.MaxVersion = version
+
+		conn, err := tls.Dial("tcp", addr, tlsConf)
+		if err != nil {
+			vs.Error = err.Error()
+			continue
+		}
+		vs.Supported = true
+		conn.Close() // #nosec G104 - TLS test connection cleanup, ignore errors
+	}
+
+	// Build TLS config from user's global settings without version overrides
+	tlsConf, err := tlsConfig.BuildTLSConfig()
+	if err != nil {
+		r.Error = fmt.Sprintf("building TLS config: %v", err)
+		return r
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConf)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	r.Connection = &TLSConnection{
+		Version:      tlsVersionString(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		Certificates: make([]*TLSCertificate, 0, len(state.PeerCertificates)),
+	}
+	for _, cert := range state.PeerCertificates {
+		r.Connection.Certificates = append(r.Connection.Certificates, &TLSCertificate{
+			Subject:  cert.Subject.CommonName,
+			Issuer:   cert.Issuer.CommonName,
+			NotAfter: cert.NotAfter,
+		})
+	}
+	return r
+}
+
+// WriteTable writes the TLS status to w for humans.
+func (r *TLSCheckReport) WriteTable(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Checking TLS status for mirror '%s' (%s:%s)...\n\n", r.Mirror, r.Host, r.Port)
+
+	b.WriteString("[+] TLS Version Support:\n")
+	for _, vs := range r.Versions {
+		switch {
+		case vs.Supported:
+			fmt.Fprintf(&b, "    %s: Supported\n", vs.Version)
+		case vs.Error != "":
+			fmt.Fprintf(&b, "    %s: Not Supported (%s)\n", vs.Version, vs.Error)
+		default:
+			fmt.Fprintf(&b, "    %s: Not Supported\n", vs.Version)
+		}
+	}
+	b.WriteString("\n[+] Connection Details:\n")
+
+	if r.Connection == nil {
+		fmt.Fprintf(&b, "Failed to establish connection: %s\n", r.Error)
+	} else {
+		fmt.Fprintf(&b, "    Negotiated Version: %s\n", r.Connection.Version)
+		fmt.Fprintf(&b, "    Negotiated Cipher:  %s\n\n", r.Connection.CipherSuite)
+
+		b.WriteString("[+] Server Certificate Chain:\n")
+		for i, cert := range r.Connection.Certificates {
+			fmt.Fprintf(&b, "    - Cert %d:\n", i)
+			fmt.Fprintf(&b, "      Subject:  %s\n", cert.Subject)
+			fmt.Fprintf(&b, "      Issuer:   %s\n", cert.Issuer)
+			fmt.Fprintf(&b, "      Expires:  %s\n", cert.NotAfter.Format(time.RFC3339))
+			if i < len(r.Connection.Certificates)-1 {
+				b.WriteString("\n")
+			}
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("TLS check complete.\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// tlsVersionString returns the name of a TLS version.
+func tlsVersionString(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("Unknown (0x%04x)", version)
+	}
+}